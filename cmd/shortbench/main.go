@@ -0,0 +1,336 @@
+// shortbench drives create and redirect traffic at a urlshortener and reports
+// throughput, latency percentiles and errors.
+//
+// Without -server it starts the service in-process on a fresh database, once
+// per entry of -workers, so worker counts can be compared in one run:
+//
+//	shortbench -workers 1,4,16 -create-rate 500 -redirect-rate 2000 -duration 10s
+//	shortbench -server http://localhost:8080 -api-key sk_... -create-rate 200
+//
+// Load is open-loop: requests start at the configured rates whether or not
+// earlier ones have finished, up to -concurrency in flight. Requests that
+// would exceed it are counted as dropped rather than delaying the schedule.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/George-Yanev/go-playground/internal/urlshortener"
+)
+
+type config struct {
+	createRate   float64
+	redirectRate float64
+	duration     time.Duration
+	warmup       int
+	concurrency  int
+	apiKey       string
+}
+
+func main() {
+	server := flag.String("server", "", "base URL of a running server; empty starts one in-process")
+	workers := flag.String("workers", "10", "comma-separated worker counts to run in-process")
+	batchSize := flag.Int("batch-size", 0, "group-commit batch size for in-process runs; 0 writes each link on its own")
+	var cfg config
+	flag.Float64Var(&cfg.createRate, "create-rate", 100, "POST /short requests per second")
+	flag.Float64Var(&cfg.redirectRate, "redirect-rate", 500, "GET /{code} requests per second")
+	flag.DurationVar(&cfg.duration, "duration", 10*time.Second, "how long to generate load")
+	flag.IntVar(&cfg.warmup, "warmup", 100, "links created before the run for redirect traffic")
+	flag.IntVar(&cfg.concurrency, "concurrency", 256, "maximum requests in flight")
+	flag.StringVar(&cfg.apiKey, "api-key", os.Getenv("SHORTBENCH_API_KEY"), "API key for creating links")
+	flag.Parse()
+
+	// the in-process service logs every request
+	slog.SetDefault(urlshortener.NewLogger(io.Discard))
+
+	if *server != "" {
+		report(os.Stdout, *server, run(*server, cfg))
+		return
+	}
+	for _, f := range strings.Split(*workers, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || n < 1 {
+			fail(fmt.Errorf("invalid worker count %q", f))
+		}
+		url, stop, err := startLocal(n, *batchSize)
+		if err != nil {
+			fail(err)
+		}
+		report(os.Stdout, fmt.Sprintf("in-process, %d workers", n), run(url, cfg))
+		stop()
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "shortbench:", err)
+	os.Exit(1)
+}
+
+// startLocal serves the shortener from a temporary database.
+func startLocal(workers, batchSize int) (string, func(), error) {
+	dir, err := os.MkdirTemp("", "shortbench")
+	if err != nil {
+		return "", nil, err
+	}
+	db, err := urlshortener.InitDBAt(filepath.Join(dir, "bench.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+
+	var links urlshortener.LinkWriter = urlshortener.NewUrlMapping(db)
+	var batch *urlshortener.BatchWriter
+	if batchSize > 0 {
+		batch = urlshortener.NewBatchWriter(db, 0, batchSize)
+		links = batch
+	}
+
+	workCh := make(chan urlshortener.WorkRequest)
+	seedCh := make(chan urlshortener.SeedRequest)
+	go urlshortener.Manager(db, seedCh)
+	pool := urlshortener.StartLinkWorkers(links, workCh, seedCh, workers)
+
+	srv := httptest.NewUnstartedServer(nil)
+	srv.Config.Handler = urlshortener.NewHandler(db, workCh, urlshortener.HttpConfig{
+		ShortUrlHost: srv.Listener.Addr().String(),
+		Health:       urlshortener.NewHealth(db, pool, 0),
+	})
+	srv.Start()
+
+	return srv.URL, func() {
+		srv.Close()
+		close(workCh)
+		if batch != nil {
+			batch.Close()
+		}
+		db.Close()
+		os.RemoveAll(dir)
+	}, nil
+}
+
+// result is what one kind of traffic produced.
+type result struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	errors    map[string]int
+	elapsed   time.Duration
+}
+
+func newResult() *result {
+	return &result{errors: map[string]int{}}
+}
+
+func (r *result) record(d time.Duration, errKind string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if errKind != "" {
+		r.errors[errKind]++
+		return
+	}
+	r.latencies = append(r.latencies, d)
+}
+
+type bench struct {
+	base   string
+	cfg    config
+	client *http.Client
+	sem    chan struct{}
+
+	mu    sync.Mutex
+	codes []string
+}
+
+// run generates load against base and returns the results by traffic kind.
+func run(base string, cfg config) map[string]*result {
+	b := &bench{
+		base: base,
+		cfg:  cfg,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			// a redirect is the answer, not something to follow
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+			Transport:     &http.Transport{MaxIdleConnsPerHost: cfg.concurrency},
+		},
+		sem: make(chan struct{}, cfg.concurrency),
+	}
+
+	for i := 0; i < cfg.warmup; i++ {
+		if _, errKind := b.create(); errKind != "" {
+			fail(fmt.Errorf("warming up: %s", errKind))
+		}
+	}
+
+	results := map[string]*result{"create": newResult(), "redirect": newResult()}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.duration)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	pace := func(rate float64, res *result, do func() string) {
+		defer wg.Done()
+		if rate <= 0 {
+			return
+		}
+		var inflight sync.WaitGroup
+		defer inflight.Wait()
+
+		tick := time.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer tick.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick.C:
+			}
+			select {
+			case b.sem <- struct{}{}:
+			default:
+				res.record(0, "dropped")
+				continue
+			}
+			inflight.Add(1)
+			go func() {
+				defer inflight.Done()
+				defer func() { <-b.sem }()
+				t := time.Now()
+				errKind := do()
+				res.record(time.Since(t), errKind)
+			}()
+		}
+	}
+
+	wg.Add(2)
+	go pace(cfg.createRate, results["create"], func() string {
+		_, errKind := b.create()
+		return errKind
+	})
+	go pace(cfg.redirectRate, results["redirect"], b.redirect)
+	wg.Wait()
+
+	elapsed := time.Since(start)
+	for _, r := range results {
+		r.elapsed = elapsed
+	}
+	return results
+}
+
+// create shortens a unique URL, returning its code or what went wrong.
+func (b *bench) create() (string, string) {
+	body, _ := json.Marshal(urlshortener.URLRequest{
+		OriginalURL: fmt.Sprintf("https://example.com/bench/%d", rand.Int64()),
+	})
+	req, _ := http.NewRequest(http.MethodPost, b.base+"/short", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if b.cfg.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+b.cfg.apiKey)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return "", "transport"
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errKind(resp)
+	}
+
+	var out urlshortener.URLResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", "bad response"
+	}
+	code := out.ShortenedURL[strings.LastIndex(out.ShortenedURL, "/")+1:]
+	b.mu.Lock()
+	b.codes = append(b.codes, code)
+	b.mu.Unlock()
+	return code, ""
+}
+
+// redirect resolves a random code created so far.
+func (b *bench) redirect() string {
+	b.mu.Lock()
+	if len(b.codes) == 0 {
+		b.mu.Unlock()
+		return "no codes"
+	}
+	code := b.codes[rand.IntN(len(b.codes))]
+	b.mu.Unlock()
+
+	resp, err := b.client.Get(b.base + "/" + code)
+	if err != nil {
+		return "transport"
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusFound {
+		return errKind(resp)
+	}
+	return ""
+}
+
+// errKind names a failed response by status and, for JSON errors, code.
+func errKind(resp *http.Response) string {
+	var body urlshortener.ErrorResponse
+	if json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&body) == nil && body.Error.Code != "" {
+		return fmt.Sprintf("%d %s", resp.StatusCode, body.Error.Code)
+	}
+	return strconv.Itoa(resp.StatusCode)
+}
+
+func report(w io.Writer, title string, results map[string]*result) {
+	fmt.Fprintf(w, "== %s\n", title)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "\tok\terrors\treq/s\tp50\tp90\tp99\tmax\t")
+	for _, kind := range []string{"create", "redirect"} {
+		r := results[kind]
+		lat := slices.Clone(r.latencies)
+		slices.Sort(lat)
+		nerr := 0
+		for _, n := range r.errors {
+			nerr += n
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.1f\t%s\t%s\t%s\t%s\t\n", kind, len(lat), nerr,
+			float64(len(lat))/r.elapsed.Seconds(),
+			percentile(lat, 50), percentile(lat, 90), percentile(lat, 99), percentile(lat, 100))
+	}
+	tw.Flush()
+
+	for _, kind := range []string{"create", "redirect"} {
+		errs := results[kind].errors
+		keys := make([]string, 0, len(errs))
+		for k := range errs {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			fmt.Fprintf(w, "  %s error %q: %d\n", kind, k, errs[k])
+		}
+	}
+	fmt.Fprintln(w)
+}
+
+// percentile of sorted latencies, rounded for display.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := (len(sorted)*p + 99) / 100
+	i = min(max(i-1, 0), len(sorted)-1)
+	return sorted[i].Round(time.Microsecond)
+}
@@ -0,0 +1,691 @@
+// shortctl manages a urlshortener service. By default it talks to a running
+// server; with -db it opens the SQLite database directly and serves the same
+// API in-process, so it also works while the server is down.
+//
+//	shortctl [flags] shorten [-owner O] [-title T] [-tag T,...] [-param NAME=TEMPLATE]... [-pass-query] [-forward-path] [-routes FILE] [-password P] [-one-time] URL...
+//	shortctl [flags] resolve CODE|SHORT_URL
+//	shortctl [flags] stats CODE|SHORT_URL
+//	shortctl [flags] links [-q TEXT] [-limit N] [-offset N]
+//	shortctl [flags] search [-prefix URL] [-owner O] [-tag T,...] [-after T] [-before T] [-title WORDS]
+//	shortctl [flags] keys [list | create NAME | revoke ID]
+//	shortctl [flags] seeds
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/George-Yanev/go-playground/internal/urlshortener"
+	"github.com/George-Yanev/go-playground/pkg/shortener"
+)
+
+type cli struct {
+	client *shortener.Client
+	json   bool
+	out    io.Writer
+}
+
+func main() {
+	server := flag.String("server", envOr("SHORTCTL_SERVER", "http://localhost:8080"), "server base URL")
+	dbPath := flag.String("db", "", "open this SQLite database instead of talking to a server")
+	host := flag.String("host", envOr("SHORT_URL_HOST", "localhost:8080"), "short URL host used with -db")
+	codeScheme := flag.String("code-scheme", os.Getenv("CODE_SCHEME"), "code scheme of the database used with -db: sequential or permuted")
+	codeKey := flag.String("code-key", os.Getenv("CODE_KEY"), "key of permuted codes used with -db")
+	adminToken := flag.String("admin-token", os.Getenv("SHORTCTL_ADMIN_TOKEN"), "admin API token")
+	apiKey := flag.String("api-key", os.Getenv("SHORTCTL_API_KEY"), "API key for creating links")
+	output := flag.String("o", "table", "output format: table or json")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: shortctl [flags] shorten|resolve|stats|links|search|delete|restore|history|keys|seeds|webhooks [args]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *output != "table" && *output != "json" {
+		fail(fmt.Errorf("unknown output format %q", *output))
+	}
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var client *shortener.Client
+	closeClient := func() error { return nil }
+	if *dbPath != "" {
+		var err error
+		var codes urlshortener.CodeScheme
+		if codes, err = urlshortener.ParseCodeScheme(*codeScheme, *codeKey); err != nil {
+			fail(err)
+		}
+		client, closeClient, err = offlineClient(*dbPath, *host, codes)
+		if err != nil {
+			fail(err)
+		}
+	} else {
+		if *apiKey == "" {
+			// the server accepts the admin token for creating links too
+			*apiKey = *adminToken
+		}
+		client = shortener.New(*server,
+			shortener.WithAdminToken(*adminToken),
+			shortener.WithAPIKey(*apiKey),
+		)
+	}
+
+	c := &cli{client: client, json: *output == "json", out: os.Stdout}
+	err := c.run(context.Background(), flag.Arg(0), flag.Args()[1:])
+	if cerr := closeClient(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fail(err)
+	}
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "shortctl:", err)
+	os.Exit(1)
+}
+
+// offlineClient serves the API from the database at path inside this process.
+// The returned close function stops the worker and hands back the seed it
+// leased, with the counter it reached, before closing the database.
+func offlineClient(path, host string, codes urlshortener.CodeScheme) (*shortener.Client, func() error, error) {
+	// keep migration and lease logging off stdout
+	slog.SetDefault(urlshortener.NewLogger(io.Discard))
+
+	if _, err := os.Stat(path); err != nil {
+		return nil, nil, fmt.Errorf("opening database: %w", err)
+	}
+	db, err := urlshortener.InitDBAt(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	token := make([]byte, 16)
+	rand.Read(token)
+	adminToken := hex.EncodeToString(token)
+
+	seeds := &offlineSeeds{SeedsDb: urlshortener.NewSeedsDb(db), links: urlshortener.NewUrlMapping(db)}
+	workCh := make(chan urlshortener.WorkRequest)
+	seedCh := make(chan urlshortener.SeedRequest)
+	go urlshortener.ManageSeeds(seeds, seedCh)
+	workers := urlshortener.StartWorkers(db, workCh, seedCh, 1)
+	handler := urlshortener.NewHandler(db, workCh, urlshortener.HttpConfig{
+		ShortUrlHost: host,
+		Codes:        codes,
+		Health:       urlshortener.NewHealth(db, workers, 0),
+		AdminToken:   adminToken,
+	})
+
+	client := shortener.New("http://offline",
+		shortener.WithHTTPClient(&http.Client{Transport: handlerTransport{handler}}),
+		shortener.WithAdminToken(adminToken),
+		shortener.WithAPIKey(adminToken),
+	)
+	return client, func() error {
+		close(workCh)
+		err := seeds.releaseAll()
+		if cerr := db.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	}, nil
+}
+
+// offlineSeeds leases seeds from the database and remembers who holds them,
+// so that releaseAll can return the lease the worker still holds on exit.
+type offlineSeeds struct {
+	*urlshortener.SeedsDb
+	links *urlshortener.UrlMapping
+
+	mu   sync.Mutex
+	held map[string]urlshortener.Seed // by holder
+}
+
+func (s *offlineSeeds) Acquire(holder string) (urlshortener.Seed, error) {
+	seed, err := s.SeedsDb.Acquire(holder)
+	if err == nil {
+		s.mu.Lock()
+		if s.held == nil {
+			s.held = map[string]urlshortener.Seed{}
+		}
+		s.held[holder] = seed
+		s.mu.Unlock()
+	}
+	return seed, err
+}
+
+func (s *offlineSeeds) Release(holder string, seed urlshortener.Seed) error {
+	s.mu.Lock()
+	delete(s.held, holder)
+	s.mu.Unlock()
+	return s.SeedsDb.Release(holder, seed)
+}
+
+// releaseAll returns the seeds still leased, with the counter of the last
+// link written under each.
+func (s *offlineSeeds) releaseAll() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for holder, seed := range s.held {
+		used, err := s.links.GetSeedCounter(seed.Seed)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		seed.CounterUsed = max(seed.CounterUsed, used)
+		if err := s.SeedsDb.Release(holder, seed); err != nil {
+			errs = append(errs, err)
+		}
+		delete(s.held, holder)
+	}
+	return errors.Join(errs...)
+}
+
+// handlerTransport answers requests by calling an http.Handler directly.
+type handlerTransport struct {
+	h http.Handler
+}
+
+func (t handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rec := httptest.NewRecorder()
+	t.h.ServeHTTP(rec, req)
+	return rec.Result(), nil
+}
+
+func (c *cli) run(ctx context.Context, cmd string, args []string) error {
+	switch cmd {
+	case "shorten":
+		return c.shorten(ctx, args)
+	case "resolve":
+		return c.resolve(ctx, args)
+	case "stats":
+		return c.stats(ctx, args)
+	case "links":
+		return c.links(ctx, args)
+	case "search":
+		return c.search(ctx, args)
+	case "delete":
+		return c.delete(ctx, args)
+	case "restore":
+		return c.restore(ctx, args)
+	case "history":
+		return c.history(ctx, args)
+	case "keys":
+		return c.keys(ctx, args)
+	case "seeds":
+		return c.seeds(ctx)
+	case "webhooks":
+		return c.webhooks(ctx, args)
+	}
+	return fmt.Errorf("unknown command %q", cmd)
+}
+
+func (c *cli) shorten(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("shorten", flag.ExitOnError)
+	interstitial := fs.Bool("interstitial", false, "show a preview page before redirecting")
+	owner := fs.String("owner", "", "team or person the links belong to")
+	title := fs.String("title", "", "title of the links")
+	tags := fs.String("tag", "", "comma-separated tags")
+	params := paramFlag{}
+	fs.Var(params, "param", "NAME=TEMPLATE query parameter set on the destination, e.g. utm_source=short; repeatable")
+	passQuery := fs.Bool("pass-query", false, "pass the short URL's query string to the destination")
+	forwardPath := fs.Bool("forward-path", false, "append the path after the code to the destination")
+	routesFile := fs.String("routes", "", "JSON file with an array of conditional routes")
+	password := fs.String("password", "", "password visitors must enter before the redirect")
+	oneTime := fs.Bool("one-time", false, "links stop working after their first redirect")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return fmt.Errorf("usage: shorten [-interstitial] [-owner O] [-title T] [-tag T,...] [-param NAME=TEMPLATE]... [-pass-query] [-forward-path] [-routes FILE] [-password P] [-one-time] URL...")
+	}
+	var routes []shortener.Route
+	if *routesFile != "" {
+		b, err := os.ReadFile(*routesFile)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(b, &routes); err != nil {
+			return fmt.Errorf("reading routes: %w", err)
+		}
+	}
+	var redirect *shortener.RedirectRules
+	if len(params) > 0 || *passQuery || *forwardPath || len(routes) > 0 {
+		redirect = &shortener.RedirectRules{Params: params, PassQuery: *passQuery, ForwardPath: *forwardPath, Routes: routes}
+	}
+
+	reqs := make([]shortener.ShortenRequest, fs.NArg())
+	for i, u := range fs.Args() {
+		reqs[i] = shortener.ShortenRequest{
+			URL:          u,
+			Interstitial: *interstitial,
+			Owner:        *owner,
+			Title:        *title,
+			Tags:         splitList(*tags),
+			Redirect:     redirect,
+			Password:     *password,
+			OneTime:      *oneTime,
+		}
+	}
+	results, err := c.client.ShortenBatch(ctx, reqs)
+	if err != nil {
+		return err
+	}
+
+	type row struct {
+		URL      string `json:"original_url"`
+		ShortURL string `json:"short_url,omitempty"`
+		Error    string `json:"error,omitempty"`
+	}
+	rows := make([]row, len(results))
+	for i, r := range results {
+		rows[i] = row{URL: reqs[i].URL, ShortURL: r.ShortURL}
+		if r.Err != nil {
+			rows[i].Error = r.Err.Error()
+		}
+	}
+	return c.print(rows, []string{"ORIGINAL URL", "SHORT URL", "ERROR"}, func(add func(...any)) {
+		for _, r := range rows {
+			add(r.URL, r.ShortURL, r.Error)
+		}
+	})
+}
+
+func (c *cli) resolve(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: resolve CODE|SHORT_URL")
+	}
+	dest, err := c.client.Resolve(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.print(map[string]string{"code": args[0], "original_url": dest}, nil, nil)
+	}
+	fmt.Fprintln(c.out, dest)
+	return nil
+}
+
+func (c *cli) stats(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: stats CODE|SHORT_URL")
+	}
+	s, err := c.client.Stats(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return c.print(s, []string{"FIELD", "VALUE"}, func(add func(...any)) {
+		add("code", s.Code)
+		add("short url", s.ShortURL)
+		add("original url", s.OriginalURL)
+		add("created", s.CreatedAt.Format(time.RFC3339))
+		add("clicks", s.Clicks)
+		add("interstitial", s.Interstitial)
+		add("owner", s.Owner)
+		add("title", s.Title)
+		add("tags", strings.Join(s.Tags, ","))
+		add("redirect", redirectText(s.Redirect))
+		add("password", s.PasswordProtected)
+		add("one-time", oneTimeText(*s))
+		for _, name := range slices.Sorted(maps.Keys(s.VariantClicks)) {
+			add("clicks "+name, s.VariantClicks[name])
+		}
+		add("disabled", disabledText(*s))
+		add("destination check", checkText(*s))
+	})
+}
+
+func (c *cli) links(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("links", flag.ExitOnError)
+	query := fs.String("q", "", "only links whose original URL contains this text")
+	limit := fs.Int("limit", 50, "maximum number of links")
+	offset := fs.Int("offset", 0, "number of links to skip")
+	broken := fs.Bool("broken", false, "only links whose destination failed its last check")
+	deleted := fs.Bool("deleted", false, "deleted links instead of live ones")
+	fs.Parse(args)
+
+	links, err := c.client.ListLinks(ctx, shortener.ListOptions{
+		Query: *query, Broken: *broken, Deleted: *deleted, Limit: *limit, Offset: *offset,
+	})
+	if err != nil {
+		return err
+	}
+	if *deleted {
+		return c.print(links, []string{"CODE", "DELETED", "BY", "ORIGINAL URL"}, func(add func(...any)) {
+			for _, l := range links {
+				add(l.Code, l.DeletedAt.Format(time.DateTime), l.DeletedBy, l.OriginalURL)
+			}
+		})
+	}
+	return c.print(links, []string{"CODE", "CREATED", "CLICKS", "DISABLED", "CHECK", "ORIGINAL URL"}, func(add func(...any)) {
+		for _, l := range links {
+			add(l.Code, l.CreatedAt.Format(time.DateTime), l.Clicks, disabledText(l), checkText(l), l.OriginalURL)
+		}
+	})
+}
+
+// checkText summarizes the last destination check: "-" if there was none,
+// the status, or "broken" with the status or error.
+func checkText(s shortener.Stats) string {
+	switch {
+	case s.LastCheck == nil:
+		return "-"
+	case !s.Broken:
+		return strconv.Itoa(s.LastCheck.Status)
+	case s.LastCheck.Status != 0:
+		return "broken " + strconv.Itoa(s.LastCheck.Status)
+	}
+	return "broken: " + s.LastCheck.Error
+}
+
+func (c *cli) search(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("search", flag.ExitOnError)
+	prefix := fs.String("prefix", "", "start of the original URL")
+	owner := fs.String("owner", "", "owner of the links")
+	tags := fs.String("tag", "", "comma-separated tags the links must all have")
+	after := fs.String("after", "", "created at or after this RFC 3339 time")
+	before := fs.String("before", "", "created before this RFC 3339 time")
+	title := fs.String("title", "", "words that must appear in the title")
+	limit := fs.Int("limit", 50, "maximum number of links")
+	offset := fs.Int("offset", 0, "number of links to skip")
+	fs.Parse(args)
+
+	opts := shortener.SearchOptions{
+		URLPrefix: *prefix,
+		Owner:     *owner,
+		Tags:      splitList(*tags),
+		Title:     *title,
+		Limit:     *limit,
+		Offset:    *offset,
+	}
+	for _, t := range []struct {
+		value string
+		dst   *time.Time
+	}{{*after, &opts.CreatedAfter}, {*before, &opts.CreatedBefore}} {
+		if t.value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, t.value)
+		if err != nil {
+			return fmt.Errorf("invalid time %q: %w", t.value, err)
+		}
+		*t.dst = parsed
+	}
+
+	links, err := c.client.Search(ctx, opts)
+	if err != nil {
+		return err
+	}
+	return c.print(links, []string{"CODE", "CREATED", "OWNER", "TAGS", "TITLE", "ORIGINAL URL"}, func(add func(...any)) {
+		for _, l := range links {
+			add(l.Code, l.CreatedAt.Format(time.DateTime), l.Owner, strings.Join(l.Tags, ","), l.Title, l.OriginalURL)
+		}
+	})
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// paramFlag collects repeated -param NAME=TEMPLATE flags.
+type paramFlag map[string]string
+
+func (p paramFlag) String() string { return "" }
+
+func (p paramFlag) Set(s string) error {
+	name, tmpl, ok := strings.Cut(s, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("want NAME=TEMPLATE, got %q", s)
+	}
+	p[name] = tmpl
+	return nil
+}
+
+func oneTimeText(s shortener.Stats) string {
+	switch {
+	case s.Consumed:
+		return "yes, used"
+	case s.OneTime:
+		return "yes"
+	}
+	return "no"
+}
+
+func redirectText(r *shortener.RedirectRules) string {
+	if r == nil {
+		return ""
+	}
+	var parts []string
+	for _, name := range slices.Sorted(maps.Keys(r.Params)) {
+		parts = append(parts, name+"="+r.Params[name])
+	}
+	if r.PassQuery {
+		parts = append(parts, "pass query")
+	}
+	if r.ForwardPath {
+		parts = append(parts, "forward path")
+	}
+	if len(r.Routes) > 0 {
+		parts = append(parts, fmt.Sprintf("%d routes", len(r.Routes)))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (c *cli) delete(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("delete", flag.ContinueOnError)
+	reason := fs.String("reason", "", "why the link is deleted, kept in its history")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return errors.New("usage: delete [-reason R] CODE|SHORT_URL")
+	}
+	return c.client.DeleteLink(ctx, fs.Arg(0), *reason)
+}
+
+func (c *cli) restore(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: restore CODE|SHORT_URL")
+	}
+	s, err := c.client.RestoreLink(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return c.print(s, []string{"CODE", "ORIGINAL URL"}, func(add func(...any)) {
+		add(s.Code, s.OriginalURL)
+	})
+}
+
+func (c *cli) history(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: history CODE|SHORT_URL")
+	}
+	entries, err := c.client.LinkHistory(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return c.print(entries, []string{"AT", "ACTION", "ACTOR", "OLD URL", "NEW URL", "REASON"}, func(add func(...any)) {
+		for _, e := range entries {
+			add(e.At.Format(time.DateTime), e.Action, e.Actor, e.OldURL, e.NewURL, e.Reason)
+		}
+	})
+}
+
+func (c *cli) keys(ctx context.Context, args []string) error {
+	sub := "list"
+	if len(args) > 0 {
+		sub = args[0]
+	}
+
+	switch {
+	case sub == "list":
+		keys, err := c.client.APIKeys(ctx)
+		if err != nil {
+			return err
+		}
+		return c.print(keys, []string{"ID", "NAME", "CREATED", "REVOKED"}, func(add func(...any)) {
+			for _, k := range keys {
+				revoked := ""
+				if k.RevokedAt != nil {
+					revoked = k.RevokedAt.Format(time.DateTime)
+				}
+				add(k.ID, k.Name, k.CreatedAt.Format(time.DateTime), revoked)
+			}
+		})
+	case sub == "create" && len(args) == 2:
+		key, err := c.client.CreateAPIKey(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		return c.print(key, []string{"ID", "NAME", "KEY"}, func(add func(...any)) {
+			add(key.ID, key.Name, key.Key)
+		})
+	case sub == "revoke" && len(args) == 2:
+		return c.client.RevokeAPIKey(ctx, args[1])
+	}
+	return fmt.Errorf("usage: keys [list | create NAME | revoke ID]")
+}
+
+func (c *cli) webhooks(ctx context.Context, args []string) error {
+	const usage = "usage: webhooks [list | create [-events E,...] [-thresholds N,...] URL | delete ID]"
+	sub := "list"
+	if len(args) > 0 {
+		sub = args[0]
+	}
+
+	switch {
+	case sub == "list":
+		hooks, err := c.client.Webhooks(ctx)
+		if err != nil {
+			return err
+		}
+		return c.print(hooks, []string{"ID", "URL", "EVENTS", "THRESHOLDS", "CREATED"}, func(add func(...any)) {
+			for _, h := range hooks {
+				events := strings.Join(h.Events, ",")
+				if events == "" {
+					events = "all"
+				}
+				add(h.ID, h.URL, events, intsText(h.ClickThresholds), h.CreatedAt.Format(time.DateTime))
+			}
+		})
+	case sub == "create":
+		fs := flag.NewFlagSet("webhooks create", flag.ContinueOnError)
+		events := fs.String("events", "", "comma-separated events to receive (default all)")
+		thresholds := fs.String("thresholds", "", "comma-separated click counts for link.click_threshold")
+		if err := fs.Parse(args[1:]); err != nil || fs.NArg() != 1 {
+			return errors.New(usage)
+		}
+		var counts []int
+		for _, n := range splitList(*thresholds) {
+			i, err := strconv.Atoi(n)
+			if err != nil {
+				return fmt.Errorf("bad threshold %q", n)
+			}
+			counts = append(counts, i)
+		}
+		hook, err := c.client.CreateWebhook(ctx, fs.Arg(0), splitList(*events), counts)
+		if err != nil {
+			return err
+		}
+		return c.print(hook, []string{"ID", "URL", "SECRET"}, func(add func(...any)) {
+			add(hook.ID, hook.URL, hook.Secret)
+		})
+	case sub == "delete" && len(args) == 2:
+		return c.client.DeleteWebhook(ctx, args[1])
+	}
+	return errors.New(usage)
+}
+
+func intsText(ns []int) string {
+	s := make([]string, len(ns))
+	for i, n := range ns {
+		s[i] = strconv.Itoa(n)
+	}
+	return strings.Join(s, ",")
+}
+
+func (c *cli) seeds(ctx context.Context) error {
+	pool, err := c.client.SeedPool(ctx)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.print(pool, nil, nil)
+	}
+
+	fmt.Fprintf(c.out, "available: %d  used: %d  exhausted: %d\n\n",
+		pool.Counts["available"], pool.Counts["used"], pool.Counts["exhausted"])
+	return c.print(pool, []string{"SEED", "STATUS", "USED", "SIZE", "LEASE HOLDER", "LEASE TAKEN"}, func(add func(...any)) {
+		for _, s := range pool.Seeds {
+			taken := ""
+			if s.LeaseTaken != nil {
+				taken = s.LeaseTaken.Format(time.DateTime)
+			}
+			add(s.Seed, s.StatusName(), s.CounterUsed, s.CounterSize, s.LeaseHolder, taken)
+		}
+	})
+}
+
+func disabledText(s shortener.Stats) string {
+	if !s.Disabled {
+		return ""
+	}
+	if s.DisabledReason == "" {
+		return "yes"
+	}
+	return s.DisabledReason
+}
+
+// print writes v as JSON, or as a table of the rows passed to add.
+func (c *cli) print(v any, header []string, rows func(add func(...any))) error {
+	if c.json || rows == nil {
+		enc := json.NewEncoder(c.out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+
+	tw := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	line := func(cells ...any) {
+		for i, cell := range cells {
+			if i > 0 {
+				fmt.Fprint(tw, "\t")
+			}
+			fmt.Fprint(tw, cell)
+		}
+		fmt.Fprintln(tw)
+	}
+	anyHeader := make([]any, len(header))
+	for i, h := range header {
+		anyHeader[i] = h
+	}
+	line(anyHeader...)
+	rows(line)
+	return tw.Flush()
+}
@@ -1,59 +1,345 @@
 package main
 
 import (
-	"database/sql"
-	"fmt"
-	"log"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/George-Yanev/go-playground/internal/urlshortener"
 )
 
+// MODE selects how the process runs:
+//
+//	standalone      (default) shortener leasing seeds from its own database
+//	seed-server     only serves the seed lease API to frontends
+//	frontend        shortener leasing seeds from SEED_SERVICE_URL
+//	serve-readonly  redirects from the snapshots in SNAPSHOT_DIR, no database
 func main() {
-	db, err := urlshortener.InitDB()
+	slog.SetDefault(urlshortener.NewLogger(os.Stdout))
+
+	mode := os.Getenv("MODE")
+	if mode == "" {
+		mode = "standalone"
+	}
+	addr := os.Getenv("LISTEN_ADDR")
+	if addr == "" {
+		addr = ":8080"
+	}
+	if mode == "serve-readonly" {
+		serveReadOnly(addr)
+		return
+	}
+	dbPath := os.Getenv("DB_PATH")
+	if dbPath == "" {
+		dbPath = urlshortener.DefaultDBPath
+	}
+
+	db, err := urlshortener.InitDBAt(dbPath)
 	if err != nil {
-		log.Fatalf("Failed to initialize the db: %v", err)
+		fatal("Failed to initialize the db", err)
 	}
 	defer db.Close()
 
-	err = syncSeedFromUrlMapping(db)
-	if err != nil {
-		log.Fatalf("Cannot sync seed table from url_mapping. Error: %v", err)
+	var seeds urlshortener.SeedSource
+	var remote *urlshortener.RemoteSeeds
+	switch mode {
+	case "standalone":
+		err = urlshortener.SyncSeedsFromUrlMapping(db)
+		if err != nil {
+			fatal("Cannot sync seed table from url_mapping", err)
+		}
+		seeds = urlshortener.NewSeedsDb(db)
+	case "seed-server":
+		// leases belong to the frontends and outlive restarts, expiring
+		// after SEED_LEASE_TTL (default 1m) without heartbeats; only the
+		// counters are raised past links this database may hold
+		cfg := urlshortener.SeedServiceConfig{Token: os.Getenv("SEED_SERVICE_TOKEN")}
+		if cfg.Token == "" {
+			fatal("Please setup SEED_SERVICE_TOKEN environment variable", nil)
+		}
+		if v := os.Getenv("SEED_LEASE_TTL"); v != "" {
+			cfg.LeaseTTL, err = time.ParseDuration(v)
+			if err != nil {
+				fatal("Invalid SEED_LEASE_TTL", err)
+			}
+		}
+		if err := urlshortener.SyncSeedCounters(db); err != nil {
+			fatal("Cannot sync seed counters from url_mapping", err)
+		}
+		urlshortener.StartSeedServer(db, addr, cfg)
+		return
+	case "frontend":
+		// links stay in this frontend's database and resolve under its
+		// own SHORT_URL_HOST; SEED_HOLDER, stable across restarts (the
+		// host name by default), lets a restart recover its leases
+		seedServiceURL := os.Getenv("SEED_SERVICE_URL")
+		if seedServiceURL == "" {
+			fatal("Please setup SEED_SERVICE_URL environment variable", nil)
+		}
+		token := os.Getenv("SEED_SERVICE_TOKEN")
+		if token == "" {
+			fatal("Please setup SEED_SERVICE_TOKEN environment variable", nil)
+		}
+		blockSize := 4
+		if v := os.Getenv("SEED_BLOCK_SIZE"); v != "" {
+			blockSize, err = strconv.Atoi(v)
+			if err != nil {
+				fatal("Invalid SEED_BLOCK_SIZE", err)
+			}
+		}
+		remote = urlshortener.NewRemoteSeeds(seedServiceURL, token, blockSize)
+		remote.Counter = urlshortener.NewUrlMapping(db).GetSeedCounter
+		if holder := os.Getenv("SEED_HOLDER"); holder != "" {
+			remote.Holder = holder
+		} else if host, err := os.Hostname(); err == nil {
+			remote.Holder = host + ":" + dbPath
+		}
+		if err := remote.Start(); err != nil {
+			fatal("Cannot reach the seed service", err)
+		}
+		seeds = remote
+	default:
+		fatal("Unknown MODE "+mode, nil)
 	}
 
 	shortUrlHost := os.Getenv("SHORT_URL_HOST")
 	if shortUrlHost == "" {
-		log.Fatalln("Please setup short_url_host environment variable")
+		fatal("Please setup short_url_host environment variable", nil)
+	}
+
+	minSeeds := 1
+	if v := os.Getenv("READY_MIN_SEEDS"); v != "" {
+		minSeeds, err = strconv.Atoi(v)
+		if err != nil {
+			fatal("Invalid READY_MIN_SEEDS", err)
+		}
+	}
+	if mode == "frontend" {
+		// the local seeds table is not used
+		minSeeds = 0
 	}
 
-	workCh := make(chan urlshortener.WorkRequest)
-	seedCh := make(chan urlshortener.SeedRequest)
+	interstitialMode, err := urlshortener.ParseInterstitialMode(os.Getenv("INTERSTITIAL_MODE"))
+	if err != nil {
+		fatal("Invalid INTERSTITIAL_MODE", err)
+	}
+	// CODE_SCHEME=permuted issues unguessable codes keyed with CODE_KEY;
+	// links created before keep their sequential codes
+	codes, err := urlshortener.ParseCodeScheme(os.Getenv("CODE_SCHEME"), os.Getenv("CODE_KEY"))
+	if err != nil {
+		fatal("Invalid CODE_SCHEME or CODE_KEY", err)
+	}
+	var allowedDomains []string
+	if v := os.Getenv("ALLOWED_DOMAINS"); v != "" {
+		allowedDomains = strings.Split(v, ",")
+	}
 
-	go urlshortener.Manager(db, seedCh)
-	urlshortener.StartWorkers(db, workCh, seedCh, 10)
-	urlshortener.StartHttpServer(workCh, shortUrlHost)
-}
+	var blocklist *urlshortener.Blocklist
+	if path := os.Getenv("BLOCKLIST_FILE"); path != "" {
+		blocklist, err = urlshortener.LoadBlocklist(path)
+		if err != nil {
+			fatal("Cannot load blocklist", err)
+		}
+		watchCtx, stopWatch := context.WithCancel(context.Background())
+		defer stopWatch()
+		go blocklist.WatchFile(watchCtx, 10*time.Second)
+	}
 
-func syncSeedFromUrlMapping(db *sql.DB) error {
-	u := urlshortener.NewUrlMapping(db)
-	seedDb := urlshortener.NewSeedsDb(db)
+	// WRITE_BATCH_SIZE > 0 commits links in groups of up to that many,
+	// optionally waiting WRITE_BATCH_WINDOW for a group to fill
+	var links urlshortener.LinkWriter = urlshortener.NewUrlMapping(db)
+	if v := os.Getenv("WRITE_BATCH_SIZE"); v != "" {
+		batchSize, err := strconv.Atoi(v)
+		if err != nil {
+			fatal("Invalid WRITE_BATCH_SIZE", err)
+		}
+		var window time.Duration
+		if v := os.Getenv("WRITE_BATCH_WINDOW"); v != "" {
+			window, err = time.ParseDuration(v)
+			if err != nil {
+				fatal("Invalid WRITE_BATCH_WINDOW", err)
+			}
+		}
+		if batchSize > 0 {
+			links = urlshortener.NewBatchWriter(db, window, batchSize)
+		}
+	}
 
-	seeds, err := seedDb.SelectSeedByStatus(1) // get used seeds 0 - available, 1 - used, 2 - exhausted
-	if err != nil {
-		return fmt.Errorf("Cannot get Seed by status: %w", err)
+	webhookWorkers := 2
+	if v := os.Getenv("WEBHOOK_WORKERS"); v != "" {
+		webhookWorkers, err = strconv.Atoi(v)
+		if err != nil {
+			fatal("Invalid WEBHOOK_WORKERS", err)
+		}
+	}
+
+	opts := []urlshortener.ServerOption{
+		urlshortener.WithDB(db),
+		urlshortener.WithAddr(addr),
+		urlshortener.WithWorkers(10),
+		urlshortener.WithSeedSource(seeds),
+		urlshortener.WithLinkWriter(links),
+		urlshortener.WithMinSeeds(minSeeds),
+		urlshortener.WithCodeScheme(codes),
+		urlshortener.WithWebhooks(urlshortener.WebhookConfig{}, webhookWorkers),
+		urlshortener.WithBasePath(os.Getenv("BASE_PATH")),
+		urlshortener.WithHttpConfig(urlshortener.HttpConfig{
+			ShortUrlHost: shortUrlHost,
+			Interstitial: urlshortener.Interstitial{
+				Mode:           interstitialMode,
+				AllowedDomains: allowedDomains,
+				// shared by replicas so a preview's continue link works on any
+				Secret: []byte(os.Getenv("INTERSTITIAL_SECRET")),
+			},
+			Blocklist:  blocklist,
+			AdminToken: os.Getenv("ADMIN_TOKEN"),
+		}),
 	}
 
-	for _, s := range seeds {
-		counterUsed, err := u.GetSeedCounter(s.Seed)
+	// LINK_CHECK_INTERVAL (e.g. 24h) turns on checking link destinations,
+	// re-checking each one after that long
+	if v := os.Getenv("LINK_CHECK_INTERVAL"); v != "" {
+		interval, err := time.ParseDuration(v)
 		if err != nil {
-			return fmt.Errorf("Cannot get url_mapping seed counter: %w", err)
+			fatal("Invalid LINK_CHECK_INTERVAL", err)
+		}
+		opts = append(opts, urlshortener.WithLinkChecker(urlshortener.LinkCheckerConfig{Interval: interval}))
+	}
+
+	// SNAPSHOT_DIR publishes snapshots for serve-readonly nodes every
+	// SNAPSHOT_INTERVAL (default 1m)
+	if dir := os.Getenv("SNAPSHOT_DIR"); dir != "" {
+		cfg := urlshortener.SnapshotConfig{Dir: dir}
+		if v := os.Getenv("SNAPSHOT_INTERVAL"); v != "" {
+			cfg.Interval, err = time.ParseDuration(v)
+			if err != nil {
+				fatal("Invalid SNAPSHOT_INTERVAL", err)
+			}
+		}
+		opts = append(opts, urlshortener.WithSnapshots(cfg))
+	}
+
+	// TLS_CERT_FILE and TLS_KEY_FILE serve HTTPS, reloading renewed
+	// certificates; HTTP_REDIRECT_ADDR (e.g. :80) redirects plaintext
+	// requests there and HSTS_MAX_AGE (e.g. 8760h) sends HSTS
+	if certFile := os.Getenv("TLS_CERT_FILE"); certFile != "" {
+		cfg := urlshortener.TLSConfig{
+			CertFile:              certFile,
+			KeyFile:               os.Getenv("TLS_KEY_FILE"),
+			RedirectAddr:          os.Getenv("HTTP_REDIRECT_ADDR"),
+			HSTSIncludeSubdomains: os.Getenv("HSTS_INCLUDE_SUBDOMAINS") == "true",
+			HSTSPreload:           os.Getenv("HSTS_PRELOAD") == "true",
+		}
+		if cfg.KeyFile == "" {
+			fatal("Please setup TLS_KEY_FILE environment variable", nil)
+		}
+		if v := os.Getenv("HSTS_MAX_AGE"); v != "" {
+			cfg.HSTSMaxAge, err = time.ParseDuration(v)
+			if err != nil {
+				fatal("Invalid HSTS_MAX_AGE", err)
+			}
+		}
+		opts = append(opts, urlshortener.WithTLS(cfg))
+	}
+
+	srv, err := urlshortener.NewServer(opts...)
+	if err != nil {
+		fatal("Cannot create the server", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := srv.Start(ctx); err != nil {
+		fatal("Cannot start the server", err)
+	}
+	<-ctx.Done()
+
+	slog.Info("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Error("shutdown", "err", err)
+	}
+	if batch, ok := links.(*urlshortener.BatchWriter); ok {
+		batch.Close()
+	}
+	if remote != nil {
+		if err := remote.Close(); err != nil {
+			slog.Error("releasing seed leases", "err", err)
 		}
+	}
+}
 
-		status := 0
-		if counterUsed == s.CounterSize {
-			status = 2
+// serveReadOnly answers redirects from the snapshots a primary publishes in
+// SNAPSHOT_DIR, checking for new ones every SNAPSHOT_REFRESH (default 10s),
+// and sends everything else to PRIMARY_URL.
+func serveReadOnly(addr string) {
+	dir := os.Getenv("SNAPSHOT_DIR")
+	if dir == "" {
+		fatal("Please setup SNAPSHOT_DIR environment variable", nil)
+	}
+	refresh := 10 * time.Second
+	if v := os.Getenv("SNAPSHOT_REFRESH"); v != "" {
+		var err error
+		refresh, err = time.ParseDuration(v)
+		if err != nil || refresh <= 0 {
+			fatal("Invalid SNAPSHOT_REFRESH", err)
 		}
-		seedDb.SetSeedStatusAndCounter(s.Seed, counterUsed, status)
 	}
-	return nil
+	interstitialMode, err := urlshortener.ParseInterstitialMode(os.Getenv("INTERSTITIAL_MODE"))
+	if err != nil {
+		fatal("Invalid INTERSTITIAL_MODE", err)
+	}
+	var allowedDomains []string
+	if v := os.Getenv("ALLOWED_DOMAINS"); v != "" {
+		allowedDomains = strings.Split(v, ",")
+	}
+
+	store, err := urlshortener.OpenSnapshotStore(dir)
+	if err != nil {
+		fatal("Cannot open the snapshot", err)
+	}
+	defer store.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go store.Watch(ctx, refresh)
+
+	srv := &http.Server{
+		Addr: addr,
+		Handler: urlshortener.NewReadOnlyHandler(store, urlshortener.ReadOnlyConfig{
+			Primary: os.Getenv("PRIMARY_URL"),
+			Interstitial: urlshortener.Interstitial{
+				Mode:           interstitialMode,
+				AllowedDomains: allowedDomains,
+			},
+		}),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	slog.Info("read-only http server listening", "addr", addr, "snapshot_through", store.Through())
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fatal("http server stopped", err)
+	}
+}
+
+func fatal(msg string, err error) {
+	if err != nil {
+		slog.Error(msg, "err", err)
+	} else {
+		slog.Error(msg)
+	}
+	os.Exit(1)
 }
@@ -0,0 +1,193 @@
+package qrcode
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRSRemainder(t *testing.T) {
+	// version 1-M "HELLO WORLD" example from the specification
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+
+	got := rsRemainder(data, rsGenerator(10))
+	if !bytes.Equal(got, want) {
+		t.Errorf("rsRemainder = %v, want %v", got, want)
+	}
+}
+
+func TestFormatAndVersionInfo(t *testing.T) {
+	formats := map[Level]int{
+		Low:      0b111011111000100,
+		Medium:   0b101010000010010,
+		Quartile: 0b011010101011111,
+		High:     0b001011010001001,
+	}
+	for level, want := range formats {
+		if got := formatInfo(level, 0); got != want {
+			t.Errorf("formatInfo(%s, 0) = %015b, want %015b", level, got, want)
+		}
+	}
+
+	if got, want := versionInfo(7), 0b000111110010010100; got != want {
+		t.Errorf("versionInfo(7) = %018b, want %018b", got, want)
+	}
+}
+
+func TestNumDataCodewords(t *testing.T) {
+	tests := []struct {
+		version int
+		level   Level
+		want    int
+	}{
+		{1, Low, 19}, {1, High, 9},
+		{5, Quartile, 62}, {7, High, 66},
+		{10, Medium, 216}, {40, Low, 2956}, {40, High, 1276},
+	}
+	for _, tt := range tests {
+		if got := numDataCodewords(tt.version, tt.level); got != tt.want {
+			t.Errorf("numDataCodewords(%d, %s) = %d, want %d", tt.version, tt.level, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	inputs := []string{
+		"https://s.io/YWFhMQ==",
+		strings.Repeat("https://example.com/a/long/path?", 6),
+		strings.Repeat("x", 500),
+	}
+	for _, in := range inputs {
+		for level := Low; level <= High; level++ {
+			c, err := Encode([]byte(in), level)
+			if err != nil {
+				t.Fatalf("Encode(%d bytes, %s): %v", len(in), level, err)
+			}
+			if got := decode(t, c); got != in {
+				t.Errorf("version %d-%s mask %d decoded %q, want %q", c.Version, level, c.Mask, got, in)
+			}
+		}
+	}
+}
+
+func TestEncodeTooLong(t *testing.T) {
+	if _, err := Encode(make([]byte, 3000), Low); err != ErrDataTooLong {
+		t.Errorf("Encode 3000 bytes: err = %v, want ErrDataTooLong", err)
+	}
+}
+
+// decode reads a symbol back the way a reader would once it has located the
+// modules: format bits, unmasking, codeword order, blocks and the segment.
+func decode(t *testing.T, c *Code) string {
+	t.Helper()
+
+	var format int
+	for i := 0; i <= 5; i++ {
+		format |= b2i(c.Dark(8, i)) << i
+	}
+	format |= b2i(c.Dark(8, 7))<<6 | b2i(c.Dark(8, 8))<<7 | b2i(c.Dark(7, 8))<<8
+	for i := 9; i < 15; i++ {
+		format |= b2i(c.Dark(14-i, 8)) << i
+	}
+	if format != formatInfo(c.Level, c.Mask) {
+		t.Fatalf("format bits %015b do not match level %s mask %d", format, c.Level, c.Mask)
+	}
+
+	var raw []byte
+	var cur byte
+	n := 0
+	for right := c.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < c.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x, y := right-j, vert
+				if (right+1)&2 == 0 {
+					y = c.size - 1 - vert
+				}
+				if c.isFunction[y*c.size+x] {
+					continue
+				}
+				cur = cur<<1 | byte(b2i(c.Dark(x, y) != maskBit(c.Mask, x, y)))
+				if n++; n%8 == 0 {
+					raw = append(raw, cur)
+				}
+			}
+		}
+	}
+
+	numBlocks := numErrorCorrectionBlocks[c.Level][c.Version]
+	eccLen := eccCodewordsPerBlock[c.Level][c.Version]
+	rawCodewords := numRawDataModules(c.Version) / 8
+	numShort := numBlocks - rawCodewords%numBlocks
+	shortLen := rawCodewords / numBlocks
+
+	blocks := make([][]byte, numBlocks)
+	k := 0
+	for i := 0; i <= shortLen; i++ {
+		for j := range blocks {
+			if i == shortLen-eccLen && j < numShort {
+				continue // placeholder in short blocks
+			}
+			blocks[j] = append(blocks[j], raw[k])
+			k++
+		}
+	}
+
+	var data []byte
+	generator := rsGenerator(eccLen)
+	for j, block := range blocks {
+		dat, ecc := block[:len(block)-eccLen], block[len(block)-eccLen:]
+		if !bytes.Equal(rsRemainder(dat, generator), ecc) {
+			t.Fatalf("block %d fails error correction check", j)
+		}
+		data = append(data, dat...)
+	}
+
+	if mode := data[0] >> 4; mode != 0x4 {
+		t.Fatalf("mode = %x, want byte mode", mode)
+	}
+	bits := func(from, count int) int {
+		v := 0
+		for i := from; i < from+count; i++ {
+			v = v<<1 | int(data[i/8]>>(7-i%8)&1)
+		}
+		return v
+	}
+	length := bits(4, charCountBits(c.Version))
+	out := make([]byte, length)
+	for i := range out {
+		out[i] = byte(bits(4+charCountBits(c.Version)+i*8, 8))
+	}
+	return string(out)
+}
+
+func b2i(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func TestRender(t *testing.T) {
+	c, err := Encode([]byte("https://s.io/YWFhMQ=="), Medium)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img := c.Image(256)
+	side := (c.Size() + 2*QuietZone) * c.scale(256)
+	if b := img.Bounds(); b.Dx() != side || b.Dy() != side {
+		t.Errorf("image is %v, want %dx%d", b, side, side)
+	}
+
+	p, err := c.PNG(256)
+	if err != nil || !bytes.HasPrefix(p, []byte("\x89PNG")) {
+		t.Errorf("PNG() = %q..., %v", p[:min(8, len(p))], err)
+	}
+	if s := c.SVG(256); !bytes.HasPrefix(s, []byte("<svg")) || !bytes.HasSuffix(s, []byte("</svg>")) {
+		t.Errorf("SVG() is not an svg document: %.40s", s)
+	}
+}
@@ -0,0 +1,61 @@
+package qrcode
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+// QuietZone is the light border, in modules, required around the symbol.
+const QuietZone = 4
+
+// scale returns the module size in pixels for an image of roughly size pixels.
+func (c *Code) scale(size int) int {
+	return max(1, size/(c.size+2*QuietZone))
+}
+
+// Image renders the symbol with its quiet zone. The result is the largest
+// whole multiple of the module count that fits in size pixels.
+func (c *Code) Image(size int) image.Image {
+	scale := c.scale(size)
+	side := (c.size + 2*QuietZone) * scale
+
+	img := image.NewPaletted(image.Rect(0, 0, side, side), color.Palette{color.White, color.Black})
+	for y := 0; y < side; y++ {
+		for x := 0; x < side; x++ {
+			if c.Dark(x/scale-QuietZone, y/scale-QuietZone) {
+				img.SetColorIndex(x, y, 1)
+			}
+		}
+	}
+	return img
+}
+
+func (c *Code) PNG(size int) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, c.Image(size)); err != nil {
+		return nil, fmt.Errorf("qrcode: encoding png: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// SVG renders the symbol as a single path scaled to size pixels.
+func (c *Code) SVG(size int) []byte {
+	side := c.size + 2*QuietZone
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		size, size, side, side)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, side, side)
+	for y := 0; y < c.size; y++ {
+		for x := 0; x < c.size; x++ {
+			if c.Dark(x, y) {
+				fmt.Fprintf(&buf, "M%d,%dh1v1h-1z", x+QuietZone, y+QuietZone)
+			}
+		}
+	}
+	buf.WriteString(`"/></svg>`)
+	return buf.Bytes()
+}
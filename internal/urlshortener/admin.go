@@ -0,0 +1,220 @@
+package urlshortener
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// requireAdmin only lets requests carrying "Authorization: Bearer <token>"
+// through. With no token configured the admin API is disabled.
+func requireAdmin(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+			return
+		}
+		next(w, r.WithContext(withActor(r.Context(), "admin")))
+	}
+}
+
+type BlocklistRules struct {
+	Rules []BlockRule `json:"rules"`
+}
+
+type EnforceResult struct {
+	Rules    int `json:"rules"`
+	Disabled int `json:"disabled"`
+}
+
+type LinkList struct {
+	Links []LinkStats `json:"links"`
+}
+
+// SeedPool counts seeds by status name: available, used and exhausted.
+type SeedPool struct {
+	Counts map[string]int `json:"counts"`
+	Seeds  []SeedInfo     `json:"seeds"`
+}
+
+type KeyList struct {
+	Keys []APIKey `json:"keys"`
+}
+
+type CreateKeyRequest struct {
+	Name string `json:"name"`
+}
+
+// NewAPIKey is returned once, on creation; Key is not stored.
+type NewAPIKey struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+func handleBlocklistRules(blocklist *Blocklist) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rules := blocklist.Rules()
+		if rules == nil {
+			rules = []BlockRule{}
+		}
+		writeJSON(w, http.StatusOK, BlocklistRules{Rules: rules})
+	}
+}
+
+// handleBlocklistEnforce reloads the blocklist file and disables existing
+// links that match any of its rules.
+func handleBlocklistEnforce(links *UrlMapping, blocklist *Blocklist) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := loggerFor(RequestIDFromContext(r.Context()))
+		if blocklist == nil {
+			writeError(w, r, http.StatusNotFound, CodeNotFound, "No blocklist configured")
+			return
+		}
+
+		if err := blocklist.Reload(); err != nil {
+			logger.Error("reloading blocklist", "err", err)
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to reload blocklist")
+			return
+		}
+		disabled, err := links.DisableMatching(actorFromContext(r.Context()), func(dest string) (string, bool) {
+			rule, ok := blocklist.Match(dest)
+			return "blocklist " + rule.String(), ok
+		})
+		if err != nil {
+			logger.Error("disabling blocklisted links", "err", err)
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to disable links")
+			return
+		}
+
+		logger.Info("blocklist enforced", "rules", len(blocklist.Rules()), "disabled", disabled)
+		writeJSON(w, http.StatusOK, EnforceResult{Rules: len(blocklist.Rules()), Disabled: disabled})
+	}
+}
+
+// handleListLinks lists links, newest first. Query parameters: q (substring
+// of the original URL), broken (only links whose destination failed its last
+// check), deleted (deleted links instead of live ones), limit (default 50, at
+// most 500) and offset.
+func handleListLinks(links *UrlMapping) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		limit, offset := 50, 0
+		if v := q.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > 500 {
+				writeError(w, r, http.StatusBadRequest, CodeBadRequest, "limit must be between 1 and 500")
+				return
+			}
+			limit = n
+		}
+		if v := q.Get("offset"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				writeError(w, r, http.StatusBadRequest, CodeBadRequest, "offset must be a non-negative number")
+				return
+			}
+			offset = n
+		}
+
+		brokenOnly := false
+		if v := q.Get("broken"); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, CodeBadRequest, "broken must be true or false")
+				return
+			}
+			brokenOnly = b
+		}
+
+		deleted := false
+		if v := q.Get("deleted"); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, CodeBadRequest, "deleted must be true or false")
+				return
+			}
+			deleted = b
+		}
+
+		list, err := links.List(q.Get("q"), brokenOnly, deleted, limit, offset)
+		if err != nil {
+			loggerFor(RequestIDFromContext(r.Context())).Error("listing links", "err", err)
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to list links")
+			return
+		}
+		stats := make([]LinkStats, len(list))
+		for i, l := range list {
+			stats[i] = newLinkStats(l)
+		}
+		writeJSON(w, http.StatusOK, LinkList{Links: stats})
+	}
+}
+
+// handleSeedPool reports every seed with its lease and a count per status.
+func handleSeedPool(seeds *SeedsDb) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		all, err := seeds.SelectAll()
+		if err != nil {
+			loggerFor(RequestIDFromContext(r.Context())).Error("selecting seeds", "err", err)
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to read seed pool")
+			return
+		}
+		counts := map[string]int{"available": 0, "used": 0, "exhausted": 0}
+		for _, s := range all {
+			counts[[]string{"available", "used", "exhausted"}[s.Status]]++
+		}
+		writeJSON(w, http.StatusOK, SeedPool{Counts: counts, Seeds: all})
+	}
+}
+
+func handleListKeys(keys *APIKeys) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		list, err := keys.List()
+		if err != nil {
+			loggerFor(RequestIDFromContext(r.Context())).Error("listing api keys", "err", err)
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to list API keys")
+			return
+		}
+		writeJSON(w, http.StatusOK, KeyList{Keys: list})
+	}
+}
+
+func handleCreateKey(keys *APIKeys) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req CreateKeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "Invalid request body")
+			return
+		}
+
+		key, plain, err := keys.Create(req.Name)
+		if err != nil {
+			loggerFor(RequestIDFromContext(r.Context())).Error("creating api key", "err", err)
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to create API key")
+			return
+		}
+		loggerFor(RequestIDFromContext(r.Context())).Info("api key created", "id", key.ID, "name", key.Name)
+		writeJSON(w, http.StatusCreated, NewAPIKey{APIKey: key, Key: plain})
+	}
+}
+
+func handleRevokeKey(keys *APIKeys) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := keys.Revoke(r.PathValue("id"))
+		if errors.Is(err, ErrKeyNotFound) {
+			writeError(w, r, http.StatusNotFound, CodeNotFound, "API key not found")
+			return
+		}
+		if err != nil {
+			loggerFor(RequestIDFromContext(r.Context())).Error("revoking api key", "err", err)
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to revoke API key")
+			return
+		}
+		loggerFor(RequestIDFromContext(r.Context())).Info("api key revoked", "id", r.PathValue("id"))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,482 @@
+package urlshortener
+
+import (
+	"database/sql"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The HTTP API is declared once as a table of routes. NewHandler registers
+// them on its mux and the OpenAPI document served at /openapi.json is
+// generated from the same table, so the two cannot drift apart.
+
+type authScheme int
+
+const (
+	authNone authScheme = iota
+	// authAPIKey accepts an API key, or the admin token, as a bearer token,
+	// and nothing while no key has been issued.
+	authAPIKey
+	// authKeyRequired is authAPIKey without the open access before the
+	// first key.
+	authKeyRequired
+	// authAdmin only accepts the admin token.
+	authAdmin
+)
+
+type queryParam struct {
+	name, typ, desc string
+}
+
+type apiResponse struct {
+	status int
+	desc   string
+	// body is a value of the JSON response type; nil for no JSON body.
+	body any
+	// content lists non-JSON media types, served as strings.
+	content []string
+}
+
+type apiRoute struct {
+	method, path string
+	summary      string
+	auth         authScheme
+	query        []queryParam
+	request      any
+	// form is a value of the type of an application/x-www-form-urlencoded
+	// request body, an alternative to request.
+	form      any
+	responses []apiResponse
+	handler   http.HandlerFunc
+}
+
+func (rt apiRoute) pattern() string { return rt.method + " " + rt.path }
+
+func ok(body any) apiResponse {
+	return apiResponse{status: http.StatusOK, desc: "OK", body: body}
+}
+
+// errs documents error responses, which all carry an ErrorResponse.
+func errs(statuses ...int) []apiResponse {
+	out := make([]apiResponse, len(statuses))
+	for i, s := range statuses {
+		out[i] = apiResponse{status: s, desc: http.StatusText(s), body: ErrorResponse{}}
+	}
+	return out
+}
+
+func responses(rs ...any) []apiResponse {
+	var out []apiResponse
+	for _, r := range rs {
+		switch r := r.(type) {
+		case apiResponse:
+			out = append(out, r)
+		case []apiResponse:
+			out = append(out, r...)
+		}
+	}
+	return out
+}
+
+func apiRoutes(db *sql.DB, workCh chan<- WorkRequest, cfg HttpConfig) []apiRoute {
+	links := NewUrlMapping(db).WithCodes(cfg.Codes)
+	keys := NewAPIKeys(db)
+	hooks := NewWebhooks(db)
+	if cfg.Clock != nil {
+		keys.now = cfg.Clock
+		hooks.now = cfg.Clock
+	}
+	s := &shortener{workCh: workCh, cfg: cfg}
+	attempts := newPasswordAttempts()
+	codeNotFound := errs(http.StatusNotFound, http.StatusInternalServerError)
+	adminErrs := errs(http.StatusUnauthorized, http.StatusInternalServerError)
+
+	return []apiRoute{
+		{
+			method: "GET", path: "/healthz", summary: "Liveness probe",
+			responses: responses(ok(Liveness{})),
+			handler:   cfg.Health.handleHealthz,
+		},
+		{
+			method: "GET", path: "/readyz", summary: "Readiness probe with per-dependency checks",
+			responses: responses(ok(Readiness{}),
+				apiResponse{status: http.StatusServiceUnavailable, desc: "Not ready", body: Readiness{}}),
+			handler: cfg.Health.handleReadyz,
+		},
+		{
+			method: "POST", path: "/short", summary: "Shorten a URL",
+			auth: authAPIKey, request: URLRequest{},
+			responses: responses(ok(URLResponse{}), errs(http.StatusBadRequest, http.StatusUnauthorized,
+				http.StatusForbidden, http.StatusInternalServerError, http.StatusServiceUnavailable)),
+			handler: s.handleShort,
+		},
+		{
+			method: "POST", path: "/short/batch", summary: "Shorten up to 100 URLs; entries fail independently",
+			auth: authAPIKey, request: BatchRequest{},
+			responses: responses(ok(BatchResponse{}), errs(http.StatusBadRequest, http.StatusUnauthorized,
+				http.StatusRequestEntityTooLarge, http.StatusInternalServerError)),
+			handler: s.handleBatch,
+		},
+		{
+			method: "GET", path: "/links/search", summary: "Search links, newest first",
+			auth: authKeyRequired,
+			query: []queryParam{
+				{"url_prefix", "string", "start of the original URL, ignoring case"},
+				{"owner", "string", "owner of the link"},
+				{"tag", "string", "tag the link must have; repeat for several"},
+				{"created_after", "string", "RFC 3339 time, inclusive"},
+				{"created_before", "string", "RFC 3339 time, exclusive"},
+				{"q", "string", "words that must all appear in the title"},
+				{"limit", "integer", "page size, 1 to 500, default 50"},
+				{"offset", "integer", "number of links to skip"},
+			},
+			responses: responses(ok(LinkList{}), errs(http.StatusBadRequest, http.StatusUnauthorized,
+				http.StatusInternalServerError)),
+			handler: handleSearch(links),
+		},
+		{
+			method: "GET", path: "/{code}", summary: "Redirect to the destination, or render the preview page or password prompt; HEAD counts no click and never reveals one-time links",
+			query: []queryParam{{"continue", "string", "signed token from the preview page's continue link; skips the page until it expires after 10 minutes"}},
+			responses: responses(
+				apiResponse{status: http.StatusFound, desc: "Redirect to the original URL"},
+				apiResponse{status: http.StatusOK, desc: "Preview page or password prompt", content: []string{"text/html"}},
+				errs(http.StatusNotFound, http.StatusGone, http.StatusInternalServerError)),
+			handler: handleRedirect(links, cfg.Interstitial, attempts),
+		},
+		{
+			method: "POST", path: "/{code}", summary: "Submit the password of a protected link and get redirected",
+			form: PasswordForm{},
+			responses: responses(
+				apiResponse{status: http.StatusSeeOther, desc: "Redirect to the original URL"},
+				apiResponse{status: http.StatusOK, desc: "Wrong password: the prompt again, with an error", content: []string{"text/html"}},
+				errs(http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusGone, http.StatusTooManyRequests, http.StatusInternalServerError)),
+			handler: handleRedirect(links, cfg.Interstitial, attempts),
+		},
+		{
+			method: "GET", path: "/{code}/{path...}", summary: "Redirect to the destination with the path appended, for links that forward paths",
+			query: []queryParam{{"continue", "string", "signed token from the preview page's continue link; skips the page until it expires after 10 minutes"}},
+			responses: responses(
+				apiResponse{status: http.StatusFound, desc: "Redirect to the original URL with the path appended"},
+				apiResponse{status: http.StatusOK, desc: "Preview page", content: []string{"text/html"}},
+				errs(http.StatusNotFound, http.StatusGone, http.StatusInternalServerError)),
+			handler: handleRedirect(links, cfg.Interstitial, attempts),
+		},
+		{
+			method: "POST", path: "/{code}/{path...}", summary: "Submit the password of a protected link that forwards paths",
+			form: PasswordForm{},
+			responses: responses(
+				apiResponse{status: http.StatusSeeOther, desc: "Redirect to the original URL with the path appended"},
+				apiResponse{status: http.StatusOK, desc: "Wrong password: the prompt again, with an error", content: []string{"text/html"}},
+				errs(http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusGone, http.StatusTooManyRequests, http.StatusInternalServerError)),
+			handler: handleRedirect(links, cfg.Interstitial, attempts),
+		},
+		{
+			method: "GET", path: "/{code}/qr", summary: "QR code of the short URL",
+			query: []queryParam{
+				{"format", "string", "png (default) or svg"},
+				{"size", "integer", "image size in pixels, 32 to 2048"},
+				{"level", "string", "error correction level: L, M, Q or H"},
+			},
+			responses: responses(
+				apiResponse{status: http.StatusOK, desc: "QR code", content: []string{"image/png", "image/svg+xml"}},
+				apiResponse{status: http.StatusNotModified, desc: "The cached QR code, matching If-None-Match, is current"},
+				errs(http.StatusBadRequest, http.StatusGone), codeNotFound),
+			handler: handleQR(links),
+		},
+		{
+			method: "GET", path: "/{code}/stats", summary: "Link details and click count",
+			responses: responses(ok(LinkStats{}), codeNotFound),
+			handler:   handleStats(links),
+		},
+		{
+			method: "GET", path: "/admin/blocklist", summary: "List blocklist rules",
+			auth: authAdmin, responses: responses(ok(BlocklistRules{}), adminErrs),
+			handler: handleBlocklistRules(cfg.Blocklist),
+		},
+		{
+			method: "POST", path: "/admin/blocklist/enforce", summary: "Reload the blocklist and disable links whose destination or route variants match",
+			auth: authAdmin, responses: responses(ok(EnforceResult{}), errs(http.StatusNotFound), adminErrs),
+			handler: handleBlocklistEnforce(links, cfg.Blocklist),
+		},
+		{
+			method: "GET", path: "/admin/links", summary: "List links, newest first",
+			auth: authAdmin,
+			query: []queryParam{
+				{"q", "string", "substring of the original URL"},
+				{"broken", "boolean", "only links whose destination failed its last check"},
+				{"deleted", "boolean", "list deleted links instead of live ones"},
+				{"limit", "integer", "page size, 1 to 500, default 50"},
+				{"offset", "integer", "number of links to skip"},
+			},
+			responses: responses(ok(LinkList{}), errs(http.StatusBadRequest), adminErrs),
+			handler:   handleListLinks(links),
+		},
+		{
+			method: "DELETE", path: "/admin/links/{code}", summary: "Delete a link; it can be restored and its code is never reissued",
+			auth:  authAdmin,
+			query: []queryParam{{"reason", "string", "why the link is deleted, kept in its history"}},
+			responses: responses(apiResponse{status: http.StatusNoContent, desc: "Deleted"},
+				errs(http.StatusNotFound), adminErrs),
+			handler: handleDeleteLink(links),
+		},
+		{
+			method: "POST", path: "/admin/links/{code}/restore", summary: "Restore a deleted link",
+			auth:      authAdmin,
+			responses: responses(ok(LinkStats{}), errs(http.StatusNotFound, http.StatusConflict), adminErrs),
+			handler:   handleRestoreLink(links),
+		},
+		{
+			method: "GET", path: "/admin/links/{code}/history", summary: "Changes to a link, deleted or not, oldest first",
+			auth:      authAdmin,
+			responses: responses(ok(LinkHistory{}), errs(http.StatusNotFound), adminErrs),
+			handler:   handleLinkHistory(links),
+		},
+		{
+			method: "GET", path: "/admin/seeds", summary: "Seed pool and leases",
+			auth: authAdmin, responses: responses(ok(SeedPool{}), adminErrs),
+			handler: handleSeedPool(NewSeedsDb(db)),
+		},
+		{
+			method: "GET", path: "/admin/keys", summary: "List API keys",
+			auth: authAdmin, responses: responses(ok(KeyList{}), adminErrs),
+			handler: handleListKeys(keys),
+		},
+		{
+			method: "POST", path: "/admin/keys", summary: "Create an API key; the key is only returned here",
+			auth: authAdmin, request: CreateKeyRequest{},
+			responses: responses(apiResponse{status: http.StatusCreated, desc: "Created", body: NewAPIKey{}},
+				errs(http.StatusBadRequest), adminErrs),
+			handler: handleCreateKey(keys),
+		},
+		{
+			method: "DELETE", path: "/admin/keys/{id}", summary: "Revoke an API key",
+			auth: authAdmin,
+			responses: responses(apiResponse{status: http.StatusNoContent, desc: "Revoked"},
+				errs(http.StatusNotFound), adminErrs),
+			handler: handleRevokeKey(keys),
+		},
+		{
+			method: "GET", path: "/admin/webhooks", summary: "List webhook endpoints",
+			auth: authAdmin, responses: responses(ok(WebhookList{}), adminErrs),
+			handler: handleListWebhooks(hooks),
+		},
+		{
+			method: "POST", path: "/admin/webhooks", summary: "Register a webhook endpoint; its signing secret is only returned here",
+			auth: authAdmin, request: CreateWebhookRequest{},
+			responses: responses(apiResponse{status: http.StatusCreated, desc: "Created", body: NewWebhook{}},
+				errs(http.StatusBadRequest), adminErrs),
+			handler: handleCreateWebhook(hooks),
+		},
+		{
+			method: "DELETE", path: "/admin/webhooks/{id}", summary: "Remove a webhook endpoint and its pending deliveries",
+			auth: authAdmin,
+			responses: responses(apiResponse{status: http.StatusNoContent, desc: "Deleted"},
+				errs(http.StatusNotFound), adminErrs),
+			handler: handleDeleteWebhook(hooks),
+		},
+	}
+}
+
+var pathParamRe = regexp.MustCompile(`\{(\w+)(\.\.\.)?\}`)
+
+// openAPIDoc builds an OpenAPI 3.0 document describing routes.
+func openAPIDoc(routes []apiRoute, basePath string) map[string]any {
+	g := &schemaGen{schemas: map[string]any{}}
+	paths := map[string]map[string]any{}
+
+	for _, rt := range routes {
+		path := pathParamRe.ReplaceAllString(rt.path, "{$1}")
+		if paths[path] == nil {
+			paths[path] = map[string]any{}
+		}
+
+		params := []any{}
+		for _, m := range pathParamRe.FindAllStringSubmatch(rt.path, -1) {
+			params = append(params, map[string]any{
+				"name": m[1], "in": "path", "required": true,
+				"schema": map[string]any{"type": "string"},
+			})
+		}
+		for _, q := range rt.query {
+			params = append(params, map[string]any{
+				"name": q.name, "in": "query", "description": q.desc,
+				"schema": map[string]any{"type": q.typ},
+			})
+		}
+
+		resps := map[string]any{}
+		for _, r := range rt.responses {
+			resp := map[string]any{"description": r.desc}
+			content := map[string]any{}
+			if r.body != nil {
+				content["application/json"] = map[string]any{"schema": g.schema(reflect.TypeOf(r.body))}
+			}
+			for _, ct := range r.content {
+				schema := map[string]any{"type": "string"}
+				if strings.HasPrefix(ct, "image/png") {
+					schema["format"] = "binary"
+				}
+				content[ct] = map[string]any{"schema": schema}
+			}
+			if len(content) > 0 {
+				resp["content"] = content
+			}
+			resps[strconv.Itoa(r.status)] = resp
+		}
+
+		op := map[string]any{
+			"summary":     rt.summary,
+			"operationId": operationID(rt),
+			"parameters":  params,
+			"responses":   resps,
+		}
+		if rt.request != nil {
+			op["requestBody"] = map[string]any{
+				"required": true,
+				"content": map[string]any{
+					"application/json": map[string]any{"schema": g.schema(reflect.TypeOf(rt.request))},
+				},
+			}
+		}
+		if rt.form != nil {
+			op["requestBody"] = map[string]any{
+				"required": true,
+				"content": map[string]any{
+					"application/x-www-form-urlencoded": map[string]any{"schema": g.schema(reflect.TypeOf(rt.form))},
+				},
+			}
+		}
+		switch rt.auth {
+		case authAPIKey, authKeyRequired:
+			op["security"] = []any{map[string]any{"apiKey": []string{}}, map[string]any{"adminToken": []string{}}}
+		case authAdmin:
+			op["security"] = []any{map[string]any{"adminToken": []string{}}}
+		}
+		paths[path][strings.ToLower(rt.method)] = op
+	}
+
+	doc := map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "urlshortener",
+			"version": "1",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": g.schemas,
+			"securitySchemes": map[string]any{
+				"apiKey":     map[string]any{"type": "http", "scheme": "bearer", "description": "API key created via /admin/keys"},
+				"adminToken": map[string]any{"type": "http", "scheme": "bearer", "description": "ADMIN_TOKEN of the server"},
+			},
+		},
+	}
+	if basePath != "" {
+		doc["servers"] = []any{map[string]any{"url": basePath}}
+	}
+	return doc
+}
+
+// operationID turns "GET /admin/keys/{id}" into "getAdminKeysId".
+func operationID(rt apiRoute) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(rt.method))
+	for _, f := range strings.FieldsFunc(rt.path, func(r rune) bool {
+		return !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9')
+	}) {
+		b.WriteString(strings.ToUpper(f[:1]) + f[1:])
+	}
+	return b.String()
+}
+
+// schemaGen derives JSON schemas from Go types using their json tags.
+// Named structs become components referenced by $ref.
+type schemaGen struct {
+	schemas map[string]any
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (g *schemaGen) schema(t reflect.Type) map[string]any {
+	if t.Kind() == reflect.Pointer {
+		s := g.schema(t.Elem())
+		if _, isRef := s["$ref"]; isRef {
+			return map[string]any{"allOf": []any{s}, "nullable": true}
+		}
+		s["nullable"] = true
+		return s
+	}
+	if t == timeType {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		if _, seen := g.schemas[t.Name()]; !seen {
+			g.schemas[t.Name()] = map[string]any{} // placeholder for recursive types
+			g.schemas[t.Name()] = g.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]any{}
+}
+
+func (g *schemaGen) object(t reflect.Type) map[string]any {
+	props := map[string]any{}
+	var required []string
+	g.fields(t, props, &required)
+	s := map[string]any{"type": "object", "properties": props}
+	if len(required) > 0 {
+		sort.Strings(required)
+		s["required"] = required
+	}
+	return s
+}
+
+func (g *schemaGen) fields(t reflect.Type, props map[string]any, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			g.fields(f.Type, props, required)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = g.schema(f.Type)
+		if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Pointer {
+			*required = append(*required, name)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package urlshortener
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var ErrKeyNotFound = errors.New("api key not found")
+
+type APIKey struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+type APIKeys struct {
+	db  *sql.DB
+	now func() time.Time
+}
+
+func NewAPIKeys(db *sql.DB) *APIKeys {
+	return &APIKeys{db: db, now: time.Now}
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create stores a new key and returns it in plain text; it cannot be
+// recovered later.
+func (k *APIKeys) Create(name string) (APIKey, string, error) {
+	raw := make([]byte, 20)
+	if _, err := rand.Read(raw); err != nil {
+		return APIKey{}, "", fmt.Errorf("generating api key: %w", err)
+	}
+	// the ID is listed and logged, so it shares nothing with the secret
+	id := make([]byte, 6)
+	if _, err := rand.Read(id); err != nil {
+		return APIKey{}, "", fmt.Errorf("generating api key id: %w", err)
+	}
+	secret := hex.EncodeToString(raw)
+	key := APIKey{
+		ID:        hex.EncodeToString(id),
+		Name:      name,
+		CreatedAt: k.now().UTC(),
+	}
+	plain := "sk_" + secret
+
+	_, err := k.db.Exec("INSERT INTO api_keys (id, name, key_hash, created_at) VALUES (?,?,?,?)",
+		key.ID, key.Name, hashKey(plain), key.CreatedAt)
+	if err != nil {
+		return APIKey{}, "", fmt.Errorf("storing api key: %w", err)
+	}
+	return key, plain, nil
+}
+
+func (k *APIKeys) List() ([]APIKey, error) {
+	r, err := k.db.Query("SELECT id, name, created_at, revoked_at FROM api_keys ORDER BY created_at")
+	if err != nil {
+		return nil, fmt.Errorf("selecting api keys: %w", err)
+	}
+	defer r.Close()
+
+	keys := []APIKey{}
+	for r.Next() {
+		var key APIKey
+		var revoked sql.NullTime
+		if err := r.Scan(&key.ID, &key.Name, &key.CreatedAt, &revoked); err != nil {
+			return nil, fmt.Errorf("scanning api key row: %w", err)
+		}
+		if revoked.Valid {
+			key.RevokedAt = &revoked.Time
+		}
+		keys = append(keys, key)
+	}
+	if err := r.Err(); err != nil {
+		return nil, fmt.Errorf("iterating api key rows: %w", err)
+	}
+	return keys, nil
+}
+
+func (k *APIKeys) Revoke(id string) error {
+	res, err := k.db.Exec("UPDATE api_keys SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL",
+		k.now().UTC(), id)
+	if err != nil {
+		return fmt.Errorf("revoking api key %s: %w", id, err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("revoking api key %s: %w", id, err)
+	} else if n == 0 {
+		return ErrKeyNotFound
+	}
+	return nil
+}
+
+// Authorized reports whether key may create links and, if it is an active
+// key, its ID. As long as no key has been issued, creation stays open; once
+// one has, it needs an active key, even after every key has been revoked.
+func (k *APIKeys) Authorized(key string) (string, bool, error) {
+	var issued bool
+	var id sql.NullString
+	err := k.db.QueryRow(`
+SELECT
+    EXISTS (SELECT 1 FROM api_keys),
+    (SELECT id FROM api_keys WHERE revoked_at IS NULL AND key_hash = ?)`,
+		hashKey(key),
+	).Scan(&issued, &id)
+	if err != nil {
+		return "", false, fmt.Errorf("checking api key: %w", err)
+	}
+	return id.String, !issued || id.Valid, nil
+}
+
+// requireAPIKey guards a route with "Authorization: Bearer <key>". The admin
+// token is accepted as well. With open, anyone passes while no key has been
+// issued, which suits link creation but not routes that list links.
+func requireAPIKey(keys *APIKeys, adminToken string, open bool, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if adminToken != "" && subtle.ConstantTimeCompare([]byte(key), []byte(adminToken)) == 1 {
+			next(w, r.WithContext(withActor(r.Context(), "admin")))
+			return
+		}
+		id, ok, err := keys.Authorized(key)
+		if err != nil {
+			loggerFor(RequestIDFromContext(r.Context())).Error("checking api key", "err", err)
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to check API key")
+			return
+		}
+		if !ok || (!open && id == "") {
+			writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Unauthorized")
+			return
+		}
+		if id != "" {
+			r = r.WithContext(withActor(r.Context(), "key:"+id))
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,178 @@
+package urlshortener
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// LinkWriter stores new links for the workers. UrlMapping inserts each link on
+// its own; BatchWriter groups concurrent inserts into one transaction.
+type LinkWriter interface {
+	Create(orig_url, short_url, seed string, counter int, opts LinkOptions) error
+	GetSeedCounter(seed string) (int, error)
+}
+
+var (
+	_ LinkWriter = (*UrlMapping)(nil)
+	_ LinkWriter = (*BatchWriter)(nil)
+)
+
+var ErrWriterClosed = errors.New("batch writer closed")
+
+type createRequest struct {
+	origURL, shortURL, seed string
+	counter                 int
+	createdAt               time.Time
+	opts                    LinkOptions
+	done                    chan error
+}
+
+// BatchWriter is a group-commit LinkWriter. SQLite serializes writers and
+// every commit syncs the WAL, so instead of one transaction per link it
+// commits the Create calls that queued up while the previous transaction was
+// running, up to MaxBatch of them, together. A non-zero Window also waits
+// that long for more calls to join a batch. Each Create returns once its row
+// is committed.
+type BatchWriter struct {
+	*UrlMapping
+	Window   time.Duration
+	MaxBatch int
+
+	// mu guards sending on reqs against Close closing it
+	mu     sync.RWMutex
+	closed bool
+	reqs   chan createRequest
+	done   chan struct{}
+}
+
+func NewBatchWriter(db *sql.DB, window time.Duration, maxBatch int) *BatchWriter {
+	w := &BatchWriter{
+		UrlMapping: NewUrlMapping(db),
+		Window:     window,
+		MaxBatch:   max(maxBatch, 1),
+		reqs:       make(chan createRequest, max(maxBatch, 1)),
+		done:       make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *BatchWriter) Create(orig_url, short_url, seed string, counter int, opts LinkOptions) error {
+	req := createRequest{
+		origURL:   orig_url,
+		shortURL:  short_url,
+		seed:      seed,
+		counter:   counter,
+		createdAt: w.now().UTC(),
+		opts:      opts,
+		done:      make(chan error, 1),
+	}
+	w.mu.RLock()
+	if w.closed {
+		w.mu.RUnlock()
+		return ErrWriterClosed
+	}
+	w.reqs <- req
+	w.mu.RUnlock()
+	return <-req.done
+}
+
+// Close commits what is pending and stops the writer.
+func (w *BatchWriter) Close() {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.reqs)
+	}
+	w.mu.Unlock()
+	<-w.done
+}
+
+func (w *BatchWriter) run() {
+	defer close(w.done)
+	for {
+		req, ok := <-w.reqs
+		if !ok {
+			return
+		}
+		batch := []createRequest{req}
+
+		// whatever queued up during the previous commit goes in right away
+	drain:
+		for len(batch) < w.MaxBatch {
+			select {
+			case req, ok := <-w.reqs:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, req)
+			default:
+				break drain
+			}
+		}
+		if w.Window > 0 {
+			timer := time.NewTimer(w.Window)
+		collect:
+			for len(batch) < w.MaxBatch {
+				select {
+				case req, ok := <-w.reqs:
+					if !ok {
+						break collect
+					}
+					batch = append(batch, req)
+				case <-timer.C:
+					break collect
+				}
+			}
+			timer.Stop()
+		}
+
+		w.commit(batch)
+	}
+}
+
+// commit inserts batch in one transaction. Each link is written under its own
+// savepoint, so a link whose rows fail part way is rolled back on its own and
+// only fails its own Create.
+func (w *BatchWriter) commit(batch []createRequest) {
+	errs := make([]error, len(batch))
+	err := func() error {
+		tx, err := w.db.Begin()
+		if err != nil {
+			return fmt.Errorf("beginning link batch: %w", err)
+		}
+		defer tx.Rollback()
+		for i, r := range batch {
+			if _, err := tx.Exec("SAVEPOINT link"); err != nil {
+				return fmt.Errorf("starting link savepoint: %w", err)
+			}
+			errs[i] = insertLink(tx, r.origURL, r.shortURL, r.seed, r.counter, r.createdAt, r.opts)
+			if errs[i] != nil {
+				if _, err := tx.Exec("ROLLBACK TO link"); err != nil {
+					return fmt.Errorf("rolling back link %s: %w", r.shortURL, err)
+				}
+			}
+			if _, err := tx.Exec("RELEASE link"); err != nil {
+				return fmt.Errorf("releasing link savepoint: %w", err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("committing link batch: %w", err)
+		}
+		return nil
+	}()
+	if err != nil {
+		slog.Error("writing link batch", "size", len(batch), "err", err)
+	}
+
+	for i, r := range batch {
+		if err != nil && errs[i] == nil {
+			errs[i] = err
+		}
+		r.done <- errs[i]
+	}
+}
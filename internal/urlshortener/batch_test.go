@@ -0,0 +1,150 @@
+package urlshortener
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBatchWriter(t *testing.T) {
+	db, err := InitDBAt(filepath.Join(t.TempDir(), "batch.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	w := NewBatchWriter(db, 5*time.Millisecond, 16)
+
+	// 40 distinct counters plus every tenth one written twice
+	var wg sync.WaitGroup
+	var taken atomic.Int32
+	for i := 0; i < 44; i++ {
+		counter := i%40 + 1
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := w.Create("https://example.com", fmt.Sprintf("https://sho.rt/%d-%d", counter, i), "aaa", counter, LinkOptions{})
+			switch {
+			case errors.Is(err, ErrCodeTaken):
+				taken.Add(1)
+			case err != nil:
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := taken.Load(); n != 4 {
+		t.Errorf("%d creates reported ErrCodeTaken, want 4", n)
+	}
+	var rows int
+	if err := db.QueryRow("SELECT COUNT(*) FROM url_mapping").Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 40 {
+		t.Errorf("%d rows committed, want 40", rows)
+	}
+	if n, _ := w.GetSeedCounter("aaa"); n != 40 {
+		t.Errorf("GetSeedCounter = %d, want 40", n)
+	}
+
+	w.Close()
+	if err := w.Create("https://example.com", "https://sho.rt/late", "aaa", 99, LinkOptions{}); !errors.Is(err, ErrWriterClosed) {
+		t.Errorf("Create after Close: err = %v, want ErrWriterClosed", err)
+	}
+}
+
+func TestBatchWriterRollsBackFailedLink(t *testing.T) {
+	db, err := InitDBAt(filepath.Join(t.TempDir(), "batch.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// fails the history row, after the link's url_mapping and tag rows are
+	// written
+	_, err = db.Exec(`CREATE TRIGGER fail_history BEFORE INSERT ON url_mapping_history
+WHEN NEW.new_url = 'https://example.com/fail'
+BEGIN SELECT RAISE(ABORT, 'injected failure'); END`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewBatchWriter(db, 20*time.Millisecond, 16)
+	defer w.Close()
+
+	var wg sync.WaitGroup
+	errs := make([]error, 5)
+	for i := range errs {
+		dest := "https://example.com/ok"
+		if i == 2 {
+			dest = "https://example.com/fail"
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = w.Create(dest, fmt.Sprintf("https://sho.rt/%d", i+1), "aaa", i+1, LinkOptions{Tags: []string{"t"}})
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if (err != nil) != (i == 2) {
+			t.Errorf("link %d: err = %v", i+1, err)
+		}
+	}
+	for _, table := range []string{"url_mapping", "link_tags", "url_mapping_history"} {
+		var rows, failed int
+		err := db.QueryRow("SELECT COUNT(*), COUNT(*) FILTER (WHERE counter = 3) FROM "+table).Scan(&rows, &failed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rows != 4 || failed != 0 {
+			t.Errorf("%s: %d rows, %d of the failed link; want 4 and 0", table, rows, failed)
+		}
+	}
+}
+
+// BenchmarkCreate compares one INSERT per link with group commit, with as
+// many concurrent writers as the server's worker pool.
+func BenchmarkCreate(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		new  func(b *testing.B) LinkWriter
+	}{
+		{"per-request", func(b *testing.B) LinkWriter { return NewUrlMapping(benchDB(b)) }},
+		{"batched", func(b *testing.B) LinkWriter {
+			w := NewBatchWriter(benchDB(b), 0, 128)
+			b.Cleanup(w.Close)
+			return w
+		}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			links := bc.new(b)
+			var counter atomic.Int64
+			b.SetParallelism(10)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					c := int(counter.Add(1))
+					err := links.Create("https://example.com/bench", fmt.Sprintf("https://sho.rt/%d", c), "aaa", c, LinkOptions{})
+					if err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func benchDB(b *testing.B) *sql.DB {
+	db, err := InitDBAt(filepath.Join(b.TempDir(), "bench.db"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { db.Close() })
+	return db
+}
@@ -0,0 +1,192 @@
+package urlshortener
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Blocklist screens destinations against rules kept in a local file, one per
+// line:
+//
+//	suffix:example.com          the host or any of its subdomains
+//	regex:^https?://[^/]+/login the whole destination URL
+//	cidr:203.0.113.0/24         destinations whose host is an IP literal
+//
+// Blank lines and lines starting with # are ignored. A nil Blocklist blocks
+// nothing.
+type Blocklist struct {
+	path string
+
+	mu      sync.RWMutex
+	rules   []BlockRule
+	modTime time.Time
+}
+
+type BlockRule struct {
+	Kind    string `json:"kind"`
+	Pattern string `json:"pattern"`
+
+	re     *regexp.Regexp
+	prefix netip.Prefix
+}
+
+func (r BlockRule) String() string { return r.Kind + ":" + r.Pattern }
+
+func (r BlockRule) match(u *url.URL, dest string) bool {
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	switch r.Kind {
+	case "suffix":
+		return host == r.Pattern || strings.HasSuffix(host, "."+r.Pattern)
+	case "regex":
+		return r.re.MatchString(dest)
+	case "cidr":
+		addr, err := netip.ParseAddr(host)
+		return err == nil && r.prefix.Contains(addr.Unmap())
+	}
+	return false
+}
+
+func LoadBlocklist(path string) (*Blocklist, error) {
+	b := &Blocklist{path: path}
+	if err := b.Reload(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func parseBlockRules(f *os.File) ([]BlockRule, error) {
+	var rules []BlockRule
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		kind, pattern, ok := strings.Cut(line, ":")
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("line %d: expected kind:pattern, got %q", n, line)
+		}
+		rule := BlockRule{Kind: kind, Pattern: pattern}
+		switch kind {
+		case "suffix":
+			rule.Pattern = strings.ToLower(strings.Trim(pattern, "."))
+		case "regex":
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			rule.re = re
+		case "cidr":
+			prefix, err := netip.ParsePrefix(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			rule.prefix = prefix.Masked()
+		default:
+			return nil, fmt.Errorf("line %d: unknown rule kind %q", n, kind)
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// Reload replaces the rules with the current contents of the file. On error
+// the previous rules stay in effect.
+func (b *Blocklist) Reload() error {
+	f, err := os.Open(b.path)
+	if err != nil {
+		return fmt.Errorf("opening blocklist: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("reading blocklist: %w", err)
+	}
+	rules, err := parseBlockRules(f)
+	if err != nil {
+		return fmt.Errorf("parsing blocklist %s: %w", b.path, err)
+	}
+
+	b.mu.Lock()
+	b.rules = rules
+	b.modTime = info.ModTime()
+	b.mu.Unlock()
+	return nil
+}
+
+// WatchFile reloads the rules whenever the file's modification time
+// changes, checking every interval until ctx is done.
+func (b *Blocklist) WatchFile(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.reloadIfChanged()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (b *Blocklist) reloadIfChanged() {
+	info, err := os.Stat(b.path)
+	if err != nil {
+		slog.Error("checking blocklist", "path", b.path, "err", err)
+		return
+	}
+
+	b.mu.RLock()
+	changed := !info.ModTime().Equal(b.modTime)
+	b.mu.RUnlock()
+	if !changed {
+		return
+	}
+
+	if err := b.Reload(); err != nil {
+		slog.Error("reloading blocklist", "path", b.path, "err", err)
+		return
+	}
+	slog.Info("blocklist reloaded", "path", b.path, "rules", len(b.Rules()))
+}
+
+func (b *Blocklist) Rules() []BlockRule {
+	if b == nil {
+		return nil
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.rules
+}
+
+// Match returns the first rule blocking dest. A destination that cannot be
+// parsed is blocked, as its host cannot be checked, unless b is nil.
+func (b *Blocklist) Match(dest string) (BlockRule, bool) {
+	if b == nil {
+		return BlockRule{}, false
+	}
+	u, err := url.Parse(dest)
+	if err != nil {
+		return BlockRule{Kind: "invalid", Pattern: "unparsable URL"}, true
+	}
+	for _, r := range b.Rules() {
+		if r.match(u, dest) {
+			return r, true
+		}
+	}
+	return BlockRule{}, false
+}
@@ -0,0 +1,189 @@
+package urlshortener
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBlocklistMatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	rules := `# phishing
+suffix:evil.example
+regex:^https?://[^/]+/wp-login\.php
+cidr:203.0.113.0/24
+cidr:2001:db8::/32
+`
+	if err := os.WriteFile(path, []byte(rules), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	b, err := LoadBlocklist(path)
+	if err != nil {
+		t.Fatalf("LoadBlocklist: %v", err)
+	}
+
+	tests := []struct {
+		dest string
+		rule string
+	}{
+		{"https://evil.example/", "suffix:evil.example"},
+		{"https://login.EVIL.example./x", "suffix:evil.example"},
+		{"https://notevil.example/", ""},
+		{"http://shop.test/wp-login.php", `regex:^https?://[^/]+/wp-login\.php`},
+		{"http://203.0.113.7:8080/a", "cidr:203.0.113.0/24"},
+		{"http://[2001:db8::1]/", "cidr:2001:db8::/32"},
+		{"http://198.51.100.1/", ""},
+		{"https://evil.example/%zz", "invalid:unparsable URL"},
+		{"https://fine.example/%zz", "invalid:unparsable URL"},
+	}
+	for _, tt := range tests {
+		rule, blocked := b.Match(tt.dest)
+		if blocked != (tt.rule != "") || (blocked && rule.String() != tt.rule) {
+			t.Errorf("Match(%q) = %q, %t; want %q", tt.dest, rule, blocked, tt.rule)
+		}
+	}
+
+	var nilList *Blocklist
+	if _, blocked := nilList.Match("https://evil.example/%zz"); blocked {
+		t.Error("nil blocklist blocked a destination")
+	}
+}
+
+func TestBlocklistReloadKeepsRulesOnError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	os.WriteFile(path, []byte("suffix:evil.example\n"), 0o644)
+	b, err := LoadBlocklist(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.WriteFile(path, []byte("bogus line\n"), 0o644)
+	if err := b.Reload(); err == nil {
+		t.Fatal("Reload accepted an invalid rule")
+	}
+	if _, blocked := b.Match("https://evil.example/"); !blocked {
+		t.Error("previous rules were dropped after a failed reload")
+	}
+}
+
+func TestShortenRejectsUncheckableDestinations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	os.WriteFile(path, []byte("suffix:evil.example\n"), 0o644)
+	b, err := LoadBlocklist(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := NewServer(
+		WithDBPath(filepath.Join(t.TempDir(), "blocklist.db")),
+		WithWorkers(1),
+		WithHttpConfig(HttpConfig{ShortUrlHost: "sho.rt", Blocklist: b}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown(context.Background())
+	api := httptest.NewServer(srv.Handler())
+	defer api.Close()
+
+	for dest, status := range map[string]int{
+		"https://evil.example/%zz":   http.StatusBadRequest,
+		"https://evil.example/ok":    http.StatusForbidden,
+		"javascript:alert(1)":        http.StatusBadRequest,
+		"//evil.example/x":           http.StatusBadRequest,
+		"/relative":                  http.StatusBadRequest,
+		"ftp://files.example/x":      http.StatusBadRequest,
+		"https://good.example/%20ok": http.StatusOK,
+	} {
+		body, _ := json.Marshal(URLRequest{OriginalURL: dest})
+		resp, err := http.Post(api.URL+"/short", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("shortening %q: status %d, want %d", dest, resp.StatusCode, status)
+		}
+	}
+	var count int
+	srv.DB().QueryRow("SELECT COUNT(*) FROM url_mapping").Scan(&count)
+	if count != 1 {
+		t.Errorf("%d links stored, want only the valid one", count)
+	}
+}
+
+func TestBlocklistWatchFileStops(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	os.WriteFile(path, []byte("suffix:evil.example\n"), 0o644)
+	b, err := LoadBlocklist(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		b.WatchFile(ctx, time.Millisecond)
+		close(done)
+	}()
+	os.WriteFile(path, []byte("suffix:worse.example\n"), 0o644)
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Hour))
+	deadline := time.Now().Add(5 * time.Second)
+	for _, blocked := b.Match("https://worse.example/"); !blocked; _, blocked = b.Match("https://worse.example/") {
+		if time.Now().After(deadline) {
+			t.Fatal("changed blocklist not reloaded")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("WatchFile still running after its context ended")
+	}
+}
+
+func TestDisableMatchingChecksVariants(t *testing.T) {
+	db, err := InitDBAt(filepath.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	links := NewUrlMapping(db)
+	routes := RedirectRules{Routes: []Route{{
+		Devices:  []string{"mobile"},
+		Variants: []Variant{{Name: "app", URL: "https://evil.example/app"}},
+	}}}
+	if err := links.Create("https://fine.example/", "https://sho.rt/a", "aaa", 1, LinkOptions{Redirect: routes}); err != nil {
+		t.Fatal(err)
+	}
+	if err := links.Create("https://fine.example/", "https://sho.rt/b", "aaa", 2, LinkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := links.DisableMatching("admin", func(dest string) (string, bool) {
+		return "suffix:evil.example", strings.Contains(dest, "evil.example")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("disabled %d links, want the one routing to a blocked variant", n)
+	}
+	for code, want := range map[string]bool{SequentialCodes{}.Encode("aaa", 1): true, SequentialCodes{}.Encode("aaa", 2): false} {
+		link, err := links.GetByCode(code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if link.Disabled != want {
+			t.Errorf("link %s disabled = %t, want %t", code, link.Disabled, want)
+		}
+	}
+}
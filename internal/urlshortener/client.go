@@ -2,10 +2,9 @@ package urlshortener
 
 import (
 	"database/sql"
-	"encoding/base64"
+	"errors"
 	"fmt"
-	"log"
-	"strconv"
+	"sync/atomic"
 
 	"github.com/google/uuid"
 )
@@ -14,19 +13,39 @@ type Seed struct {
 	Seed        string
 	CounterUsed int
 	CounterSize int
+
+	// lease is set on seeds leased from a seed service; it ends when the
+	// service may have handed the seed to someone else.
+	lease *seedLease
 }
 
 type Seeds []Seed
 
 type SeedRequest struct {
-	Query   string
-	ReplyCn chan Seed
+	Query     string
+	RequestID string
+	// Exhausted is the seed the worker used up, if any, so it can be closed.
+	Exhausted Seed
+	ReplyCn   chan Seed
+}
+
+// SeedSource hands out seed leases. SeedsDb leases from the local database,
+// RemoteSeeds from a seed service shared by several instances.
+type SeedSource interface {
+	Acquire(holder string) (Seed, error)
+	// Release returns a lease, marking the seed exhausted once its counter
+	// is used up.
+	Release(holder string, seed Seed) error
 }
 
 type WorkRequest struct {
 	OriginalUrl  string
 	ShortUrlHost string
-	DoneCh       chan<- WorkResponse
+	// Codes makes the code of the new link; SequentialCodes when nil.
+	Codes     CodeScheme
+	Options   LinkOptions
+	RequestID string
+	DoneCh    chan<- WorkResponse
 }
 
 type WorkResponse struct {
@@ -36,27 +55,75 @@ type WorkResponse struct {
 
 type URLRequest struct {
 	OriginalURL string `json:"original_url"`
+	// QR asks for a QR code data URI in the response.
+	QR bool `json:"qr,omitempty"`
+	// Interstitial shows a preview page before redirecting.
+	Interstitial bool `json:"interstitial,omitempty"`
+	// Owner, Title and Tags describe the link for search.
+	Owner string   `json:"owner,omitempty"`
+	Title string   `json:"title,omitempty"`
+	Tags  []string `json:"tags,omitempty"`
+	// Redirect sets rules applied to the destination on every visit.
+	Redirect *RedirectRules `json:"redirect,omitempty"`
+	// Password protects the link with a prompt; only a hash is stored.
+	Password string `json:"password,omitempty"`
+	// OneTime links stop resolving after their first redirect.
+	OneTime bool `json:"one_time,omitempty"`
 }
 
 func Manager(db *sql.DB, reqCh <-chan SeedRequest) {
-	seedsDb := NewSeedsDb(db)
+	ManageSeeds(NewSeedsDb(db), reqCh)
+}
 
+// ManageSeeds serves worker seed requests from src.
+func ManageSeeds(src SeedSource, reqCh <-chan SeedRequest) {
 	for req := range reqCh {
-		seed, err := seedsDb.Acquire(req.Query)
-		if err != nil {
-			log.Printf("Error acquiring seed: %v\n", err)
+		logger := loggerFor(req.RequestID).With("lease_holder", req.Query)
+
+		// house keeping. Close a seed if a client has already used one
+		if req.Exhausted != (Seed{}) {
+			if err := src.Release(req.Query, req.Exhausted); err != nil {
+				logger.Error("releasing seed", "seed", req.Exhausted.Seed, "err", err)
+			}
 		}
 
-		log.Printf("Client: %s acquired Seed: %v\n", req.Query, seed)
+		seed, err := src.Acquire(req.Query)
+		if err != nil {
+			logger.Error("acquiring seed", "err", err)
+		} else {
+			logger.Info("seed acquired", "seed", seed.Seed, "counter_used", seed.CounterUsed)
+		}
 		req.ReplyCn <- seed
-
-		// house keeping. Close a seed if a client has already used one
 	}
 }
 
-func StartWorkers(db *sql.DB, workCh <-chan WorkRequest, seedCh chan<- SeedRequest, numWorkers int) {
+// maxCreateAttempts bounds how often a worker retries a request whose short
+// code turned out to be taken.
+const maxCreateAttempts = 5
+
+// WorkerPool tracks the goroutines started by StartWorkers.
+type WorkerPool struct {
+	size    int
+	running atomic.Int32
+}
+
+func (p *WorkerPool) Size() int { return p.size }
+
+func (p *WorkerPool) Running() int { return int(p.running.Load()) }
+
+func StartWorkers(db *sql.DB, workCh <-chan WorkRequest, seedCh chan<- SeedRequest, numWorkers int) *WorkerPool {
+	return StartLinkWorkers(NewUrlMapping(db), workCh, seedCh, numWorkers)
+}
+
+// StartLinkWorkers is StartWorkers storing links through links, such as a
+// BatchWriter.
+func StartLinkWorkers(links LinkWriter, workCh <-chan WorkRequest, seedCh chan<- SeedRequest, numWorkers int) *WorkerPool {
+	pool := &WorkerPool{size: numWorkers}
 	for i := 0; i < numWorkers; i++ {
+		pool.running.Add(1)
 		go func() {
+			defer pool.running.Add(-1)
+
 			var seed Seed
 			leaseHolderID := uuid.New().String()
 
@@ -67,30 +134,60 @@ func StartWorkers(db *sql.DB, workCh <-chan WorkRequest, seedCh chan<- SeedReque
 			}
 
 			for work := range workCh {
-				if seed == (Seed{}) || seed.CounterUsed == seed.CounterSize {
-					seedCh <- request
-					seed = <-responseCh
+				logger := loggerFor(work.RequestID).With("worker", leaseHolderID)
+
+				var sUrl string
+				var err error
+				codes := work.Codes
+				if codes == nil {
+					codes = SequentialCodes{}
 				}
-				// generate short string
-				cUsed := seed.CounterUsed + 1
-				sUrlPath := base64.URLEncoding.EncodeToString([]byte(seed.Seed + strconv.Itoa(cUsed)))
-				sUrl := fmt.Sprintf("https://%s/%s", work.ShortUrlHost, sUrlPath)
-				um := UrlMapping{db: db}
-				err := um.Create(work.OriginalUrl, sUrl, seed.Seed, cUsed)
-				if err != nil {
-					fmt.Printf("Unable to write to url_mapping. Error: %v\n", err)
-				} else {
-					seed.CounterUsed = cUsed
+				for attempt := 1; ; attempt++ {
+					if seed.leaseLost() {
+						logger.Warn("seed lease lost, dropping seed", "seed", seed.Seed, "counter_used", seed.CounterUsed)
+					}
+					if seed == (Seed{}) || seed.CounterUsed >= seed.CounterSize || seed.leaseLost() {
+						request.RequestID = work.RequestID
+						request.Exhausted = seed
+						seedCh <- request
+						seed = <-responseCh
+					}
+					if seed == (Seed{}) {
+						sUrl, err = "", ErrNoSeeds
+						break
+					}
+					// generate short string
+					cUsed := seed.CounterUsed + 1
+					sUrl = fmt.Sprintf("https://%s/%s", work.ShortUrlHost, codes.Encode(seed.Seed, cUsed))
+					err = links.Create(work.OriginalUrl, sUrl, seed.Seed, cUsed, work.Options)
+					if err == nil {
+						seed.CounterUsed = cUsed
+						logger.Info("url shortened", "short_url", sUrl, "seed", seed.Seed, "counter", cUsed)
+						break
+					}
+					if !errors.Is(err, ErrCodeTaken) || attempt == maxCreateAttempts {
+						logger.Error("writing url_mapping", "seed", seed.Seed, "counter", cUsed, "attempt", attempt, "err", err)
+						sUrl = ""
+						break
+					}
+
+					// rows the seed's stored counter missed; skip past them
+					used, syncErr := links.GetSeedCounter(seed.Seed)
+					if syncErr != nil {
+						logger.Error("resyncing seed counter", "seed", seed.Seed, "err", syncErr)
+						sUrl, err = "", syncErr
+						break
+					}
+					seed.CounterUsed = max(used, cUsed)
+					logger.Warn("short code taken, resynced seed counter",
+						"seed", seed.Seed, "counter", cUsed, "counter_used", seed.CounterUsed, "attempt", attempt)
 				}
 
 				// finish the response regardless of the status
-				wr := WorkResponse{
-					ShortUrl: sUrl,
-					Err:      err,
-				}
-				work.DoneCh <- wr
+				work.DoneCh <- WorkResponse{ShortUrl: sUrl, Err: err}
 				close(work.DoneCh)
 			}
 		}()
 	}
+	return pool
 }
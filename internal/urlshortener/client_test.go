@@ -0,0 +1,58 @@
+package urlshortener
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWorkerSkipsTakenCodes(t *testing.T) {
+	db, err := InitDBAt(filepath.Join(t.TempDir(), "workers.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// only "aaa" can be leased, and url_mapping already has counters the
+	// seeds table never heard of, as after a crash before a release
+	seeds := NewSeedsDb(db)
+	for _, s := range generateSeeds() {
+		if s.Seed != "aaa" {
+			if err := seeds.SetSeedStatusAndCounter(s.Seed, 4096, 2); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	links := NewUrlMapping(db)
+	if n, err := links.GetSeedCounter("aaa"); err != nil || n != 0 {
+		t.Fatalf("GetSeedCounter of unused seed = %d, %v; want 0", n, err)
+	}
+	for c := 1; c <= 3; c++ {
+		if err := links.Create("https://example.com/old", encodeCode("aaa", c), "aaa", c, LinkOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = links.Create("https://example.com/dup", "dup", "aaa", 3, LinkOptions{})
+	if !errors.Is(err, ErrCodeTaken) {
+		t.Fatalf("Create of a taken counter: err = %v, want ErrCodeTaken", err)
+	}
+
+	workCh := make(chan WorkRequest)
+	seedCh := make(chan SeedRequest)
+	go Manager(db, seedCh)
+	StartWorkers(db, workCh, seedCh, 1)
+	defer close(workCh)
+
+	for _, want := range []int{4, 5} {
+		doneCh := make(chan WorkResponse, 1)
+		workCh <- WorkRequest{OriginalUrl: "https://example.com/new", ShortUrlHost: "sho.rt", DoneCh: doneCh}
+		resp := <-doneCh
+		if resp.Err != nil {
+			t.Fatalf("shortening: %v", resp.Err)
+		}
+		if code := encodeCode("aaa", want); !strings.HasSuffix(resp.ShortUrl, "/"+code) {
+			t.Errorf("short URL %s, want code %s", resp.ShortUrl, code)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package urlshortener
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// seedLen is the length of the seeds created by generateSeeds.
+const seedLen = 3
+
+// CodeScheme turns the seed and counter a link was created with into its
+// short code and back. A deployment picks one through HttpConfig.Codes.
+type CodeScheme interface {
+	Encode(seed string, counter int) string
+	Decode(code string) (seed string, counter int, err error)
+}
+
+// SequentialCodes is the default CodeScheme: the seed and counter, base64
+// encoded. Codes of one seed follow each other, so they reveal how many
+// links were created and can be enumerated.
+type SequentialCodes struct{}
+
+func (SequentialCodes) Encode(seed string, counter int) string { return encodeCode(seed, counter) }
+
+func (SequentialCodes) Decode(code string) (string, int, error) { return decodeCode(code) }
+
+// encodeCode returns the path component of a short URL.
+func encodeCode(seed string, counter int) string {
+	return base64.URLEncoding.EncodeToString([]byte(seed + strconv.Itoa(counter)))
+}
+
+// decodeCode reverses encodeCode, so a code can be looked up through the
+// (seed, counter) index without knowing the host it was issued for.
+func decodeCode(code string) (string, int, error) {
+	raw, err := base64.URLEncoding.DecodeString(code)
+	if err != nil || len(raw) <= seedLen {
+		return "", 0, fmt.Errorf("invalid short code %q", code)
+	}
+	counter, err := strconv.Atoi(string(raw[seedLen:]))
+	if err != nil || counter <= 0 {
+		return "", 0, fmt.Errorf("invalid short code %q", code)
+	}
+	return string(raw[:seedLen]), counter, nil
+}
+
+// codeOfShortURL returns the code a short URL ends with.
+func codeOfShortURL(shortURL string) string {
+	return shortURL[strings.LastIndex(shortURL, "/")+1:]
+}
+
+// ParseCodeScheme returns the scheme named "sequential" (or "") or
+// "permuted"; key is the secret of permuted codes.
+func ParseCodeScheme(name, key string) (CodeScheme, error) {
+	switch name {
+	case "", "sequential":
+		return SequentialCodes{}, nil
+	case "permuted":
+		return NewPermutedCodes([]byte(key))
+	}
+	return nil, fmt.Errorf("unknown code scheme %q", name)
+}
+
+const (
+	// A 3 byte seed and a counter of at most 4096, the seeds' counter_size,
+	// fit in 36 bits.
+	counterBits = 12
+	pairBits    = 8*seedLen + counterBits
+	halfBits    = pairBits / 2
+	halfMask    = 1<<halfBits - 1
+
+	feistelRounds = 8
+	// permutedCodeLen base62 digits cover the 2^36 pairs.
+	permutedCodeLen = 7
+	base62Digits    = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// PermutedCodes is a CodeScheme for unguessable codes. The (seed, counter)
+// pair, as a 36-bit number, goes through a Feistel network keyed with a
+// secret and comes out as 7 base62 digits. Consecutive links get unrelated
+// codes, yet no two pairs share one, since the network is a permutation.
+//
+// Decode still accepts sequential codes, so links created before a
+// deployment switched schemes keep resolving. Pairs outside the 36-bit space
+// are encoded sequentially too.
+type PermutedCodes struct {
+	key []byte
+}
+
+// NewPermutedCodes returns a PermutedCodes keyed with key, which must be at
+// least 16 bytes. Changing the key changes every code issued with it.
+func NewPermutedCodes(key []byte) (*PermutedCodes, error) {
+	if len(key) < 16 {
+		return nil, errors.New("code key must be at least 16 bytes")
+	}
+	return &PermutedCodes{key: key}, nil
+}
+
+func (p *PermutedCodes) Encode(seed string, counter int) string {
+	if len(seed) != seedLen || counter < 1 || counter > 1<<counterBits {
+		return encodeCode(seed, counter)
+	}
+	var pair uint64
+	for i := range seedLen {
+		pair = pair<<8 | uint64(seed[i])
+	}
+	pair = pair<<counterBits | uint64(counter-1)
+
+	n := p.permute(pair, false)
+	code := make([]byte, permutedCodeLen)
+	for i := permutedCodeLen - 1; i >= 0; i-- {
+		code[i] = base62Digits[n%62]
+		n /= 62
+	}
+	return string(code)
+}
+
+func (p *PermutedCodes) Decode(code string) (string, int, error) {
+	if len(code) != permutedCodeLen {
+		// sequential codes are padded base64, a multiple of 4 long
+		return decodeCode(code)
+	}
+	var n uint64
+	for i := range len(code) {
+		d := strings.IndexByte(base62Digits, code[i])
+		if d < 0 {
+			return "", 0, fmt.Errorf("invalid short code %q", code)
+		}
+		n = n*62 + uint64(d)
+	}
+	if n >= 1<<pairBits {
+		return "", 0, fmt.Errorf("invalid short code %q", code)
+	}
+
+	pair := p.permute(n, true)
+	counter := int(pair&(1<<counterBits-1)) + 1
+	seed := make([]byte, seedLen)
+	pair >>= counterBits
+	for i := seedLen - 1; i >= 0; i-- {
+		seed[i] = byte(pair)
+		pair >>= 8
+	}
+	return string(seed), counter, nil
+}
+
+// permute runs the balanced Feistel network over the two 18-bit halves of
+// n, or backwards to invert it.
+func (p *PermutedCodes) permute(n uint64, inverse bool) uint64 {
+	mac := hmac.New(sha256.New, p.key)
+	round := func(i int, half uint64) uint64 {
+		var in [5]byte
+		in[0] = byte(i)
+		binary.BigEndian.PutUint32(in[1:], uint32(half))
+		mac.Reset()
+		mac.Write(in[:])
+		return binary.BigEndian.Uint64(mac.Sum(nil)) & halfMask
+	}
+
+	l, r := n>>halfBits, n&halfMask
+	if !inverse {
+		for i := range feistelRounds {
+			l, r = r, l^round(i, r)
+		}
+	} else {
+		for i := feistelRounds - 1; i >= 0; i-- {
+			l, r = r^round(i, l), l
+		}
+	}
+	return l<<halfBits | r
+}
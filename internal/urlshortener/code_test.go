@@ -0,0 +1,128 @@
+package urlshortener
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPermutedCodes(t *testing.T) {
+	codes, err := NewPermutedCodes([]byte("0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for _, seed := range []string{"aaa", "abc", "ccc"} {
+		sorted := true
+		prev := ""
+		for counter := 1; counter <= 4096; counter++ {
+			code := codes.Encode(seed, counter)
+			if len(code) != permutedCodeLen || strings.Trim(code, base62Digits) != "" {
+				t.Fatalf("Encode(%s, %d) = %q, want 7 base62 digits", seed, counter, code)
+			}
+			if seen[code] {
+				t.Fatalf("Encode(%s, %d) = %q, issued before", seed, counter, code)
+			}
+			seen[code] = true
+			if gotSeed, gotCounter, err := codes.Decode(code); gotSeed != seed || gotCounter != counter || err != nil {
+				t.Fatalf("Decode(%q) = %q, %d, %v; want %s, %d", code, gotSeed, gotCounter, err, seed, counter)
+			}
+			sorted = sorted && code > prev
+			prev = code
+		}
+		if sorted {
+			t.Errorf("codes of seed %s come in order", seed)
+		}
+	}
+
+	other, _ := NewPermutedCodes([]byte("fedcba9876543210"))
+	if other.Encode("aaa", 1) == codes.Encode("aaa", 1) {
+		t.Error("codes do not depend on the key")
+	}
+
+	// links issued before switching schemes keep resolving
+	if seed, counter, err := codes.Decode(encodeCode("abc", 42)); seed != "abc" || counter != 42 || err != nil {
+		t.Errorf("Decode of a sequential code = %q, %d, %v", seed, counter, err)
+	}
+	if code := codes.Encode("abc", 5000); code != encodeCode("abc", 5000) {
+		t.Errorf("counter past 36 bits encoded as %q, want the sequential code", code)
+	}
+	for _, bad := range []string{"zzzzzzz", "abc-def", "YWFh"} {
+		if _, _, err := codes.Decode(bad); err == nil {
+			t.Errorf("Decode(%q) succeeded", bad)
+		}
+	}
+
+	if _, err := NewPermutedCodes([]byte("short")); err == nil {
+		t.Error("NewPermutedCodes accepted a 5 byte key")
+	}
+	if _, err := ParseCodeScheme("random", ""); err == nil {
+		t.Error("ParseCodeScheme accepted an unknown scheme")
+	}
+}
+
+func TestPermutedCodesServer(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "codes.db")
+	db, err := InitDBAt(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// a link from before the switch, with a seed of its own
+	if err := NewUrlMapping(db).Create("https://example.com/old", "https://sho.rt/"+encodeCode("zzz", 1), "zzz", 1, LinkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	codes, _ := ParseCodeScheme("permuted", "a deployment secret")
+	srv, err := NewServer(
+		WithDB(db),
+		WithWorkers(1),
+		WithCodeScheme(codes),
+		WithHttpConfig(HttpConfig{ShortUrlHost: "sho.rt"}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown(context.Background())
+	api := httptest.NewServer(srv.Handler())
+	defer api.Close()
+
+	first := createLink(t, api.URL, `{"original_url":"https://example.com/1"}`)
+	second := createLink(t, api.URL, `{"original_url":"https://example.com/2"}`)
+	for _, code := range []string{first, second} {
+		if len(code) != permutedCodeLen {
+			t.Errorf("issued code %q, want a permuted one", code)
+		}
+	}
+	if stats := getStats(t, api.URL, second); stats.Code != second || stats.OriginalURL != "https://example.com/2" {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	for code, want := range map[string]string{first: "https://example.com/1", encodeCode("zzz", 1): "https://example.com/old"} {
+		resp, err := client.Get(api.URL + "/" + code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get("Location"); got != want {
+			t.Errorf("GET /%s redirected to %q, want %s", code, got, want)
+		}
+	}
+	// the sequential codes of permuted links must not lead anywhere
+	seed, counter, _ := codes.Decode(first)
+	sequential := encodeCode(seed, counter)
+	for _, path := range []string{"/" + sequential, "/" + sequential + "/stats", "/" + sequential + "/qr"} {
+		resp, err := client.Get(api.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("GET %s of a permuted link: status %d to %q, want 404", path, resp.StatusCode, resp.Header.Get("Location"))
+		}
+	}
+}
@@ -2,49 +2,452 @@ package urlshortener
 
 import (
 	"database/sql"
-	_ "embed"
+	"embed"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io/fs"
+	"log/slog"
+	"slices"
+	"strings"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3" // SQLite driver
+	"github.com/mattn/go-sqlite3" // SQLite driver
 )
 
-//go:embed init.sql
-var initSQL string
+// migrationFS holds the schema, one numbered file per change. The number of
+// files applied so far is tracked in PRAGMA user_version.
+//
+//go:embed migrations/*.sql
+var migrationFS embed.FS
 
 type UrlMapping struct {
-	db *sql.DB
+	db    *sql.DB
+	now   func() time.Time
+	codes CodeScheme
+}
+
+var (
+	ErrLinkNotFound = errors.New("link not found")
+	ErrNoSeeds      = errors.New("No seeds available for acquisition")
+	ErrNotLeased    = errors.New("seed is not leased by this holder")
+	// ErrCodeTaken means the seed and counter, and so the short code, are
+	// already in url_mapping.
+	ErrCodeTaken = errors.New("short code already taken")
+)
+
+// Link is a row of url_mapping addressed by its short code.
+type Link struct {
+	Code        string
+	ShortUrl    string
+	OriginalUrl string
+	CreatedAt   time.Time
+	Clicks      int
+	// Disabled links are kept but no longer resolve.
+	Disabled       bool
+	DisabledReason string
+	// Consumed is set once a one-time link has been followed.
+	Consumed bool
+	// Broken is set when the last check found the destination gone; see
+	// LinkChecker. Check.CheckedAt is zero until the first check.
+	Broken bool
+	Check  LinkCheck
+	// DeletedAt is set for soft deleted links, which only the history and
+	// restore endpoints still see.
+	DeletedAt time.Time
+	DeletedBy string
+	LinkOptions
+}
+
+// LinkOptions are the per-link settings chosen when the link is created.
+type LinkOptions struct {
+	// Interstitial shows the preview page instead of redirecting straight away.
+	Interstitial bool
+	// Owner is the team or person the link belongs to.
+	Owner string
+	Title string
+	// Tags are normalized with normalizeTags.
+	Tags []string
+	// Redirect rewrites the destination when the link is followed.
+	Redirect RedirectRules
+	// PasswordHash, from hashPassword, puts a password prompt before the
+	// redirect.
+	PasswordHash string
+	// OneTime links stop resolving after their first redirect.
+	OneTime bool
+	// CreatedBy is the actor recorded in the link's history.
+	CreatedBy string
 }
 
 type SeedsDb struct {
 	db *sql.DB
 }
 
+// WithClock returns a copy of u that timestamps new links with now.
+func (u *UrlMapping) WithClock(now func() time.Time) *UrlMapping {
+	c := *u
+	c.now = now
+	return &c
+}
+
+// WithCodes returns a copy of u that reads and reports codes of the given
+// scheme; nil keeps the current one.
+func (u *UrlMapping) WithCodes(codes CodeScheme) *UrlMapping {
+	c := *u
+	if codes != nil {
+		c.codes = codes
+	}
+	return &c
+}
+
 func NewUrlMapping(db *sql.DB) *UrlMapping {
-	return &UrlMapping{db: db}
+	return &UrlMapping{db: db, now: time.Now, codes: SequentialCodes{}}
 }
 
-func (u *UrlMapping) Create(orig_url, short_url, seed string, counter int) error {
-	_, err := u.db.Exec(
-		"INSERT INTO url_mapping (original_url, short_url, seed, counter, created_at) "+
-			"VALUES (?,?,?,?,?)",
-		orig_url, short_url, seed, counter, time.Now().UTC(),
+func (u *UrlMapping) Create(orig_url, short_url, seed string, counter int, opts LinkOptions) error {
+	tx, err := u.db.Begin()
+	if err != nil {
+		return fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+	if err := insertLink(tx, orig_url, short_url, seed, counter, u.now().UTC(), opts); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// insertLink adds a url_mapping row, with its tags, title index entry and
+// link.created event, in a transaction.
+func insertLink(db execer, orig_url, short_url, seed string, counter int, createdAt time.Time, opts LinkOptions) error {
+	var rules string
+	if !opts.Redirect.IsZero() {
+		b, err := json.Marshal(opts.Redirect)
+		if err != nil {
+			return fmt.Errorf("encoding redirect rules: %w", err)
+		}
+		rules = string(b)
+	}
+	res, err := db.Exec(
+		"INSERT INTO url_mapping (original_url, short_url, seed, counter, created_at, interstitial, owner, title, "+
+			"redirect_rules, password_hash, one_time) VALUES (?,?,?,?,?,?,?,?,?,?,?)",
+		orig_url, short_url, seed, counter, createdAt, opts.Interstitial, opts.Owner, opts.Title,
+		rules, opts.PasswordHash, opts.OneTime,
 	)
-	return err
+	if isUniqueViolation(err) {
+		return fmt.Errorf("%w: seed %s counter %d", ErrCodeTaken, seed, counter)
+	}
+	if err != nil {
+		return err
+	}
+	if opts.hasMeta() {
+		rowid, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		if err := insertLinkMeta(db, rowid, seed, counter, opts); err != nil {
+			return err
+		}
+	}
+	err = recordHistory(db, seed, counter, HistoryEntry{
+		Action: HistoryCreated,
+		Actor:  opts.CreatedBy,
+		At:     createdAt,
+		NewURL: orig_url,
+	})
+	if err != nil {
+		return err
+	}
+	return enqueueEvent(db, WebhookEvent{
+		Type:       EventLinkCreated,
+		OccurredAt: createdAt,
+		Link:       EventLink{Code: codeOfShortURL(short_url), ShortURL: short_url, OriginalURL: orig_url},
+	})
+}
+
+// isUniqueViolation reports whether err is SQLite rejecting a duplicate
+// primary key or unique index entry.
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique ||
+		sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
 }
 
+// GetSeedCounter returns the highest counter of seed in url_mapping, 0 if the
+// seed has not been used. Deleted links count, so their codes are not issued
+// again.
 func (u *UrlMapping) GetSeedCounter(seed string) (int, error) {
-	var counter int
+	var counter sql.NullInt64
 	err := u.db.QueryRow("Select MAX(counter) FROM url_mapping WHERE seed = ?", seed).Scan(&counter)
+	if err != nil {
+		return -1, fmt.Errorf("unable to get seed counter from url_mapping: %w", err)
+	}
+	return int(counter.Int64), nil // NULL when there are no rows
+}
+
+// linkColumns are the url_mapping columns read by scanLink.
+const linkColumns = "seed, counter, short_url, original_url, created_at, clicks, " +
+	"disabled, disabled_reason, interstitial, owner, title, redirect_rules, " +
+	"password_hash, one_time, consumed_at IS NOT NULL, broken, check_status, check_error, checked_at, " +
+	"deleted_at, deleted_by, " +
+	"(SELECT group_concat(tag, ',') FROM link_tags t WHERE t.seed = url_mapping.seed AND t.counter = url_mapping.counter)"
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func (u *UrlMapping) scanLink(row rowScanner) (Link, error) {
+	var link Link
+	var seed string
+	var counter int
+	var rules string
+	var tags sql.NullString
+	var checkedAt, deletedAt sql.NullTime
+	err := row.Scan(&seed, &counter, &link.ShortUrl, &link.OriginalUrl, &link.CreatedAt, &link.Clicks,
+		&link.Disabled, &link.DisabledReason, &link.Interstitial, &link.Owner, &link.Title, &rules,
+		&link.PasswordHash, &link.OneTime, &link.Consumed,
+		&link.Broken, &link.Check.Status, &link.Check.Error, &checkedAt,
+		&deletedAt, &link.DeletedBy, &tags)
+	if err != nil {
+		return Link{}, err
+	}
+	link.Check.CheckedAt = checkedAt.Time
+	link.DeletedAt = deletedAt.Time
+	if rules != "" {
+		if err := json.Unmarshal([]byte(rules), &link.Redirect); err != nil {
+			return Link{}, fmt.Errorf("decoding redirect rules: %w", err)
+		}
+	}
+	link.Code = u.codes.Encode(seed, counter)
+	if tags.Valid {
+		link.Tags = strings.Split(tags.String, ",")
+		slices.Sort(link.Tags)
+	}
+	return link, nil
+}
+
+// decode returns the seed and counter of code, or ErrLinkNotFound. A code
+// the current scheme would not produce for them, such as the sequential code
+// of a link under PermutedCodes, only counts if the link was issued with it,
+// so permuted links cannot be walked through their sequential codes.
+func (u *UrlMapping) decode(code string) (string, int, error) {
+	seed, counter, err := u.codes.Decode(code)
+	if err != nil {
+		return "", 0, ErrLinkNotFound
+	}
+	if u.codes.Encode(seed, counter) == code {
+		return seed, counter, nil
+	}
+	var shortURL string
+	err = u.db.QueryRow("SELECT short_url FROM url_mapping WHERE seed = ? AND counter = ?", seed, counter).Scan(&shortURL)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && codeOfShortURL(shortURL) != code) {
+		return "", 0, ErrLinkNotFound
+	}
+	if err != nil {
+		return "", 0, fmt.Errorf("looking up code %s: %w", code, err)
+	}
+	return seed, counter, nil
+}
+
+// GetByCode returns the link of code unless it was deleted.
+func (u *UrlMapping) GetByCode(code string) (Link, error) {
+	return u.getByCode(code, false)
+}
+
+func (u *UrlMapping) getByCode(code string, withDeleted bool) (Link, error) {
+	seed, counter, err := u.decode(code)
+	if err != nil {
+		return Link{}, err
+	}
+
+	link, err := u.scanLink(u.db.QueryRow(
+		"SELECT "+linkColumns+" FROM url_mapping WHERE seed = ? AND counter = ? AND (deleted_at IS NULL OR ?)",
+		seed, counter, withDeleted,
+	))
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return 0, nil // counter will start from 0
+			return Link{}, ErrLinkNotFound
 		}
-		return -1, fmt.Errorf("unable to get seed counter from url_mapping: %w", err)
+		return Link{}, fmt.Errorf("looking up code %s: %w", code, err)
+	}
+	return link, nil
+}
+
+// List returns links, newest first, whose original URL contains query;
+// only broken ones with brokenOnly. With deleted it lists deleted links
+// instead of live ones.
+func (u *UrlMapping) List(query string, brokenOnly, deleted bool, limit, offset int) ([]Link, error) {
+	r, err := u.db.Query(
+		"SELECT "+linkColumns+" FROM url_mapping WHERE instr(lower(original_url), lower(?)) > 0 AND (broken OR NOT ?) "+
+			"AND (deleted_at IS NOT NULL) = ? ORDER BY created_at DESC, rowid DESC LIMIT ? OFFSET ?",
+		query, brokenOnly, deleted, limit, offset,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("listing links: %w", err)
+	}
+	defer r.Close()
+
+	links := []Link{}
+	for r.Next() {
+		link, err := u.scanLink(r)
+		if err != nil {
+			return nil, fmt.Errorf("scanning link row: %w", err)
+		}
+		links = append(links, link)
+	}
+	if err := r.Err(); err != nil {
+		return nil, fmt.Errorf("iterating link rows: %w", err)
+	}
+	return links, nil
+}
+
+// RecordClick counts a click on the link and, unless variant is empty, on
+// that variant of it.
+func (u *UrlMapping) RecordClick(code, variant string) error {
+	seed, counter, err := u.decode(code)
+	if err != nil {
+		return err
+	}
+
+	tx, err := u.db.Begin()
+	if err != nil {
+		return fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+	link := EventLink{Code: code}
+	err = tx.QueryRow("UPDATE url_mapping SET clicks = clicks + 1 WHERE seed = ? AND counter = ? AND deleted_at IS NULL "+
+		"RETURNING clicks, short_url, original_url", seed, counter).Scan(&link.Clicks, &link.ShortURL, &link.OriginalURL)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrLinkNotFound
 	}
+	if err != nil {
+		return fmt.Errorf("recording click for %s: %w", code, err)
+	}
+	if err := u.clicked(tx, seed, counter, variant, link); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
 
-	return counter, nil
+// clicked records what follows from a click on link: the variant's count and
+// a link.click_threshold event for endpoints waiting for its new count.
+func (u *UrlMapping) clicked(tx *sql.Tx, seed string, counter int, variant string, link EventLink) error {
+	if variant != "" {
+		if err := recordVariantClick(tx, seed, counter, variant); err != nil {
+			return err
+		}
+	}
+	return enqueueEvent(tx, WebhookEvent{
+		Type:       EventLinkClickThreshold,
+		OccurredAt: u.now().UTC(),
+		Link:       link,
+		Threshold:  link.Clicks,
+	})
+}
+
+func recordVariantClick(db execer, seed string, counter int, variant string) error {
+	_, err := db.Exec("INSERT INTO link_variant_clicks (seed, counter, variant, clicks) VALUES (?,?,?,1) "+
+		"ON CONFLICT (seed, counter, variant) DO UPDATE SET clicks = clicks + 1", seed, counter, variant)
+	if err != nil {
+		return fmt.Errorf("recording click for variant %s: %w", variant, err)
+	}
+	return nil
+}
+
+// DisableMatching disables every enabled link whose destination, or the URL
+// of any of its route variants, match reports as blocked, storing the reason
+// it returns and actor in the links' history. It returns the number of links
+// disabled.
+func (u *UrlMapping) DisableMatching(actor string, match func(dest string) (string, bool)) (int, error) {
+	type row struct {
+		seed     string
+		counter  int
+		shortURL string
+		dest     string
+		reason   string
+	}
+
+	r, err := u.db.Query("SELECT seed, counter, short_url, original_url, redirect_rules FROM url_mapping WHERE disabled = 0 AND deleted_at IS NULL")
+	if err != nil {
+		return 0, fmt.Errorf("selecting enabled links: %w", err)
+	}
+	var matched []row
+	for r.Next() {
+		var m row
+		var rules string
+		if err := r.Scan(&m.seed, &m.counter, &m.shortURL, &m.dest, &rules); err != nil {
+			r.Close()
+			return 0, fmt.Errorf("scanning link row: %w", err)
+		}
+		dests := []string{m.dest}
+		if rules != "" {
+			var redirect RedirectRules
+			if err := json.Unmarshal([]byte(rules), &redirect); err != nil {
+				r.Close()
+				return 0, fmt.Errorf("decoding redirect rules of link %s/%d: %w", m.seed, m.counter, err)
+			}
+			for _, rt := range redirect.Routes {
+				for _, v := range rt.Variants {
+					dests = append(dests, v.URL)
+				}
+			}
+		}
+		for _, dest := range dests {
+			if reason, ok := match(dest); ok {
+				m.reason = reason
+				matched = append(matched, m)
+				break
+			}
+		}
+	}
+	r.Close()
+	if err := r.Err(); err != nil {
+		return 0, fmt.Errorf("iterating link rows: %w", err)
+	}
+
+	tx, err := u.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+	now := u.now().UTC()
+	for _, m := range matched {
+		_, err := tx.Exec("UPDATE url_mapping SET disabled = 1, disabled_reason = ? WHERE seed = ? AND counter = ?",
+			m.reason, m.seed, m.counter)
+		if err != nil {
+			return 0, fmt.Errorf("disabling link %s/%d: %w", m.seed, m.counter, err)
+		}
+		err = recordHistory(tx, m.seed, m.counter, HistoryEntry{
+			Action: HistoryDisabled,
+			Actor:  actor,
+			At:     now,
+			OldURL: m.dest,
+			NewURL: m.dest,
+			Reason: m.reason,
+		})
+		if err != nil {
+			return 0, err
+		}
+		err = enqueueEvent(tx, WebhookEvent{
+			Type:       EventLinkDisabled,
+			OccurredAt: now,
+			Link:       EventLink{Code: u.codes.Encode(m.seed, m.counter), ShortURL: m.shortURL, OriginalURL: m.dest},
+			Reason:     m.reason,
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("committing disabled links: %w", err)
+	}
+	return len(matched), nil
 }
 
 func NewSeedsDb(db *sql.DB) *SeedsDb {
@@ -101,7 +504,54 @@ func (s *SeedsDb) SelectSeedByStatus(status int) (Seeds, error) {
 
 // }
 
+// SeedInfo is a row of the seeds table, lease included.
+type SeedInfo struct {
+	Seed        string     `json:"seed"`
+	Status      int        `json:"status"` // 0 available, 1 used, 2 exhausted
+	CounterUsed int        `json:"counter_used"`
+	CounterSize int        `json:"counter_size"`
+	LeaseHolder string     `json:"lease_holder,omitempty"`
+	LeaseTaken  *time.Time `json:"lease_taken,omitempty"`
+}
+
+func (s *SeedsDb) SelectAll() ([]SeedInfo, error) {
+	r, err := s.db.Query("SELECT seed, status, counter_used, counter_size, lease_holder, lease_taken FROM seeds ORDER BY seed")
+	if err != nil {
+		return nil, fmt.Errorf("Selecting seeds: %w", err)
+	}
+	defer r.Close()
+
+	seeds := []SeedInfo{}
+	for r.Next() {
+		var s SeedInfo
+		var holder sql.NullString
+		var taken sql.NullTime
+		if err := r.Scan(&s.Seed, &s.Status, &s.CounterUsed, &s.CounterSize, &holder, &taken); err != nil {
+			return nil, fmt.Errorf("Scanning seed row: %w", err)
+		}
+		s.LeaseHolder = holder.String
+		if taken.Valid {
+			s.LeaseTaken = &taken.Time
+		}
+		seeds = append(seeds, s)
+	}
+	if err := r.Err(); err != nil {
+		return nil, fmt.Errorf("Error iterating seed rows: %w", err)
+	}
+	return seeds, nil
+}
+
 func (s *SeedsDb) Acquire(holder string) (Seed, error) {
+	return s.acquire(holder, nil)
+}
+
+// AcquireUntil leases a seed to holder until expires, after which
+// ReclaimExpired takes it back unless Renew extended it.
+func (s *SeedsDb) AcquireUntil(holder string, expires time.Time) (Seed, error) {
+	return s.acquire(holder, expires.Unix())
+}
+
+func (s *SeedsDb) acquire(holder string, expires any) (Seed, error) {
 	var acquiredSeed Seed
 
 	query := `
@@ -109,7 +559,8 @@ UPDATE seeds
 SET
     status = 1,
     lease_holder = ?,
-    lease_taken = datetime('now')
+    lease_taken = datetime('now'),
+    lease_expires = ?
 WHERE
     status = 0
     AND rowid = (
@@ -121,10 +572,10 @@ WHERE
     )
 RETURNING seed, counter_used, counter_size
 `
-	err := s.db.QueryRow(query, holder).Scan(&acquiredSeed.Seed, &acquiredSeed.CounterUsed, &acquiredSeed.CounterSize)
+	err := s.db.QueryRow(query, holder, expires).Scan(&acquiredSeed.Seed, &acquiredSeed.CounterUsed, &acquiredSeed.CounterSize)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return Seed{}, fmt.Errorf("No seeds available for acquisition")
+			return Seed{}, ErrNoSeeds
 		}
 		return Seed{}, fmt.Errorf("Failed to acquire seed: %w", err)
 	}
@@ -132,6 +583,99 @@ RETURNING seed, counter_used, counter_size
 	return acquiredSeed, nil
 }
 
+// Release ends holder's lease on seed, storing how far its counter got. A
+// used up seed is marked exhausted, otherwise it becomes available again.
+// The stored counter never goes back.
+func (s *SeedsDb) Release(holder string, seed Seed) error {
+	res, err := s.db.Exec(`
+UPDATE seeds
+SET
+    counter_used = MAX(counter_used, ?1),
+    status = CASE WHEN MAX(counter_used, ?1) >= counter_size THEN 2 ELSE 0 END
+WHERE seed = ?2 AND status = 1 AND lease_holder = ?3`,
+		seed.CounterUsed, seed.Seed, holder,
+	)
+	if err != nil {
+		return fmt.Errorf("releasing seed %s: %w", seed.Seed, err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("releasing seed %s: %w", seed.Seed, err)
+	} else if n == 0 {
+		return ErrNotLeased
+	}
+	return nil
+}
+
+// Renew extends holder's leases until expires, first raising the counters
+// of the reported seeds it holds, and returns the seeds it still holds.
+func (s *SeedsDb) Renew(holder string, reported []Seed, expires time.Time) (Seeds, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("renewing leases: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, seed := range reported {
+		if _, err := tx.Exec(`
+UPDATE seeds SET counter_used = MAX(counter_used, ?)
+WHERE seed = ? AND status = 1 AND lease_holder = ?`,
+			seed.CounterUsed, seed.Seed, holder,
+		); err != nil {
+			return nil, fmt.Errorf("renewing lease on %s: %w", seed.Seed, err)
+		}
+	}
+	r, err := tx.Query(`
+UPDATE seeds SET lease_expires = ?
+WHERE status = 1 AND lease_holder = ? AND lease_expires IS NOT NULL
+RETURNING seed, counter_used, counter_size`, expires.Unix(), holder)
+	if err != nil {
+		return nil, fmt.Errorf("renewing leases: %w", err)
+	}
+	defer r.Close()
+	held := Seeds{}
+	for r.Next() {
+		var seed Seed
+		if err := r.Scan(&seed.Seed, &seed.CounterUsed, &seed.CounterSize); err != nil {
+			return nil, fmt.Errorf("renewing leases: %w", err)
+		}
+		held = append(held, seed)
+	}
+	if err := r.Err(); err != nil {
+		return nil, fmt.Errorf("renewing leases: %w", err)
+	}
+	r.Close()
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("renewing leases: %w", err)
+	}
+	return held, nil
+}
+
+// ReclaimExpired ends the leases that expired before now, keeping the last
+// counter their holder reported, and returns the seeds taken back.
+func (s *SeedsDb) ReclaimExpired(now time.Time) (Seeds, error) {
+	r, err := s.db.Query(`
+UPDATE seeds
+SET status = CASE WHEN counter_used >= counter_size THEN 2 ELSE 0 END
+WHERE status = 1 AND lease_expires IS NOT NULL AND lease_expires <= ?
+RETURNING seed, counter_used, counter_size`, now.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("reclaiming expired leases: %w", err)
+	}
+	defer r.Close()
+	var reclaimed Seeds
+	for r.Next() {
+		var seed Seed
+		if err := r.Scan(&seed.Seed, &seed.CounterUsed, &seed.CounterSize); err != nil {
+			return nil, fmt.Errorf("reclaiming expired leases: %w", err)
+		}
+		reclaimed = append(reclaimed, seed)
+	}
+	if err := r.Err(); err != nil {
+		return nil, fmt.Errorf("reclaiming expired leases: %w", err)
+	}
+	return reclaimed, nil
+}
+
 // func (s *SeedsDb) SelectSeedsByLeaseHolder(holder string) (Seeds, error) {
 // 	var seeds Seeds
 // 	r, err := s.db.Query("SELECT seed, counter FROM seeds WHERE lease_holder = ? ORDER BY counter DESC LIMIT 1", holder)
@@ -153,15 +697,128 @@ RETURNING seed, counter_used, counter_size
 // 	return seeds, nil
 // }
 
+// SyncSeedsFromUrlMapping returns seeds still leased by a previous run to the
+// pool. Their counters are taken from url_mapping, since the lease holder
+// never got to release them, and used up seeds are marked exhausted.
+func SyncSeedsFromUrlMapping(db *sql.DB) error {
+	u := NewUrlMapping(db)
+	seedDb := NewSeedsDb(db)
+
+	seeds, err := seedDb.SelectSeedByStatus(1) // get used seeds 0 - available, 1 - used, 2 - exhausted
+	if err != nil {
+		return fmt.Errorf("Cannot get Seed by status: %w", err)
+	}
+
+	for _, s := range seeds {
+		counterUsed, err := u.GetSeedCounter(s.Seed)
+		if err != nil {
+			return fmt.Errorf("Cannot get url_mapping seed counter: %w", err)
+		}
+
+		status := 0
+		if counterUsed >= s.CounterSize {
+			status = 2
+		}
+		if err := seedDb.SetSeedStatusAndCounter(s.Seed, counterUsed, status); err != nil {
+			return fmt.Errorf("Cannot sync seed %s: %w", s.Seed, err)
+		}
+	}
+	return nil
+}
+
+// SyncSeedCounters raises the counter of every seed to the highest counter
+// used in url_mapping, marking used up seeds that are not leased exhausted.
+// Unlike SyncSeedsFromUrlMapping it leaves leases alone, so the seed service
+// runs it on a database whose leases belong to live frontends.
+func SyncSeedCounters(db *sql.DB) error {
+	_, err := db.Exec(`
+UPDATE seeds
+SET
+    counter_used = MAX(counter_used, m.counter),
+    status = CASE WHEN status = 0 AND MAX(counter_used, m.counter) >= counter_size THEN 2 ELSE status END
+FROM (SELECT seed, MAX(counter) AS counter FROM url_mapping GROUP BY seed) AS m
+WHERE seeds.seed = m.seed`)
+	if err != nil {
+		return fmt.Errorf("syncing seed counters: %w", err)
+	}
+	return nil
+}
+
+func migrationNames() ([]string, error) {
+	// fs.Glob returns names in lexical order, which is the order to apply them
+	return fs.Glob(migrationFS, "migrations/*.sql")
+}
+
+// SchemaVersion reports the migration the database is at and the latest one
+// known to this binary.
+func SchemaVersion(db *sql.DB) (current, latest int, err error) {
+	names, err := migrationNames()
+	if err != nil {
+		return 0, 0, fmt.Errorf("listing migrations: %w", err)
+	}
+	if err := db.QueryRow("PRAGMA user_version").Scan(&current); err != nil {
+		return 0, 0, fmt.Errorf("reading schema version: %w", err)
+	}
+	return current, len(names), nil
+}
+
+func migrate(db *sql.DB) error {
+	current, _, err := SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	names, err := migrationNames()
+	if err != nil {
+		return fmt.Errorf("listing migrations: %w", err)
+	}
+
+	for i := current; i < len(names); i++ {
+		body, err := migrationFS.ReadFile(names[i])
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", names[i], err)
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("starting migration %s: %w", names[i], err)
+		}
+		if _, err := tx.Exec(string(body)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("applying %s: %w", names[i], err)
+		}
+		// PRAGMA does not accept bound parameters
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("recording %s: %w", names[i], err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("committing %s: %w", names[i], err)
+		}
+		slog.Info("migration applied", "migration", names[i])
+	}
+	return nil
+}
+
+// DefaultDBPath is the database file used by InitDB.
+const DefaultDBPath = "urlshortener.db"
+
 func InitDB() (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", "file:urlshortener.db")
+	return InitDBAt(DefaultDBPath)
+}
+
+// InitDBAt opens, migrates and seeds the database stored in path.
+func InitDBAt(path string) (*sql.DB, error) {
+	// Write-Ahead Logging for better concurrency
+	db, err := sql.Open("sqlite3", "file:"+path+"?_journal_mode=WAL")
 	if err != nil {
 		return nil, fmt.Errorf("Unable to create/open the database: %w", err)
 	}
 
-	_, err = db.Exec(initSQL)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to execute init.sql: %w", err)
+	if err := migrate(db); err != nil {
+		return nil, fmt.Errorf("Failed to migrate the database: %w", err)
+	}
+	if err := setupTitleIndex(db); err != nil {
+		return nil, err
 	}
 
 	r, err := db.Query("SELECT COUNT(*) FROM seeds")
@@ -196,7 +853,7 @@ func InitDB() (*sql.DB, error) {
 		}
 	}
 
-	log.Println("Database initialized successfully")
+	slog.Info("database initialized")
 	return db, nil
 }
 
@@ -0,0 +1,267 @@
+package urlshortener
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// service is one run of the shortener as cmd/urlshortener wires it: Manager,
+// StartWorkers and the HTTP handler on a database file.
+type service struct {
+	t      *testing.T
+	db     *sql.DB
+	srv    *httptest.Server
+	workCh chan WorkRequest
+}
+
+func startService(t *testing.T, path string, workers int) *service {
+	t.Helper()
+	db, err := InitDBAt(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SyncSeedsFromUrlMapping(db); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &service{t: t, db: db, workCh: make(chan WorkRequest)}
+	seedCh := make(chan SeedRequest)
+	go Manager(db, seedCh)
+	pool := StartWorkers(db, s.workCh, seedCh, workers)
+	s.srv = httptest.NewServer(NewHandler(db, s.workCh, HttpConfig{
+		ShortUrlHost: "sho.rt",
+		Health:       NewHealth(db, pool, 0),
+	}))
+	t.Cleanup(s.stop)
+	return s
+}
+
+// stop ends the run the way a crash would: leases are not released.
+func (s *service) stop() {
+	if s.srv == nil {
+		return
+	}
+	s.srv.Close()
+	close(s.workCh)
+	s.db.Close()
+	s.srv = nil
+}
+
+// shorten creates a link, returning its code, or the HTTP status on failure.
+func (s *service) shorten(dest string) (string, int) {
+	s.t.Helper()
+	body, _ := json.Marshal(URLRequest{OriginalURL: dest})
+	resp, err := http.Post(s.srv.URL+"/short", "application/json", bytes.NewReader(body))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", resp.StatusCode
+	}
+	var out URLResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		s.t.Fatal(err)
+	}
+	code, ok := strings.CutPrefix(out.ShortenedURL, "https://sho.rt/")
+	if !ok {
+		s.t.Fatalf("short URL %q not on the configured host", out.ShortenedURL)
+	}
+	return code, resp.StatusCode
+}
+
+func (s *service) mustShorten(dest string) (seed string, counter int) {
+	s.t.Helper()
+	code, status := s.shorten(dest)
+	if status != http.StatusOK {
+		s.t.Fatalf("shortening %s: status %d", dest, status)
+	}
+	seed, counter, err := decodeCode(code)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return seed, counter
+}
+
+func setCounterSize(t *testing.T, path string, size int) {
+	t.Helper()
+	db, err := InitDBAt(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("UPDATE seeds SET counter_size = ?", size); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func seedState(t *testing.T, db *sql.DB, seed string) (status, counterUsed int) {
+	t.Helper()
+	err := db.QueryRow("SELECT status, counter_used FROM seeds WHERE seed = ?", seed).Scan(&status, &counterUsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status, counterUsed
+}
+
+func TestE2ECreateRedirectStats(t *testing.T) {
+	s := startService(t, filepath.Join(t.TempDir(), "e2e.db"), 2)
+
+	code, status := s.shorten("https://example.com/page")
+	if status != http.StatusOK {
+		t.Fatalf("shorten: status %d", status)
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(s.srv.URL + "/" + code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "https://example.com/page" {
+		t.Fatalf("redirect: %d to %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	resp, err = http.Get(s.srv.URL + "/" + code + "/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var stats LinkStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Code != code || stats.OriginalURL != "https://example.com/page" || stats.Clicks != 1 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestE2ESeedRollover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "e2e.db")
+	setCounterSize(t, path, 3)
+	s := startService(t, path, 1)
+
+	var seeds []string
+	for i := 0; i < 7; i++ {
+		seed, counter := s.mustShorten(fmt.Sprintf("https://example.com/%d", i))
+		if want := i%3 + 1; counter != want {
+			t.Errorf("link %d: counter %d, want %d", i, counter, want)
+		}
+		if counter == 1 {
+			seeds = append(seeds, seed)
+		}
+	}
+	if len(seeds) != 3 || seeds[0] == seeds[1] || seeds[1] == seeds[2] {
+		t.Fatalf("seeds used %v, want three distinct", seeds)
+	}
+
+	// the first two were released as exhausted when the worker moved on
+	for _, seed := range seeds[:2] {
+		if status, used := seedState(t, s.db, seed); status != 2 || used != 3 {
+			t.Errorf("seed %s: status %d, counter_used %d; want exhausted at 3", seed, status, used)
+		}
+	}
+	if status, _ := seedState(t, s.db, seeds[2]); status != 1 {
+		t.Errorf("seed %s in use: status %d, want 1", seeds[2], status)
+	}
+}
+
+func TestE2ESeedExhaustion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "e2e.db")
+	setCounterSize(t, path, 2)
+	s := startService(t, path, 1)
+
+	capacity := 2 * len(generateSeeds())
+	for i := 0; i < capacity; i++ {
+		s.mustShorten(fmt.Sprintf("https://example.com/%d", i))
+	}
+	for i := 0; i < 2; i++ {
+		if _, status := s.shorten("https://example.com/more"); status != http.StatusServiceUnavailable {
+			t.Fatalf("shortening past capacity: status %d, want 503", status)
+		}
+	}
+
+	var exhausted int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM seeds WHERE status = 2").Scan(&exhausted); err != nil {
+		t.Fatal(err)
+	}
+	if exhausted != len(generateSeeds()) {
+		t.Errorf("%d seeds exhausted, want all %d", exhausted, len(generateSeeds()))
+	}
+}
+
+func TestE2ERestartRecovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "e2e.db")
+	s := startService(t, path, 1)
+	var seed string
+	for i := 0; i < 5; i++ {
+		seed, _ = s.mustShorten(fmt.Sprintf("https://example.com/%d", i))
+	}
+	if status, used := seedState(t, s.db, seed); status != 1 || used != 0 {
+		t.Fatalf("leased seed before crash: status %d, counter_used %d", status, used)
+	}
+	s.stop()
+
+	// the restart syncs the lease back from url_mapping
+	s = startService(t, path, 1)
+	if status, used := seedState(t, s.db, seed); status != 0 || used != 5 {
+		t.Fatalf("seed after restart: status %d, counter_used %d; want available at 5", status, used)
+	}
+
+	gotSeed, counter := s.mustShorten("https://example.com/after")
+	if gotSeed == seed && counter <= 5 {
+		t.Errorf("reissued counter %d of seed %s", counter, seed)
+	}
+	var rows int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM url_mapping").Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 6 {
+		t.Errorf("%d links stored, want 6", rows)
+	}
+}
+
+func TestE2EConcurrentCreates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "e2e.db")
+	setCounterSize(t, path, 16) // force rollovers under contention
+	s := startService(t, path, 8)
+
+	const n = 200
+	codes := make([]string, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			code, status := s.shorten(fmt.Sprintf("https://example.com/%d", i))
+			if status != http.StatusOK {
+				t.Errorf("link %d: status %d", i, status)
+			}
+			codes[i] = code
+		}()
+	}
+	wg.Wait()
+
+	seen := map[string]bool{}
+	for _, c := range codes {
+		if seen[c] {
+			t.Errorf("code %s issued twice", c)
+		}
+		seen[c] = true
+	}
+	var rows int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM url_mapping").Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != n {
+		t.Errorf("%d links stored, want %d", rows, n)
+	}
+}
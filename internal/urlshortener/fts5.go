@@ -0,0 +1,7 @@
+//go:build sqlite_fts5
+
+package urlshortener
+
+// Built with -tags sqlite_fts5 the SQLite driver includes FTS5, and link
+// titles are searched through the link_titles full-text index.
+const hasFTS5 = true
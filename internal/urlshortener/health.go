@@ -0,0 +1,130 @@
+package urlshortener
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Health answers liveness and readiness probes.
+type Health struct {
+	db      *sql.DB
+	seeds   *SeedsDb
+	workers *WorkerPool
+	// MinSeeds is the number of available or leased seeds required to be ready.
+	MinSeeds int
+	extra    map[string]func(context.Context) CheckResult
+}
+
+type CheckResult struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type Liveness struct {
+	Status string `json:"status"`
+}
+
+type Readiness struct {
+	Ready  bool                   `json:"ready"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+func NewHealth(db *sql.DB, workers *WorkerPool, minSeeds int) *Health {
+	return &Health{
+		db:       db,
+		seeds:    NewSeedsDb(db),
+		workers:  workers,
+		MinSeeds: minSeeds,
+	}
+}
+
+// AddCheck adds a readiness check, such as the seed service's for a
+// frontend. Checks are added before the probes are served.
+func (h *Health) AddCheck(name string, check func(context.Context) CheckResult) {
+	if h.extra == nil {
+		h.extra = map[string]func(context.Context) CheckResult{}
+	}
+	h.extra[name] = check
+}
+
+func (h *Health) Check(ctx context.Context) Readiness {
+	checks := map[string]CheckResult{
+		"db":         h.checkDB(ctx),
+		"migrations": h.checkMigrations(),
+		"seeds":      h.checkSeeds(),
+		"workers":    h.checkWorkers(),
+	}
+	for name, check := range h.extra {
+		checks[name] = check(ctx)
+	}
+
+	ready := true
+	for _, c := range checks {
+		ready = ready && c.OK
+	}
+	return Readiness{Ready: ready, Checks: checks}
+}
+
+func (h *Health) checkDB(ctx context.Context) CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	if err := h.db.PingContext(ctx); err != nil {
+		return CheckResult{Detail: err.Error()}
+	}
+	return CheckResult{OK: true}
+}
+
+func (h *Health) checkMigrations() CheckResult {
+	current, latest, err := SchemaVersion(h.db)
+	if err != nil {
+		return CheckResult{Detail: err.Error()}
+	}
+	return CheckResult{
+		OK:     current == latest,
+		Detail: fmt.Sprintf("schema version %d of %d", current, latest),
+	}
+}
+
+func (h *Health) checkSeeds() CheckResult {
+	count := 0
+	for _, status := range []int{0, 1} { // available, used (leased)
+		seeds, err := h.seeds.SelectSeedByStatus(status)
+		if err != nil {
+			return CheckResult{Detail: err.Error()}
+		}
+		count += len(seeds)
+	}
+	return CheckResult{
+		OK:     count >= h.MinSeeds,
+		Detail: fmt.Sprintf("%d seeds available or leased, %d required", count, h.MinSeeds),
+	}
+}
+
+func (h *Health) checkWorkers() CheckResult {
+	if h.workers == nil {
+		return CheckResult{Detail: "workers not started"}
+	}
+	running, size := h.workers.Running(), h.workers.Size()
+	return CheckResult{
+		OK:     size > 0 && running == size,
+		Detail: fmt.Sprintf("%d of %d workers running", running, size),
+	}
+}
+
+func (h *Health) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, Liveness{Status: "ok"})
+}
+
+func (h *Health) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	readiness := h.Check(r.Context())
+
+	status := http.StatusOK
+	if !readiness.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, readiness)
+}
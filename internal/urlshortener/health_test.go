@@ -0,0 +1,128 @@
+package urlshortener
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadiness(t *testing.T) {
+	running := func(size, alive int) *WorkerPool {
+		p := &WorkerPool{size: size}
+		p.running.Add(int32(alive))
+		return p
+	}
+	tests := []struct {
+		name string
+		// setup breaks the database or returns the workers to report
+		setup    func(t *testing.T, db *sql.DB) *WorkerPool
+		minSeeds int
+		failing  []string
+	}{
+		{
+			name:  "ready",
+			setup: func(*testing.T, *sql.DB) *WorkerPool { return running(2, 2) },
+		},
+		{
+			name: "database unreachable",
+			setup: func(t *testing.T, db *sql.DB) *WorkerPool {
+				db.Close()
+				return running(2, 2)
+			},
+			failing: []string{"db", "migrations", "seeds"},
+		},
+		{
+			name: "migrations pending",
+			setup: func(t *testing.T, db *sql.DB) *WorkerPool {
+				if _, err := db.Exec("PRAGMA user_version = 1"); err != nil {
+					t.Fatal(err)
+				}
+				return running(2, 2)
+			},
+			failing: []string{"migrations"},
+		},
+		{
+			name: "seeds exhausted",
+			setup: func(t *testing.T, db *sql.DB) *WorkerPool {
+				if _, err := db.Exec("UPDATE seeds SET status = 2"); err != nil {
+					t.Fatal(err)
+				}
+				return running(2, 2)
+			},
+			minSeeds: 1,
+			failing:  []string{"seeds"},
+		},
+		{
+			name:     "too few seeds",
+			setup:    func(*testing.T, *sql.DB) *WorkerPool { return running(2, 2) },
+			minSeeds: 1 << 20,
+			failing:  []string{"seeds"},
+		},
+		{
+			name:    "worker died",
+			setup:   func(*testing.T, *sql.DB) *WorkerPool { return running(2, 1) },
+			failing: []string{"workers"},
+		},
+		{
+			name:    "workers not started",
+			setup:   func(*testing.T, *sql.DB) *WorkerPool { return nil },
+			failing: []string{"workers"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := InitDBAt(filepath.Join(t.TempDir(), "health.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			h := NewHealth(db, tt.setup(t, db), tt.minSeeds)
+
+			rec := httptest.NewRecorder()
+			h.handleReadyz(rec, httptest.NewRequest("GET", "/readyz", nil))
+			wantStatus := http.StatusOK
+			if len(tt.failing) > 0 {
+				wantStatus = http.StatusServiceUnavailable
+			}
+			if rec.Code != wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, wantStatus)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type = %q", ct)
+			}
+			var body Readiness
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("decoding %s: %v", rec.Body, err)
+			}
+			if body.Ready != (len(tt.failing) == 0) {
+				t.Errorf("ready = %v with failing checks %v", body.Ready, tt.failing)
+			}
+			failing := map[string]bool{}
+			for _, name := range tt.failing {
+				failing[name] = true
+			}
+			for _, name := range []string{"db", "migrations", "seeds", "workers"} {
+				c, ok := body.Checks[name]
+				if !ok {
+					t.Errorf("check %s missing from %s", name, rec.Body)
+					continue
+				}
+				if c.OK == failing[name] {
+					t.Errorf("check %s = %+v, want ok %v", name, c, !failing[name])
+				}
+				if !c.OK && c.Detail == "" {
+					t.Errorf("failed check %s has no detail", name)
+				}
+			}
+
+			rec = httptest.NewRecorder()
+			h.handleHealthz(rec, httptest.NewRequest("GET", "/healthz", nil))
+			if rec.Code != http.StatusOK {
+				t.Errorf("/healthz status = %d, want 200 regardless of readiness", rec.Code)
+			}
+		})
+	}
+}
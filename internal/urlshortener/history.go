@@ -0,0 +1,210 @@
+package urlshortener
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// History actions.
+const (
+	HistoryCreated  = "created"
+	HistoryDisabled = "disabled"
+	HistoryDeleted  = "deleted"
+	HistoryRestored = "restored"
+	// HistoryConsumed is the visit that used up a one-time link.
+	HistoryConsumed = "consumed"
+)
+
+// ErrNotDeleted means a link asked to be restored was never deleted.
+var ErrNotDeleted = errors.New("link is not deleted")
+
+// HistoryEntry is a change to a link: who made it, when, and the destination
+// before and after it.
+type HistoryEntry struct {
+	Action string `json:"action"`
+	// Actor is "admin", "key:<id>" for an API key, "anonymous" while link
+	// creation is open, "visitor" for a consumed one-time link, or empty for
+	// links older than the history.
+	Actor  string    `json:"actor,omitempty"`
+	At     time.Time `json:"at"`
+	OldURL string    `json:"old_url,omitempty"`
+	NewURL string    `json:"new_url,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+type LinkHistory struct {
+	Code    string         `json:"code"`
+	Entries []HistoryEntry `json:"entries"`
+}
+
+func recordHistory(db execer, seed string, counter int, e HistoryEntry) error {
+	_, err := db.Exec("INSERT INTO url_mapping_history (seed, counter, action, actor, at, old_url, new_url, reason) "+
+		"VALUES (?,?,?,?,?,?,?,?)", seed, counter, e.Action, e.Actor, e.At, e.OldURL, e.NewURL, e.Reason)
+	if err != nil {
+		return fmt.Errorf("recording %s of link %s/%d: %w", e.Action, seed, counter, err)
+	}
+	return nil
+}
+
+// Delete soft deletes the link of code: it stops resolving and drops out of
+// lists and search, but keeps its row, so the code is never issued again.
+func (u *UrlMapping) Delete(code, actor, reason string) error {
+	seed, counter, err := u.decode(code)
+	if err != nil {
+		return err
+	}
+
+	tx, err := u.db.Begin()
+	if err != nil {
+		return fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+	now := u.now().UTC()
+	var dest string
+	err = tx.QueryRow("UPDATE url_mapping SET deleted_at = ?, deleted_by = ? "+
+		"WHERE seed = ? AND counter = ? AND deleted_at IS NULL RETURNING original_url",
+		now, actor, seed, counter).Scan(&dest)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrLinkNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("deleting %s: %w", code, err)
+	}
+	err = recordHistory(tx, seed, counter, HistoryEntry{Action: HistoryDeleted, Actor: actor, At: now, OldURL: dest, Reason: reason})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Restore brings back a deleted link, returning ErrNotDeleted if it is live.
+func (u *UrlMapping) Restore(code, actor string) (Link, error) {
+	seed, counter, err := u.decode(code)
+	if err != nil {
+		return Link{}, err
+	}
+
+	tx, err := u.db.Begin()
+	if err != nil {
+		return Link{}, fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+	now := u.now().UTC()
+	var dest string
+	var deleted bool
+	err = tx.QueryRow("SELECT original_url, deleted_at IS NOT NULL FROM url_mapping WHERE seed = ? AND counter = ?",
+		seed, counter).Scan(&dest, &deleted)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Link{}, ErrLinkNotFound
+	}
+	if err != nil {
+		return Link{}, fmt.Errorf("looking up code %s: %w", code, err)
+	}
+	if !deleted {
+		return Link{}, ErrNotDeleted
+	}
+	_, err = tx.Exec("UPDATE url_mapping SET deleted_at = NULL, deleted_by = '' WHERE seed = ? AND counter = ?", seed, counter)
+	if err != nil {
+		return Link{}, fmt.Errorf("restoring %s: %w", code, err)
+	}
+	if err := recordHistory(tx, seed, counter, HistoryEntry{Action: HistoryRestored, Actor: actor, At: now, NewURL: dest}); err != nil {
+		return Link{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Link{}, fmt.Errorf("committing restore of %s: %w", code, err)
+	}
+	return u.GetByCode(code)
+}
+
+// History returns the changes to the link of code, deleted or not, oldest
+// first.
+func (u *UrlMapping) History(code string) ([]HistoryEntry, error) {
+	if _, err := u.getByCode(code, true); err != nil {
+		return nil, err
+	}
+	seed, counter, _ := u.decode(code)
+
+	r, err := u.db.Query("SELECT action, actor, at, old_url, new_url, reason FROM url_mapping_history "+
+		"WHERE seed = ? AND counter = ? ORDER BY id", seed, counter)
+	if err != nil {
+		return nil, fmt.Errorf("selecting history of %s: %w", code, err)
+	}
+	defer r.Close()
+
+	entries := []HistoryEntry{}
+	for r.Next() {
+		var e HistoryEntry
+		if err := r.Scan(&e.Action, &e.Actor, &e.At, &e.OldURL, &e.NewURL, &e.Reason); err != nil {
+			return nil, fmt.Errorf("scanning history row: %w", err)
+		}
+		entries = append(entries, e)
+	}
+	if err := r.Err(); err != nil {
+		return nil, fmt.Errorf("iterating history rows: %w", err)
+	}
+	return entries, nil
+}
+
+// handleDeleteLink soft deletes a link; the optional reason query parameter
+// goes to its history.
+func handleDeleteLink(links *UrlMapping) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		code := r.PathValue("code")
+		actor := actorFromContext(r.Context())
+		err := links.Delete(code, actor, r.URL.Query().Get("reason"))
+		if errors.Is(err, ErrLinkNotFound) {
+			writeError(w, r, http.StatusNotFound, CodeNotFound, "Link not found")
+			return
+		}
+		if err != nil {
+			loggerFor(RequestIDFromContext(r.Context())).Error("deleting link", "code", code, "err", err)
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to delete link")
+			return
+		}
+		loggerFor(RequestIDFromContext(r.Context())).Info("link deleted", "code", code, "actor", actor)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func handleRestoreLink(links *UrlMapping) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		code := r.PathValue("code")
+		actor := actorFromContext(r.Context())
+		link, err := links.Restore(code, actor)
+		if errors.Is(err, ErrLinkNotFound) {
+			writeError(w, r, http.StatusNotFound, CodeNotFound, "Link not found")
+			return
+		}
+		if errors.Is(err, ErrNotDeleted) {
+			writeError(w, r, http.StatusConflict, CodeConflict, "Link is not deleted")
+			return
+		}
+		if err != nil {
+			loggerFor(RequestIDFromContext(r.Context())).Error("restoring link", "code", code, "err", err)
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to restore link")
+			return
+		}
+		loggerFor(RequestIDFromContext(r.Context())).Info("link restored", "code", code, "actor", actor)
+		writeJSON(w, http.StatusOK, newLinkStats(link))
+	}
+}
+
+func handleLinkHistory(links *UrlMapping) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		code := r.PathValue("code")
+		entries, err := links.History(code)
+		if errors.Is(err, ErrLinkNotFound) {
+			writeError(w, r, http.StatusNotFound, CodeNotFound, "Link not found")
+			return
+		}
+		if err != nil {
+			loggerFor(RequestIDFromContext(r.Context())).Error("reading link history", "code", code, "err", err)
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to read link history")
+			return
+		}
+		writeJSON(w, http.StatusOK, LinkHistory{Code: code, Entries: entries})
+	}
+}
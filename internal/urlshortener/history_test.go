@@ -0,0 +1,140 @@
+package urlshortener
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSoftDeleteAndRestore(t *testing.T) {
+	srv, err := NewServer(
+		WithDBPath(filepath.Join(t.TempDir(), "history.db")),
+		WithWorkers(1),
+		WithHttpConfig(HttpConfig{ShortUrlHost: "sho.rt", AdminToken: "secret"}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown(context.Background())
+	api := httptest.NewServer(srv.Handler())
+	defer api.Close()
+
+	do := func(method, path, token, body string, out any) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, api.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if out != nil {
+			json.NewDecoder(resp.Body).Decode(out)
+		} else {
+			io.Copy(io.Discard, resp.Body)
+		}
+		return resp.StatusCode
+	}
+
+	var key NewAPIKey
+	if status := do("POST", "/admin/keys", "secret", `{"name":"ci"}`, &key); status != http.StatusCreated {
+		t.Fatalf("creating key: status %d", status)
+	}
+	var short URLResponse
+	if status := do("POST", "/short", key.Key, `{"original_url":"https://example.com/doc"}`, &short); status != http.StatusOK {
+		t.Fatalf("shortening: status %d", status)
+	}
+	code := strings.TrimPrefix(short.ShortenedURL, "https://sho.rt/")
+
+	if status := do("DELETE", "/admin/links/"+code+"?reason=spam", key.Key, "", nil); status != http.StatusUnauthorized {
+		t.Errorf("delete with an API key: status %d, want 401", status)
+	}
+	if status := do("DELETE", "/admin/links/"+code+"?reason=spam", "secret", "", nil); status != http.StatusNoContent {
+		t.Fatalf("delete: status %d", status)
+	}
+	for _, path := range []string{"/" + code, "/" + code + "/stats", "/" + code + "/qr"} {
+		if status := do("GET", path, "", "", nil); status != http.StatusNotFound {
+			t.Errorf("GET %s of a deleted link: status %d, want 404", path, status)
+		}
+	}
+	var list LinkList
+	do("GET", "/links/search", "secret", "", &list)
+	if len(list.Links) != 0 {
+		t.Errorf("search found deleted links: %+v", list.Links)
+	}
+	do("GET", "/admin/links?deleted=true", "secret", "", &list)
+	if len(list.Links) != 1 || list.Links[0].Code != code || list.Links[0].DeletedAt == nil || list.Links[0].DeletedBy != "admin" {
+		t.Errorf("deleted links = %+v", list.Links)
+	}
+	if status := do("DELETE", "/admin/links/"+code, "secret", "", nil); status != http.StatusNotFound {
+		t.Errorf("second delete: status %d, want 404", status)
+	}
+
+	var restored LinkStats
+	if status := do("POST", "/admin/links/"+code+"/restore", "secret", "", &restored); status != http.StatusOK || restored.DeletedAt != nil {
+		t.Fatalf("restore: status %d, %+v", status, restored)
+	}
+	if status := do("POST", "/admin/links/"+code+"/restore", "secret", "", nil); status != http.StatusConflict {
+		t.Errorf("restoring a live link: status %d, want 409", status)
+	}
+	if status := do("POST", "/admin/links/zzzzzz/restore", "secret", "", nil); status != http.StatusNotFound {
+		t.Errorf("restoring an unknown link: status %d, want 404", status)
+	}
+	if stats := getStats(t, api.URL, code); stats.OriginalURL != "https://example.com/doc" {
+		t.Errorf("stats after restore = %+v", stats)
+	}
+
+	var history LinkHistory
+	if status := do("GET", "/admin/links/"+code+"/history", "secret", "", &history); status != http.StatusOK {
+		t.Fatalf("history: status %d", status)
+	}
+	want := []HistoryEntry{
+		{Action: HistoryCreated, Actor: "key:" + key.ID, NewURL: "https://example.com/doc"},
+		{Action: HistoryDeleted, Actor: "admin", OldURL: "https://example.com/doc", Reason: "spam"},
+		{Action: HistoryRestored, Actor: "admin", NewURL: "https://example.com/doc"},
+	}
+	if len(history.Entries) != len(want) {
+		t.Fatalf("history = %+v, want %d entries", history.Entries, len(want))
+	}
+	for i, e := range history.Entries {
+		if e.At.IsZero() {
+			t.Errorf("entry %d has no time", i)
+		}
+		e.At = want[i].At
+		if e != want[i] {
+			t.Errorf("entry %d = %+v, want %+v", i, e, want[i])
+		}
+	}
+
+	if _, err := srv.DB().Exec("DELETE FROM url_mapping"); err == nil {
+		t.Error("url_mapping rows can be deleted")
+	}
+}
+
+func TestDeletedCodesNotReissued(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reissue.db")
+	s := startService(t, path, 1)
+	s.mustShorten("https://example.com/1")
+	seed, counter := s.mustShorten("https://example.com/2")
+	deleted := encodeCode(seed, counter)
+	if err := NewUrlMapping(s.db).Delete(deleted, "admin", ""); err != nil {
+		t.Fatal(err)
+	}
+	// the lease is not released, so the next run takes the seed's counter
+	// from url_mapping
+	s.stop()
+
+	s = startService(t, path, 1)
+	next, nextCounter := s.mustShorten("https://example.com/3")
+	if next == seed && nextCounter <= counter {
+		t.Errorf("issued %s/%d after deleting %s/%d", next, nextCounter, seed, counter)
+	}
+	if _, err := NewUrlMapping(s.db).GetByCode(deleted); err != ErrLinkNotFound {
+		t.Errorf("GetByCode of the deleted code = %v, want ErrLinkNotFound", err)
+	}
+}
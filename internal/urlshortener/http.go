@@ -1,36 +1,379 @@
 package urlshortener
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"time"
 )
 
-func StartHttpServer(workCh chan<- WorkRequest, shortUrlHost string) {
-	http.HandleFunc("POST /short", func(w http.ResponseWriter, r *http.Request) {
-		req := URLRequest{}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
-			return
+// maxBatchSize caps the number of URLs in one POST /short/batch.
+const maxBatchSize = 100
+
+type HttpConfig struct {
+	// Addr to listen on, ":8080" when empty.
+	Addr         string
+	ShortUrlHost string
+	Health       *Health
+	Interstitial Interstitial
+	// Blocklist screens destinations before they are shortened. Optional.
+	Blocklist *Blocklist
+	// AdminToken guards the /admin API; empty disables it.
+	AdminToken string
+	// BasePath is where the API is mounted when it is served under a
+	// sub-path, such as "/s". Only used to advertise it in the OpenAPI
+	// document; stripping it is up to the caller.
+	BasePath string
+	// Clock timestamps API keys; time.Now when nil.
+	Clock func() time.Time
+	// Codes is the scheme of the short codes, SequentialCodes when nil.
+	Codes CodeScheme
+	// TLS serves HTTPS on Addr instead of plaintext HTTP. Optional.
+	TLS *TLSConfig
+}
+
+type URLResponse struct {
+	ShortenedURL string `json:"shortened_url"`
+	QRCode       string `json:"qr_code,omitempty"`
+}
+
+type BatchRequest struct {
+	URLs []URLRequest `json:"urls"`
+}
+
+// BatchResult holds either the shortened URL or the error for one entry.
+type BatchResult struct {
+	URLResponse
+	Error *APIError `json:"error,omitempty"`
+}
+
+type BatchResponse struct {
+	Results []BatchResult `json:"results"`
+}
+
+// LinkStats is the public view of a url_mapping row.
+type LinkStats struct {
+	Code           string    `json:"code"`
+	ShortURL       string    `json:"short_url"`
+	OriginalURL    string    `json:"original_url"`
+	CreatedAt      time.Time `json:"created_at"`
+	Clicks         int       `json:"clicks"`
+	Interstitial   bool      `json:"interstitial"`
+	Disabled       bool      `json:"disabled"`
+	DisabledReason string    `json:"disabled_reason,omitempty"`
+	Owner          string    `json:"owner,omitempty"`
+	Title          string    `json:"title,omitempty"`
+	Tags           []string  `json:"tags,omitempty"`
+	// Redirect is set for links with redirect rules.
+	Redirect *RedirectRules `json:"redirect,omitempty"`
+	// VariantClicks counts clicks per variant of the link's routes; only
+	// reported by the stats endpoint.
+	VariantClicks map[string]int `json:"variant_clicks,omitempty"`
+	// PasswordProtected and OneTime links hide their destination from the
+	// stats endpoint and from searches without the admin token.
+	PasswordProtected bool `json:"password_protected,omitempty"`
+	OneTime           bool `json:"one_time,omitempty"`
+	// Consumed is set once a one-time link has been followed.
+	Consumed bool `json:"consumed,omitempty"`
+	// Broken is set when the destination failed its last check, described
+	// by LastCheck, which only authenticated callers see.
+	Broken    bool       `json:"broken,omitempty"`
+	LastCheck *LinkCheck `json:"last_check,omitempty"`
+	// DeletedAt and DeletedBy are only seen in the admin list of deleted
+	// links.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	DeletedBy string     `json:"deleted_by,omitempty"`
+}
+
+func newLinkStats(l Link) LinkStats {
+	s := LinkStats{
+		Code:           l.Code,
+		ShortURL:       l.ShortUrl,
+		OriginalURL:    l.OriginalUrl,
+		CreatedAt:      l.CreatedAt,
+		Clicks:         l.Clicks,
+		Interstitial:   l.Interstitial,
+		Disabled:       l.Disabled,
+		DisabledReason: l.DisabledReason,
+		Owner:          l.Owner,
+		Title:          l.Title,
+		Tags:           l.Tags,
+	}
+	if !l.Redirect.IsZero() {
+		s.Redirect = &l.Redirect
+	}
+	s.PasswordProtected = l.PasswordHash != ""
+	s.OneTime = l.OneTime
+	s.Consumed = l.Consumed
+	s.Broken = l.Broken
+	if !l.Check.CheckedAt.IsZero() {
+		s.LastCheck = &l.Check
+	}
+	if !l.DeletedAt.IsZero() {
+		s.DeletedAt = &l.DeletedAt
+		s.DeletedBy = l.DeletedBy
+	}
+	return s
+}
+
+type shortener struct {
+	workCh chan<- WorkRequest
+	cfg    HttpConfig
+}
+
+// shorten screens req and hands it to a worker.
+func (s *shortener) shorten(ctx context.Context, req URLRequest) (URLResponse, *APIError) {
+	requestID := RequestIDFromContext(ctx)
+	logger := loggerFor(requestID)
+
+	if u, err := url.Parse(req.OriginalURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return URLResponse{}, &APIError{Status: http.StatusBadRequest, Code: CodeBadRequest,
+			Message: "original_url must be an absolute http or https URL"}
+	}
+	if rule, blocked := s.cfg.Blocklist.Match(req.OriginalURL); blocked {
+		logger.Warn("destination blocked", "original_url", req.OriginalURL, "rule", rule.String())
+		return URLResponse{}, &APIError{Status: http.StatusForbidden, Code: CodeBlocked, Message: "Destination is blocked"}
+	}
+
+	tags, err := normalizeTags(req.Tags)
+	if err != nil {
+		return URLResponse{}, &APIError{Status: http.StatusBadRequest, Code: CodeBadRequest, Message: err.Error()}
+	}
+	if len(req.Title) > maxTitleLen || len(req.Owner) > maxTitleLen {
+		return URLResponse{}, &APIError{Status: http.StatusBadRequest, Code: CodeBadRequest,
+			Message: fmt.Sprintf("owner and title are limited to %d bytes", maxTitleLen)}
+	}
+	var rules RedirectRules
+	if req.Redirect != nil {
+		if err := req.Redirect.Validate(); err != nil {
+			return URLResponse{}, &APIError{Status: http.StatusBadRequest, Code: CodeBadRequest, Message: err.Error()}
+		}
+		rules = *req.Redirect
+		for _, rt := range rules.Routes {
+			for _, v := range rt.Variants {
+				if rule, blocked := s.cfg.Blocklist.Match(v.URL); blocked {
+					logger.Warn("destination blocked", "original_url", v.URL, "rule", rule.String())
+					return URLResponse{}, &APIError{Status: http.StatusForbidden, Code: CodeBlocked, Message: "Destination is blocked"}
+				}
+			}
+		}
+	}
+
+	var passwordHash string
+	if req.Password != "" {
+		if len(req.Password) > maxPasswordLen {
+			return URLResponse{}, &APIError{Status: http.StatusBadRequest, Code: CodeBadRequest,
+				Message: fmt.Sprintf("password is limited to %d bytes", maxPasswordLen)}
+		}
+		if passwordHash, err = hashPassword(req.Password); err != nil {
+			logger.Error("hashing link password", "err", err)
+			return URLResponse{}, &APIError{Status: http.StatusInternalServerError, Code: CodeInternal, Message: "Failed to shorten URL"}
 		}
+	}
 
-		doneCh := make(chan WorkResponse, 1)
+	doneCh := make(chan WorkResponse, 1)
+	s.workCh <- WorkRequest{
+		OriginalUrl:  req.OriginalURL,
+		ShortUrlHost: s.cfg.ShortUrlHost,
+		Codes:        s.cfg.Codes,
+		Options: LinkOptions{
+			Interstitial: req.Interstitial,
+			Owner:        req.Owner,
+			Title:        req.Title,
+			Tags:         tags,
+			Redirect:     rules,
+			PasswordHash: passwordHash,
+			OneTime:      req.OneTime,
+			CreatedBy:    actorFromContext(ctx),
+		},
+		RequestID: requestID,
+		DoneCh:    doneCh,
+	}
+	resp := <-doneCh
+	if errors.Is(resp.Err, ErrNoSeeds) {
+		return URLResponse{}, &APIError{Status: http.StatusServiceUnavailable, Code: CodeUnavailable, Message: "No capacity to shorten URLs"}
+	}
+	if resp.Err != nil {
+		// the worker already logged the cause
+		return URLResponse{}, &APIError{Status: http.StatusInternalServerError, Code: CodeInternal, Message: "Failed to shorten URL"}
+	}
 
-		work := WorkRequest{
-			OriginalUrl:  req.OriginalURL,
-			ShortUrlHost: shortUrlHost,
-			DoneCh:       doneCh,
+	body := URLResponse{ShortenedURL: resp.ShortUrl}
+	if req.QR {
+		uri, err := qrDataURI(resp.ShortUrl)
+		if err != nil {
+			logger.Error("encoding qr code", "short_url", resp.ShortUrl, "err", err)
+			return URLResponse{}, &APIError{Status: http.StatusInternalServerError, Code: CodeInternal, Message: "Failed to encode QR code"}
 		}
-		workCh <- work
-		resp := <-doneCh
-		if resp.Err != nil {
-			http.Error(w, fmt.Sprintf("Failed to shorten URL: %v", resp.Err), http.StatusInternalServerError)
+		body.QRCode = uri
+	}
+	return body, nil
+}
+
+func (s *shortener) handleShort(w http.ResponseWriter, r *http.Request) {
+	req := URLRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "Invalid request body")
+		return
+	}
+
+	body, apiErr := s.shorten(r.Context(), req)
+	if apiErr != nil {
+		writeAPIError(w, r, apiErr)
+		return
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+// handleBatch shortens up to maxBatchSize URLs concurrently. Entries fail
+// independently, so the response is 200 with an error per failed entry.
+func (s *shortener) handleBatch(w http.ResponseWriter, r *http.Request) {
+	req := BatchRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.URLs) == 0 {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "Invalid request body")
+		return
+	}
+	if len(req.URLs) > maxBatchSize {
+		writeError(w, r, http.StatusRequestEntityTooLarge, CodeTooLarge, fmt.Sprintf("At most %d URLs per batch", maxBatchSize))
+		return
+	}
+
+	results := make([]BatchResult, len(req.URLs))
+	done := make(chan struct{})
+	for i, u := range req.URLs {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			body, apiErr := s.shorten(r.Context(), u)
+			if apiErr != nil {
+				apiErr.RequestID = RequestIDFromContext(r.Context())
+				results[i].Error = apiErr
+				return
+			}
+			results[i].URLResponse = body
+		}()
+	}
+	for range req.URLs {
+		<-done
+	}
+
+	writeJSON(w, http.StatusOK, BatchResponse{Results: results})
+}
+
+// hideDestination blanks where a password-protected or one-time link leads,
+// which would otherwise be learnt without the password or without using the
+// link up.
+func (s *LinkStats) hideDestination() {
+	if s.PasswordProtected || s.OneTime {
+		s.OriginalURL, s.Redirect = "", nil
+	}
+}
+
+func handleStats(links *UrlMapping) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		link, err := links.GetByCode(r.PathValue("code"))
+		if err != nil {
+			if errors.Is(err, ErrLinkNotFound) {
+				writeError(w, r, http.StatusNotFound, CodeNotFound, "Link not found")
+				return
+			}
+			loggerFor(RequestIDFromContext(r.Context())).Error("looking up link", "err", err)
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to look up link")
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"shortened_url": resp.ShortUrl})
+		// the endpoint is public; the check results, which tell how the
+		// destination answered the checker, are in the admin list
+		stats := newLinkStats(link)
+		stats.LastCheck = nil
+		stats.hideDestination()
+		if len(link.Redirect.Routes) > 0 {
+			if stats.VariantClicks, err = links.VariantClicks(link.Code); err != nil {
+				loggerFor(RequestIDFromContext(r.Context())).Error("looking up variant clicks", "err", err)
+				writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to look up link")
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, stats)
+	}
+}
+
+// NewHandler returns the shortener's HTTP API on its own mux, together with
+// its OpenAPI document at GET /openapi.json and the web UI under /ui/.
+func NewHandler(db *sql.DB, workCh chan<- WorkRequest, cfg HttpConfig) http.Handler {
+	keys := NewAPIKeys(db)
+	mux := http.NewServeMux()
+
+	routes := apiRoutes(db, workCh, cfg)
+	routes = append(routes, apiRoute{
+		method: "GET", path: "/openapi.json", summary: "This document",
+		responses: responses(ok(map[string]any{})),
 	})
+	doc := openAPIDoc(routes, cfg.BasePath)
+	routes[len(routes)-1].handler = func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, doc)
+	}
 
-	log.Fatal(http.ListenAndServe(":8080", nil)) // nil uses the default ServeMux
+	for _, rt := range routes {
+		h := rt.handler
+		switch rt.auth {
+		case authAPIKey:
+			h = requireAPIKey(keys, cfg.AdminToken, true, h)
+		case authKeyRequired:
+			h = requireAPIKey(keys, cfg.AdminToken, false, h)
+		case authAdmin:
+			h = requireAdmin(cfg.AdminToken, h)
+		}
+		mux.HandleFunc(rt.pattern(), h)
+	}
+	registerUI(mux)
+	return withRequestID(mux)
+}
+
+func StartHttpServer(db *sql.DB, workCh chan<- WorkRequest, cfg HttpConfig) {
+	addr := cfg.Addr
+	if addr == "" {
+		addr = ":8080"
+	}
+	h := NewHandler(db, workCh, cfg)
+	if cfg.TLS == nil {
+		slog.Info("http server listening", "addr", addr)
+		srv := &http.Server{Addr: addr, Handler: h, ReadHeaderTimeout: 10 * time.Second}
+		err := srv.ListenAndServe()
+		slog.Error("http server stopped", "err", err)
+		os.Exit(1)
+	}
+
+	srv, certs, err := cfg.TLS.server(h)
+	if err != nil {
+		slog.Error("http server stopped", "err", err)
+		os.Exit(1)
+	}
+	go certs.Watch(context.Background(), cfg.TLS.reloadInterval())
+	if cfg.TLS.RedirectAddr != "" {
+		// bound before serving HTTPS, so that a taken port stops the start
+		ln, err := net.Listen("tcp", cfg.TLS.RedirectAddr)
+		if err != nil {
+			slog.Error("listening for https redirects", "addr", cfg.TLS.RedirectAddr, "err", err)
+			os.Exit(1)
+		}
+		_, port, _ := net.SplitHostPort(addr)
+		redirect := &http.Server{Handler: redirectToHTTPS(port), ReadHeaderTimeout: 10 * time.Second}
+		slog.Info("https redirect listener", "addr", ln.Addr().String())
+		go func() {
+			err := redirect.Serve(ln)
+			slog.Error("https redirect listener stopped", "err", err)
+			os.Exit(1)
+		}()
+	}
+	srv.Addr = addr
+	slog.Info("https server listening", "addr", addr)
+	err = srv.ListenAndServeTLS("", "")
+	slog.Error("http server stopped", "err", err)
+	os.Exit(1)
 }
@@ -0,0 +1,315 @@
+package urlshortener
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// LinkCheck is the outcome of the last request the link checker sent to a
+// link's destination.
+type LinkCheck struct {
+	// Status is the HTTP status of the response; 0 if there was none.
+	Status    int       `json:"status,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// brokenStatus reports whether a destination answering with status is
+// broken. Servers refusing the checker itself (401, 403 and 429) get the
+// benefit of the doubt.
+func brokenStatus(status int) bool {
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests:
+		return false
+	}
+	return status >= 400
+}
+
+type LinkCheckerConfig struct {
+	// Client sends the checks and, like a browser, follows redirects. The
+	// default one refuses to connect to addresses that are not public, see
+	// publicOnly; a Client set here has to guard against that itself.
+	Client *http.Client
+	// Interval is how long a check stays fresh, a day by default.
+	Interval time.Duration
+	// PollInterval is how often due links are looked for, a minute by
+	// default.
+	PollInterval time.Duration
+	// Concurrency caps the checks in flight, 8 by default, and PerHost those
+	// to any one host, 2 by default.
+	Concurrency int
+	PerHost     int
+	Now         func() time.Time
+}
+
+// publicClient returns the default checker client. Anyone who can shorten a
+// link picks what it requests, so every connection, including those of
+// redirects, goes through publicOnly, and proxies from the environment are
+// not used since they would connect on the checker's behalf.
+func publicClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 5 * time.Second, Control: publicOnly}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: 10 * time.Second, Transport: transport}
+}
+
+var errNonPublicAddr = errors.New("destination address is not public")
+
+// nonPublicPrefixes are ranges that net/netip does not classify but that do
+// not lead to the public internet either.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"), // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"), // NAT64, embeds any IPv4 address
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("2002::/16"), // 6to4, likewise
+}
+
+// publicOnly is a net.Dialer Control function refusing connections to
+// loopback, private, link-local (which holds cloud metadata endpoints),
+// multicast and reserved addresses. It runs after name resolution, on the
+// address actually dialed, so a name resolving to such an address is refused
+// too.
+func publicOnly(network, address string, _ syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errNonPublicAddr, address)
+	}
+	if !publicAddr(ap.Addr()) {
+		return fmt.Errorf("%w: %s", errNonPublicAddr, ap.Addr())
+	}
+	return nil
+}
+
+func publicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, p := range nonPublicPrefixes {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// LinkChecker periodically requests the destinations of enabled links and
+// records the outcome, marking links whose destination is gone as broken.
+// Only the original URL is checked, not the variants of redirect routes.
+type LinkChecker struct {
+	db     *sql.DB
+	cfg    LinkCheckerConfig
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newLinkChecker(db *sql.DB, cfg LinkCheckerConfig) *LinkChecker {
+	if cfg.Client == nil {
+		cfg.Client = publicClient()
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 24 * time.Hour
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = time.Minute
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 8
+	}
+	if cfg.PerHost <= 0 {
+		cfg.PerHost = 2
+	}
+	if cfg.Now == nil {
+		cfg.Now = time.Now
+	}
+	return &LinkChecker{db: db, cfg: cfg}
+}
+
+func StartLinkChecker(db *sql.DB, cfg LinkCheckerConfig) *LinkChecker {
+	c := newLinkChecker(db, cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel, c.done = cancel, make(chan struct{})
+	go func() {
+		defer close(c.done)
+		c.run(ctx)
+	}()
+	return c
+}
+
+// Stop aborts the checks in flight, without recording them, and waits for
+// the checker to exit.
+func (c *LinkChecker) Stop() {
+	c.cancel()
+	<-c.done
+}
+
+const checkBatch = 100
+
+func (c *LinkChecker) run(ctx context.Context) {
+	ticker := time.NewTicker(c.cfg.PollInterval)
+	defer ticker.Stop()
+	for {
+		n, err := c.checkDue(ctx, checkBatch)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("checking link destinations", "err", err)
+		}
+		if n == checkBatch {
+			continue
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+type dueLink struct {
+	seed    string
+	counter int
+	dest    string
+}
+
+// checkDue checks up to limit links never checked or last checked more than
+// an Interval ago, oldest first, and returns how many it checked.
+func (c *LinkChecker) checkDue(ctx context.Context, limit int) (int, error) {
+	now := c.cfg.Now().UTC()
+	rows, err := c.db.QueryContext(ctx, `
+SELECT seed, counter, original_url FROM url_mapping
+WHERE disabled = 0 AND consumed_at IS NULL AND deleted_at IS NULL AND (checked_at IS NULL OR checked_at <= ?)
+ORDER BY checked_at IS NOT NULL, checked_at LIMIT ?`, now.Add(-c.cfg.Interval), limit)
+	if err != nil {
+		return 0, fmt.Errorf("selecting links to check: %w", err)
+	}
+	byHost := map[string][]dueLink{}
+	n := 0
+	for rows.Next() {
+		var l dueLink
+		if err := rows.Scan(&l.seed, &l.counter, &l.dest); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("scanning link row: %w", err)
+		}
+		host := ""
+		if u, err := url.Parse(l.dest); err == nil {
+			host = strings.ToLower(u.Host)
+		}
+		byHost[host] = append(byHost[host], l)
+		n++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("iterating link rows: %w", err)
+	}
+
+	// PerHost goroutines drain each host's queue, taking a slot of the
+	// global limit for every request.
+	slots := make(chan struct{}, c.cfg.Concurrency)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	broken := 0
+	for _, due := range byHost {
+		queue := make(chan dueLink, len(due))
+		for _, l := range due {
+			queue <- l
+		}
+		close(queue)
+		for range min(c.cfg.PerHost, len(due)) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for l := range queue {
+					select {
+					case slots <- struct{}{}:
+					case <-ctx.Done():
+						return
+					}
+					bad, err := c.check(ctx, l)
+					<-slots
+					if err != nil {
+						if ctx.Err() == nil {
+							slog.Error("recording link check", "seed", l.seed, "counter", l.counter, "err", err)
+						}
+						continue
+					}
+					if bad {
+						mu.Lock()
+						broken++
+						mu.Unlock()
+					}
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return n, err
+	}
+	if n > 0 {
+		slog.Info("link destinations checked", "checked", n, "broken", broken)
+	}
+	return n, nil
+}
+
+// check requests the destination of l and records the outcome, reporting
+// whether the link is broken.
+func (c *LinkChecker) check(ctx context.Context, l dueLink) (bool, error) {
+	status, err := c.probe(ctx, l.dest)
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	res := LinkCheck{Status: status, CheckedAt: c.cfg.Now().UTC()}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	broken := err != nil || brokenStatus(status)
+	if broken {
+		slog.Debug("broken link destination", "seed", l.seed, "counter", l.counter, "status", status, "err", err)
+	}
+	_, err = c.db.Exec(
+		"UPDATE url_mapping SET check_status = ?, check_error = ?, checked_at = ?, broken = ? WHERE seed = ? AND counter = ?",
+		res.Status, res.Error, res.CheckedAt, broken, l.seed, l.counter,
+	)
+	return broken, err
+}
+
+// probe sends a HEAD request, and a GET if the answer is an error, as some
+// servers do not implement HEAD or answer it differently.
+func (c *LinkChecker) probe(ctx context.Context, dest string) (int, error) {
+	status, err := c.request(ctx, http.MethodHead, dest)
+	if err != nil || status < 400 {
+		return status, err
+	}
+	return c.request(ctx, http.MethodGet, dest)
+}
+
+func (c *LinkChecker) request(ctx context.Context, method, dest string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, dest, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("User-Agent", "urlshortener-linkcheck")
+	resp, err := c.cfg.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,285 @@
+package urlshortener
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBrokenStatus(t *testing.T) {
+	for status, want := range map[int]bool{200: false, 204: false, 301: false, 401: false, 403: false, 429: false, 400: true, 404: true, 410: true, 500: true, 503: true} {
+		if got := brokenStatus(status); got != want {
+			t.Errorf("brokenStatus(%d) = %v, want %v", status, got, want)
+		}
+	}
+}
+
+// destinations stands in for the sites links point to.
+func destinations(t *testing.T) (*httptest.Server, *sync.Map) {
+	t.Helper()
+	var hits sync.Map // "METHOD /path" -> *atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := hits.LoadOrStore(r.Method+" "+r.URL.Path, new(atomic.Int32))
+		n.(*atomic.Int32).Add(1)
+		switch r.URL.Path {
+		case "/ok":
+		case "/moved":
+			http.Redirect(w, r, "/ok", http.StatusMovedPermanently)
+		case "/no-head":
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			}
+		case "/bot-wall":
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+func hitCount(hits *sync.Map, key string) int32 {
+	if n, ok := hits.Load(key); ok {
+		return n.(*atomic.Int32).Load()
+	}
+	return 0
+}
+
+func TestLinkChecker(t *testing.T) {
+	db, err := InitDBAt(filepath.Join(t.TempDir(), "check.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	dest, hits := destinations(t)
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	links := NewUrlMapping(db)
+	paths := []string{dest.URL + "/ok", dest.URL + "/moved", dest.URL + "/no-head", dest.URL + "/bot-wall", dest.URL + "/gone", down.URL + "/x"}
+	for i, p := range paths {
+		if err := links.Create(p, fmt.Sprintf("https://sho.rt/%d", i), "aaa", i+1, LinkOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := links.Create(dest.URL+"/disabled", "https://sho.rt/disabled", "aaa", 100, LinkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := links.DisableMatching("test", func(d string) (string, bool) { return "test", d == dest.URL+"/disabled" }); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	checker := newLinkChecker(db, LinkCheckerConfig{Client: dest.Client(), Interval: time.Hour, Now: func() time.Time { return now }})
+	if n, err := checker.checkDue(context.Background(), 100); err != nil || n != len(paths) {
+		t.Fatalf("checkDue = %d, %v; want %d", n, err, len(paths))
+	}
+
+	for i, want := range []struct {
+		status int
+		broken bool
+	}{{200, false}, {200, false}, {200, false}, {403, false}, {404, true}, {0, true}} {
+		link, err := links.GetByCode(encodeCode("aaa", i+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if link.Check.Status != want.status || link.Broken != want.broken || !link.Check.CheckedAt.Equal(now) {
+			t.Errorf("%s: status %d, broken %v, checked at %v", paths[i], link.Check.Status, link.Broken, link.Check.CheckedAt)
+		}
+		if (link.Check.Error != "") != (want.status == 0) {
+			t.Errorf("%s: error %q", paths[i], link.Check.Error)
+		}
+	}
+	if hitCount(hits, "GET /ok") != 0 || hitCount(hits, "GET /no-head") != 1 || hitCount(hits, "HEAD /disabled") != 0 {
+		t.Error("checker sent GET to a destination handling HEAD, or skipped the GET fallback, or checked a disabled link")
+	}
+
+	if n, _ := checker.checkDue(context.Background(), 100); n != 0 {
+		t.Errorf("re-checked %d fresh links", n)
+	}
+	now = now.Add(time.Hour)
+	if n, _ := checker.checkDue(context.Background(), 2); n != 2 {
+		t.Errorf("checked %d stale links, want the batch of 2", n)
+	}
+}
+
+func TestLinkCheckerPerHostLimit(t *testing.T) {
+	db, err := InitDBAt(filepath.Join(t.TempDir(), "check.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var inFlight, peak atomic.Int32
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer slow.Close()
+
+	links := NewUrlMapping(db)
+	for i := range 10 {
+		if err := links.Create(slow.URL+"/page", fmt.Sprintf("https://sho.rt/%d", i), "aaa", i+1, LinkOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checker := newLinkChecker(db, LinkCheckerConfig{Client: slow.Client(), PerHost: 3, Concurrency: 8})
+	if n, err := checker.checkDue(context.Background(), 100); err != nil || n != 10 {
+		t.Fatalf("checkDue = %d, %v", n, err)
+	}
+	if p := peak.Load(); p > 3 || p < 2 {
+		t.Errorf("peak of %d requests to one host, want up to 3", p)
+	}
+}
+
+func TestBrokenLinksAPI(t *testing.T) {
+	dest, _ := destinations(t)
+	srv, err := NewServer(
+		WithDBPath(filepath.Join(t.TempDir(), "api.db")),
+		WithWorkers(1),
+		WithWebhooks(WebhookConfig{}, 0),
+		WithHttpConfig(HttpConfig{ShortUrlHost: "sho.rt", AdminToken: "secret"}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown(context.Background())
+	api := httptest.NewServer(srv.Handler())
+	defer api.Close()
+
+	good := createLink(t, api.URL, `{"original_url":"`+dest.URL+`/ok"}`)
+	gone := createLink(t, api.URL, `{"original_url":"`+dest.URL+`/gone"}`)
+	if n, err := newLinkChecker(srv.DB(), LinkCheckerConfig{Client: dest.Client()}).checkDue(context.Background(), 100); err != nil || n != 2 {
+		t.Fatalf("checkDue = %d, %v", n, err)
+	}
+
+	list := func(query string) []LinkStats {
+		req, _ := http.NewRequest("GET", api.URL+"/admin/links"+query, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var res LinkList
+		json.NewDecoder(resp.Body).Decode(&res)
+		return res.Links
+	}
+	if got := list("?broken=true"); len(got) != 1 || got[0].Code != gone || !got[0].Broken || got[0].LastCheck.Status != 404 {
+		t.Errorf("broken links = %+v, want only %s", got, gone)
+	}
+	if got := list(""); len(got) != 2 {
+		t.Errorf("listed %d links, want 2", len(got))
+	}
+	if stats := getStats(t, api.URL, good); stats.Broken || stats.LastCheck != nil {
+		t.Errorf("public stats of a working link = %+v", stats)
+	}
+	if stats := getStats(t, api.URL, gone); !stats.Broken || stats.LastCheck != nil {
+		t.Errorf("public stats of a broken link = %+v, want broken without the check", stats)
+	}
+
+	search := func(auth string) []LinkStats {
+		req, _ := http.NewRequest("GET", api.URL+"/links/search", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", "Bearer "+auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var res LinkList
+		json.NewDecoder(resp.Body).Decode(&res)
+		return res.Links
+	}
+	for _, l := range search("secret") {
+		if l.LastCheck == nil {
+			t.Errorf("admin search hides the check of %s", l.Code)
+		}
+	}
+}
+
+func TestPublicOnly(t *testing.T) {
+	for _, tc := range []struct {
+		addr   string
+		public bool
+	}{
+		{"93.184.215.14:443", true},
+		{"[2606:2800:21f:cb07:6820:80da:af6b:8b2c]:80", true},
+		{"127.0.0.1:80", false},
+		{"[::1]:80", false},
+		{"10.1.2.3:80", false},
+		{"172.16.0.1:80", false},
+		{"192.168.1.1:80", false},
+		{"169.254.169.254:80", false}, // cloud metadata
+		{"[fd00:ec2::254]:80", false}, // cloud metadata over IPv6
+		{"[fe80::1]:80", false},
+		{"100.64.0.1:80", false},
+		{"0.0.0.0:80", false},
+		{"[::]:80", false},
+		{"[::ffff:127.0.0.1]:80", false},
+		{"[64:ff9b::a00:1]:80", false},
+		{"224.0.0.1:80", false},
+		{"255.255.255.255:80", false},
+		{"localhost:80", false},
+	} {
+		err := publicOnly("tcp", tc.addr, nil)
+		if (err == nil) != tc.public {
+			t.Errorf("publicOnly(%s) = %v, want public %v", tc.addr, err, tc.public)
+		}
+	}
+}
+
+func TestLinkCheckerRefusesNonPublicDestinations(t *testing.T) {
+	var hits atomic.Int32
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	defer internal.Close()
+
+	db, err := InitDBAt(filepath.Join(t.TempDir(), "ssrf.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	links := NewUrlMapping(db)
+	// by address, and by a name resolving to loopback
+	dests := []string{internal.URL + "/admin", strings.Replace(internal.URL, "127.0.0.1", "localhost", 1) + "/admin"}
+	for i, dest := range dests {
+		if err := links.Create(dest, fmt.Sprintf("https://sho.rt/%d", i), "aaa", i+1, LinkOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n, err := newLinkChecker(db, LinkCheckerConfig{}).checkDue(context.Background(), 100); err != nil || n != len(dests) {
+		t.Fatalf("checkDue = %d, %v", n, err)
+	}
+	if n := hits.Load(); n != 0 {
+		t.Errorf("the checker reached a loopback server %d times", n)
+	}
+	for i := range dests {
+		link, err := links.GetByCode(SequentialCodes{}.Encode("aaa", i+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !link.Broken || !strings.Contains(link.Check.Error, errNonPublicAddr.Error()) {
+			t.Errorf("check of %s = %+v, broken %v", dests[i], link.Check, link.Broken)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package urlshortener
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RequestIDHeader carries the request ID back to the caller so a response can
+// be matched with the log lines it produced.
+const RequestIDHeader = "X-Request-ID"
+
+type ctxKey int
+
+const (
+	requestIDKey ctxKey = iota
+	actorKey
+)
+
+// NewLogger returns a JSON logger suitable for slog.SetDefault.
+func NewLogger(w io.Writer) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(w, nil))
+}
+
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// withActor records who is making the request, for the history of the links
+// it changes: "admin" for the admin token, "key:<id>" for an API key.
+func withActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey, actor)
+}
+
+// actorFromContext returns the actor set by withActor, "anonymous" if there
+// is none.
+func actorFromContext(ctx context.Context) string {
+	if actor, _ := ctx.Value(actorKey).(string); actor != "" {
+		return actor
+	}
+	return "anonymous"
+}
+
+// loggerFor returns the default logger tagged with the request ID, if any.
+func loggerFor(requestID string) *slog.Logger {
+	if requestID == "" {
+		return slog.Default()
+	}
+	return slog.Default().With("request_id", requestID)
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// withRequestID assigns every request an ID, exposes it in the X-Request-ID
+// response header and logs the request once it has been served.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := uuid.New().String()
+		w.Header().Set(RequestIDHeader, id)
+
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r.WithContext(WithRequestID(r.Context(), id)))
+
+		loggerFor(id).Info("http request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", sw.status,
+			"duration_ms", time.Since(start).Milliseconds(),
+		)
+	})
+}
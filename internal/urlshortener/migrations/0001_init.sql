@@ -1,6 +1,3 @@
--- Enable Write-Ahead Logging for better concurrency
-PRAGMA journal_mode = WAL;
-
 -- Seeds Table
 CREATE TABLE IF NOT EXISTS seeds (
     seed TEXT PRIMARY KEY, -- 24-bit value
@@ -0,0 +1,3 @@
+-- Click counting and per-link interstitial (preview) mode
+ALTER TABLE url_mapping ADD COLUMN clicks INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE url_mapping ADD COLUMN interstitial INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,3 @@
+-- Links can be disabled, e.g. when their destination is blocklisted
+ALTER TABLE url_mapping ADD COLUMN disabled INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE url_mapping ADD COLUMN disabled_reason TEXT NOT NULL DEFAULT '';
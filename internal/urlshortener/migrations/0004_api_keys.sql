@@ -0,0 +1,8 @@
+-- API keys for link creation. Only a hash of each key is stored.
+CREATE TABLE IF NOT EXISTS api_keys (
+    id TEXT PRIMARY KEY, -- public prefix of the key
+    name TEXT NOT NULL,
+    key_hash TEXT NOT NULL UNIQUE,
+    created_at DATETIME NOT NULL,
+    revoked_at DATETIME NULL
+);
@@ -0,0 +1,17 @@
+-- Who created a link and what it is for, to search links by team or campaign.
+-- The full-text index over titles needs FTS5 and is set up outside the
+-- migrations, see search.go.
+ALTER TABLE url_mapping ADD COLUMN owner TEXT NOT NULL DEFAULT '';
+ALTER TABLE url_mapping ADD COLUMN title TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS idx_owner ON url_mapping (owner);
+CREATE INDEX IF NOT EXISTS idx_created_at ON url_mapping (created_at);
+
+CREATE TABLE IF NOT EXISTS link_tags (
+    seed INTEGER NOT NULL, -- same affinity as url_mapping.seed
+    counter INTEGER NOT NULL,
+    tag TEXT NOT NULL,
+    PRIMARY KEY (seed, counter, tag)
+);
+
+CREATE INDEX IF NOT EXISTS idx_link_tags_tag ON link_tags (tag);
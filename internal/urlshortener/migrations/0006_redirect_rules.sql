@@ -0,0 +1,3 @@
+-- Per-link rewriting of the destination at redirect time, as JSON
+-- (see RedirectRules); empty for plain redirects.
+ALTER TABLE url_mapping ADD COLUMN redirect_rules TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,9 @@
+-- Clicks per variant of links with conditional routes (see routes.go); the
+-- total stays in url_mapping.clicks.
+CREATE TABLE IF NOT EXISTS link_variant_clicks (
+    seed INTEGER NOT NULL, -- same affinity as url_mapping.seed
+    counter INTEGER NOT NULL,
+    variant TEXT NOT NULL,
+    clicks INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (seed, counter, variant)
+);
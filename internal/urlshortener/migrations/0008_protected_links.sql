@@ -0,0 +1,5 @@
+-- Password-protected links store a PBKDF2 hash of the password (see
+-- protect.go); one-time links are consumed by their first redirect.
+ALTER TABLE url_mapping ADD COLUMN password_hash TEXT NOT NULL DEFAULT '';
+ALTER TABLE url_mapping ADD COLUMN one_time INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE url_mapping ADD COLUMN consumed_at TIMESTAMP;
@@ -0,0 +1,27 @@
+-- Webhook endpoints and the outbox of their deliveries. Events are written
+-- to the outbox in the transaction of the change they report, one row per
+-- subscribed endpoint, and sent by the webhook workers (see webhooks.go).
+CREATE TABLE IF NOT EXISTS webhooks (
+    id TEXT PRIMARY KEY,
+    url TEXT NOT NULL,
+    secret TEXT NOT NULL, -- HMAC key, needed in plain text to sign
+    events TEXT NOT NULL DEFAULT '', -- comma-separated; empty for all
+    click_thresholds TEXT NOT NULL DEFAULT '', -- comma-separated
+    created_at DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS webhook_outbox (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    webhook_id TEXT NOT NULL,
+    event TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at DATETIME NOT NULL,
+    last_error TEXT NOT NULL DEFAULT '',
+    delivered_at DATETIME NULL,
+    failed_at DATETIME NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_outbox_pending ON webhook_outbox (next_attempt_at)
+    WHERE delivered_at IS NULL AND failed_at IS NULL;
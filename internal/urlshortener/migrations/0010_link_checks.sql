@@ -0,0 +1,8 @@
+-- Outcome of the last request the link checker (see linkcheck.go) sent to
+-- each destination. checked_at is NULL until the first check.
+ALTER TABLE url_mapping ADD COLUMN check_status INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE url_mapping ADD COLUMN check_error TEXT NOT NULL DEFAULT '';
+ALTER TABLE url_mapping ADD COLUMN checked_at DATETIME NULL;
+ALTER TABLE url_mapping ADD COLUMN broken INTEGER NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS idx_checked_at ON url_mapping (checked_at);
@@ -0,0 +1,28 @@
+-- Links are soft deleted: the row stays, so its seed and counter, and with
+-- them its short code, are never handed out again. Every change to a link is
+-- recorded in url_mapping_history (see history.go).
+ALTER TABLE url_mapping ADD COLUMN deleted_at DATETIME NULL;
+ALTER TABLE url_mapping ADD COLUMN deleted_by TEXT NOT NULL DEFAULT '';
+
+CREATE TRIGGER IF NOT EXISTS url_mapping_soft_delete BEFORE DELETE ON url_mapping
+BEGIN
+    SELECT RAISE(ABORT, 'url_mapping rows are soft deleted, set deleted_at instead');
+END;
+
+CREATE TABLE IF NOT EXISTS url_mapping_history (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    seed TEXT NOT NULL,
+    counter INTEGER NOT NULL,
+    action TEXT NOT NULL, -- created, disabled, deleted or restored
+    actor TEXT NOT NULL DEFAULT '',
+    at DATETIME NOT NULL,
+    old_url TEXT NOT NULL DEFAULT '',
+    new_url TEXT NOT NULL DEFAULT '',
+    reason TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS idx_url_mapping_history_link ON url_mapping_history (seed, counter, id);
+
+-- links created before the history was kept
+INSERT INTO url_mapping_history (seed, counter, action, at, new_url)
+SELECT seed, counter, 'created', created_at, original_url FROM url_mapping ORDER BY rowid;
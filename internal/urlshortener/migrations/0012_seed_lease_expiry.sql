@@ -0,0 +1,4 @@
+-- Leases handed out by the seed service (see seedservice.go) expire, in unix
+-- seconds, unless the holder renews them, and are then reclaimed. Leases
+-- taken from the local database keep a NULL expiry and never expire.
+ALTER TABLE seeds ADD COLUMN lease_expires INTEGER NULL;
@@ -0,0 +1,6 @@
+//go:build !sqlite_fts5
+
+package urlshortener
+
+// Without FTS5 title search falls back to matching every word with LIKE.
+const hasFTS5 = false
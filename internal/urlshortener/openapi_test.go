@@ -0,0 +1,196 @@
+package urlshortener
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func newTestAPI(t *testing.T) *httptest.Server {
+	t.Helper()
+	db, err := InitDBAt(filepath.Join(t.TempDir(), "api.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	workCh := make(chan WorkRequest)
+	seedCh := make(chan SeedRequest)
+	go Manager(db, seedCh)
+	workers := StartWorkers(db, workCh, seedCh, 1)
+	srv := httptest.NewServer(NewHandler(db, workCh, HttpConfig{
+		ShortUrlHost: "sho.rt",
+		Health:       NewHealth(db, workers, 0),
+		AdminToken:   "secret",
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	srv := newTestAPI(t)
+
+	resp, err := http.Get(srv.URL + "/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	var doc struct {
+		OpenAPI    string                               `json:"openapi"`
+		Paths      map[string]map[string]map[string]any `json:"paths"`
+		Components struct {
+			Schemas         map[string]any `json:"schemas"`
+			SecuritySchemes map[string]any `json:"securitySchemes"`
+		} `json:"components"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.OpenAPI != "3.0.3" {
+		t.Errorf("openapi = %q", doc.OpenAPI)
+	}
+
+	want := []string{
+		"GET /healthz", "GET /readyz", "GET /openapi.json",
+		"POST /short", "POST /short/batch", "GET /links/search",
+		"GET /{code}", "GET /{code}/qr", "GET /{code}/stats",
+		"GET /admin/blocklist", "POST /admin/blocklist/enforce",
+		"GET /admin/links", "GET /admin/seeds",
+		"GET /admin/keys", "POST /admin/keys", "DELETE /admin/keys/{id}",
+	}
+	for _, w := range want {
+		method, path, _ := strings.Cut(w, " ")
+		if doc.Paths[path][strings.ToLower(method)] == nil {
+			t.Errorf("%s is not documented", w)
+		}
+	}
+
+	placeholder := regexp.MustCompile(`\{(\w+)\}`)
+	for path, ops := range doc.Paths {
+		for method, op := range ops {
+			name := strings.ToUpper(method) + " " + path
+
+			declared := map[string]bool{}
+			params, _ := op["parameters"].([]any)
+			for _, p := range params {
+				p := p.(map[string]any)
+				if p["in"] == "path" {
+					declared[p["name"].(string)] = true
+				}
+			}
+			for _, m := range placeholder.FindAllStringSubmatch(path, -1) {
+				if !declared[m[1]] {
+					t.Errorf("%s: path parameter %s not declared", name, m[1])
+				}
+			}
+
+			responses, _ := op["responses"].(map[string]any)
+			if len(responses) == 0 {
+				t.Errorf("%s: no responses", name)
+			}
+			for status, r := range responses {
+				if status < "400" || path == "/readyz" {
+					continue // readyz reports its checks when unavailable
+				}
+				schema := jsonPath(r, "content", "application/json", "schema", "$ref")
+				if schema != "#/components/schemas/ErrorResponse" {
+					t.Errorf("%s: %s response is %v, want ErrorResponse", name, status, schema)
+				}
+			}
+
+			if sec, ok := op["security"].([]any); ok {
+				for _, s := range sec {
+					for scheme := range s.(map[string]any) {
+						if doc.Components.SecuritySchemes[scheme] == nil {
+							t.Errorf("%s: unknown security scheme %s", name, scheme)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	// every $ref points at a schema that exists
+	raw, _ := json.Marshal(doc)
+	for _, m := range regexp.MustCompile(`"\$ref":"#/components/schemas/(\w+)"`).FindAllStringSubmatch(string(raw), -1) {
+		if doc.Components.Schemas[m[1]] == nil {
+			t.Errorf("dangling $ref to %s", m[1])
+		}
+	}
+
+	// the preview's continue parameter carries a signed token
+	params, _ := doc.Paths["/{code}"]["get"]["parameters"].([]any)
+	for _, p := range params {
+		if jsonPath(p, "name") == "continue" {
+			if typ := jsonPath(p, "schema", "type"); typ != "string" {
+				t.Errorf("continue parameter has type %v, want string", typ)
+			}
+		}
+	}
+
+	// embedded structs are flattened
+	if jsonPath(doc.Components.Schemas["NewAPIKey"], "properties", "id") == nil {
+		t.Error("NewAPIKey schema lacks the embedded APIKey fields")
+	}
+}
+
+// jsonPath walks nested JSON objects along keys.
+func jsonPath(v any, keys ...string) any {
+	for _, k := range keys {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = m[k]
+	}
+	return v
+}
+
+func TestErrorEnvelope(t *testing.T) {
+	srv := newTestAPI(t)
+
+	for _, tc := range []struct {
+		method, path, auth, body string
+		status                   int
+		code                     string
+	}{
+		{"POST", "/short", "secret", "not json", http.StatusBadRequest, CodeBadRequest},
+		{"GET", "/admin/keys", "wrong", "", http.StatusUnauthorized, CodeUnauthorized},
+		{"GET", "/nope/stats", "", "", http.StatusNotFound, CodeNotFound},
+		{"GET", "/admin/links?limit=0", "secret", "", http.StatusBadRequest, CodeBadRequest},
+	} {
+		req, _ := http.NewRequest(tc.method, srv.URL+tc.path, strings.NewReader(tc.body))
+		if tc.auth != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body ErrorResponse
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if err != nil {
+			t.Errorf("%s %s: decoding error body: %v", tc.method, tc.path, err)
+			continue
+		}
+
+		if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s %s: Content-Type %q", tc.method, tc.path, ct)
+		}
+		got := body.Error
+		if resp.StatusCode != tc.status || got.Status != tc.status || got.Code != tc.code {
+			t.Errorf("%s %s: %d %+v, want %d %s", tc.method, tc.path, resp.StatusCode, got, tc.status, tc.code)
+		}
+		if got.RequestID == "" || got.RequestID != resp.Header.Get(RequestIDHeader) {
+			t.Errorf("%s %s: request_id %q, header %q", tc.method, tc.path, got.RequestID, resp.Header.Get(RequestIDHeader))
+		}
+	}
+}
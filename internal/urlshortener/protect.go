@@ -0,0 +1,216 @@
+package urlshortener
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var passwordTmpl = template.Must(template.ParseFS(templateFS, "templates/password.html"))
+
+// ErrLinkConsumed means a one-time link has already been followed.
+var ErrLinkConsumed = errors.New("one-time link already used")
+
+const maxPasswordLen = 1024
+
+// passwordIterations is the PBKDF2-HMAC-SHA256 work factor of new hashes;
+// stored hashes carry their own.
+var passwordIterations = 600_000
+
+// hashPassword returns "pbkdf2-sha256$ITERATIONS$SALT$HASH" with the salt
+// and hash in unpadded base64.
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("generating salt: %w", err)
+	}
+	key := pbkdf2SHA256([]byte(password), salt, passwordIterations, sha256.Size)
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIterations, enc.EncodeToString(salt), enc.EncodeToString(key)), nil
+}
+
+// checkPassword reports whether password matches a hashPassword hash.
+func checkPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iter, err := strconv.Atoi(parts[1])
+	if err != nil || iter < 1 {
+		return false
+	}
+	enc := base64.RawStdEncoding
+	salt, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := enc.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	got := pbkdf2SHA256([]byte(password), salt, iter, len(want))
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// pbkdf2SHA256 derives a key as in RFC 8018 with HMAC-SHA256 as the PRF.
+func pbkdf2SHA256(password, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	n := prf.Size()
+	blocks := (keyLen + n - 1) / n
+
+	var idx [4]byte
+	dk := make([]byte, 0, blocks*n)
+	u := make([]byte, n)
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(idx[:], uint32(block))
+		prf.Write(idx[:])
+		dk = prf.Sum(dk)
+		t := dk[len(dk)-n:]
+		copy(u, t)
+		for i := 1; i < iter; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range u {
+				t[j] ^= u[j]
+			}
+		}
+	}
+	return dk[:keyLen]
+}
+
+// PasswordForm is the form posted by the password prompt.
+type PasswordForm struct {
+	Password string `json:"password"`
+}
+
+func renderPasswordForm(w http.ResponseWriter, link Link, msg string) error {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	return passwordTmpl.Execute(w, map[string]any{
+		"Link":  link,
+		"Error": msg,
+	})
+}
+
+// Password attempts allowed per window, for one link and from one client
+// address. Each attempt costs a full PBKDF2 run, so guessing is throttled
+// along with the load it puts on the server.
+const (
+	passwordWindow      = time.Minute
+	passwordCodeLimit   = 20
+	passwordClientLimit = 10
+)
+
+// passwordAttempts counts password attempts per link and per client address
+// in fixed windows.
+type passwordAttempts struct {
+	mu      sync.Mutex
+	windows map[string]*attemptWindow
+}
+
+type attemptWindow struct {
+	start time.Time
+	n     int
+}
+
+func newPasswordAttempts() *passwordAttempts {
+	return &passwordAttempts{windows: map[string]*attemptWindow{}}
+}
+
+// allow records an attempt on code from addr, or returns how long to wait
+// when either already used up its window.
+func (a *passwordAttempts) allow(code, addr string, now time.Time) (time.Duration, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.windows) > 10_000 {
+		for key, w := range a.windows {
+			if now.Sub(w.start) >= passwordWindow {
+				delete(a.windows, key)
+			}
+		}
+	}
+
+	keys := []string{"code:" + code, "addr:" + addr}
+	limits := []int{passwordCodeLimit, passwordClientLimit}
+	var wait time.Duration
+	for i, key := range keys {
+		w := a.windows[key]
+		if w == nil || now.Sub(w.start) >= passwordWindow {
+			w = &attemptWindow{start: now}
+			a.windows[key] = w
+		}
+		if w.n >= limits[i] {
+			wait = max(wait, w.start.Add(passwordWindow).Sub(now))
+		}
+	}
+	if wait > 0 {
+		return wait, false
+	}
+	for _, key := range keys {
+		a.windows[key].n++
+	}
+	return 0, true
+}
+
+// clientAddr is the address a request came from, without the port.
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Consume marks a one-time link as used, counts the click and records it in
+// the link's history, or returns ErrLinkConsumed if that already happened. The check and the update are a
+// single statement, so of concurrent visits only one succeeds.
+func (u *UrlMapping) Consume(code, variant string) error {
+	seed, counter, err := u.decode(code)
+	if err != nil {
+		return err
+	}
+
+	tx, err := u.db.Begin()
+	if err != nil {
+		return fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+	now := u.now().UTC()
+	link := EventLink{Code: code}
+	err = tx.QueryRow("UPDATE url_mapping SET consumed_at = ?, clicks = clicks + 1 "+
+		"WHERE seed = ? AND counter = ? AND consumed_at IS NULL AND deleted_at IS NULL RETURNING clicks, short_url, original_url",
+		now, seed, counter).Scan(&link.Clicks, &link.ShortURL, &link.OriginalURL)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrLinkConsumed
+	}
+	if err != nil {
+		return fmt.Errorf("consuming %s: %w", code, err)
+	}
+	if err := u.clicked(tx, seed, counter, variant, link); err != nil {
+		return err
+	}
+	err = recordHistory(tx, seed, counter, HistoryEntry{Action: HistoryConsumed, Actor: "visitor", At: now, OldURL: link.OriginalURL})
+	if err != nil {
+		return err
+	}
+	if err := enqueueEvent(tx, WebhookEvent{Type: EventLinkExpired, OccurredAt: now, Link: link}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
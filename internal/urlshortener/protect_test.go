@@ -0,0 +1,310 @@
+package urlshortener
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPBKDF2(t *testing.T) {
+	// RFC 7914, section 11
+	for _, tc := range []struct {
+		password, salt string
+		iter           int
+		want           string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+			"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56" +
+			"a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+	} {
+		got := hex.EncodeToString(pbkdf2SHA256([]byte(tc.password), []byte(tc.salt), tc.iter, 64))
+		if got != tc.want {
+			t.Errorf("pbkdf2(%q, %q, %d) = %s, want %s", tc.password, tc.salt, tc.iter, got, tc.want)
+		}
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	fastPasswordHashing(t)
+	hash, err := hashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !checkPassword(hash, "correct horse") {
+		t.Error("right password rejected")
+	}
+	for _, wrong := range []string{"", "correct horse ", "Correct horse"} {
+		if checkPassword(hash, wrong) {
+			t.Errorf("wrong password %q accepted", wrong)
+		}
+	}
+	if checkPassword("sha1$1$c2FsdA$aGFzaA", "x") || checkPassword("", "") {
+		t.Error("malformed hash accepted")
+	}
+	if other, _ := hashPassword("correct horse"); other == hash {
+		t.Error("hashes are not salted")
+	}
+}
+
+// fastPasswordHashing lowers the PBKDF2 work factor for the test.
+func fastPasswordHashing(t *testing.T) {
+	old := passwordIterations
+	passwordIterations = 1000
+	t.Cleanup(func() { passwordIterations = old })
+}
+
+func TestPasswordProtectedLink(t *testing.T) {
+	fastPasswordHashing(t)
+	srv := newTestAPI(t)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	code := createLink(t, srv.URL, `{"original_url":"https://docs.example/secret.pdf","password":"hunter2"}`)
+
+	for _, path := range []string{"/" + code, "/" + code + "+"} {
+		resp, err := client.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `type="password"`) {
+			t.Errorf("GET %s: status %d, want the password prompt", path, resp.StatusCode)
+		}
+		if strings.Contains(string(body), "docs.example") {
+			t.Errorf("GET %s: prompt reveals the destination", path)
+		}
+	}
+
+	post := func(password string) *http.Response {
+		resp, err := client.PostForm(srv.URL+"/"+code, url.Values{"password": {password}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	if resp := post("hunter3"); resp.StatusCode != http.StatusOK || resp.Header.Get("Location") != "" {
+		t.Errorf("wrong password: status %d to %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if resp := post("hunter2"); resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "https://docs.example/secret.pdf" {
+		t.Errorf("right password: status %d to %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	stats := getStats(t, srv.URL, code)
+	if !stats.PasswordProtected || stats.OriginalURL != "" || stats.Clicks != 1 {
+		t.Errorf("stats = %+v, want protected, without destination, 1 click", stats)
+	}
+
+	plain := createLink(t, srv.URL, `{"original_url":"https://example.com"}`)
+	resp, err := client.PostForm(srv.URL+"/"+plain, url.Values{"password": {"x"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST to an unprotected link: status %d, want 405", resp.StatusCode)
+	}
+}
+
+func TestPasswordAttemptsThrottled(t *testing.T) {
+	fastPasswordHashing(t)
+	srv := newTestAPI(t)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	code := createLink(t, srv.URL, `{"original_url":"https://docs.example/secret.pdf","password":"hunter2"}`)
+
+	post := func(password string) *http.Response {
+		resp, err := client.PostForm(srv.URL+"/"+code, url.Values{"password": {password}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	for i := 0; i < passwordClientLimit; i++ {
+		if resp := post("guess"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("attempt %d: status %d", i+1, resp.StatusCode)
+		}
+	}
+	resp := post("hunter2")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Location") != "" {
+		t.Errorf("attempt past the limit: status %d to %q, want 429", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err != nil || secs < 1 || secs > 60 {
+		t.Errorf("Retry-After %q", resp.Header.Get("Retry-After"))
+	}
+
+	// the link's own limit holds against attempts spread over addresses
+	attempts := newPasswordAttempts()
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < passwordCodeLimit; i++ {
+		if _, ok := attempts.allow("abc", fmt.Sprintf("10.0.0.%d", i), now); !ok {
+			t.Fatalf("attempt %d refused", i+1)
+		}
+	}
+	if wait, ok := attempts.allow("abc", "10.0.1.1", now.Add(10*time.Second)); ok || wait != 50*time.Second {
+		t.Errorf("attempt past the link's limit: allowed %v, wait %v", ok, wait)
+	}
+	if _, ok := attempts.allow("abc", "10.0.1.1", now.Add(passwordWindow)); !ok {
+		t.Error("attempt in the next window refused")
+	}
+}
+
+func TestOneTimeLinkConcurrentClicks(t *testing.T) {
+	srv := newTestAPI(t)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	code := createLink(t, srv.URL, `{"original_url":"https://example.com/invite","one_time":true}`)
+
+	const visitors = 20
+	statuses := make(chan int, visitors)
+	var wg sync.WaitGroup
+	for range visitors {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(srv.URL + "/" + code)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+
+	counts := map[int]int{}
+	for s := range statuses {
+		counts[s]++
+	}
+	if counts[http.StatusFound] != 1 || counts[http.StatusGone] != visitors-1 {
+		t.Errorf("statuses %v, want one redirect and %d gone", counts, visitors-1)
+	}
+	if stats := getStats(t, srv.URL, code); !stats.OneTime || !stats.Consumed || stats.Clicks != 1 {
+		t.Errorf("stats = %+v, want consumed with 1 click", stats)
+	}
+
+	req, _ := http.NewRequest("GET", srv.URL+"/admin/links/"+code+"/history", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var history LinkHistory
+	json.NewDecoder(resp.Body).Decode(&history)
+	var consumed []HistoryEntry
+	for _, e := range history.Entries {
+		if e.Action == HistoryConsumed {
+			consumed = append(consumed, e)
+		}
+	}
+	if len(consumed) != 1 || consumed[0].OldURL != "https://example.com/invite" || consumed[0].Actor != "visitor" {
+		t.Errorf("history = %+v, want one consumption of the destination", history.Entries)
+	}
+}
+
+func TestHiddenDestinations(t *testing.T) {
+	fastPasswordHashing(t)
+	srv := newTestAPI(t)
+	protected := createLink(t, srv.URL, `{"original_url":"https://docs.example/secret.pdf","password":"hunter2"}`)
+	oneTime := createLink(t, srv.URL, `{"original_url":"https://docs.example/invite","one_time":true,`+
+		`"redirect":{"params":{"ref":"short"}}}`)
+	plain := createLink(t, srv.URL, `{"original_url":"https://docs.example/public"}`)
+
+	for _, code := range []string{protected, oneTime} {
+		if stats := getStats(t, srv.URL, code); stats.OriginalURL != "" || stats.Redirect != nil {
+			t.Errorf("stats of %s reveal its destination: %+v", code, stats)
+		}
+	}
+	if stats := getStats(t, srv.URL, oneTime); stats.Consumed || stats.Clicks != 0 {
+		t.Errorf("stats used up the one-time link: %+v", stats)
+	}
+
+	search := func(query, auth string) map[string]LinkStats {
+		t.Helper()
+		req, _ := http.NewRequest("GET", srv.URL+"/links/search?"+query, nil)
+		if auth != "" {
+			req.Header.Set("Authorization", "Bearer "+auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var list LinkList
+		json.NewDecoder(resp.Body).Decode(&list)
+		found := map[string]LinkStats{}
+		for _, l := range list.Links {
+			found[l.Code] = l
+		}
+		return found
+	}
+	req, _ := http.NewRequest("POST", srv.URL+"/admin/keys", strings.NewReader(`{"name":"ci"}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var key NewAPIKey
+	json.NewDecoder(resp.Body).Decode(&key)
+	resp.Body.Close()
+
+	found := search("", key.Key)
+	for _, code := range []string{protected, oneTime} {
+		if l, ok := found[code]; !ok || l.OriginalURL != "" || l.Redirect != nil {
+			t.Errorf("search with an API key: %s = %+v, want it listed without destination", code, l)
+		}
+	}
+	if found[plain].OriginalURL != "https://docs.example/public" {
+		t.Errorf("search with an API key: %s = %+v", plain, found[plain])
+	}
+	if found := search("url_prefix=https://docs.example/", key.Key); len(found) != 1 || found[plain].Code == "" {
+		t.Errorf("url_prefix search with an API key matched %v, want only %s", slices.Collect(maps.Keys(found)), plain)
+	}
+
+	found = search("url_prefix=https://docs.example/", "secret")
+	if len(found) != 3 || found[protected].OriginalURL != "https://docs.example/secret.pdf" || found[oneTime].Redirect == nil {
+		t.Errorf("admin search = %+v, want every link with its destination", found)
+	}
+}
+
+func createLink(t *testing.T, base, body string) string {
+	t.Helper()
+	resp, err := http.Post(base+"/short", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("create: status %d", resp.StatusCode)
+	}
+	var short URLResponse
+	json.NewDecoder(resp.Body).Decode(&short)
+	return strings.TrimPrefix(short.ShortenedURL, "https://sho.rt/")
+}
+
+func getStats(t *testing.T, base, code string) LinkStats {
+	t.Helper()
+	resp, err := http.Get(base + "/" + code + "/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var stats LinkStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	return stats
+}
@@ -0,0 +1,115 @@
+package urlshortener
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/George-Yanev/go-playground/internal/qrcode"
+)
+
+const (
+	defaultQRSize = 256
+	maxQRSize     = 2048
+)
+
+// handleQR renders the short URL of {code} as a PNG or SVG QR code.
+// Query parameters: format=png|svg, size in pixels, level=L|M|Q|H.
+func handleQR(links *UrlMapping) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+
+		size := defaultQRSize
+		if v := q.Get("size"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 32 || n > maxQRSize {
+				writeError(w, r, http.StatusBadRequest, CodeBadRequest, "size must be between 32 and 2048")
+				return
+			}
+			size = n
+		}
+
+		level := qrcode.Medium
+		if v := q.Get("level"); v != "" {
+			l, err := qrcode.ParseLevel(v)
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, CodeBadRequest, "level must be one of L, M, Q, H")
+				return
+			}
+			level = l
+		}
+
+		format := q.Get("format")
+		if format == "" {
+			format = "png"
+		}
+		if format != "png" && format != "svg" {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "format must be png or svg")
+			return
+		}
+
+		link, err := links.GetByCode(r.PathValue("code"))
+		if err != nil {
+			if errors.Is(err, ErrLinkNotFound) {
+				writeError(w, r, http.StatusNotFound, CodeNotFound, "Link not found")
+				return
+			}
+			loggerFor(RequestIDFromContext(r.Context())).Error("looking up link", "err", err)
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to look up link")
+			return
+		}
+
+		if link.Disabled {
+			writeError(w, r, http.StatusGone, CodeLinkDisabled, "Link disabled")
+			return
+		}
+
+		code, err := qrcode.Encode([]byte(link.ShortUrl), level)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to encode QR code")
+			return
+		}
+
+		var img []byte
+		if format == "svg" {
+			w.Header().Set("Content-Type", "image/svg+xml")
+			img = code.SVG(size)
+		} else {
+			if img, err = code.PNG(size); err != nil {
+				writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to render QR code")
+				return
+			}
+			w.Header().Set("Content-Type", "image/png")
+		}
+
+		// the image only changes with the short URL, but caches revalidate
+		// it on every use so that a disabled or deleted link stops showing
+		w.Header().Set("Cache-Control", "private, no-cache")
+		w.Header().Set("ETag", qrETag(link.ShortUrl, format, size, level))
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(img))
+	}
+}
+
+func qrETag(shortUrl, format string, size int, level qrcode.Level) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%d\x00%d", shortUrl, format, size, level)))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// qrDataURI returns a PNG QR code for shortUrl as a data: URI.
+func qrDataURI(shortUrl string) (string, error) {
+	code, err := qrcode.Encode([]byte(shortUrl), qrcode.Medium)
+	if err != nil {
+		return "", err
+	}
+	img, err := code.PNG(defaultQRSize)
+	if err != nil {
+		return "", err
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(img), nil
+}
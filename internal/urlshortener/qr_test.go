@@ -0,0 +1,66 @@
+package urlshortener
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestQRCodeRevalidated(t *testing.T) {
+	srv, err := NewServer(
+		WithDBPath(filepath.Join(t.TempDir(), "qr.db")),
+		WithWorkers(1),
+		WithHttpConfig(HttpConfig{ShortUrlHost: "sho.rt"}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown(context.Background())
+	api := httptest.NewServer(srv.Handler())
+	defer api.Close()
+
+	resp, err := http.Post(api.URL+"/short", "application/json", strings.NewReader(`{"original_url":"https://example.com/qr"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var short URLResponse
+	json.NewDecoder(resp.Body).Decode(&short)
+	resp.Body.Close()
+	code := strings.TrimPrefix(short.ShortenedURL, "https://sho.rt/")
+
+	get := func(path, etag string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest("GET", api.URL+path, nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	resp = get("/"+code+"/qr", "")
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || etag == "" || resp.Header.Get("Cache-Control") != "private, no-cache" {
+		t.Fatalf("GET qr: status %d, ETag %q, Cache-Control %q", resp.StatusCode, etag, resp.Header.Get("Cache-Control"))
+	}
+	if resp := get("/"+code+"/qr", etag); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("revalidating an unchanged QR code: status %d, want 304", resp.StatusCode)
+	}
+	if resp := get("/"+code+"/qr?format=svg", etag); resp.StatusCode != http.StatusOK {
+		t.Errorf("the SVG matched the PNG's ETag: status %d", resp.StatusCode)
+	}
+
+	if _, err := NewUrlMapping(srv.DB()).DisableMatching("test", func(d string) (string, bool) { return "test", true }); err != nil {
+		t.Fatal(err)
+	}
+	if resp := get("/"+code+"/qr", etag); resp.StatusCode != http.StatusGone {
+		t.Errorf("revalidating the QR code of a disabled link: status %d, want 410", resp.StatusCode)
+	}
+}
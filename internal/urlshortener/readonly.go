@@ -0,0 +1,211 @@
+package urlshortener
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SnapshotStore resolves codes on a read-only node from the newest full
+// snapshot in a directory and the deltas published after it. Refresh picks
+// up new deltas without reloading the snapshot; a newer full snapshot
+// replaces both.
+type SnapshotStore struct {
+	dir string
+
+	refreshMu sync.Mutex
+	mu        sync.RWMutex
+	base      *Snapshot
+	// overlay holds the destinations from deltas, "" for removed links.
+	overlay map[string]string
+	through uint64
+}
+
+// OpenSnapshotStore loads the snapshot directory dir, failing with
+// ErrNoSnapshot if it holds no full snapshot yet.
+func OpenSnapshotStore(dir string) (*SnapshotStore, error) {
+	s := &SnapshotStore{dir: dir, overlay: map[string]string{}}
+	if err := s.Refresh(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if s.base == nil {
+		return nil, fmt.Errorf("%w in %s", ErrNoSnapshot, dir)
+	}
+	return s, nil
+}
+
+// Refresh loads a full snapshot newer than what the store holds, then
+// applies the deltas that continue from there.
+func (s *SnapshotStore) Refresh() error {
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+
+	files, err := listSnapshots(s.dir)
+	if err != nil {
+		return err
+	}
+	// only Refresh changes base and through, and refreshMu is held
+	through := s.through
+	var base *Snapshot
+	for i := len(files) - 1; i >= 0; i-- {
+		f := files[i]
+		if f.kind != SnapshotFull {
+			continue
+		}
+		if s.base == nil || f.through > through {
+			if base, err = OpenSnapshot(f.path); err != nil {
+				return err
+			}
+			through = base.Through
+		}
+		break
+	}
+
+	var deltas []*Snapshot
+	for _, f := range files {
+		if f.kind != SnapshotDelta || f.from > through || f.through <= through {
+			continue
+		}
+		data, err := os.ReadFile(f.path)
+		if os.IsNotExist(err) {
+			// pruned by a new full snapshot, which the next refresh loads
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading delta: %w", err)
+		}
+		info, err := parseSnapshot(data)
+		if err != nil {
+			return fmt.Errorf("reading delta %s: %w", f.path, err)
+		}
+		deltas = append(deltas, &Snapshot{SnapshotInfo: info, data: data})
+		through = info.Through
+	}
+	if base == nil && len(deltas) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	old := s.base
+	if base != nil {
+		s.base, s.overlay = base, map[string]string{}
+	}
+	for _, d := range deltas {
+		for i := 0; i < d.Count; i++ {
+			code, dest, removed := d.entry(i)
+			if removed {
+				s.overlay[string(code)] = ""
+			} else {
+				s.overlay[string(code)] = string(dest)
+			}
+		}
+	}
+	s.through = through
+	s.mu.Unlock()
+
+	if base != nil && old != nil {
+		old.Close()
+	}
+	slog.Info("snapshot refreshed", "through", through, "full", base != nil, "deltas", len(deltas))
+	return nil
+}
+
+// Watch refreshes the store every interval until ctx is done.
+func (s *SnapshotStore) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Refresh(); err != nil {
+				slog.Error("refreshing snapshot", "dir", s.dir, "err", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Lookup returns the destination of code, if the node can serve it.
+func (s *SnapshotStore) Lookup(code string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if dest, ok := s.overlay[code]; ok {
+		return dest, dest != ""
+	}
+	if s.base == nil {
+		return "", false
+	}
+	dest, removed, ok := s.base.Lookup(code)
+	return dest, ok && !removed
+}
+
+// Through is the url_mapping_history ID the store is up to date with.
+func (s *SnapshotStore) Through() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.through
+}
+
+func (s *SnapshotStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.base == nil {
+		return nil
+	}
+	err := s.base.Close()
+	s.base = nil
+	return err
+}
+
+type ReadOnlyConfig struct {
+	// Primary is the base URL of the full shortener, base path included.
+	// Requests the snapshot cannot answer are redirected there; without it
+	// they get a 404.
+	Primary string
+	// Interstitial is the primary's preview policy; redirects it would
+	// preview are left to the primary.
+	Interstitial Interstitial
+}
+
+// NewReadOnlyHandler serves GET /{code} from store, for links that are plain
+// redirects, along with /healthz and a /readyz reporting the snapshot
+// position. Everything else, including links the snapshot does not know or
+// cannot serve, is sent to the primary with a 307. Clicks are not counted.
+func NewReadOnlyHandler(store *SnapshotStore, cfg ReadOnlyConfig) http.Handler {
+	primary := strings.TrimSuffix(cfg.Primary, "/")
+	toPrimary := func(w http.ResponseWriter, r *http.Request) {
+		if primary == "" {
+			writeError(w, r, http.StatusNotFound, CodeNotFound, "Link not found")
+			return
+		}
+		http.Redirect(w, r, primary+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, Liveness{Status: "ok"})
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, Readiness{Ready: true, Checks: map[string]CheckResult{
+			"snapshot": {OK: true, Detail: fmt.Sprintf("through history ID %d", store.Through())},
+		}})
+	})
+	mux.HandleFunc("GET /{code}", func(w http.ResponseWriter, r *http.Request) {
+		code := r.PathValue("code")
+		dest, ok := store.Lookup(code)
+		if !ok || cfg.Interstitial.required(Link{}, dest) {
+			toPrimary(w, r)
+			return
+		}
+		http.Redirect(w, r, dest, http.StatusFound)
+	})
+	mux.HandleFunc("/", toPrimary)
+	return withRequestID(mux)
+}
@@ -0,0 +1,269 @@
+package urlshortener
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"embed"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed templates/*.html
+var templateFS embed.FS
+
+var previewTmpl = template.Must(template.ParseFS(templateFS, "templates/preview.html"))
+
+type InterstitialMode string
+
+const (
+	// InterstitialOff only previews links created with the interstitial flag
+	// or requested with a trailing "+".
+	InterstitialOff InterstitialMode = "off"
+	// InterstitialExternal also previews links leaving AllowedDomains.
+	InterstitialExternal InterstitialMode = "external"
+	// InterstitialAlways previews every link.
+	InterstitialAlways InterstitialMode = "always"
+)
+
+func ParseInterstitialMode(s string) (InterstitialMode, error) {
+	switch m := InterstitialMode(s); m {
+	case "":
+		return InterstitialOff, nil
+	case InterstitialOff, InterstitialExternal, InterstitialAlways:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown interstitial mode %q", s)
+}
+
+// Interstitial decides which redirects go through the preview page.
+type Interstitial struct {
+	Mode InterstitialMode
+	// AllowedDomains match the destination host and all of its subdomains.
+	AllowedDomains []string
+	// Secret signs the continue links of preview pages. A random one is
+	// made when empty, so replicas behind one address need to share it.
+	Secret []byte
+}
+
+// continueTTL is how long the continue link of a preview page is valid, so
+// that a shared link cannot skip the preview for long.
+const continueTTL = 10 * time.Minute
+
+// continueToken signs code and extraPath to skip the preview until expires.
+func (p Interstitial) continueToken(code, extraPath string, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return exp + "." + base64.RawURLEncoding.EncodeToString(p.continueMAC(code, extraPath, exp))
+}
+
+func (p Interstitial) continueMAC(code, extraPath, exp string) []byte {
+	mac := hmac.New(sha256.New, p.Secret)
+	mac.Write([]byte(code + "\x00" + extraPath + "\x00" + exp))
+	return mac.Sum(nil)[:16]
+}
+
+// continued reports whether token is an unexpired continue token for code
+// and extraPath.
+func (p Interstitial) continued(token, code, extraPath string, now time.Time) bool {
+	exp, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return false
+	}
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || now.Unix() >= expires {
+		return false
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	return err == nil && hmac.Equal(got, p.continueMAC(code, extraPath, exp))
+}
+
+func (p Interstitial) required(link Link, dest string) bool {
+	if link.Interstitial {
+		return true
+	}
+	switch p.Mode {
+	case InterstitialAlways:
+		return true
+	case InterstitialExternal:
+		return !p.allowed(dest)
+	}
+	return false
+}
+
+func (p Interstitial) allowed(dest string) bool {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, d := range p.AllowedDomains {
+		d = strings.ToLower(d)
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleRedirect sends GET /{code} to the destination, or the variant chosen
+// by the link's routes, rewritten by its RedirectRules; GET /{code}/{path...}
+// is only served for links that forward paths. "/{code}+" always renders the
+// preview page; links that require one are previewed unless the visitor comes
+// from its continue button, whose signed link expires after continueTTL.
+// Password-protected links render a prompt instead, which POSTs the password
+// back to the same URL; attempts are limited per link and per client address,
+// answering 429 with Retry-After beyond that. One-time links are gone after their first redirect.
+// HEAD answers like GET but counts no click, so clients can resolve a code;
+// for a one-time link it answers 200 without a Location instead, as telling
+// where the link leads would use it up without consuming it.
+func handleRedirect(links *UrlMapping, policy Interstitial, attempts *passwordAttempts) http.HandlerFunc {
+	if len(policy.Secret) == 0 {
+		policy.Secret = make([]byte, 32)
+		if _, err := rand.Read(policy.Secret); err != nil {
+			panic(fmt.Sprintf("generating interstitial secret: %v", err))
+		}
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := loggerFor(RequestIDFromContext(r.Context()))
+
+		code, preview := strings.CutSuffix(r.PathValue("code"), "+")
+		peek := r.Method == http.MethodHead
+		link, err := links.GetByCode(code)
+		if err != nil {
+			if errors.Is(err, ErrLinkNotFound) {
+				writeError(w, r, http.StatusNotFound, CodeNotFound, "Link not found")
+				return
+			}
+			logger.Error("looking up link", "err", err)
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to look up link")
+			return
+		}
+
+		if link.Disabled {
+			writeError(w, r, http.StatusGone, CodeLinkDisabled, "Link disabled")
+			return
+		}
+		if link.Consumed {
+			writeError(w, r, http.StatusGone, CodeLinkConsumed, "Link already used")
+			return
+		}
+		if r.Method == http.MethodPost && link.PasswordHash == "" {
+			w.Header().Set("Allow", "GET")
+			writeError(w, r, http.StatusMethodNotAllowed, CodeBadRequest, "Link is not password protected")
+			return
+		}
+
+		query := r.URL.Query()
+		token := query.Get("continue")
+		query.Del("continue")
+		extraPath := r.PathValue("path")
+		now := links.now()
+		variant, _ := chooseVariant(link.Redirect.Routes, newVisit(r, now))
+		dest, err := link.Redirect.destination(link, variant, extraPath, query, now)
+		if errors.Is(err, errPathNotForwarded) {
+			writeError(w, r, http.StatusNotFound, CodeNotFound, "Link not found")
+			return
+		}
+		if err != nil {
+			logger.Error("building destination", "code", code, "err", err)
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to build destination")
+			return
+		}
+
+		status := http.StatusFound
+		if link.PasswordHash != "" {
+			// the prompt stands in for the preview, which would reveal the
+			// destination
+			if r.Method != http.MethodPost {
+				if err := renderPasswordForm(w, link, ""); err != nil {
+					logger.Error("rendering password form", "code", code, "err", err)
+				}
+				return
+			}
+			if wait, ok := attempts.allow(code, clientAddr(r), now); !ok {
+				logger.Warn("link password attempts throttled", "code", code, "addr", clientAddr(r))
+				w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+				writeError(w, r, http.StatusTooManyRequests, CodeRateLimited, "Too many password attempts, try again later")
+				return
+			}
+			password := r.PostFormValue("password")
+			if len(password) > maxPasswordLen || !checkPassword(link.PasswordHash, password) {
+				logger.Info("wrong link password", "code", code)
+				if err := renderPasswordForm(w, link, "Wrong password, try again."); err != nil {
+					logger.Error("rendering password form", "code", code, "err", err)
+				}
+				return
+			}
+			status = http.StatusSeeOther
+		} else if preview || (policy.required(link, dest) && !policy.continued(token, code, extraPath, now)) {
+			next := continueURL(code, extraPath, query, policy.continueToken(code, extraPath, now.Add(continueTTL)))
+			if err := renderPreview(w, link, dest, next); err != nil {
+				logger.Error("rendering preview", "code", code, "err", err)
+			}
+			return
+		}
+
+		switch {
+		case peek && link.OneTime:
+			// the destination is only given out once, by a visit
+			w.Header().Set("Cache-Control", "no-store")
+			return
+		case peek:
+			// looking is not a click
+		case link.OneTime:
+			if err := links.Consume(code, variant.Name); errors.Is(err, ErrLinkConsumed) {
+				writeError(w, r, http.StatusGone, CodeLinkConsumed, "Link already used")
+				return
+			} else if err != nil {
+				logger.Error("consuming link", "code", code, "err", err)
+				writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to resolve link")
+				return
+			}
+			w.Header().Set("Cache-Control", "no-store")
+		default:
+			if err := links.RecordClick(code, variant.Name); err != nil {
+				// the visitor still gets where they are going
+				logger.Error("recording click", "code", code, "err", err)
+			}
+		}
+		http.Redirect(w, r, dest, status)
+	}
+}
+
+// continueURL leads from the preview page back to the redirect, keeping the
+// forwarded path and query. It is relative so that it works under a base
+// path: the page is served from /{code}+/{path...} or /{code}/{path...}.
+func continueURL(code, extraPath string, query url.Values, token string) string {
+	q := url.Values{"continue": {token}}
+	for k, vs := range query {
+		q[k] = vs
+	}
+	p := strings.Repeat("../", strings.Count(extraPath, "/")) + code
+	if extraPath != "" {
+		p = "../" + p + "/" + extraPath
+	}
+	return p + "?" + q.Encode()
+}
+
+func renderPreview(w http.ResponseWriter, link Link, dest, continueURL string) error {
+	host := dest
+	if u, err := url.Parse(dest); err == nil && u.Host != "" {
+		host = u.Host
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	return previewTmpl.Execute(w, map[string]any{
+		"Link":        link,
+		"Host":        host,
+		"Destination": dest,
+		"ContinueURL": continueURL,
+	})
+}
@@ -0,0 +1,174 @@
+package urlshortener
+
+import (
+	"context"
+	"encoding/json"
+	"html"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var continueHref = regexp.MustCompile(`href="([^"]*continue=[^"]*)"`)
+
+// previewServer serves the API under policy.
+func previewServer(t *testing.T, policy Interstitial) *httptest.Server {
+	t.Helper()
+	srv, err := NewServer(
+		WithDBPath(filepath.Join(t.TempDir(), "preview.db")),
+		WithWorkers(1),
+		WithHttpConfig(HttpConfig{ShortUrlHost: "sho.rt", Interstitial: policy}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Shutdown(context.Background()) })
+	api := httptest.NewServer(srv.Handler())
+	t.Cleanup(api.Close)
+	return api
+}
+
+// visitPreview follows nothing and returns the status, the Location and, for a
+// preview page, its continue link resolved against the page.
+func visitPreview(t *testing.T, base, path string) (status int, location, next string) {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(base + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if m := continueHref.FindSubmatch(body); m != nil {
+		page, _ := url.Parse(base + path)
+		ref, err := url.Parse(html.UnescapeString(string(m[1])))
+		if err != nil {
+			t.Fatal(err)
+		}
+		next = page.ResolveReference(ref).RequestURI()
+	}
+	return resp.StatusCode, resp.Header.Get("Location"), next
+}
+
+func shortenForPreview(t *testing.T, base, body string) string {
+	t.Helper()
+	resp, err := http.Post(base+"/short", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var short URLResponse
+	if err := json.NewDecoder(resp.Body).Decode(&short); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("shortening %s: status %d, %v", body, resp.StatusCode, err)
+	}
+	return "/" + strings.TrimPrefix(short.ShortenedURL, "https://sho.rt/")
+}
+
+func TestInterstitialModes(t *testing.T) {
+	for _, tc := range []struct {
+		mode InterstitialMode
+		// previewed by destination, for links without the interstitial flag
+		previewed map[string]bool
+	}{
+		{InterstitialOff, map[string]bool{"https://docs.example.com/a": false, "https://elsewhere.net/b": false}},
+		{InterstitialExternal, map[string]bool{"https://docs.example.com/a": false, "https://elsewhere.net/b": true}},
+		{InterstitialAlways, map[string]bool{"https://docs.example.com/a": true, "https://elsewhere.net/b": true}},
+	} {
+		t.Run(string(tc.mode), func(t *testing.T) {
+			api := previewServer(t, Interstitial{Mode: tc.mode, AllowedDomains: []string{"example.com"}})
+			for dest, previewed := range tc.previewed {
+				path := shortenForPreview(t, api.URL, `{"original_url":"`+dest+`"}`)
+				status, location, next := visitPreview(t, api.URL, path)
+				if previewed {
+					if status != http.StatusOK || next == "" {
+						t.Errorf("%s to %s: status %d, want the preview", path, dest, status)
+						continue
+					}
+					if status, location, _ = visitPreview(t, api.URL, next); status != http.StatusFound || location != dest {
+						t.Errorf("continuing to %s: %d to %q", dest, status, location)
+					}
+				} else if status != http.StatusFound || location != dest {
+					t.Errorf("%s to %s: %d to %q, want a redirect", path, dest, status, location)
+				}
+				if status, _, next := visitPreview(t, api.URL, path+"+"); status != http.StatusOK || next == "" {
+					t.Errorf("%s+: status %d, want the preview", path, status)
+				}
+			}
+
+			flagged := shortenForPreview(t, api.URL, `{"original_url":"https://docs.example.com/c","interstitial":true}`)
+			if status, _, next := visitPreview(t, api.URL, flagged); status != http.StatusOK || next == "" {
+				t.Errorf("link with the interstitial flag: status %d, want the preview", status)
+			}
+		})
+	}
+}
+
+func TestInterstitialCannotBeSkipped(t *testing.T) {
+	policy := Interstitial{Mode: InterstitialAlways, Secret: []byte("test secret")}
+	api := previewServer(t, policy)
+	dest := "https://elsewhere.net/doc"
+	path := shortenForPreview(t, api.URL, `{"original_url":"`+dest+`"}`)
+	other := shortenForPreview(t, api.URL, `{"original_url":"https://elsewhere.net/other"}`)
+	_, _, next := visitPreview(t, api.URL, path)
+	token := strings.TrimPrefix(next, path+"?continue=")
+	_, _, otherNext := visitPreview(t, api.URL, other)
+	otherToken := strings.TrimPrefix(otherNext, other+"?continue=")
+
+	code := strings.TrimPrefix(path, "/")
+	forged := Interstitial{Secret: []byte("another secret")}.continueToken(code, "", time.Now().Add(time.Hour))
+	expired := policy.continueToken(code, "", time.Now().Add(-time.Second))
+	for _, skip := range []string{
+		"?continue",
+		"?continue=1",
+		"?continue=" + url.QueryEscape(forged),
+		"?continue=" + url.QueryEscape(otherToken),
+		"?continue=" + url.QueryEscape(token) + "x",
+		"?continue=" + url.QueryEscape(expired),
+	} {
+		if status, location, _ := visitPreview(t, api.URL, path+skip); status != http.StatusOK {
+			t.Errorf("%s%s skipped the preview: %d to %q", path, skip, status, location)
+		}
+	}
+
+	if status, location, _ := visitPreview(t, api.URL, next); status != http.StatusFound || location != dest {
+		t.Errorf("continue link of the preview: %d to %q, want a redirect to %s", status, location, dest)
+	}
+}
+
+func TestHeadDoesNotSkipVisits(t *testing.T) {
+	api := previewServer(t, Interstitial{Mode: InterstitialExternal, AllowedDomains: []string{"example.com"}})
+	plain := shortenForPreview(t, api.URL, `{"original_url":"https://docs.example.com/a"}`)
+	previewed := shortenForPreview(t, api.URL, `{"original_url":"https://elsewhere.net/b"}`)
+	oneTime := shortenForPreview(t, api.URL, `{"original_url":"https://docs.example.com/once","one_time":true}`)
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	head := func(path string) (int, string) {
+		t.Helper()
+		resp, err := client.Head(api.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode, resp.Header.Get("Location")
+	}
+	if status, location := head(plain); status != http.StatusFound || location != "https://docs.example.com/a" {
+		t.Errorf("HEAD %s: %d to %q, want the redirect", plain, status, location)
+	}
+	if status, location := head(previewed); status != http.StatusOK || location != "" {
+		t.Errorf("HEAD of a previewed link: %d to %q, want the preview", status, location)
+	}
+	for range 2 {
+		if status, location := head(oneTime); status != http.StatusOK || location != "" {
+			t.Errorf("HEAD of a one-time link: %d to %q, want 200 without a destination", status, location)
+		}
+	}
+	if status, location, _ := visitPreview(t, api.URL, oneTime); status != http.StatusFound || location != "https://docs.example.com/once" {
+		t.Errorf("visiting the one-time link after HEADs: %d to %q", status, location)
+	}
+}
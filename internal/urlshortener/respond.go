@@ -0,0 +1,52 @@
+package urlshortener
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Error codes returned in the "code" field of error responses.
+const (
+	CodeBadRequest   = "bad_request"
+	CodeUnauthorized = "unauthorized"
+	CodeBlocked      = "destination_blocked"
+	CodeNotFound     = "not_found"
+	CodeConflict     = "conflict"
+	CodeLinkDisabled = "link_disabled"
+	CodeLinkConsumed = "link_consumed"
+	CodeTooLarge     = "too_large"
+	CodeRateLimited  = "rate_limited"
+	CodeInternal     = "internal"
+	CodeUnavailable  = "unavailable"
+)
+
+// APIError is the body of every error response, wrapped in ErrorResponse.
+// Messages are meant for API users; internal causes are only logged.
+type APIError struct {
+	Status    int    `json:"status"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+func (e *APIError) Error() string { return e.Message }
+
+type ErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, msg string) {
+	writeAPIError(w, r, &APIError{Status: status, Code: code, Message: msg})
+}
+
+func writeAPIError(w http.ResponseWriter, r *http.Request, e *APIError) {
+	body := *e
+	body.RequestID = RequestIDFromContext(r.Context())
+	writeJSON(w, e.Status, ErrorResponse{Error: body})
+}
@@ -0,0 +1,147 @@
+package urlshortener
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// RedirectRules rewrite a link's destination each time it is followed.
+type RedirectRules struct {
+	// Params are set on the destination's query, overriding what is there.
+	// Values are templates; see expandTemplate for the placeholders.
+	Params map[string]string `json:"params,omitempty"`
+	// PassQuery copies the short URL's query string to the destination.
+	PassQuery bool `json:"pass_query,omitempty"`
+	// ForwardPath appends what follows the code in the short URL to the
+	// destination's path: /{code}/a/b goes to destination/a/b.
+	ForwardPath bool `json:"forward_path,omitempty"`
+	// Routes replace the destination by a variant for the visits matching
+	// them; the first matching route is used.
+	Routes []Route `json:"routes,omitempty"`
+}
+
+func (r RedirectRules) IsZero() bool {
+	return len(r.Params) == 0 && !r.PassQuery && !r.ForwardPath && len(r.Routes) == 0
+}
+
+const maxRedirectParams = 20
+
+var placeholderRe = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// Validate checks parameter names, that templates only use known
+// placeholders and the routes.
+func (r RedirectRules) Validate() error {
+	if len(r.Params) > maxRedirectParams {
+		return fmt.Errorf("at most %d redirect params", maxRedirectParams)
+	}
+	for name, tmpl := range r.Params {
+		if name == "" || len(name) > 64 {
+			return errors.New("redirect param names must be 1 to 64 bytes")
+		}
+		if len(tmpl) > 256 {
+			return fmt.Errorf("redirect param %s: template longer than 256 bytes", name)
+		}
+		for _, m := range placeholderRe.FindAllStringSubmatch(tmpl, -1) {
+			if !knownPlaceholder(m[1]) {
+				return fmt.Errorf("redirect param %s: unknown placeholder {%s}", name, m[1])
+			}
+		}
+	}
+	return validateRoutes(r.Routes)
+}
+
+func knownPlaceholder(name string) bool {
+	switch name {
+	case "code", "owner", "title", "tag", "date", "variant":
+		return true
+	}
+	q, ok := strings.CutPrefix(name, "query.")
+	return ok && q != ""
+}
+
+// expandTemplate replaces the placeholders in tmpl:
+//
+//	{code}        the short code
+//	{owner}       the link's owner
+//	{title}       the link's title
+//	{tag}         the link's first tag
+//	{date}        the day of the click, 2006-01-02 in UTC
+//	{variant}     the name of the variant chosen by the routes
+//	{query.NAME}  parameter NAME of the short URL's query string
+//
+// Placeholders without a value expand to the empty string.
+func expandTemplate(tmpl string, link Link, variant string, query url.Values, now time.Time) string {
+	return placeholderRe.ReplaceAllStringFunc(tmpl, func(m string) string {
+		name := m[1 : len(m)-1]
+		switch name {
+		case "code":
+			return link.Code
+		case "owner":
+			return link.Owner
+		case "title":
+			return link.Title
+		case "tag":
+			if len(link.Tags) > 0 {
+				return link.Tags[0]
+			}
+			return ""
+		case "date":
+			return now.UTC().Format(time.DateOnly)
+		case "variant":
+			return variant
+		}
+		if q, ok := strings.CutPrefix(name, "query."); ok {
+			return query.Get(q)
+		}
+		return m
+	})
+}
+
+var errPathNotForwarded = errors.New("link does not forward paths")
+
+// destination is where a visit to link goes: the variant's URL, or the
+// link's own if variant is the zero Variant, rewritten by the rules. extraPath
+// is what followed the code in the short URL and query its query string,
+// without our own parameters.
+func (r RedirectRules) destination(link Link, variant Variant, extraPath string, query url.Values, now time.Time) (string, error) {
+	base := link.OriginalUrl
+	if variant.URL != "" {
+		base = variant.URL
+	}
+	if len(r.Params) == 0 && !r.PassQuery && extraPath == "" {
+		return base, nil
+	}
+	if extraPath != "" && !r.ForwardPath {
+		return "", errPathNotForwarded
+	}
+
+	dest, err := url.Parse(base)
+	if err != nil {
+		return "", fmt.Errorf("parsing destination: %w", err)
+	}
+	if extraPath != "" {
+		for _, seg := range strings.Split(extraPath, "/") {
+			if seg == "." || seg == ".." {
+				return "", errPathNotForwarded
+			}
+		}
+		dest.Path = strings.TrimSuffix(dest.Path, "/") + "/" + extraPath
+		dest.RawPath = ""
+	}
+
+	q := dest.Query()
+	if r.PassQuery {
+		for k, vs := range query {
+			q[k] = vs
+		}
+	}
+	for k, tmpl := range r.Params {
+		q.Set(k, expandTemplate(tmpl, link, variant.Name, query, now))
+	}
+	dest.RawQuery = q.Encode()
+	return dest.String(), nil
+}
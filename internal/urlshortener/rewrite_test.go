@@ -0,0 +1,129 @@
+package urlshortener
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedirectRulesDestination(t *testing.T) {
+	link := Link{
+		Code:        "abc",
+		OriginalUrl: "https://shop.example/landing?ref=short",
+		LinkOptions: LinkOptions{Owner: "growth", Tags: []string{"spring"}},
+	}
+	now := time.Date(2024, 4, 2, 23, 0, 0, 0, time.FixedZone("", -3*3600))
+	utm := map[string]string{
+		"utm_source":   "shortener",
+		"utm_campaign": "{tag}-{date}",
+		"utm_content":  "{code}/{query.v}",
+	}
+
+	for _, tc := range []struct {
+		name  string
+		rules RedirectRules
+		path  string
+		query string
+		want  string
+	}{
+		{"no rules", RedirectRules{}, "", "x=1", "https://shop.example/landing?ref=short"},
+		{"templates", RedirectRules{Params: utm}, "", "v=b&x=1",
+			"https://shop.example/landing?ref=short&utm_campaign=spring-2024-04-03&utm_content=abc%2Fb&utm_source=shortener"},
+		{"pass query", RedirectRules{PassQuery: true}, "", "x=1&ref=ad",
+			"https://shop.example/landing?ref=ad&x=1"},
+		{"templates win over passed query", RedirectRules{Params: utm, PassQuery: true}, "", "utm_source=evil",
+			"https://shop.example/landing?ref=short&utm_campaign=spring-2024-04-03&utm_content=abc%2F&utm_source=shortener"},
+		{"forward path", RedirectRules{ForwardPath: true}, "a/b c", "",
+			"https://shop.example/landing/a/b%20c?ref=short"},
+	} {
+		q, _ := url.ParseQuery(tc.query)
+		got, err := tc.rules.destination(link, Variant{}, tc.path, q, now)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s:\n got %s\nwant %s", tc.name, got, tc.want)
+		}
+	}
+
+	if _, err := (RedirectRules{}).destination(link, Variant{}, "a", nil, now); err != errPathNotForwarded {
+		t.Errorf("path on a link without forwarding: %v", err)
+	}
+	if _, err := (RedirectRules{ForwardPath: true}).destination(link, Variant{}, "a/../../admin", nil, now); err != errPathNotForwarded {
+		t.Errorf("dot segments: %v", err)
+	}
+}
+
+func TestRedirectRulesAPI(t *testing.T) {
+	srv := newTestAPI(t)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	create := func(body string) (string, int) {
+		resp, err := http.Post(srv.URL+"/short", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var short URLResponse
+		json.NewDecoder(resp.Body).Decode(&short)
+		return strings.TrimPrefix(short.ShortenedURL, "https://sho.rt/"), resp.StatusCode
+	}
+	get := func(path string) *http.Response {
+		resp, err := client.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	if _, status := create(`{"original_url":"https://example.com","redirect":{"params":{"a":"{nope}"}}}`); status != http.StatusBadRequest {
+		t.Errorf("unknown placeholder: status %d, want 400", status)
+	}
+
+	code, status := create(`{"original_url":"https://docs.example/v1/","redirect":{"params":{"utm_medium":"short-{code}"},"pass_query":true,"forward_path":true}}`)
+	if status != http.StatusOK {
+		t.Fatalf("create: status %d", status)
+	}
+	resp := get("/" + code + "/guide/intro?lang=de")
+	want := "https://docs.example/v1/guide/intro?lang=de&utm_medium=short-" + url.QueryEscape(code)
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != want {
+		t.Errorf("redirect: %d to %q, want %q", resp.StatusCode, resp.Header.Get("Location"), want)
+	}
+	// /{code}/stats and /{code}/qr are not forwarded
+	if resp := get("/" + code + "/stats"); resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("stats: %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	plain, _ := create(`{"original_url":"https://example.com/plain"}`)
+	if resp := get("/" + plain + "/extra"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("path on a link without forwarding: status %d, want 404", resp.StatusCode)
+	}
+	if resp := get("/" + plain + "?utm_source=x"); resp.Header.Get("Location") != "https://example.com/plain" {
+		t.Errorf("query passed without pass_query: %q", resp.Header.Get("Location"))
+	}
+}
+
+func TestContinueURL(t *testing.T) {
+	for _, tc := range []struct {
+		page, code, path, want string
+	}{
+		{"/abc+", "abc", "", "/abc?continue=tok"},
+		{"/abc", "abc", "", "/abc?continue=tok"},
+		{"/abc+/a/b", "abc", "a/b", "/abc/a/b?continue=tok"},
+		{"/s/abc/a/", "abc", "a/", "/s/abc/a/?continue=tok"},
+	} {
+		page, _ := url.Parse("https://sho.rt" + tc.page)
+		ref, err := url.Parse(continueURL(tc.code, tc.path, nil, "tok"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := page.ResolveReference(ref).RequestURI(); got != tc.want {
+			t.Errorf("from %s: %s, want %s", tc.page, got, tc.want)
+		}
+	}
+}
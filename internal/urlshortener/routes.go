@@ -0,0 +1,232 @@
+package urlshortener
+
+import (
+	"cmp"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Route sends the visits matching all of its conditions to one of its
+// variants, picked by weight. Empty conditions match every visit.
+type Route struct {
+	// Devices are device classes: mobile, tablet, desktop or bot.
+	Devices []string `json:"devices,omitempty"`
+	// Languages match the visitor's preferred language from
+	// Accept-Language: "de" matches de and de-AT, "pt-br" only pt-BR.
+	Languages []string `json:"languages,omitempty"`
+	// After and Before bound the time of the visit, inclusive and exclusive.
+	After  *time.Time `json:"after,omitempty"`
+	Before *time.Time `json:"before,omitempty"`
+	// Variants split the matching visits by weight.
+	Variants []Variant `json:"variants"`
+}
+
+// Variant is an alternative destination. Its name identifies it in click
+// counts and in the {variant} placeholder.
+type Variant struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// Weight is the variant's share of its route's visits, 1 if unset.
+	Weight int `json:"weight,omitempty"`
+}
+
+const (
+	maxRoutes   = 20
+	maxVariants = 10
+)
+
+var devices = []string{"mobile", "tablet", "desktop", "bot"}
+
+func validateRoutes(routes []Route) error {
+	if len(routes) > maxRoutes {
+		return fmt.Errorf("at most %d routes", maxRoutes)
+	}
+	var names []string
+	for i, rt := range routes {
+		if len(rt.Variants) == 0 || len(rt.Variants) > maxVariants {
+			return fmt.Errorf("route %d: 1 to %d variants", i, maxVariants)
+		}
+		for _, d := range rt.Devices {
+			if !slices.Contains(devices, d) {
+				return fmt.Errorf("route %d: unknown device %q, want one of %s", i, d, strings.Join(devices, ", "))
+			}
+		}
+		for _, l := range rt.Languages {
+			if l == "" || len(l) > 35 {
+				return fmt.Errorf("route %d: invalid language %q", i, l)
+			}
+		}
+		if rt.After != nil && rt.Before != nil && !rt.Before.After(*rt.After) {
+			return fmt.Errorf("route %d: before must be later than after", i)
+		}
+		for _, v := range rt.Variants {
+			if !tagRe.MatchString(v.Name) {
+				return fmt.Errorf("route %d: invalid variant name %q", i, v.Name)
+			}
+			if slices.Contains(names, v.Name) {
+				return fmt.Errorf("duplicate variant name %q", v.Name)
+			}
+			names = append(names, v.Name)
+			if v.Weight < 0 {
+				return fmt.Errorf("variant %s: negative weight", v.Name)
+			}
+			u, err := url.Parse(v.URL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("variant %s: url must be an absolute http(s) URL", v.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// visit is what routes are matched against.
+type visit struct {
+	device   string
+	language string
+	at       time.Time
+	// roll returns a random number in [0, n).
+	roll func(n int) int
+}
+
+func newVisit(r *http.Request, now time.Time) visit {
+	return visit{
+		device:   deviceClass(r.UserAgent()),
+		language: preferredLanguage(r.Header.Get("Accept-Language")),
+		at:       now,
+		roll:     rand.IntN,
+	}
+}
+
+// chooseVariant returns a variant of the first route matching v, or false to
+// use the link's own destination.
+func chooseVariant(routes []Route, v visit) (Variant, bool) {
+	for _, rt := range routes {
+		if rt.matches(v) {
+			return rt.pick(v.roll), true
+		}
+	}
+	return Variant{}, false
+}
+
+func (rt Route) matches(v visit) bool {
+	if len(rt.Devices) > 0 && !slices.Contains(rt.Devices, v.device) {
+		return false
+	}
+	if len(rt.Languages) > 0 && !slices.ContainsFunc(rt.Languages, func(l string) bool {
+		l = strings.ToLower(l)
+		return v.language == l || strings.HasPrefix(v.language, l+"-")
+	}) {
+		return false
+	}
+	if rt.After != nil && v.at.Before(*rt.After) {
+		return false
+	}
+	if rt.Before != nil && !v.at.Before(*rt.Before) {
+		return false
+	}
+	return true
+}
+
+func (rt Route) pick(roll func(n int) int) Variant {
+	total := 0
+	for _, v := range rt.Variants {
+		total += max(v.Weight, 1)
+	}
+	n := roll(total)
+	for _, v := range rt.Variants {
+		if n -= max(v.Weight, 1); n < 0 {
+			return v
+		}
+	}
+	return rt.Variants[len(rt.Variants)-1]
+}
+
+// deviceClass guesses mobile, tablet, desktop or bot from a User-Agent.
+func deviceClass(ua string) string {
+	ua = strings.ToLower(ua)
+	switch {
+	case ua == "" || containsAny(ua, "bot", "crawler", "spider", "slurp", "curl/", "wget/"):
+		return "bot"
+	case containsAny(ua, "ipad", "tablet", "kindle", "silk/") ||
+		(strings.Contains(ua, "android") && !strings.Contains(ua, "mobile")):
+		return "tablet"
+	case containsAny(ua, "mobi", "iphone", "ipod", "android", "windows phone"):
+		return "mobile"
+	}
+	return "desktop"
+}
+
+func containsAny(s string, subs ...string) bool {
+	for _, sub := range subs {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// preferredLanguage returns the lower-cased language with the highest
+// quality in an Accept-Language header, "" if there is none.
+func preferredLanguage(header string) string {
+	type lang struct {
+		tag string
+		q   float64
+	}
+	var langs []lang
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		if s, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			f, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				continue
+			}
+			q = f
+		}
+		if q > 0 {
+			langs = append(langs, lang{tag, q})
+		}
+	}
+	if len(langs) == 0 {
+		return ""
+	}
+	slices.SortStableFunc(langs, func(a, b lang) int { return cmp.Compare(b.q, a.q) })
+	return langs[0].tag
+}
+
+// VariantClicks returns the clicks of each variant of the link.
+func (u *UrlMapping) VariantClicks(code string) (map[string]int, error) {
+	seed, counter, err := u.decode(code)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := u.db.Query("SELECT variant, clicks FROM link_variant_clicks WHERE seed = ? AND counter = ?", seed, counter)
+	if err != nil {
+		return nil, fmt.Errorf("querying variant clicks: %w", err)
+	}
+	defer rows.Close()
+
+	clicks := map[string]int{}
+	for rows.Next() {
+		var variant string
+		var n int
+		if err := rows.Scan(&variant, &n); err != nil {
+			return nil, fmt.Errorf("scanning variant clicks: %w", err)
+		}
+		clicks[variant] = n
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating variant clicks: %w", err)
+	}
+	return clicks, nil
+}
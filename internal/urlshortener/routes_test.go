@@ -0,0 +1,150 @@
+package urlshortener
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeviceClass(t *testing.T) {
+	for ua, want := range map[string]string{
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) AppleWebKit/605.1.15 Mobile/15E148":     "mobile",
+		"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 Chrome/124.0 Mobile Safari/537.36": "mobile",
+		"Mozilla/5.0 (Linux; Android 13; SM-X710) AppleWebKit/537.36 Chrome/124.0 Safari/537.36":        "tablet",
+		"Mozilla/5.0 (iPad; CPU OS 17_4 like Mac OS X) AppleWebKit/605.1.15 Mobile/15E148":              "tablet",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 Chrome/124.0 Safari/537.36":       "desktop",
+		"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)":                      "bot",
+		"curl/8.5.0": "bot",
+		"":           "bot",
+	} {
+		if got := deviceClass(ua); got != want {
+			t.Errorf("deviceClass(%q) = %s, want %s", ua, got, want)
+		}
+	}
+}
+
+func TestPreferredLanguage(t *testing.T) {
+	for header, want := range map[string]string{
+		"":                            "",
+		"de-AT":                       "de-at",
+		"en;q=0.8, fr-CH, fr;q=0.9":   "fr-ch",
+		"*, es;q=0.5":                 "es",
+		"en;q=0, it;q=0.1, pt;q=oops": "it",
+	} {
+		if got := preferredLanguage(header); got != want {
+			t.Errorf("preferredLanguage(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestChooseVariant(t *testing.T) {
+	start := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 0, 7)
+	routes := []Route{
+		{Devices: []string{"mobile"}, Variants: []Variant{{Name: "app", URL: "https://app.example"}}},
+		{Languages: []string{"de"}, After: &start, Before: &end, Variants: []Variant{{Name: "sale-de", URL: "https://de.example/sale"}}},
+		{Variants: []Variant{
+			{Name: "a", URL: "https://a.example", Weight: 3},
+			{Name: "b", URL: "https://b.example"},
+		}},
+	}
+	roll := func(n int) func(int) int {
+		return func(total int) int {
+			if total != 4 && total != 1 {
+				t.Errorf("rolled over %d, want the route's total weight", total)
+			}
+			return n
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		v    visit
+		want string
+	}{
+		{"device", visit{device: "mobile", language: "de", at: start, roll: roll(0)}, "app"},
+		{"language in window", visit{device: "desktop", language: "de-at", at: start, roll: roll(0)}, "sale-de"},
+		{"language after window", visit{device: "desktop", language: "de", at: end, roll: roll(0)}, "a"},
+		{"other language", visit{device: "desktop", language: "dk", at: start, roll: roll(2)}, "a"},
+		{"weighted split", visit{device: "desktop", at: start, roll: roll(3)}, "b"},
+	} {
+		got, ok := chooseVariant(routes, tc.v)
+		if !ok || got.Name != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got.Name, tc.want)
+		}
+	}
+
+	if _, ok := chooseVariant(routes[:2], visit{device: "bot", roll: roll(0)}); ok {
+		t.Error("visit matching no route got a variant")
+	}
+}
+
+func TestRoutesAPI(t *testing.T) {
+	srv := newTestAPI(t)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	post := func(body string) (*http.Response, URLResponse) {
+		resp, err := http.Post(srv.URL+"/short", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var short URLResponse
+		json.NewDecoder(resp.Body).Decode(&short)
+		return resp, short
+	}
+
+	if resp, _ := post(`{"original_url":"https://example.com","redirect":{"routes":[{"devices":["phone"],"variants":[{"name":"x","url":"https://x.example"}]}]}}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown device: status %d, want 400", resp.StatusCode)
+	}
+
+	resp, short := post(`{"original_url":"https://shop.example","redirect":{
+		"params":{"utm_content":"{variant}"},
+		"routes":[
+			{"devices":["mobile"],"variants":[{"name":"app","url":"https://app.example/open"}]},
+			{"languages":["fr"],"variants":[{"name":"fr","url":"https://shop.example/fr"}]}
+		]}}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("create: status %d", resp.StatusCode)
+	}
+	code := strings.TrimPrefix(short.ShortenedURL, "https://sho.rt/")
+
+	visit := func(ua, lang string) string {
+		req, _ := http.NewRequest("GET", srv.URL+"/"+code, nil)
+		req.Header.Set("User-Agent", ua)
+		req.Header.Set("Accept-Language", lang)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.Header.Get("Location")
+	}
+	const iphone = "Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) Mobile/15E148"
+	const desktop = "Mozilla/5.0 (X11; Linux x86_64) Firefox/125.0"
+	for _, tc := range []struct{ ua, lang, want string }{
+		{iphone, "fr", "https://app.example/open?utm_content=app"},
+		{desktop, "fr-FR, en;q=0.5", "https://shop.example/fr?utm_content=fr"},
+		{desktop, "fr-FR, en;q=0.5", "https://shop.example/fr?utm_content=fr"},
+		{desktop, "en", "https://shop.example?utm_content="},
+	} {
+		if got := visit(tc.ua, tc.lang); got != tc.want {
+			t.Errorf("%s / %s: redirected to %s, want %s", tc.ua, tc.lang, got, tc.want)
+		}
+	}
+
+	resp, err := http.Get(srv.URL + "/" + code + "/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var stats LinkStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Clicks != 4 || stats.VariantClicks["app"] != 1 || stats.VariantClicks["fr"] != 2 || len(stats.VariantClicks) != 2 {
+		t.Errorf("clicks %d, variant clicks %v", stats.Clicks, stats.VariantClicks)
+	}
+}
@@ -0,0 +1,249 @@
+package urlshortener
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxTags     = 20
+	maxTitleLen = 200
+)
+
+var tagRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_.:-]{0,63}$`)
+
+// normalizeTags lower-cases and dedupes tags, rejecting ones that are not
+// short words of letters, digits and _ . : -
+func normalizeTags(tags []string) ([]string, error) {
+	var out []string
+	for _, t := range tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if !tagRe.MatchString(t) {
+			return nil, fmt.Errorf("invalid tag %q", t)
+		}
+		if !slices.Contains(out, t) {
+			out = append(out, t)
+		}
+	}
+	if len(out) > maxTags {
+		return nil, fmt.Errorf("at most %d tags per link", maxTags)
+	}
+	slices.Sort(out)
+	return out, nil
+}
+
+// setupTitleIndex creates the link_titles full-text index when FTS5 is built
+// in and indexes titles of links added since it was last updated, e.g. by a
+// binary built without FTS5. It is not a migration so that the same database
+// works with both builds.
+func setupTitleIndex(db *sql.DB) error {
+	if !hasFTS5 {
+		return nil
+	}
+	if _, err := db.Exec("CREATE VIRTUAL TABLE IF NOT EXISTS link_titles USING fts5(title)"); err != nil {
+		return fmt.Errorf("creating title index: %w", err)
+	}
+	_, err := db.Exec(`
+INSERT INTO link_titles (rowid, title)
+SELECT rowid, title FROM url_mapping
+WHERE title != '' AND rowid > (SELECT COALESCE(MAX(rowid), 0) FROM link_titles)`)
+	if err != nil {
+		return fmt.Errorf("updating title index: %w", err)
+	}
+	return nil
+}
+
+// insertLinkMeta stores the tags and indexes the title of the url_mapping row
+// just inserted as rowid.
+func insertLinkMeta(db execer, rowid int64, seed string, counter int, opts LinkOptions) error {
+	for _, tag := range opts.Tags {
+		_, err := db.Exec("INSERT OR IGNORE INTO link_tags (seed, counter, tag) VALUES (?,?,?)", seed, counter, tag)
+		if err != nil {
+			return fmt.Errorf("tagging link: %w", err)
+		}
+	}
+	if hasFTS5 && opts.Title != "" {
+		if _, err := db.Exec("INSERT INTO link_titles (rowid, title) VALUES (?,?)", rowid, opts.Title); err != nil {
+			return fmt.Errorf("indexing link title: %w", err)
+		}
+	}
+	return nil
+}
+
+// hasMeta reports whether storing opts takes more than the url_mapping row.
+func (o LinkOptions) hasMeta() bool {
+	return len(o.Tags) > 0 || (hasFTS5 && o.Title != "")
+}
+
+// SearchQuery filters links; zero fields match everything.
+type SearchQuery struct {
+	// URLPrefix matches the start of the original URL, ignoring case.
+	URLPrefix string
+	Owner     string
+	// Tags must all be present on a link.
+	Tags []string
+	// CreatedAfter and CreatedBefore bound created_at, inclusive and
+	// exclusive respectively.
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	// Title holds words that must all appear in the title.
+	Title  string
+	Limit  int
+	Offset int
+	// MatchHidden lets URLPrefix match password-protected and one-time
+	// links, whose destination a match would confirm.
+	MatchHidden bool
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// Search returns links matching q, newest first.
+func (u *UrlMapping) Search(q SearchQuery) ([]Link, error) {
+	where := []string{"deleted_at IS NULL"}
+	var args []any
+
+	if q.URLPrefix != "" {
+		where = append(where, `original_url LIKE ? ESCAPE '\'`)
+		args = append(args, likeEscaper.Replace(q.URLPrefix)+"%")
+		if !q.MatchHidden {
+			where = append(where, "password_hash = '' AND one_time = 0")
+		}
+	}
+	if q.Owner != "" {
+		where = append(where, "owner = ?")
+		args = append(args, q.Owner)
+	}
+	if len(q.Tags) > 0 {
+		where = append(where, "(SELECT COUNT(*) FROM link_tags t WHERE t.seed = url_mapping.seed "+
+			"AND t.counter = url_mapping.counter AND t.tag IN (?"+strings.Repeat(",?", len(q.Tags)-1)+")) = ?")
+		for _, t := range q.Tags {
+			args = append(args, t)
+		}
+		args = append(args, len(q.Tags))
+	}
+	if !q.CreatedAfter.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, q.CreatedAfter.UTC())
+	}
+	if !q.CreatedBefore.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, q.CreatedBefore.UTC())
+	}
+	if words := strings.Fields(q.Title); len(words) > 0 {
+		if hasFTS5 {
+			// quoted prefix terms, so user input is never FTS5 syntax
+			terms := make([]string, len(words))
+			for i, w := range words {
+				terms[i] = `"` + strings.ReplaceAll(w, `"`, `""`) + `"*`
+			}
+			where = append(where, "rowid IN (SELECT rowid FROM link_titles WHERE link_titles MATCH ?)")
+			args = append(args, strings.Join(terms, " "))
+		} else {
+			for _, w := range words {
+				where = append(where, `title LIKE ? ESCAPE '\'`)
+				args = append(args, "%"+likeEscaper.Replace(w)+"%")
+			}
+		}
+	}
+
+	query := "SELECT " + linkColumns + " FROM url_mapping WHERE " + strings.Join(where, " AND ") + " ORDER BY created_at DESC, rowid DESC LIMIT ? OFFSET ?"
+	args = append(args, q.Limit, q.Offset)
+
+	r, err := u.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("searching links: %w", err)
+	}
+	defer r.Close()
+
+	links := []Link{}
+	for r.Next() {
+		link, err := u.scanLink(r)
+		if err != nil {
+			return nil, fmt.Errorf("scanning link row: %w", err)
+		}
+		links = append(links, link)
+	}
+	if err := r.Err(); err != nil {
+		return nil, fmt.Errorf("iterating link rows: %w", err)
+	}
+	return links, nil
+}
+
+// parseSearchQuery reads a SearchQuery from the query parameters of
+// GET /links/search: url_prefix, owner, tag (repeated), created_after,
+// created_before (RFC 3339), q (title words), limit and offset.
+func parseSearchQuery(r *http.Request) (SearchQuery, error) {
+	v := r.URL.Query()
+	q := SearchQuery{
+		URLPrefix: v.Get("url_prefix"),
+		Owner:     v.Get("owner"),
+		Title:     v.Get("q"),
+		Limit:     50,
+	}
+
+	if len(v["tag"]) > 0 {
+		tags, err := normalizeTags(v["tag"])
+		if err != nil {
+			return SearchQuery{}, err
+		}
+		q.Tags = tags
+	}
+	for name, dst := range map[string]*time.Time{"created_after": &q.CreatedAfter, "created_before": &q.CreatedBefore} {
+		if s := v.Get(name); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return SearchQuery{}, fmt.Errorf("%s must be an RFC 3339 time", name)
+			}
+			*dst = t
+		}
+	}
+	if s := v.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > 500 {
+			return SearchQuery{}, errors.New("limit must be between 1 and 500")
+		}
+		q.Limit = n
+	}
+	if s := v.Get("offset"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return SearchQuery{}, errors.New("offset must be a non-negative number")
+		}
+		q.Offset = n
+	}
+	return q, nil
+}
+
+func handleSearch(links *UrlMapping) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q, err := parseSearchQuery(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, err.Error())
+			return
+		}
+		// only the admin sees where protected and one-time links lead
+		actor := actorFromContext(r.Context())
+		q.MatchHidden = actor == "admin"
+		list, err := links.Search(q)
+		if err != nil {
+			loggerFor(RequestIDFromContext(r.Context())).Error("searching links", "err", err)
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to search links")
+			return
+		}
+		stats := make([]LinkStats, len(list))
+		for i, l := range list {
+			stats[i] = newLinkStats(l)
+			if actor != "admin" {
+				stats[i].hideDestination()
+			}
+		}
+		writeJSON(w, http.StatusOK, LinkList{Links: stats})
+	}
+}
@@ -0,0 +1,144 @@
+package urlshortener
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSearch(t *testing.T) {
+	db, err := InitDBAt(filepath.Join(t.TempDir(), "search.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	day := func(d int) time.Time { return time.Date(2024, 3, d, 9, 0, 0, 0, time.UTC) }
+	for i, l := range []struct {
+		url, owner, title string
+		tags              []string
+		created           time.Time
+	}{
+		{"https://shop.example/spring", "growth", "Spring sale landing page", []string{"campaign:spring", "email"}, day(1)},
+		{"https://shop.example/summer", "growth", "Summer teaser", []string{"campaign:summer", "email"}, day(2)},
+		{"https://SHOP.example/spring/ads", "ads", "Spring sale banner", []string{"campaign:spring"}, day(3)},
+		{"https://blog.example/100%_real", "content", "Release notes", nil, day(4)},
+	} {
+		links := NewUrlMapping(db).WithClock(func() time.Time { return l.created })
+		opts := LinkOptions{Owner: l.owner, Title: l.title, Tags: l.tags}
+		if err := links.Create(l.url, "https://sho.rt/"+l.owner+l.url, "aaa", i+1, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	links := NewUrlMapping(db)
+	for _, tc := range []struct {
+		name string
+		q    SearchQuery
+		want []string // original URLs, newest first
+	}{
+		{"all", SearchQuery{}, []string{
+			"https://blog.example/100%_real", "https://SHOP.example/spring/ads",
+			"https://shop.example/summer", "https://shop.example/spring"}},
+		{"url prefix ignores case", SearchQuery{URLPrefix: "https://shop.example/spring"}, []string{
+			"https://SHOP.example/spring/ads", "https://shop.example/spring"}},
+		{"url prefix wildcards are literal", SearchQuery{URLPrefix: "https://blog.example/100%_"}, []string{
+			"https://blog.example/100%_real"}},
+		{"url prefix % is not a wildcard", SearchQuery{URLPrefix: "https://%"}, nil},
+		{"owner", SearchQuery{Owner: "growth"}, []string{
+			"https://shop.example/summer", "https://shop.example/spring"}},
+		{"all tags", SearchQuery{Tags: []string{"campaign:spring", "email"}}, []string{
+			"https://shop.example/spring"}},
+		{"owner and tag", SearchQuery{Owner: "growth", Tags: []string{"email"}}, []string{
+			"https://shop.example/summer", "https://shop.example/spring"}},
+		{"date range", SearchQuery{CreatedAfter: day(2), CreatedBefore: day(4)}, []string{
+			"https://SHOP.example/spring/ads", "https://shop.example/summer"}},
+		{"title words", SearchQuery{Title: "spring SALE"}, []string{
+			"https://SHOP.example/spring/ads", "https://shop.example/spring"}},
+		{"title word prefix", SearchQuery{Title: "relea"}, []string{"https://blog.example/100%_real"}},
+		{"title with fts syntax", SearchQuery{Title: `"sale" OR NEAR(`}, nil},
+		{"page", SearchQuery{Limit: 1, Offset: 1}, []string{"https://SHOP.example/spring/ads"}},
+	} {
+		if tc.q.Limit == 0 {
+			tc.q.Limit = 50
+		}
+		got, err := links.Search(tc.q)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		var urls []string
+		for _, l := range got {
+			urls = append(urls, l.OriginalUrl)
+		}
+		if !slices.Equal(urls, tc.want) {
+			t.Errorf("%s: got %q, want %q", tc.name, urls, tc.want)
+		}
+	}
+}
+
+func TestSearchAPI(t *testing.T) {
+	srv := newTestAPI(t)
+
+	post := func(body string) int {
+		resp, err := http.Post(srv.URL+"/short", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if s := post(`{"original_url":"https://example.com/a","owner":"team-x","title":"Launch video","tags":["Campaign:Y"," video "]}`); s != http.StatusOK {
+		t.Fatalf("create: status %d", s)
+	}
+	if s := post(`{"original_url":"https://example.com/b","owner":"team-x","tags":["campaign:z"]}`); s != http.StatusOK {
+		t.Fatalf("create: status %d", s)
+	}
+	if s := post(`{"original_url":"https://example.com/c","tags":["no spaces"]}`); s != http.StatusBadRequest {
+		t.Errorf("invalid tag: status %d, want 400", s)
+	}
+
+	search := func(query, auth string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest("GET", srv.URL+"/links/search?"+query, nil)
+		if auth != "" {
+			req.Header.Set("Authorization", "Bearer "+auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	// listing links needs a key even before the first one is issued
+	if resp := search("", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("anonymous search: status %d, want 401", resp.StatusCode)
+	}
+
+	v := url.Values{"owner": {"team-x"}, "tag": {"campaign:y"}, "q": {"launch"}}
+	resp := search(v.Encode(), "secret")
+	defer resp.Body.Close()
+	var list LinkList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Links) != 1 {
+		t.Fatalf("got %d links, want 1", len(list.Links))
+	}
+	l := list.Links[0]
+	if l.OriginalURL != "https://example.com/a" || l.Owner != "team-x" || l.Title != "Launch video" ||
+		!slices.Equal(l.Tags, []string{"campaign:y", "video"}) {
+		t.Errorf("link = %+v", l)
+	}
+
+	resp = search("created_after=yesterday", "secret")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("bad created_after: status %d, want 400", resp.StatusCode)
+	}
+}
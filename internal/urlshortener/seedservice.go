@@ -0,0 +1,514 @@
+package urlshortener
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// The seed service lets several urlshortener instances share one seeds table.
+// A single instance owns the database and leases seeds over HTTP; the others
+// run ManageSeeds with a RemoteSeeds source. Seeds are leased to one holder at
+// a time, so codes never collide across instances.
+//
+// Each frontend keeps the links it creates in its own database and serves
+// them under its own ShortUrlHost: a code resolves on the frontend that
+// issued it. Frontends renew their leases with heartbeats that carry how far
+// their url_mapping got in each seed; the leases of a frontend that stops
+// renewing are reclaimed after the lease TTL and resume from those counters.
+// A worker drops its seed once the lease is lost or has gone unrenewed for
+// the TTL, so a reclaimed seed is never issued from twice.
+
+const maxLeaseBlock = 64
+
+type leaseRequest struct {
+	Holder string `json:"holder"`
+	Count  int    `json:"count"`
+}
+
+type leaseResponse struct {
+	Seeds []seedJSON `json:"seeds"`
+	// TTLMillis is how long the leases last from the request without
+	// another renewal.
+	TTLMillis int64 `json:"ttl_ms,omitempty"`
+}
+
+type releaseRequest struct {
+	Holder      string `json:"holder"`
+	CounterUsed int    `json:"counter_used"`
+}
+
+// renewRequest reports the counters of the seeds the holder uses; the
+// response lists the seeds it still holds.
+type renewRequest struct {
+	Holder string     `json:"holder"`
+	Seeds  []seedJSON `json:"seeds"`
+}
+
+type seedJSON struct {
+	Seed        string `json:"seed"`
+	CounterUsed int    `json:"counter_used"`
+	CounterSize int    `json:"counter_size"`
+}
+
+func toSeedJSON(s Seed) seedJSON {
+	return seedJSON{Seed: s.Seed, CounterUsed: s.CounterUsed, CounterSize: s.CounterSize}
+}
+
+func (s seedJSON) seed() Seed {
+	return Seed{Seed: s.Seed, CounterUsed: s.CounterUsed, CounterSize: s.CounterSize}
+}
+
+// seedLease is a RemoteSeeds lease shared with the worker using the seed.
+// It ends when a heartbeat finds the seed gone, or when the leases were not
+// renewed within the service's TTL and the seed may have been reclaimed.
+type seedLease struct {
+	lost atomic.Bool
+	// until is the UnixNano time the lease runs out without a renewal; 0
+	// when the service does not say.
+	until atomic.Int64
+}
+
+func (l *seedLease) renew(sent time.Time, ttl time.Duration) {
+	if ttl > 0 {
+		l.until.Store(sent.Add(ttl).UnixNano())
+	}
+}
+
+// leaseLost reports whether the seed was leased from a seed service that may
+// no longer count it as ours; no code may be issued from it then.
+func (s Seed) leaseLost() bool {
+	if s.lease == nil {
+		return false
+	}
+	until := s.lease.until.Load()
+	return s.lease.lost.Load() || (until != 0 && time.Now().UnixNano() >= until)
+}
+
+type SeedServiceConfig struct {
+	// Token must be sent as a bearer token by every client. Without one the
+	// service refuses all requests.
+	Token string
+	// LeaseTTL is how long a lease lasts without being renewed, 1 minute by
+	// default.
+	LeaseTTL time.Duration
+	// Now is the clock for lease expiry; time.Now when nil.
+	Now func() time.Time
+}
+
+// NewSeedServiceHandler serves the lease API:
+//
+//	POST /seeds/lease           {"holder", "count"} -> {"seeds": [...]}
+//	POST /seeds/renew           {"holder", "seeds": [...]} -> {"seeds": [...]}
+//	POST /seeds/{seed}/release  {"holder", "counter_used"}
+//
+// Expired leases are reclaimed before new ones are handed out.
+func NewSeedServiceHandler(db *sql.DB, cfg SeedServiceConfig) http.Handler {
+	if cfg.LeaseTTL <= 0 {
+		cfg.LeaseTTL = time.Minute
+	}
+	if cfg.Now == nil {
+		cfg.Now = time.Now
+	}
+	seeds := NewSeedsDb(db)
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("POST /seeds/lease", requireAdmin(cfg.Token, func(w http.ResponseWriter, r *http.Request) {
+		logger := loggerFor(RequestIDFromContext(r.Context()))
+
+		var req leaseRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Holder == "" {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "Invalid request body")
+			return
+		}
+		count := min(max(req.Count, 1), maxLeaseBlock)
+
+		now := cfg.Now()
+		reclaimed, err := seeds.ReclaimExpired(now)
+		if err != nil {
+			logger.Error("reclaiming leases", "err", err)
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to lease seeds")
+			return
+		}
+		for _, seed := range reclaimed {
+			logger.Warn("expired lease reclaimed", "seed", seed.Seed, "counter_used", seed.CounterUsed)
+		}
+
+		resp := leaseResponse{Seeds: []seedJSON{}, TTLMillis: cfg.LeaseTTL.Milliseconds()}
+		for i := 0; i < count; i++ {
+			seed, err := seeds.AcquireUntil(req.Holder, now.Add(cfg.LeaseTTL))
+			if errors.Is(err, ErrNoSeeds) {
+				break
+			}
+			if err != nil {
+				logger.Error("leasing seed", "holder", req.Holder, "err", err)
+				writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to lease seeds")
+				return
+			}
+			resp.Seeds = append(resp.Seeds, toSeedJSON(seed))
+		}
+		if len(resp.Seeds) == 0 {
+			writeError(w, r, http.StatusServiceUnavailable, CodeUnavailable, ErrNoSeeds.Error())
+			return
+		}
+
+		logger.Info("seeds leased", "holder", req.Holder, "count", len(resp.Seeds))
+		writeJSON(w, http.StatusOK, resp)
+	}))
+
+	mux.HandleFunc("POST /seeds/renew", requireAdmin(cfg.Token, func(w http.ResponseWriter, r *http.Request) {
+		logger := loggerFor(RequestIDFromContext(r.Context()))
+
+		var req renewRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Holder == "" {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "Invalid request body")
+			return
+		}
+		reported := make([]Seed, len(req.Seeds))
+		for i, s := range req.Seeds {
+			reported[i] = s.seed()
+		}
+		held, err := seeds.Renew(req.Holder, reported, cfg.Now().Add(cfg.LeaseTTL))
+		if err != nil {
+			logger.Error("renewing leases", "holder", req.Holder, "err", err)
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to renew leases")
+			return
+		}
+
+		resp := leaseResponse{Seeds: []seedJSON{}, TTLMillis: cfg.LeaseTTL.Milliseconds()}
+		for _, seed := range held {
+			resp.Seeds = append(resp.Seeds, toSeedJSON(seed))
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}))
+
+	mux.HandleFunc("POST /seeds/{seed}/release", requireAdmin(cfg.Token, func(w http.ResponseWriter, r *http.Request) {
+		logger := loggerFor(RequestIDFromContext(r.Context()))
+
+		var req releaseRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Holder == "" {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "Invalid request body")
+			return
+		}
+
+		seed := Seed{Seed: r.PathValue("seed"), CounterUsed: req.CounterUsed}
+		err := seeds.Release(req.Holder, seed)
+		if errors.Is(err, ErrNotLeased) {
+			writeError(w, r, http.StatusConflict, CodeConflict, err.Error())
+			return
+		}
+		if err != nil {
+			logger.Error("releasing seed", "seed", seed.Seed, "err", err)
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to release seed")
+			return
+		}
+
+		logger.Info("seed released", "holder", req.Holder, "seed", seed.Seed, "counter_used", seed.CounterUsed)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	return mux
+}
+
+// StartSeedServer serves the lease API on addr until the listener fails.
+func StartSeedServer(db *sql.DB, addr string, cfg SeedServiceConfig) {
+	slog.Info("seed service listening", "addr", addr)
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           withRequestID(NewSeedServiceHandler(db, cfg)),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	err := srv.ListenAndServe()
+	slog.Error("seed service stopped", "err", err)
+	os.Exit(1)
+}
+
+// RemoteSeeds is a SeedSource backed by a seed service. It leases seeds in
+// blocks of BlockSize and hands them out locally one at a time. Start
+// recovers the leases of a previous run and keeps them renewed; Close
+// returns them all.
+type RemoteSeeds struct {
+	BaseURL    string
+	BlockSize  int
+	HTTPClient *http.Client
+	// Token authenticates to the seed service.
+	Token string
+	// Holder is the lease holder known to the service; all of this
+	// process's workers share it. Keeping it across restarts lets Start
+	// recover the previous run's leases; it is random by default.
+	Holder string
+	// Counter reports how far this instance's url_mapping got in seed, such
+	// as UrlMapping.GetSeedCounter, for heartbeats and releases. Optional.
+	Counter func(seed string) (int, error)
+	// HeartbeatInterval is how often leases are renewed, 10 seconds by
+	// default. It must stay well below the service's lease TTL.
+	HeartbeatInterval time.Duration
+
+	mu      sync.Mutex
+	pending []Seed
+	// held are the seeds leased from the service, pending or in use.
+	held     map[string]Seed
+	beatAt   time.Time
+	beatErr  error
+	stopBeat context.CancelFunc
+	beatDone chan struct{}
+}
+
+func NewRemoteSeeds(baseURL, token string, blockSize int) *RemoteSeeds {
+	return &RemoteSeeds{
+		BaseURL:    baseURL,
+		BlockSize:  blockSize,
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+		Token:      token,
+		Holder:     uuid.New().String(),
+		held:       map[string]Seed{},
+	}
+}
+
+var _ SeedSource = (*RemoteSeeds)(nil)
+var _ SeedSource = (*SeedsDb)(nil)
+
+func (rs *RemoteSeeds) heartbeatInterval() time.Duration {
+	if rs.HeartbeatInterval <= 0 {
+		return 10 * time.Second
+	}
+	return rs.HeartbeatInterval
+}
+
+func (rs *RemoteSeeds) Acquire(holder string) (Seed, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if len(rs.pending) == 0 {
+		var resp leaseResponse
+		sent := time.Now()
+		err := rs.post(context.Background(), "/seeds/lease",
+			leaseRequest{Holder: rs.Holder, Count: rs.BlockSize}, &resp)
+		if err != nil {
+			return Seed{}, err
+		}
+		for _, s := range resp.Seeds {
+			seed := s.seed()
+			seed.lease = &seedLease{}
+			seed.lease.renew(sent, time.Duration(resp.TTLMillis)*time.Millisecond)
+			rs.pending = append(rs.pending, seed)
+			rs.held[s.Seed] = seed
+		}
+		slog.Info("seed block leased", "holder", rs.Holder, "count", len(resp.Seeds))
+	}
+
+	seed := rs.pending[0]
+	rs.pending = rs.pending[1:]
+	return seed, nil
+}
+
+func (rs *RemoteSeeds) Release(holder string, seed Seed) error {
+	if seed.lease != nil && seed.lease.lost.Load() {
+		// the service already gave it away; heartbeat dropped it
+		return nil
+	}
+	seed.CounterUsed = rs.counter(seed)
+	err := rs.post(context.Background(), "/seeds/"+seed.Seed+"/release",
+		releaseRequest{Holder: rs.Holder, CounterUsed: seed.CounterUsed}, nil)
+	if err == nil || errors.Is(err, ErrNotLeased) {
+		rs.mu.Lock()
+		delete(rs.held, seed.Seed)
+		rs.mu.Unlock()
+	}
+	return err
+}
+
+// counter is how far seed was used: its counter, or further if url_mapping
+// says so.
+func (rs *RemoteSeeds) counter(seed Seed) int {
+	if rs.Counter == nil {
+		return seed.CounterUsed
+	}
+	used, err := rs.Counter(seed.Seed)
+	if err != nil {
+		slog.Error("reading seed counter", "seed", seed.Seed, "err", err)
+		return seed.CounterUsed
+	}
+	return max(used, seed.CounterUsed)
+}
+
+// Start returns the leases Holder still has from a previous run, with the
+// counters url_mapping reached, then renews the leases of this run in the
+// background until Close.
+func (rs *RemoteSeeds) Start() error {
+	var resp leaseResponse
+	if err := rs.post(context.Background(), "/seeds/renew", renewRequest{Holder: rs.Holder}, &resp); err != nil {
+		return fmt.Errorf("recovering seed leases: %w", err)
+	}
+	for _, s := range resp.Seeds {
+		seed := s.seed()
+		seed.CounterUsed = rs.counter(seed)
+		err := rs.post(context.Background(), "/seeds/"+seed.Seed+"/release",
+			releaseRequest{Holder: rs.Holder, CounterUsed: seed.CounterUsed}, nil)
+		if err != nil && !errors.Is(err, ErrNotLeased) {
+			return fmt.Errorf("recovering seed lease %s: %w", seed.Seed, err)
+		}
+		slog.Info("seed lease recovered", "holder", rs.Holder, "seed", seed.Seed, "counter_used", seed.CounterUsed)
+	}
+
+	rs.mu.Lock()
+	rs.beatAt, rs.beatErr = time.Now(), nil
+	ctx, cancel := context.WithCancel(context.Background())
+	rs.stopBeat, rs.beatDone = cancel, make(chan struct{})
+	rs.mu.Unlock()
+
+	go func() {
+		defer close(rs.beatDone)
+		ticker := time.NewTicker(rs.heartbeatInterval())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				rs.heartbeat(ctx)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// heartbeat renews the leases, reporting their counters. Seeds the service
+// no longer lists as ours are dropped from pending and marked lost, so the
+// worker using one stops issuing codes from it.
+func (rs *RemoteSeeds) heartbeat(ctx context.Context) {
+	rs.mu.Lock()
+	req := renewRequest{Holder: rs.Holder, Seeds: []seedJSON{}}
+	held := make([]Seed, 0, len(rs.held))
+	for _, seed := range rs.held {
+		held = append(held, seed)
+	}
+	rs.mu.Unlock()
+	for _, seed := range held {
+		seed.CounterUsed = rs.counter(seed)
+		req.Seeds = append(req.Seeds, toSeedJSON(seed))
+	}
+
+	var resp leaseResponse
+	sent := time.Now()
+	err := rs.post(ctx, "/seeds/renew", req, &resp)
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.Error("renewing seed leases", "holder", rs.Holder, "err", err)
+		}
+		rs.beatErr = err
+		return
+	}
+	rs.beatAt, rs.beatErr = time.Now(), nil
+
+	still := map[string]bool{}
+	for _, s := range resp.Seeds {
+		still[s.Seed] = true
+	}
+	for _, seed := range held {
+		if still[seed.Seed] {
+			seed.lease.renew(sent, time.Duration(resp.TTLMillis)*time.Millisecond)
+			continue
+		}
+		if _, ok := rs.held[seed.Seed]; ok {
+			slog.Error("seed lease lost", "holder", rs.Holder, "seed", seed.Seed)
+			seed.lease.lost.Store(true)
+			delete(rs.held, seed.Seed)
+		}
+	}
+	pending := rs.pending[:0]
+	for _, seed := range rs.pending {
+		if _, ok := rs.held[seed.Seed]; ok {
+			pending = append(pending, seed)
+		}
+	}
+	rs.pending = pending
+}
+
+// Check reports whether the last heartbeat reached the seed service, for
+// readiness probes.
+func (rs *RemoteSeeds) Check(ctx context.Context) CheckResult {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	switch {
+	case rs.beatAt.IsZero():
+		return CheckResult{Detail: "seed service not contacted yet"}
+	case rs.beatErr != nil:
+		return CheckResult{Detail: rs.beatErr.Error()}
+	}
+	return CheckResult{OK: true, Detail: fmt.Sprintf("leases renewed %s ago", time.Since(rs.beatAt).Round(time.Second))}
+}
+
+// Close stops renewing the leases and releases them all, with the counters
+// url_mapping reached. The workers must have stopped.
+func (rs *RemoteSeeds) Close() error {
+	rs.mu.Lock()
+	if rs.stopBeat != nil {
+		rs.stopBeat()
+		rs.mu.Unlock()
+		<-rs.beatDone
+		rs.mu.Lock()
+	}
+	held := make([]Seed, 0, len(rs.held))
+	for _, seed := range rs.held {
+		held = append(held, seed)
+	}
+	rs.pending = nil
+	rs.mu.Unlock()
+
+	var errs []error
+	for _, seed := range held {
+		if err := rs.Release(rs.Holder, seed); err != nil && !errors.Is(err, ErrNotLeased) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (rs *RemoteSeeds) post(ctx context.Context, path string, body, out any) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rs.BaseURL+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+rs.Token)
+
+	resp, err := rs.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("calling seed service: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusServiceUnavailable:
+		return ErrNoSeeds
+	case resp.StatusCode == http.StatusConflict:
+		return ErrNotLeased
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("seed service %s: unexpected status %s", path, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decoding seed service response: %w", err)
+	}
+	return nil
+}
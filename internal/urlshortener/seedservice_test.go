@@ -0,0 +1,402 @@
+package urlshortener
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRemoteSeedsLeaseWithoutCollisions(t *testing.T) {
+	db, err := InitDBAt(filepath.Join(t.TempDir(), "seeds.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	total := len(generateSeeds())
+
+	srv := httptest.NewServer(NewSeedServiceHandler(db, SeedServiceConfig{Token: "seed-token"}))
+	defer srv.Close()
+
+	// three frontends draining the pool concurrently
+	var mu sync.Mutex
+	seen := map[string]int{}
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		remote := NewRemoteSeeds(srv.URL, "seed-token", 4)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				seed, err := remote.Acquire("worker")
+				if errors.Is(err, ErrNoSeeds) {
+					return
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				seen[seed.Seed]++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(seen) != total {
+		t.Errorf("leased %d distinct seeds, want %d", len(seen), total)
+	}
+	for seed, n := range seen {
+		if n != 1 {
+			t.Errorf("seed %s leased %d times", seed, n)
+		}
+	}
+}
+
+func TestRemoteSeedsRelease(t *testing.T) {
+	db, err := InitDBAt(filepath.Join(t.TempDir(), "seeds.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	srv := httptest.NewServer(NewSeedServiceHandler(db, SeedServiceConfig{Token: "seed-token"}))
+	defer srv.Close()
+
+	a, b := NewRemoteSeeds(srv.URL, "seed-token", 1), NewRemoteSeeds(srv.URL, "seed-token", 1)
+	seed, err := a.Acquire("worker")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seed.CounterUsed = seed.CounterSize
+	if err := b.Release("worker", seed); !errors.Is(err, ErrNotLeased) {
+		t.Errorf("release by another instance: err = %v, want ErrNotLeased", err)
+	}
+	if err := a.Release("worker", seed); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+
+	exhausted, err := NewSeedsDb(db).SelectSeedByStatus(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exhausted) != 1 || exhausted[0].Seed != seed.Seed {
+		t.Errorf("exhausted seeds = %v, want [%s]", exhausted, seed.Seed)
+	}
+}
+
+func TestSeedServiceRequiresToken(t *testing.T) {
+	db, err := InitDBAt(filepath.Join(t.TempDir(), "seeds.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for name, cfg := range map[string]SeedServiceConfig{
+		"wrong token": {Token: "seed-token"},
+		"no token":    {},
+	} {
+		srv := httptest.NewServer(NewSeedServiceHandler(db, cfg))
+		remote := NewRemoteSeeds(srv.URL, "guess", 1)
+		if _, err := remote.Acquire("worker"); err == nil || errors.Is(err, ErrNoSeeds) {
+			t.Errorf("%s: Acquire err = %v, want a refusal", name, err)
+		}
+		if err := remote.Start(); err == nil {
+			t.Errorf("%s: Start succeeded", name)
+		}
+		srv.Close()
+	}
+	if leased, _ := NewSeedsDb(db).SelectSeedByStatus(1); len(leased) != 0 {
+		t.Errorf("seeds leased without the token: %v", leased)
+	}
+}
+
+func TestSeedLeasesExpire(t *testing.T) {
+	db, err := InitDBAt(filepath.Join(t.TempDir(), "seeds.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var mu sync.Mutex
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	advance := func(d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(d)
+	}
+	srv := httptest.NewServer(NewSeedServiceHandler(db, SeedServiceConfig{
+		Token:    "seed-token",
+		LeaseTTL: time.Minute,
+		Now: func() time.Time {
+			mu.Lock()
+			defer mu.Unlock()
+			return now
+		},
+	}))
+	defer srv.Close()
+
+	// a leases a block, uses one seed up to 5 and then stops renewing
+	a := NewRemoteSeeds(srv.URL, "seed-token", 2)
+	inUse, err := a.Acquire("worker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Counter = func(seed string) (int, error) {
+		if seed == inUse.Seed {
+			return 5, nil
+		}
+		return 0, nil
+	}
+	a.heartbeat(context.Background())
+	if c := a.Check(context.Background()); !c.OK {
+		t.Errorf("Check after a heartbeat = %+v", c)
+	}
+
+	advance(59 * time.Second)
+	b := NewRemoteSeeds(srv.URL, "seed-token", 1)
+	if _, err := b.Acquire("worker"); err != nil {
+		t.Fatal(err)
+	}
+	if leased, _ := NewSeedsDb(db).SelectSeedByStatus(1); len(leased) != 3 {
+		t.Fatalf("%d seeds leased before the TTL, want 3", len(leased))
+	}
+
+	advance(2 * time.Second)
+	if _, err := b.Acquire("worker"); err != nil {
+		t.Fatal(err)
+	}
+	infos, err := NewSeedsDb(db).SelectAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range infos {
+		if info.LeaseHolder != a.Holder {
+			continue
+		}
+		if info.Status != 0 {
+			t.Errorf("seed %s of the silent holder still leased", info.Seed)
+		}
+		if want := map[bool]int{true: 5, false: 0}[info.Seed == inUse.Seed]; info.CounterUsed != want {
+			t.Errorf("seed %s reclaimed at counter %d, want %d", info.Seed, info.CounterUsed, want)
+		}
+	}
+
+	// a finds out with its next heartbeat and stops handing out its block
+	if inUse.leaseLost() {
+		t.Error("lease lost before the heartbeat")
+	}
+	a.heartbeat(context.Background())
+	if !inUse.leaseLost() {
+		t.Error("lease of the seed in use not marked lost")
+	}
+	a.mu.Lock()
+	pending, held := len(a.pending), len(a.held)
+	a.mu.Unlock()
+	if pending != 0 || held != 0 {
+		t.Errorf("after losing its leases a still has %d pending and %d held seeds", pending, held)
+	}
+}
+
+// A worker stops issuing codes from a seed once its lease is lost, even
+// though it holds the seed in hand.
+func TestWorkerDropsLostSeed(t *testing.T) {
+	dir := t.TempDir()
+	seedDB, err := InitDBAt(filepath.Join(dir, "seeds.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seedDB.Close()
+	var mu sync.Mutex
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	srv := httptest.NewServer(NewSeedServiceHandler(seedDB, SeedServiceConfig{
+		Token:    "seed-token",
+		LeaseTTL: time.Minute,
+		Now: func() time.Time {
+			mu.Lock()
+			defer mu.Unlock()
+			return now
+		},
+	}))
+	defer srv.Close()
+
+	db, err := InitDBAt(filepath.Join(dir, "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	remote := NewRemoteSeeds(srv.URL, "seed-token", 1)
+	seedCh := make(chan SeedRequest)
+	workCh := make(chan WorkRequest)
+	defer close(seedCh)
+	defer close(workCh)
+	go ManageSeeds(remote, seedCh)
+	StartWorkers(db, workCh, seedCh, 1)
+	seedOf := func() string {
+		t.Helper()
+		doneCh := make(chan WorkResponse, 1)
+		workCh <- WorkRequest{OriginalUrl: "https://example.com/", ShortUrlHost: "sho.rt", DoneCh: doneCh}
+		resp := <-doneCh
+		if resp.Err != nil {
+			t.Fatalf("shortening: %v", resp.Err)
+		}
+		seed, _, err := SequentialCodes{}.Decode(codeOfShortURL(resp.ShortUrl))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return seed
+	}
+
+	first := seedOf()
+	mu.Lock()
+	now = now.Add(2 * time.Minute)
+	mu.Unlock()
+	if _, err := NewRemoteSeeds(srv.URL, "seed-token", 1).Acquire("worker"); err != nil {
+		t.Fatal(err)
+	}
+	remote.heartbeat(context.Background())
+
+	if second := seedOf(); second == first {
+		t.Errorf("worker kept issuing codes from seed %s after losing its lease", first)
+	}
+}
+
+// Frontends each store their links and serve them under their own host,
+// leasing seeds from one seed service.
+func TestFrontendsShareSeedService(t *testing.T) {
+	dir := t.TempDir()
+	seedDB, err := InitDBAt(filepath.Join(dir, "seeds.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seedDB.Close()
+	service := httptest.NewServer(NewSeedServiceHandler(seedDB, SeedServiceConfig{Token: "seed-token"}))
+	defer service.Close()
+
+	type frontend struct {
+		srv    *Server
+		api    *httptest.Server
+		remote *RemoteSeeds
+	}
+	start := func(name, holder string) frontend {
+		t.Helper()
+		db, err := InitDBAt(filepath.Join(dir, name+".db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		remote := NewRemoteSeeds(service.URL, "seed-token", 2)
+		remote.Holder = holder
+		remote.Counter = NewUrlMapping(db).GetSeedCounter
+		if err := remote.Start(); err != nil {
+			t.Fatal(err)
+		}
+		srv, err := NewServer(WithDB(db), WithWorkers(2), WithSeedSource(remote),
+			WithHttpConfig(HttpConfig{ShortUrlHost: name + ".sho.rt"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		api := httptest.NewServer(srv.Handler())
+		t.Cleanup(api.Close)
+		return frontend{srv, api, remote}
+	}
+	shorten := func(f frontend, dest string) string {
+		t.Helper()
+		resp, err := http.Post(f.api.URL+"/short", "application/json", strings.NewReader(`{"original_url":"`+dest+`"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var short URLResponse
+		json.NewDecoder(resp.Body).Decode(&short)
+		u, err := url.Parse(short.ShortenedURL)
+		if err != nil || u.Host == "" {
+			t.Fatalf("shortening on %s: status %d, %q", f.api.URL, resp.StatusCode, short.ShortenedURL)
+		}
+		return u.Host + u.Path
+	}
+	status := func(f frontend, path string) int {
+		t.Helper()
+		client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+		resp, err := client.Get(f.api.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	a, b := start("a", "frontend-a"), start("b", "frontend-b")
+	codes := map[string]string{}
+	for i := 0; i < 10; i++ {
+		for _, f := range []frontend{a, b} {
+			short := shorten(f, "https://example.com/"+f.remote.Holder)
+			host, path, _ := strings.Cut(short, "/")
+			if prev, ok := codes[path]; ok {
+				t.Fatalf("code %s issued as %s and %s", path, prev, short)
+			}
+			codes[path] = short
+			if got := status(f, "/"+path); got != http.StatusFound {
+				t.Errorf("%s on its own frontend: status %d", short, got)
+			}
+			other := map[string]frontend{"a.sho.rt": b, "b.sho.rt": a}[host]
+			if got := status(other, "/"+path); got != http.StatusNotFound {
+				t.Errorf("%s on the other frontend: status %d, want 404", short, got)
+			}
+		}
+	}
+	if got := status(a, "/readyz"); got != http.StatusOK {
+		t.Errorf("frontend /readyz: status %d", got)
+	}
+
+	// a shuts down cleanly and returns its seeds with their counters
+	a.srv.Shutdown(context.Background())
+	if err := a.remote.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkReleased := func(holder string, db *sql.DB) {
+		t.Helper()
+		infos, _ := NewSeedsDb(seedDB).SelectAll()
+		for _, info := range infos {
+			if info.LeaseHolder != holder {
+				continue
+			}
+			if info.Status == 1 {
+				t.Errorf("seed %s still leased to %s", info.Seed, holder)
+			}
+			used, _ := NewUrlMapping(db).GetSeedCounter(info.Seed)
+			if info.CounterUsed < used {
+				t.Errorf("seed %s released at counter %d, but %s used %d", info.Seed, info.CounterUsed, holder, used)
+			}
+		}
+	}
+	checkReleased("frontend-a", a.srv.DB())
+
+	// b crashes; restarted under the same holder it recovers its leases
+	b.remote.mu.Lock()
+	b.remote.stopBeat()
+	b.remote.mu.Unlock()
+	b.srv.Shutdown(context.Background())
+	restarted := start("b", "frontend-b")
+	checkReleased("frontend-b", restarted.srv.DB())
+	short := shorten(restarted, "https://example.com/after-restart")
+	if _, ok := codes[strings.SplitN(short, "/", 2)[1]]; ok {
+		t.Errorf("code %s issued again after the restart", short)
+	}
+
+	// readiness follows the seed service
+	service.Close()
+	restarted.remote.heartbeat(context.Background())
+	if got := status(restarted, "/readyz"); got != http.StatusServiceUnavailable {
+		t.Errorf("/readyz without the seed service: status %d, want 503", got)
+	}
+}
@@ -0,0 +1,439 @@
+package urlshortener
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Server is the shortener as one embeddable value: seed manager, workers and
+// HTTP API. NewServer starts the workers, so Handler can be mounted in
+// another service straight away; Start additionally listens on the
+// configured address.
+type Server struct {
+	db       *sql.DB
+	ownsDB   bool
+	dbPath   string
+	mux      *http.ServeMux
+	addr     string
+	workers  int
+	seeds    SeedSource
+	links    LinkWriter
+	minSeeds int
+	now      func() time.Time
+	codes    CodeScheme
+	cfg      HttpConfig
+	hookCfg  WebhookConfig
+	hookN    int
+	checkCfg *LinkCheckerConfig
+	snapCfg  *SnapshotConfig
+	tlsCfg   *TLSConfig
+
+	workCh  chan WorkRequest
+	seedCh  chan SeedRequest
+	pool    *WorkerPool
+	hooks   *WebhookWorkers
+	checker *LinkChecker
+	snaps   *SnapshotPublisher
+	handler http.Handler
+
+	mu          sync.Mutex
+	httpSrv     *http.Server
+	listener    net.Listener
+	redirectSrv *http.Server
+	redirectLn  net.Listener
+	stopCerts   context.CancelFunc
+	stopped     bool
+
+	// requests holds a read lock per request being served; Shutdown takes
+	// the write lock before closing workCh, so no handler is left to send
+	// on it. closing refuses the requests that come after.
+	requests sync.RWMutex
+	closing  atomic.Bool
+	drained  chan struct{}
+}
+
+type ServerOption func(*Server)
+
+// WithDB uses an already opened and migrated database; the caller closes it.
+// As with WithDBPath, leases left behind by the previous run are recovered
+// unless seeds come from WithSeedSource, so the database must not be shared
+// with another running Server.
+func WithDB(db *sql.DB) ServerOption {
+	return func(s *Server) { s.db = db }
+}
+
+// WithDBPath opens the database at path with InitDBAt; Shutdown closes it.
+// Unless seeds come from WithSeedSource, leases left behind by the previous
+// run are recovered with SyncSeedsFromUrlMapping.
+func WithDBPath(path string) ServerOption {
+	return func(s *Server) { s.dbPath = path }
+}
+
+// WithMux registers the API on mux, under the base path if one is set,
+// instead of leaving it to the caller to mount Handler.
+func WithMux(mux *http.ServeMux) ServerOption {
+	return func(s *Server) { s.mux = mux }
+}
+
+// WithAddr sets the address Start listens on, ":8080" by default.
+func WithAddr(addr string) ServerOption {
+	return func(s *Server) { s.addr = addr }
+}
+
+// WithWorkers sets the number of shortening workers, 10 by default.
+func WithWorkers(n int) ServerOption {
+	return func(s *Server) { s.workers = n }
+}
+
+// WithClock timestamps links and API keys with now instead of time.Now.
+func WithClock(now func() time.Time) ServerOption {
+	return func(s *Server) { s.now = now }
+}
+
+// WithCodeScheme issues and resolves short codes with codes, such as
+// PermutedCodes, instead of SequentialCodes, unless the HttpConfig brings
+// its own.
+func WithCodeScheme(codes CodeScheme) ServerOption {
+	return func(s *Server) { s.codes = codes }
+}
+
+// WithSeedSource leases seeds from src, such as RemoteSeeds, instead of the
+// server's database. The caller starts and closes it; a RemoteSeeds is
+// added to the readiness checks.
+func WithSeedSource(src SeedSource) ServerOption {
+	return func(s *Server) { s.seeds = src }
+}
+
+// WithLinkWriter stores links through w, such as a BatchWriter.
+func WithLinkWriter(w LinkWriter) ServerOption {
+	return func(s *Server) { s.links = w }
+}
+
+// WithMinSeeds sets how many seeds must be available or leased for /readyz,
+// unless the HttpConfig brings its own Health.
+func WithMinSeeds(n int) ServerOption {
+	return func(s *Server) { s.minSeeds = n }
+}
+
+// WithWebhooks configures webhook delivery with numWorkers senders, 2 by
+// default; 0 leaves the outbox to be delivered by another process.
+func WithWebhooks(cfg WebhookConfig, numWorkers int) ServerOption {
+	return func(s *Server) { s.hookCfg, s.hookN = cfg, numWorkers }
+}
+
+// WithLinkChecker periodically checks link destinations, see LinkChecker.
+// The checker is off unless this option is given.
+func WithLinkChecker(cfg LinkCheckerConfig) ServerOption {
+	return func(s *Server) { s.checkCfg = &cfg }
+}
+
+// WithSnapshots publishes snapshots of the links for read-only redirect
+// nodes, see SnapshotPublisher.
+func WithSnapshots(cfg SnapshotConfig) ServerOption {
+	return func(s *Server) { s.snapCfg = &cfg }
+}
+
+// WithTLS makes Start serve HTTPS and HTTP/2, see TLSConfig, unless the
+// HttpConfig brings its own TLS.
+func WithTLS(cfg TLSConfig) ServerOption {
+	return func(s *Server) { s.tlsCfg = &cfg }
+}
+
+// WithBasePath serves the API under prefix, e.g. "/s". Short URLs are built
+// from ShortUrlHost, which should then include the prefix too.
+func WithBasePath(prefix string) ServerOption {
+	return func(s *Server) { s.cfg.BasePath = strings.TrimSuffix(prefix, "/") }
+}
+
+// WithHttpConfig sets the API configuration. Its Addr is used unless
+// WithAddr is given as well.
+func WithHttpConfig(cfg HttpConfig) ServerOption {
+	return func(s *Server) {
+		base := s.cfg.BasePath
+		s.cfg = cfg
+		if s.cfg.BasePath == "" {
+			s.cfg.BasePath = base
+		}
+	}
+}
+
+func NewServer(opts ...ServerOption) (*Server, error) {
+	s := &Server{workers: 10, hookN: 2, now: time.Now}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.workers < 1 {
+		return nil, fmt.Errorf("urlshortener: invalid worker count %d", s.workers)
+	}
+	if s.hookN < 0 {
+		return nil, fmt.Errorf("urlshortener: invalid webhook worker count %d", s.hookN)
+	}
+	if s.db == nil {
+		if s.dbPath == "" {
+			return nil, errors.New("urlshortener: server needs WithDB or WithDBPath")
+		}
+		db, err := InitDBAt(s.dbPath)
+		if err != nil {
+			return nil, err
+		}
+		s.db, s.ownsDB = db, true
+	}
+	if s.addr == "" {
+		s.addr = s.cfg.Addr
+	}
+	if s.addr == "" {
+		s.addr = ":8080"
+	}
+	if s.cfg.TLS != nil {
+		s.tlsCfg = s.cfg.TLS
+	}
+
+	if s.seeds == nil {
+		if err := SyncSeedsFromUrlMapping(s.db); err != nil {
+			if s.ownsDB {
+				s.db.Close()
+			}
+			return nil, fmt.Errorf("urlshortener: syncing seeds: %w", err)
+		}
+		s.seeds = NewSeedsDb(s.db)
+	}
+	if s.links == nil {
+		s.links = NewUrlMapping(s.db).WithClock(s.now)
+	}
+	if s.cfg.Clock == nil {
+		s.cfg.Clock = s.now
+	}
+	if s.cfg.Codes == nil {
+		s.cfg.Codes = s.codes
+	}
+
+	s.workCh = make(chan WorkRequest)
+	s.seedCh = make(chan SeedRequest)
+	go ManageSeeds(s.seeds, s.seedCh)
+	s.pool = StartLinkWorkers(s.links, s.workCh, s.seedCh, s.workers)
+	if s.cfg.Health == nil {
+		s.cfg.Health = NewHealth(s.db, s.pool, s.minSeeds)
+		if remote, ok := s.seeds.(*RemoteSeeds); ok {
+			s.cfg.Health.AddCheck("seed_service", remote.Check)
+		}
+	}
+	if s.hookN > 0 {
+		if s.hookCfg.Now == nil {
+			s.hookCfg.Now = s.now
+		}
+		s.hooks = StartWebhookWorkers(s.db, s.hookCfg, s.hookN)
+	}
+	if s.checkCfg != nil {
+		if s.checkCfg.Now == nil {
+			s.checkCfg.Now = s.now
+		}
+		s.checker = StartLinkChecker(s.db, *s.checkCfg)
+	}
+	if s.snapCfg != nil {
+		s.snaps = StartSnapshotPublisher(NewUrlMapping(s.db).WithClock(s.now).WithCodes(s.cfg.Codes), *s.snapCfg)
+	}
+
+	s.handler = s.refuseStopped(NewHandler(s.db, s.workCh, s.cfg))
+	if s.cfg.BasePath != "" {
+		s.handler = http.StripPrefix(s.cfg.BasePath, s.handler)
+	}
+	if s.mux != nil {
+		s.mux.Handle(s.cfg.BasePath+"/", s.handler)
+	}
+	return s, nil
+}
+
+// Handler serves the API, expecting request paths to include the base path.
+// Once Shutdown has begun it answers 503.
+func (s *Server) Handler() http.Handler { return s.handler }
+
+// refuseStopped tracks the requests next serves for Shutdown and answers 503
+// once it has begun.
+func (s *Server) refuseStopped(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// TryRLock fails while Shutdown waits for the write lock
+		if !s.requests.TryRLock() {
+			writeError(w, r, http.StatusServiceUnavailable, CodeUnavailable, "Server is shutting down")
+			return
+		}
+		defer s.requests.RUnlock()
+		if s.closing.Load() {
+			writeError(w, r, http.StatusServiceUnavailable, CodeUnavailable, "Server is shutting down")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// DB returns the server's database handle.
+func (s *Server) DB() *sql.DB { return s.db }
+
+// Workers reports the worker pool, e.g. for health checks.
+func (s *Server) Workers() *WorkerPool { return s.pool }
+
+// Start listens on the configured address and serves Handler, or the mux
+// given with WithMux, in the background. Cancelling ctx shuts the server down.
+// With TLS it serves HTTPS, watches the certificate files and starts the
+// redirect listener if one is configured.
+func (s *Server) Start(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return http.ErrServerClosed
+	}
+	if s.httpSrv != nil {
+		return errors.New("urlshortener: server already started")
+	}
+
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("urlshortener: listening: %w", err)
+	}
+	var h http.Handler = s.handler
+	if s.mux != nil {
+		h = s.mux
+	}
+	if s.tlsCfg == nil {
+		s.httpSrv = &http.Server{Handler: h, ReadHeaderTimeout: 10 * time.Second}
+		slog.Info("http server listening", "addr", ln.Addr().String())
+		go serve(s.httpSrv, ln, false)
+	} else if err := s.startTLS(ln, h); err != nil {
+		ln.Close()
+		return err
+	}
+	s.listener = ln
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		s.Shutdown(shutdownCtx)
+	}()
+	return nil
+}
+
+func (s *Server) startTLS(ln net.Listener, h http.Handler) error {
+	srv, certs, err := s.tlsCfg.server(h)
+	if err != nil {
+		return fmt.Errorf("urlshortener: %w", err)
+	}
+	if s.tlsCfg.RedirectAddr != "" {
+		rln, err := net.Listen("tcp", s.tlsCfg.RedirectAddr)
+		if err != nil {
+			return fmt.Errorf("urlshortener: listening for https redirects: %w", err)
+		}
+		_, port, _ := net.SplitHostPort(ln.Addr().String())
+		s.redirectLn = rln
+		s.redirectSrv = &http.Server{Handler: redirectToHTTPS(port), ReadHeaderTimeout: 10 * time.Second}
+		slog.Info("https redirect listener", "addr", rln.Addr().String())
+		go serve(s.redirectSrv, rln, false)
+	}
+	watchCtx, cancel := context.WithCancel(context.Background())
+	go certs.Watch(watchCtx, s.tlsCfg.reloadInterval())
+	s.stopCerts = cancel
+	s.httpSrv = srv
+	slog.Info("https server listening", "addr", ln.Addr().String())
+	go serve(srv, ln, true)
+	return nil
+}
+
+func serve(srv *http.Server, ln net.Listener, useTLS bool) {
+	var err error
+	if useTLS {
+		err = srv.ServeTLS(ln, "", "")
+	} else {
+		err = srv.Serve(ln)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("http server stopped", "err", err)
+	}
+}
+
+// Addr is the address the server listens on once started, useful with ":0".
+func (s *Server) Addr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return s.addr
+	}
+	return s.listener.Addr().String()
+}
+
+// RedirectAddr is the address of the HTTPS redirect listener once started,
+// empty without one.
+func (s *Server) RedirectAddr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.redirectLn == nil {
+		return ""
+	}
+	return s.redirectLn.Addr().String()
+}
+
+// Shutdown stops accepting requests, on the redirect listener too, waits for
+// those in flight until ctx ends, then stops the certificate watcher, the
+// workers, the link checker and the snapshot publisher, waits for webhooks
+// being sent and closes a database opened by the server. Handler answers 503
+// from then on. If ctx ends first, the workers stop once the remaining
+// requests finish. Seeds still leased by workers are recovered by
+// SyncSeedsFromUrlMapping on the next start.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return nil
+	}
+	s.stopped = true
+	s.closing.Store(true)
+	s.drained = make(chan struct{})
+	go func() {
+		// requests being served through Handler may still be sending work
+		s.requests.Lock()
+		close(s.workCh)
+		close(s.drained)
+	}()
+
+	var err error
+	if s.httpSrv != nil {
+		err = s.httpSrv.Shutdown(ctx)
+	}
+	if s.redirectSrv != nil {
+		if rerr := s.redirectSrv.Shutdown(ctx); err == nil {
+			err = rerr
+		}
+	}
+	if s.stopCerts != nil {
+		s.stopCerts()
+	}
+	select {
+	case <-s.drained:
+	case <-ctx.Done():
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+	if s.hooks != nil {
+		s.hooks.Stop()
+	}
+	if s.checker != nil {
+		s.checker.Stop()
+	}
+	if s.snaps != nil {
+		s.snaps.Stop()
+	}
+	if s.ownsDB {
+		if cerr := s.db.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
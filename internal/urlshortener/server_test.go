@@ -0,0 +1,170 @@
+package urlshortener
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerStartShutdown(t *testing.T) {
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	srv, err := NewServer(
+		WithDBPath(filepath.Join(t.TempDir(), "server.db")),
+		WithAddr("127.0.0.1:0"),
+		WithWorkers(2),
+		WithClock(func() time.Time { return created }),
+		WithHttpConfig(HttpConfig{ShortUrlHost: "sho.rt"}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := srv.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	base := "http://" + srv.Addr()
+
+	resp, err := http.Post(base+"/short", "application/json", strings.NewReader(`{"original_url":"https://example.com"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var short URLResponse
+	json.NewDecoder(resp.Body).Decode(&short)
+	resp.Body.Close()
+	code := strings.TrimPrefix(short.ShortenedURL, "https://sho.rt/")
+
+	resp, err = http.Get(base + "/" + code + "/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats LinkStats
+	json.NewDecoder(resp.Body).Decode(&stats)
+	resp.Body.Close()
+	if !stats.CreatedAt.Equal(created) {
+		t.Errorf("created_at %v, want the injected clock's %v", stats.CreatedAt, created)
+	}
+
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := http.Get(base + "/healthz"); err == nil {
+		t.Error("server still answering after Shutdown")
+	}
+	if err := srv.Start(ctx); err == nil {
+		t.Error("Start after Shutdown succeeded")
+	}
+}
+
+func TestServerMountedUnderSubPath(t *testing.T) {
+	db, err := InitDBAt(filepath.Join(t.TempDir(), "server.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// a gateway with routes of its own
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /gateway", func(w http.ResponseWriter, r *http.Request) {})
+	srv, err := NewServer(
+		WithDB(db),
+		WithMux(mux),
+		WithWorkers(1),
+		WithBasePath("/s/"),
+		WithHttpConfig(HttpConfig{ShortUrlHost: "gw.example/s"}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown(context.Background())
+	gw := httptest.NewServer(mux)
+	defer gw.Close()
+
+	body, _ := json.Marshal(URLRequest{OriginalURL: "https://example.com/mounted"})
+	resp, err := http.Post(gw.URL+"/s/short", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var short URLResponse
+	json.NewDecoder(resp.Body).Decode(&short)
+	resp.Body.Close()
+	code, ok := strings.CutPrefix(short.ShortenedURL, "https://gw.example/s/")
+	if !ok {
+		t.Fatalf("short URL %q not under the sub-path", short.ShortenedURL)
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err = client.Get(gw.URL + "/s/" + code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "https://example.com/mounted" {
+		t.Errorf("redirect: %d to %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	resp, err = http.Get(gw.URL + "/s/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc map[string]any
+	json.NewDecoder(resp.Body).Decode(&doc)
+	resp.Body.Close()
+	if got := jsonPath(doc["servers"].([]any)[0], "url"); got != "/s" {
+		t.Errorf("openapi server url %v, want /s", got)
+	}
+
+	if resp, err := http.Get(gw.URL + "/gateway"); err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("gateway route: %v", err)
+	}
+}
+
+// A server embedded through Handler alone refuses work once shut down
+// instead of sending on the stopped workers' channel, and recovers the
+// leases its previous run left in the caller's database.
+func TestServerHandlerAfterShutdown(t *testing.T) {
+	db, err := InitDBAt(filepath.Join(t.TempDir(), "server.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	seeds := NewSeedsDb(db)
+	if _, err := seeds.Acquire("previous-run"); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := NewServer(WithDB(db), WithWorkers(1), WithHttpConfig(HttpConfig{ShortUrlHost: "sho.rt"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leased, err := seeds.SelectSeedByStatus(1); err != nil || len(leased) != 0 {
+		t.Errorf("leases of the previous run left: %v, %v", leased, err)
+	}
+	api := httptest.NewServer(srv.Handler())
+	defer api.Close()
+	shorten := func() int {
+		t.Helper()
+		resp, err := http.Post(api.URL+"/short", "application/json", strings.NewReader(`{"original_url":"https://example.com"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if got := shorten(); got != http.StatusOK {
+		t.Fatalf("shortening: status %d", got)
+	}
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := shorten(); got != http.StatusServiceUnavailable {
+		t.Errorf("shortening after Shutdown: status %d, want 503", got)
+	}
+}
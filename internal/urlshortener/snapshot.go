@@ -0,0 +1,476 @@
+package urlshortener
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A snapshot file maps short codes to destinations for the read-only redirect
+// nodes, which never open the database. It is immutable and laid out to be
+// memory mapped and searched in place:
+//
+//	header  40 bytes: magic "SHRTSNAP", version uint16, kind uint16,
+//	        count uint32, from uint64, through uint64, created unix seconds int64
+//	index   count entries of 16 bytes, sorted by code: record offset uint64,
+//	        code length uint16, flags uint16, destination length uint32
+//	records code and destination bytes of each entry
+//	trailer CRC-32C of everything before it, uint32
+//
+// All integers are little endian. from and through are url_mapping_history
+// IDs: a full snapshot holds every link an edge node can serve as of through,
+// a delta the state, as of through, of every link changed after from, with
+// the flag snapshotRemoved on links that can no longer be served there.
+//
+// Only plain redirects are exported. Links with a password, a preview page,
+// redirect rules or a single use need the primary, as do disabled and
+// deleted links, which the primary answers with 410 and 404.
+
+const (
+	snapshotMagic   = "SHRTSNAP"
+	snapshotVersion = 1
+
+	SnapshotFull  = 1
+	SnapshotDelta = 2
+
+	snapshotRemoved = 1
+
+	snapshotHeaderLen = 40
+	snapshotEntryLen  = 16
+)
+
+var (
+	ErrBadSnapshot = errors.New("invalid snapshot file")
+	ErrNoSnapshot  = errors.New("no snapshot found")
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// SnapshotInfo describes a snapshot file.
+type SnapshotInfo struct {
+	Kind    int
+	Count   int
+	From    uint64
+	Through uint64
+	Created time.Time
+}
+
+type snapshotEntry struct {
+	code    string
+	dest    string
+	removed bool
+}
+
+// writeSnapshot writes entries, which must be sorted by code, as a snapshot
+// described by info.
+func writeSnapshot(w io.Writer, info SnapshotInfo, entries []snapshotEntry) error {
+	crc := crc32.New(crc32c)
+	bw := bufio.NewWriter(io.MultiWriter(w, crc))
+
+	var head [snapshotHeaderLen]byte
+	copy(head[:], snapshotMagic)
+	binary.LittleEndian.PutUint16(head[8:], snapshotVersion)
+	binary.LittleEndian.PutUint16(head[10:], uint16(info.Kind))
+	binary.LittleEndian.PutUint32(head[12:], uint32(len(entries)))
+	binary.LittleEndian.PutUint64(head[16:], info.From)
+	binary.LittleEndian.PutUint64(head[24:], info.Through)
+	binary.LittleEndian.PutUint64(head[32:], uint64(info.Created.Unix()))
+	bw.Write(head[:])
+
+	off := uint64(snapshotHeaderLen + snapshotEntryLen*len(entries))
+	var entry [snapshotEntryLen]byte
+	for _, e := range entries {
+		if len(e.code) > 0xffff {
+			return fmt.Errorf("code %.20q... too long for a snapshot", e.code)
+		}
+		var flags uint16
+		if e.removed {
+			flags = snapshotRemoved
+		}
+		binary.LittleEndian.PutUint64(entry[0:], off)
+		binary.LittleEndian.PutUint16(entry[8:], uint16(len(e.code)))
+		binary.LittleEndian.PutUint16(entry[10:], flags)
+		binary.LittleEndian.PutUint32(entry[12:], uint32(len(e.dest)))
+		bw.Write(entry[:])
+		off += uint64(len(e.code) + len(e.dest))
+	}
+	for _, e := range entries {
+		bw.WriteString(e.code)
+		bw.WriteString(e.dest)
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("writing snapshot: %w", err)
+	}
+	if err := binary.Write(w, binary.LittleEndian, crc.Sum32()); err != nil {
+		return fmt.Errorf("writing snapshot: %w", err)
+	}
+	return nil
+}
+
+// parseSnapshot checks data is a whole snapshot file and reads its header.
+func parseSnapshot(data []byte) (SnapshotInfo, error) {
+	if len(data) < snapshotHeaderLen+4 || string(data[:8]) != snapshotMagic {
+		return SnapshotInfo{}, ErrBadSnapshot
+	}
+	if v := binary.LittleEndian.Uint16(data[8:]); v != snapshotVersion {
+		return SnapshotInfo{}, fmt.Errorf("%w: version %d", ErrBadSnapshot, v)
+	}
+	body := data[:len(data)-4]
+	if crc32.Checksum(body, crc32c) != binary.LittleEndian.Uint32(data[len(body):]) {
+		return SnapshotInfo{}, fmt.Errorf("%w: checksum mismatch", ErrBadSnapshot)
+	}
+	info := SnapshotInfo{
+		Kind:    int(binary.LittleEndian.Uint16(data[10:])),
+		Count:   int(binary.LittleEndian.Uint32(data[12:])),
+		From:    binary.LittleEndian.Uint64(data[16:]),
+		Through: binary.LittleEndian.Uint64(data[24:]),
+		Created: time.Unix(int64(binary.LittleEndian.Uint64(data[32:])), 0).UTC(),
+	}
+	if info.Kind != SnapshotFull && info.Kind != SnapshotDelta {
+		return SnapshotInfo{}, fmt.Errorf("%w: kind %d", ErrBadSnapshot, info.Kind)
+	}
+	if uint64(len(body)) < uint64(snapshotHeaderLen)+uint64(snapshotEntryLen)*uint64(info.Count) {
+		return SnapshotInfo{}, fmt.Errorf("%w: truncated index", ErrBadSnapshot)
+	}
+	for i := 0; i < info.Count; i++ {
+		e := data[snapshotHeaderLen+snapshotEntryLen*i:]
+		off := binary.LittleEndian.Uint64(e)
+		n := uint64(binary.LittleEndian.Uint16(e[8:])) + uint64(binary.LittleEndian.Uint32(e[12:]))
+		if off > uint64(len(body)) || n > uint64(len(body))-off {
+			return SnapshotInfo{}, fmt.Errorf("%w: entry %d out of bounds", ErrBadSnapshot, i)
+		}
+	}
+	return info, nil
+}
+
+// Snapshot is an open snapshot file, memory mapped where the platform
+// allows it.
+type Snapshot struct {
+	SnapshotInfo
+	data  []byte
+	unmap func() error
+}
+
+// OpenSnapshot maps the snapshot file at path and verifies its checksum.
+func OpenSnapshot(path string) (*Snapshot, error) {
+	data, unmap, err := mapFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening snapshot %s: %w", path, err)
+	}
+	info, err := parseSnapshot(data)
+	if err != nil {
+		unmap()
+		return nil, fmt.Errorf("opening snapshot %s: %w", path, err)
+	}
+	return &Snapshot{SnapshotInfo: info, data: data, unmap: unmap}, nil
+}
+
+// Close unmaps the file; s must not be used afterwards.
+func (s *Snapshot) Close() error {
+	return s.unmap()
+}
+
+func (s *Snapshot) entry(i int) (code, dest []byte, removed bool) {
+	e := s.data[snapshotHeaderLen+snapshotEntryLen*i:]
+	off := binary.LittleEndian.Uint64(e)
+	codeLen := uint64(binary.LittleEndian.Uint16(e[8:]))
+	destLen := uint64(binary.LittleEndian.Uint32(e[12:]))
+	return s.data[off : off+codeLen], s.data[off+codeLen : off+codeLen+destLen],
+		binary.LittleEndian.Uint16(e[10:])&snapshotRemoved != 0
+}
+
+// Lookup binary searches the index for code. ok is false if the snapshot
+// has no entry for it; removed is only set in deltas.
+func (s *Snapshot) Lookup(code string) (dest string, removed, ok bool) {
+	key := []byte(code)
+	i := sort.Search(s.Count, func(i int) bool {
+		c, _, _ := s.entry(i)
+		return bytes.Compare(c, key) >= 0
+	})
+	if i == s.Count {
+		return "", false, false
+	}
+	c, d, rm := s.entry(i)
+	if !bytes.Equal(c, key) {
+		return "", false, false
+	}
+	return string(d), rm, true
+}
+
+// edgeServable selects the url_mapping rows a read-only node can redirect
+// on its own.
+const edgeServable = "disabled = 0 AND deleted_at IS NULL AND password_hash = '' AND one_time = 0 " +
+	"AND interstitial = 0 AND redirect_rules = ''"
+
+// ExportSnapshot writes a full snapshot of the links read-only nodes can
+// serve.
+func (u *UrlMapping) ExportSnapshot(w io.Writer) (SnapshotInfo, error) {
+	return u.export(w, SnapshotFull, 0)
+}
+
+// ExportDelta writes the changes to links since the snapshot or delta that
+// went through from.
+func (u *UrlMapping) ExportDelta(w io.Writer, from uint64) (SnapshotInfo, error) {
+	return u.export(w, SnapshotDelta, from)
+}
+
+func (u *UrlMapping) export(w io.Writer, kind int, from uint64) (SnapshotInfo, error) {
+	// the reads share one transaction, so the links match the history ID
+	tx, err := u.db.Begin()
+	if err != nil {
+		return SnapshotInfo{}, fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	info := SnapshotInfo{Kind: kind, From: from, Created: u.now().UTC()}
+	if err := tx.QueryRow("SELECT COALESCE(MAX(id), 0) FROM url_mapping_history").Scan(&info.Through); err != nil {
+		return SnapshotInfo{}, fmt.Errorf("reading history position: %w", err)
+	}
+	query := "SELECT seed, counter, short_url, original_url, 1 FROM url_mapping WHERE " + edgeServable
+	args := []any{}
+	if kind == SnapshotDelta {
+		query = "SELECT seed, counter, short_url, original_url, " + edgeServable + " FROM url_mapping " +
+			"WHERE (seed, counter) IN (SELECT seed, counter FROM url_mapping_history WHERE id > ? AND id <= ?)"
+		args = append(args, from, info.Through)
+	}
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return SnapshotInfo{}, fmt.Errorf("selecting links to export: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []snapshotEntry
+	for rows.Next() {
+		var seed, shortURL, dest string
+		var counter int
+		var servable bool
+		if err := rows.Scan(&seed, &counter, &shortURL, &dest, &servable); err != nil {
+			return SnapshotInfo{}, fmt.Errorf("scanning link row: %w", err)
+		}
+		if !servable {
+			dest = ""
+		}
+		// the code a link was issued with and the one of the current scheme
+		// both resolve on the primary
+		code := u.codes.Encode(seed, counter)
+		entries = append(entries, snapshotEntry{code: code, dest: dest, removed: !servable})
+		if issued := codeOfShortURL(shortURL); issued != code {
+			entries = append(entries, snapshotEntry{code: issued, dest: dest, removed: !servable})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return SnapshotInfo{}, fmt.Errorf("iterating link rows: %w", err)
+	}
+	slices.SortFunc(entries, func(a, b snapshotEntry) int { return strings.Compare(a.code, b.code) })
+	entries = slices.CompactFunc(entries, func(a, b snapshotEntry) bool { return a.code == b.code })
+	info.Count = len(entries)
+	return info, writeSnapshot(w, info, entries)
+}
+
+// snapshotFile is a snapshot or delta in a snapshot directory, named
+// snapshot-<through>.snap or delta-<from>-<through>.snap.
+type snapshotFile struct {
+	path          string
+	kind          int
+	from, through uint64
+}
+
+func snapshotFileName(info SnapshotInfo) string {
+	if info.Kind == SnapshotFull {
+		return fmt.Sprintf("snapshot-%020d.snap", info.Through)
+	}
+	return fmt.Sprintf("delta-%020d-%020d.snap", info.From, info.Through)
+}
+
+// listSnapshots returns the snapshot files in dir ordered by through, full
+// snapshots before deltas ending at the same point.
+func listSnapshots(dir string) ([]snapshotFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("listing snapshots: %w", err)
+	}
+	var files []snapshotFile
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".snap")
+		if !ok {
+			continue
+		}
+		f := snapshotFile{path: filepath.Join(dir, e.Name())}
+		var err error
+		if rest, ok := strings.CutPrefix(name, "snapshot-"); ok {
+			f.kind = SnapshotFull
+			f.through, err = strconv.ParseUint(rest, 10, 64)
+		} else if rest, ok := strings.CutPrefix(name, "delta-"); ok {
+			f.kind = SnapshotDelta
+			from, through, _ := strings.Cut(rest, "-")
+			if f.from, err = strconv.ParseUint(from, 10, 64); err == nil {
+				f.through, err = strconv.ParseUint(through, 10, 64)
+			}
+		} else {
+			continue
+		}
+		if err == nil {
+			files = append(files, f)
+		}
+	}
+	slices.SortFunc(files, func(a, b snapshotFile) int {
+		if a.through != b.through {
+			return compareUint(a.through, b.through)
+		}
+		return a.kind - b.kind
+	})
+	return files, nil
+}
+
+func compareUint(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+type SnapshotConfig struct {
+	// Dir receives the snapshot and delta files, to be copied to or shared
+	// with the read-only nodes.
+	Dir string
+	// Interval is how often changes are published, a minute by default.
+	Interval time.Duration
+	// FullEvery replaces the deltas with a new full snapshot once that many
+	// follow the last one, 60 by default.
+	FullEvery int
+}
+
+// SnapshotPublisher keeps a snapshot directory up to date: a full snapshot
+// followed by a delta per Interval with changes, older files being removed
+// whenever a new full snapshot supersedes them.
+type SnapshotPublisher struct {
+	links  *UrlMapping
+	cfg    SnapshotConfig
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newSnapshotPublisher(links *UrlMapping, cfg SnapshotConfig) *SnapshotPublisher {
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Minute
+	}
+	if cfg.FullEvery <= 0 {
+		cfg.FullEvery = 60
+	}
+	return &SnapshotPublisher{links: links, cfg: cfg}
+}
+
+func StartSnapshotPublisher(links *UrlMapping, cfg SnapshotConfig) *SnapshotPublisher {
+	p := newSnapshotPublisher(links, cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel, p.done = cancel, make(chan struct{})
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(p.cfg.Interval)
+		defer ticker.Stop()
+		for {
+			if _, err := p.Publish(); err != nil {
+				slog.Error("publishing snapshot", "dir", p.cfg.Dir, "err", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// Stop waits for a publication in progress and stops the publisher.
+func (p *SnapshotPublisher) Stop() {
+	p.cancel()
+	<-p.done
+}
+
+// Publish writes a full snapshot if the directory has none or FullEvery
+// deltas follow it, and otherwise a delta if links changed since the last
+// file. It returns what it wrote, a zero SnapshotInfo if nothing.
+func (p *SnapshotPublisher) Publish() (SnapshotInfo, error) {
+	if err := os.MkdirAll(p.cfg.Dir, 0o755); err != nil {
+		return SnapshotInfo{}, fmt.Errorf("creating snapshot directory: %w", err)
+	}
+	files, err := listSnapshots(p.cfg.Dir)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	full, deltas := -1, 0
+	for i, f := range files {
+		if f.kind == SnapshotFull {
+			full, deltas = i, 0
+		} else if full >= 0 && f.through > files[full].through {
+			deltas++
+		}
+	}
+
+	if full < 0 || deltas >= p.cfg.FullEvery {
+		info, err := p.write(func(w io.Writer) (SnapshotInfo, error) { return p.links.ExportSnapshot(w) })
+		if err != nil {
+			return SnapshotInfo{}, err
+		}
+		// nodes behind the new snapshot load it rather than the deltas
+		for _, f := range files {
+			if f.path != filepath.Join(p.cfg.Dir, snapshotFileName(info)) {
+				os.Remove(f.path)
+			}
+		}
+		return info, nil
+	}
+
+	last := files[len(files)-1].through
+	var current uint64
+	if err := p.links.db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM url_mapping_history").Scan(&current); err != nil {
+		return SnapshotInfo{}, fmt.Errorf("reading history position: %w", err)
+	}
+	if current == last {
+		return SnapshotInfo{}, nil
+	}
+	return p.write(func(w io.Writer) (SnapshotInfo, error) { return p.links.ExportDelta(w, last) })
+}
+
+// write exports into a temporary file and renames it into place, so readers
+// never see a partial file.
+func (p *SnapshotPublisher) write(export func(io.Writer) (SnapshotInfo, error)) (SnapshotInfo, error) {
+	tmp, err := os.CreateTemp(p.cfg.Dir, ".snapshot-*")
+	if err != nil {
+		return SnapshotInfo{}, fmt.Errorf("creating snapshot file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	info, err := export(tmp)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return SnapshotInfo{}, fmt.Errorf("writing snapshot file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(p.cfg.Dir, snapshotFileName(info))); err != nil {
+		return SnapshotInfo{}, fmt.Errorf("publishing snapshot file: %w", err)
+	}
+	slog.Info("snapshot published", "kind", info.Kind, "from", info.From, "through", info.Through, "links", info.Count)
+	return info, nil
+}
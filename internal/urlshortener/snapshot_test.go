@@ -0,0 +1,159 @@
+package urlshortener
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshotFile(t *testing.T) {
+	entries := []snapshotEntry{
+		{code: "YWFhMQ==", dest: "https://example.com/1"},
+		{code: "YWFhMg==", dest: "", removed: true},
+		{code: "YWFhMw==", dest: "https://example.com/3"},
+	}
+	var buf bytes.Buffer
+	info := SnapshotInfo{Kind: SnapshotDelta, Count: len(entries), From: 4, Through: 9, Created: time.Unix(1700000000, 0).UTC()}
+	if err := writeSnapshot(&buf, info, entries); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "delta.snap")
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := OpenSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.SnapshotInfo != info {
+		t.Errorf("info = %+v, want %+v", s.SnapshotInfo, info)
+	}
+	for code, want := range map[string]string{"YWFhMQ==": "https://example.com/1", "YWFhMw==": "https://example.com/3"} {
+		if dest, removed, ok := s.Lookup(code); dest != want || removed || !ok {
+			t.Errorf("Lookup(%s) = %q, %v, %v", code, dest, removed, ok)
+		}
+	}
+	if _, removed, ok := s.Lookup("YWFhMg=="); !removed || !ok {
+		t.Error("removed entry not reported")
+	}
+	for _, code := range []string{"", "A", "YWFhMR==", "zzz"} {
+		if _, _, ok := s.Lookup(code); ok {
+			t.Errorf("Lookup(%q) found an entry", code)
+		}
+	}
+
+	corrupt := bytes.Clone(buf.Bytes())
+	corrupt[snapshotHeaderLen+2*snapshotEntryLen+3] ^= 1
+	for name, data := range map[string][]byte{
+		"corrupt":   corrupt,
+		"truncated": buf.Bytes()[:buf.Len()-5],
+		"empty":     nil,
+	} {
+		if _, err := parseSnapshot(data); !errors.Is(err, ErrBadSnapshot) {
+			t.Errorf("%s file: err = %v, want ErrBadSnapshot", name, err)
+		}
+	}
+}
+
+func TestReadOnlyNode(t *testing.T) {
+	db, err := InitDBAt(filepath.Join(t.TempDir(), "primary.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	links := NewUrlMapping(db)
+	create := func(counter int, dest string, opts LinkOptions) string {
+		t.Helper()
+		if err := links.Create(dest, "https://sho.rt/"+encodeCode("aaa", counter), "aaa", counter, opts); err != nil {
+			t.Fatal(err)
+		}
+		return encodeCode("aaa", counter)
+	}
+	plain := create(1, "https://example.com/plain", LinkOptions{})
+	other := create(2, "https://example.com/other", LinkOptions{})
+	protected := create(3, "https://example.com/secret", LinkOptions{PasswordHash: "x"})
+	once := create(4, "https://example.com/once", LinkOptions{OneTime: true})
+
+	dir := filepath.Join(t.TempDir(), "snapshots")
+	pub := newSnapshotPublisher(links, SnapshotConfig{Dir: dir, FullEvery: 2})
+	if info, err := pub.Publish(); err != nil || info.Kind != SnapshotFull || info.Count != 2 {
+		t.Fatalf("first Publish = %+v, %v; want a full snapshot of 2 links", info, err)
+	}
+	if info, err := pub.Publish(); err != nil || info.Kind != 0 {
+		t.Errorf("Publish without changes = %+v, %v; want nothing", info, err)
+	}
+
+	store, err := OpenSnapshotStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	edge := httptest.NewServer(NewReadOnlyHandler(store, ReadOnlyConfig{Primary: "https://primary.example/s/"}))
+	defer edge.Close()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	expect := func(path string, status int, location string) {
+		t.Helper()
+		resp, err := client.Get(edge.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status || resp.Header.Get("Location") != location {
+			t.Errorf("GET %s: %d to %q, want %d to %q", path, resp.StatusCode, resp.Header.Get("Location"), status, location)
+		}
+	}
+	expect("/"+plain, http.StatusFound, "https://example.com/plain")
+	expect("/"+other+"?utm=x", http.StatusFound, "https://example.com/other")
+	expect("/"+plain+"+", http.StatusTemporaryRedirect, "https://primary.example/s/"+plain+"+")
+	expect("/"+protected, http.StatusTemporaryRedirect, "https://primary.example/s/"+protected)
+	expect("/"+once, http.StatusTemporaryRedirect, "https://primary.example/s/"+once)
+	expect("/"+plain+"/stats", http.StatusTemporaryRedirect, "https://primary.example/s/"+plain+"/stats")
+
+	// changes reach the node as a delta
+	if err := links.Delete(plain, "admin", ""); err != nil {
+		t.Fatal(err)
+	}
+	added := create(5, "https://example.com/added", LinkOptions{})
+	if info, err := pub.Publish(); err != nil || info.Kind != SnapshotDelta || info.Count != 2 {
+		t.Fatalf("Publish after changes = %+v, %v; want a delta of 2 links", info, err)
+	}
+	if err := store.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	expect("/"+plain, http.StatusTemporaryRedirect, "https://primary.example/s/"+plain)
+	expect("/"+added, http.StatusFound, "https://example.com/added")
+	expect("/"+other, http.StatusFound, "https://example.com/other")
+
+	// a new full snapshot replaces the deltas once FullEvery of them pile up
+	if _, err := links.Restore(plain, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := pub.Publish(); err != nil || info.Kind != SnapshotDelta {
+		t.Fatalf("Publish = %+v, %v; want a delta", info, err)
+	}
+	if _, err := links.DisableMatching("admin", func(d string) (string, bool) { return "test", d == "https://example.com/other" }); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := pub.Publish(); err != nil || info.Kind != SnapshotFull || info.Count != 2 {
+		t.Fatalf("Publish = %+v, %v; want a full snapshot of 2 links", info, err)
+	}
+	if files, _ := listSnapshots(dir); len(files) != 1 {
+		t.Errorf("snapshot directory holds %+v, want only the new snapshot", files)
+	}
+	if err := store.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	expect("/"+plain, http.StatusFound, "https://example.com/plain")
+	expect("/"+other, http.StatusTemporaryRedirect, "https://primary.example/s/"+other)
+
+	if _, err := OpenSnapshotStore(t.TempDir()); !errors.Is(err, ErrNoSnapshot) {
+		t.Errorf("OpenSnapshotStore of an empty directory: err = %v, want ErrNoSnapshot", err)
+	}
+}
@@ -0,0 +1,181 @@
+package urlshortener
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TLSConfig serves the API over HTTPS, with HTTP/2, from a certificate and
+// key in PEM files that are reloaded when they change, so a renewed
+// certificate needs no restart.
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	// ReloadInterval is how often the files are checked for changes, 10
+	// seconds by default.
+	ReloadInterval time.Duration
+	// RedirectAddr, such as ":80", starts a plaintext listener sending every
+	// request to the same URL over HTTPS, on the port of the HTTPS listener
+	// or without one if that is 443. Empty for none.
+	RedirectAddr string
+	// HSTSMaxAge, if positive, sends Strict-Transport-Security with HTTPS
+	// responses, optionally covering subdomains and asking for preloading.
+	HSTSMaxAge            time.Duration
+	HSTSIncludeSubdomains bool
+	HSTSPreload           bool
+}
+
+func (c TLSConfig) reloadInterval() time.Duration {
+	if c.ReloadInterval <= 0 {
+		return 10 * time.Second
+	}
+	return c.ReloadInterval
+}
+
+// server returns an HTTPS server for h, to be started with ServeTLS(ln, "", "")
+// or ListenAndServeTLS("", ""), and the certificate it serves.
+func (c TLSConfig) server(h http.Handler) (*http.Server, *CertReloader, error) {
+	certs, err := LoadCertificate(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	if hsts := c.hstsHeader(); hsts != "" {
+		next := h
+		h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS != nil {
+				w.Header().Set("Strict-Transport-Security", hsts)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	return &http.Server{
+		Handler:           h,
+		ReadHeaderTimeout: 10 * time.Second,
+		TLSConfig: &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certs.GetCertificate,
+			NextProtos:     []string{"h2", "http/1.1"},
+		},
+	}, certs, nil
+}
+
+func (c TLSConfig) hstsHeader() string {
+	if c.HSTSMaxAge <= 0 {
+		return ""
+	}
+	v := "max-age=" + strconv.FormatInt(int64(c.HSTSMaxAge/time.Second), 10)
+	if c.HSTSIncludeSubdomains {
+		v += "; includeSubDomains"
+	}
+	if c.HSTSPreload {
+		v += "; preload"
+	}
+	return v
+}
+
+// redirectToHTTPS sends requests to the HTTPS listener on httpsPort:
+// permanently, and keeping the method and body for anything but GET and HEAD.
+func redirectToHTTPS(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		status := http.StatusPermanentRedirect
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			status = http.StatusMovedPermanently
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
+	})
+}
+
+// CertReloader holds a certificate loaded from a pair of PEM files and
+// reloads it when either changes. A pair that fails to load, such as one
+// caught halfway through being replaced, is retried on the next check while
+// the previous certificate stays in use.
+type CertReloader struct {
+	certFile, keyFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	version [2]fileVersion
+}
+
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+func LoadCertificate(certFile, keyFile string) (*CertReloader, error) {
+	c := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// GetCertificate is a tls.Config.GetCertificate returning the current
+// certificate.
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// reload loads the pair if either file changed since the last load and
+// reports whether it did.
+func (c *CertReloader) reload() (bool, error) {
+	var version [2]fileVersion
+	for i, path := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return false, fmt.Errorf("checking tls certificate: %w", err)
+		}
+		version[i] = fileVersion{modTime: info.ModTime(), size: info.Size()}
+	}
+	c.mu.RLock()
+	unchanged := c.cert != nil && version == c.version
+	c.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("loading tls certificate: %w", err)
+	}
+	c.mu.Lock()
+	c.cert, c.version = &cert, version
+	c.mu.Unlock()
+	return true, nil
+}
+
+// Watch checks the files every interval until ctx is done.
+func (c *CertReloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			reloaded, err := c.reload()
+			if err != nil {
+				slog.Error("reloading tls certificate", "cert_file", c.certFile, "err", err)
+			} else if reloaded {
+				slog.Info("tls certificate reloaded", "cert_file", c.certFile)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
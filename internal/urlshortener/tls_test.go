@@ -0,0 +1,167 @@
+package urlshortener
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 named cn to
+// certFile and keyFile and returns it.
+func writeTestCert(t *testing.T, certFile, keyFile, cn string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestTLSServer(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	first := writeTestCert(t, certFile, keyFile, "first")
+
+	srv, err := NewServer(
+		WithDBPath(filepath.Join(dir, "tls.db")),
+		WithWorkers(1),
+		WithAddr("127.0.0.1:0"),
+		WithTLS(TLSConfig{
+			CertFile:              certFile,
+			KeyFile:               keyFile,
+			ReloadInterval:        10 * time.Millisecond,
+			RedirectAddr:          "127.0.0.1:0",
+			HSTSMaxAge:            365 * 24 * time.Hour,
+			HSTSIncludeSubdomains: true,
+		}),
+		WithHttpConfig(HttpConfig{ShortUrlHost: "sho.rt"}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown(context.Background())
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(first)
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}, ForceAttemptHTTP2: true},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get("https://" + srv.Addr() + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+		t.Errorf("GET /healthz: status %d over %s, want 200 over HTTP/2", resp.StatusCode, resp.Proto)
+	}
+	if got, want := resp.Header.Get("Strict-Transport-Security"), "max-age=31536000; includeSubDomains"; got != want {
+		t.Errorf("Strict-Transport-Security = %q, want %q", got, want)
+	}
+
+	_, port, _ := net.SplitHostPort(srv.Addr())
+	for method, status := range map[string]int{"GET": http.StatusMovedPermanently, "POST": http.StatusPermanentRedirect} {
+		req, _ := http.NewRequest(method, "http://"+srv.RedirectAddr()+"/short?x=1", nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if want := "https://127.0.0.1:" + port + "/short?x=1"; resp.StatusCode != status || resp.Header.Get("Location") != want {
+			t.Errorf("%s on the redirect listener: %d to %q, want %d to %q", method, resp.StatusCode, resp.Header.Get("Location"), status, want)
+		}
+	}
+
+	// a renewed certificate is served without a restart
+	second := writeTestCert(t, certFile, keyFile, "second")
+	served := func() string {
+		conn, err := tls.Dial("tcp", srv.Addr(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for served() != second.Subject.CommonName {
+		if time.Now().After(deadline) {
+			t.Fatal("renewed certificate not served")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCertReloaderKeepsCertificateOnError(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(t, certFile, keyFile, "good")
+	certs, err := LoadCertificate(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded, err := certs.reload(); reloaded || err != nil {
+		t.Errorf("reload of unchanged files = %v, %v", reloaded, err)
+	}
+
+	// the certificate was replaced but the key not yet
+	other := t.TempDir()
+	writeTestCert(t, certFile, filepath.Join(other, "key.pem"), "next")
+	if _, err := certs.reload(); err == nil {
+		t.Error("reload of a mismatched pair succeeded")
+	}
+	cert, _ := certs.GetCertificate(nil)
+	if cert.Leaf == nil || cert.Leaf.Subject.CommonName != "good" {
+		t.Errorf("serving %v after a failed reload, want the previous certificate", cert.Leaf)
+	}
+
+	if _, err := LoadCertificate(filepath.Join(dir, "missing.pem"), keyFile); err == nil {
+		t.Error("LoadCertificate of a missing file succeeded")
+	}
+}
@@ -0,0 +1,48 @@
+package urlshortener
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// The web UI is a few static pages calling the JSON API from the browser,
+// so it needs no handlers of its own and is left out of the OpenAPI
+// document.
+//
+//go:embed ui
+var uiFiles embed.FS
+
+// registerUI serves every file of the UI at its own path: a /ui/ prefix
+// pattern would conflict with GET /{code}/qr and GET /{code}/stats.
+func registerUI(mux *http.ServeMux) {
+	root, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		panic(err)
+	}
+	entries, err := fs.ReadDir(root, ".")
+	if err != nil {
+		panic(err)
+	}
+
+	files := http.StripPrefix("/ui", http.FileServerFS(root))
+	serve := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; img-src 'self' data:; frame-ancestors 'none'")
+		w.Header().Set("Cache-Control", "no-cache")
+		files.ServeHTTP(w, r)
+	}
+	for _, e := range entries {
+		mux.HandleFunc("GET /ui/"+e.Name(), serve)
+	}
+	mux.HandleFunc("GET /ui/{$}", serve)
+	mux.HandleFunc("GET /ui", redirectToUI)
+	mux.HandleFunc("GET /{$}", redirectToUI)
+}
+
+// redirectToUI sends "/" and "/ui" to the UI. The Location is relative, as
+// http.Redirect would resolve it against a path the base path was stripped
+// from.
+func redirectToUI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Location", "ui/")
+	w.WriteHeader(http.StatusFound)
+}
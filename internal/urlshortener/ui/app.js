@@ -0,0 +1,209 @@
+// The web UI is a client of the JSON API served next to it; see
+// /openapi.json. The API lives one level above the /ui/ directory, which
+// keeps it working when the shortener is mounted under a base path.
+"use strict";
+
+const apiBase = location.pathname.slice(0, location.pathname.lastIndexOf("/ui/"));
+
+// The API key, or admin token, is kept in this browser only.
+function token() {
+  return localStorage.getItem("shortener-token") || "";
+}
+
+async function api(method, path, body) {
+  const headers = {};
+  if (token()) headers["Authorization"] = "Bearer " + token();
+  if (body !== undefined) headers["Content-Type"] = "application/json";
+  const resp = await fetch(apiBase + path, {
+    method,
+    headers,
+    body: body === undefined ? undefined : JSON.stringify(body),
+  });
+  const data = await resp.json().catch(() => null);
+  if (!resp.ok) {
+    const msg = data && data.error ? data.error.message : resp.statusText;
+    throw new Error(resp.status === 401 ? msg + ": set an API key above" : msg);
+  }
+  return data;
+}
+
+// el builds an element; strings become text nodes, never HTML.
+function el(tag, attrs, ...children) {
+  const e = document.createElement(tag);
+  for (const [k, v] of Object.entries(attrs || {})) {
+    if (k === "class") e.className = v;
+    else e.setAttribute(k, v);
+  }
+  for (const c of children) {
+    if (c !== null && c !== undefined) e.append(c);
+  }
+  return e;
+}
+
+function codeOf(shortURL) {
+  return shortURL.slice(shortURL.lastIndexOf("/") + 1);
+}
+
+function detailURL(code) {
+  return "link.html?code=" + encodeURIComponent(code);
+}
+
+function formatTime(s) {
+  return new Date(s).toLocaleString();
+}
+
+function showError(target, err) {
+  target.replaceChildren(el("p", { class: "error" }, err.message));
+}
+
+function setupHeader() {
+  const input = document.getElementById("token");
+  input.value = token();
+  input.addEventListener("change", () => {
+    if (input.value) localStorage.setItem("shortener-token", input.value.trim());
+    else localStorage.removeItem("shortener-token");
+  });
+}
+
+function setupShorten() {
+  const form = document.getElementById("shorten");
+  const out = document.getElementById("result");
+  form.addEventListener("submit", async (ev) => {
+    ev.preventDefault();
+    const f = form.elements;
+    const req = {
+      original_url: f.original_url.value.trim(),
+      qr: true,
+      interstitial: f.interstitial.checked,
+      one_time: f.one_time.checked,
+    };
+    if (f.title.value) req.title = f.title.value.trim();
+    if (f.owner.value) req.owner = f.owner.value.trim();
+    const tags = f.tags.value.split(",").map((t) => t.trim()).filter(Boolean);
+    if (tags.length) req.tags = tags;
+    if (f.password.value) req.password = f.password.value;
+
+    form.querySelector("button").disabled = true;
+    try {
+      const res = await api("POST", "/short", req);
+      const code = codeOf(res.shortened_url);
+      out.replaceChildren(el("div", { class: "result" },
+        res.qr_code ? el("img", { src: res.qr_code, alt: "QR code", width: "120", height: "120" }) : null,
+        el("div", {},
+          el("div", { class: "short" }, el("a", { href: res.shortened_url }, res.shortened_url)),
+          el("p", {}, el("a", { href: detailURL(code) }, "Details and stats")))));
+      form.reset();
+    } catch (err) {
+      showError(out, err);
+    } finally {
+      form.querySelector("button").disabled = false;
+    }
+  });
+}
+
+const pageSize = 50;
+
+function setupLinks() {
+  const form = document.getElementById("filters");
+  const out = document.getElementById("links");
+  const prev = document.getElementById("prev");
+  const next = document.getElementById("next");
+  let offset = 0;
+
+  async function load() {
+    const q = new URLSearchParams({ limit: pageSize, offset });
+    const f = form.elements;
+    if (f.q.value) q.set("q", f.q.value.trim());
+    if (f.owner.value) q.set("owner", f.owner.value.trim());
+    if (f.tag.value) q.set("tag", f.tag.value.trim());
+    try {
+      const res = await api("GET", "/links/search?" + q);
+      render(res.links);
+      prev.disabled = offset === 0;
+      next.disabled = res.links.length < pageSize;
+    } catch (err) {
+      showError(out, err);
+    }
+  }
+
+  function render(links) {
+    if (!links.length) {
+      out.replaceChildren(el("p", { class: "muted" }, "No links yet."));
+      return;
+    }
+    const rows = links.map((l) => el("tr", {},
+      el("td", {}, el("a", { href: detailURL(l.code) }, l.code)),
+      el("td", { class: "dest" },
+        l.title ? el("div", {}, l.title) : null,
+        el("div", { class: "muted" }, l.original_url || (l.password_protected ? "password protected" : "one-time link")),
+        el("div", {}, ...(l.tags || []).map((t) => el("span", { class: "tag" }, t)))),
+      el("td", { class: "num" }, String(l.clicks)),
+      el("td", {}, formatTime(l.created_at)),
+      el("td", {}, statusBadge(l))));
+    out.replaceChildren(el("table", {},
+      el("thead", {}, el("tr", {}, ...["Code", "Link", "Clicks", "Created", ""].map((h) => el("th", {}, h)))),
+      el("tbody", {}, ...rows)));
+  }
+
+  form.addEventListener("submit", (ev) => {
+    ev.preventDefault();
+    offset = 0;
+    load();
+  });
+  prev.addEventListener("click", () => { offset = Math.max(0, offset - pageSize); load(); });
+  next.addEventListener("click", () => { offset += pageSize; load(); });
+  load();
+}
+
+function statusBadge(l) {
+  if (l.disabled) return el("span", { class: "badge" }, "disabled");
+  if (l.consumed) return el("span", { class: "badge" }, "used");
+  if (l.broken) return el("span", { class: "badge" }, "broken");
+  return null;
+}
+
+async function setupLink() {
+  const code = new URLSearchParams(location.search).get("code");
+  const out = document.getElementById("link");
+  if (!code) {
+    showError(out, new Error("No link given"));
+    return;
+  }
+  const path = "/" + encodeURIComponent(code);
+  try {
+    const s = await api("GET", path + "/stats");
+    document.title = (s.title || s.code) + " - URL shortener";
+    const rows = [
+      ["Short link", el("a", { href: s.short_url }, s.short_url)],
+      ["Destination", s.original_url || (s.password_protected ? "hidden, the link is password protected" : "hidden, the link is one-time")],
+      ["Title", s.title],
+      ["Owner", s.owner],
+      ["Tags", s.tags && s.tags.length ? s.tags.join(", ") : ""],
+      ["Created", formatTime(s.created_at)],
+      ["Clicks", String(s.clicks)],
+    ];
+    for (const [name, n] of Object.entries(s.variant_clicks || {})) {
+      rows.push(["Clicks on " + name, String(n)]);
+    }
+    if (s.interstitial) rows.push(["Preview page", "yes"]);
+    if (s.one_time) rows.push(["One-time", s.consumed ? "used" : "not used yet"]);
+    if (s.disabled) rows.push(["Disabled", s.disabled_reason || "yes"]);
+    if (s.last_check) {
+      const c = s.last_check;
+      const outcome = c.status ? "HTTP " + c.status : c.error;
+      rows.push(["Destination check", (s.broken ? "broken, " : "") + outcome + " on " + formatTime(c.checked_at)]);
+    } else if (s.broken) {
+      rows.push(["Destination check", "broken"]);
+    }
+    out.replaceChildren(el("div", { class: "detail" },
+      el("dl", {}, ...rows.filter(([, v]) => v).flatMap(([k, v]) => [el("dt", {}, k), el("dd", {}, v)])),
+      el("div", {},
+        el("img", { src: apiBase + path + "/qr?size=240", alt: "QR code", width: "240", height: "240" }),
+        el("p", {}, el("a", { href: apiBase + path + "/qr?format=svg&size=1024", download: s.code + ".svg" }, "Download SVG")))));
+  } catch (err) {
+    showError(out, err);
+  }
+}
+
+setupHeader();
+({ shorten: setupShorten, links: setupLinks, link: setupLink })[document.body.dataset.page]();
@@ -0,0 +1,51 @@
+package urlshortener
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestWebUI(t *testing.T) {
+	srv := newTestAPI(t)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	for _, path := range []string{"/", "/ui"} {
+		resp, err := client.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "ui/" {
+			t.Errorf("GET %s: status %d to %q, want a relative redirect to ui/", path, resp.StatusCode, resp.Header.Get("Location"))
+		}
+	}
+
+	for path, want := range map[string]string{
+		"/ui/":           `data-page="shorten"`,
+		"/ui/links.html": `data-page="links"`,
+		"/ui/link.html":  `data-page="link"`,
+		"/ui/app.js":     `fetch(apiBase + path`,
+		"/ui/style.css":  `.detail`,
+	} {
+		resp, err := client.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), want) {
+			t.Errorf("GET %s: status %d, body without %q", path, resp.StatusCode, want)
+		}
+		if !strings.Contains(resp.Header.Get("Content-Security-Policy"), "default-src 'self'") {
+			t.Errorf("GET %s: no Content-Security-Policy", path)
+		}
+	}
+
+	// the UI's files do not shadow links
+	code := createLink(t, srv.URL, `{"original_url":"https://example.com"}`)
+	if stats := getStats(t, srv.URL, code); stats.OriginalURL != "https://example.com" {
+		t.Errorf("stats next to the UI = %+v", stats)
+	}
+}
@@ -0,0 +1,488 @@
+package urlshortener
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Webhook event types.
+const (
+	EventLinkCreated = "link.created"
+	// EventLinkExpired is sent when a one-time link is used up.
+	EventLinkExpired = "link.expired"
+	// EventLinkClickThreshold is sent when a link's clicks reach one of the
+	// endpoint's ClickThresholds.
+	EventLinkClickThreshold = "link.click_threshold"
+	EventLinkDisabled       = "link.disabled"
+)
+
+var webhookEvents = []string{EventLinkCreated, EventLinkExpired, EventLinkClickThreshold, EventLinkDisabled}
+
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+// Webhook is an endpoint receiving link events.
+type Webhook struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// Events the endpoint receives; empty for all of them.
+	Events          []string  `json:"events,omitempty"`
+	ClickThresholds []int     `json:"click_thresholds,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+type CreateWebhookRequest struct {
+	URL             string   `json:"url"`
+	Events          []string `json:"events,omitempty"`
+	ClickThresholds []int    `json:"click_thresholds,omitempty"`
+}
+
+// NewWebhook is returned once, on creation, with the secret that signs the
+// endpoint's deliveries.
+type NewWebhook struct {
+	Webhook
+	Secret string `json:"secret"`
+}
+
+type WebhookList struct {
+	Webhooks []Webhook `json:"webhooks"`
+}
+
+// WebhookEvent is the JSON body of a delivery.
+type WebhookEvent struct {
+	Type       string    `json:"type"`
+	OccurredAt time.Time `json:"occurred_at"`
+	Link       EventLink `json:"link"`
+	// Threshold is the click count reached, for link.click_threshold.
+	Threshold int `json:"threshold,omitempty"`
+	// Reason is why the link was disabled, for link.disabled.
+	Reason string `json:"reason,omitempty"`
+}
+
+type EventLink struct {
+	Code        string `json:"code"`
+	ShortURL    string `json:"short_url"`
+	OriginalURL string `json:"original_url"`
+	Clicks      int    `json:"clicks"`
+}
+
+type Webhooks struct {
+	db  *sql.DB
+	now func() time.Time
+}
+
+func NewWebhooks(db *sql.DB) *Webhooks {
+	return &Webhooks{db: db, now: time.Now}
+}
+
+func (req CreateWebhookRequest) validate() error {
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an absolute http(s) URL")
+	}
+	for _, ev := range req.Events {
+		if !slices.Contains(webhookEvents, ev) {
+			return fmt.Errorf("unknown event %q, want one of %s", ev, strings.Join(webhookEvents, ", "))
+		}
+	}
+	for _, n := range req.ClickThresholds {
+		if n < 1 {
+			return errors.New("click thresholds must be positive")
+		}
+	}
+	return nil
+}
+
+// Create registers an endpoint with a new signing secret.
+func (h *Webhooks) Create(req CreateWebhookRequest) (NewWebhook, error) {
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return NewWebhook{}, fmt.Errorf("generating webhook secret: %w", err)
+	}
+	hook := NewWebhook{
+		Webhook: Webhook{
+			ID:              hex.EncodeToString(raw[:4]),
+			URL:             req.URL,
+			Events:          req.Events,
+			ClickThresholds: req.ClickThresholds,
+			CreatedAt:       h.now().UTC(),
+		},
+		Secret: "whsec_" + hex.EncodeToString(raw[4:]),
+	}
+
+	thresholds := make([]string, len(req.ClickThresholds))
+	for i, n := range req.ClickThresholds {
+		thresholds[i] = strconv.Itoa(n)
+	}
+	_, err := h.db.Exec("INSERT INTO webhooks (id, url, secret, events, click_thresholds, created_at) VALUES (?,?,?,?,?,?)",
+		hook.ID, hook.URL, hook.Secret, strings.Join(req.Events, ","), strings.Join(thresholds, ","), hook.CreatedAt)
+	if err != nil {
+		return NewWebhook{}, fmt.Errorf("storing webhook: %w", err)
+	}
+	return hook, nil
+}
+
+func (h *Webhooks) List() ([]Webhook, error) {
+	rows, err := h.db.Query("SELECT id, url, events, click_thresholds, created_at FROM webhooks ORDER BY created_at")
+	if err != nil {
+		return nil, fmt.Errorf("listing webhooks: %w", err)
+	}
+	defer rows.Close()
+
+	hooks := []Webhook{}
+	for rows.Next() {
+		var hook Webhook
+		var events, thresholds string
+		if err := rows.Scan(&hook.ID, &hook.URL, &events, &thresholds, &hook.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scanning webhook row: %w", err)
+		}
+		if events != "" {
+			hook.Events = strings.Split(events, ",")
+		}
+		for _, s := range strings.Split(thresholds, ",") {
+			if n, err := strconv.Atoi(s); err == nil {
+				hook.ClickThresholds = append(hook.ClickThresholds, n)
+			}
+		}
+		hooks = append(hooks, hook)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating webhook rows: %w", err)
+	}
+	return hooks, nil
+}
+
+// Delete removes an endpoint and drops its pending deliveries.
+func (h *Webhooks) Delete(id string) error {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("DELETE FROM webhooks WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("deleting webhook: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("deleting webhook: %w", err)
+	} else if n == 0 {
+		return ErrWebhookNotFound
+	}
+	_, err = tx.Exec("DELETE FROM webhook_outbox WHERE webhook_id = ? AND delivered_at IS NULL AND failed_at IS NULL", id)
+	if err != nil {
+		return fmt.Errorf("dropping pending deliveries: %w", err)
+	}
+	return tx.Commit()
+}
+
+// enqueueEvent adds a delivery of ev to the outbox for every endpoint that
+// subscribed to it, through db or the transaction of the change.
+func enqueueEvent(db execer, ev WebhookEvent) error {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return fmt.Errorf("encoding %s event: %w", ev.Type, err)
+	}
+	query := "INSERT INTO webhook_outbox (webhook_id, event, payload, created_at, next_attempt_at) " +
+		"SELECT id, ?, ?, ?, ? FROM webhooks WHERE (events = '' OR instr(',' || events || ',', ?) > 0)"
+	args := []any{ev.Type, string(payload), ev.OccurredAt, ev.OccurredAt, "," + ev.Type + ","}
+	if ev.Type == EventLinkClickThreshold {
+		query += " AND instr(',' || click_thresholds || ',', ?) > 0"
+		args = append(args, ","+strconv.Itoa(ev.Threshold)+",")
+	}
+	if _, err := db.Exec(query, args...); err != nil {
+		return fmt.Errorf("queueing %s event: %w", ev.Type, err)
+	}
+	return nil
+}
+
+// WebhookConfig tunes webhook delivery; zero fields take the defaults.
+type WebhookConfig struct {
+	// Client sends the deliveries, by default with a 10s timeout.
+	Client *http.Client
+	// PollInterval is how often the outbox is checked, 1s by default.
+	PollInterval time.Duration
+	// RetryBase is the delay before the first retry, doubled for each
+	// further one up to an hour; 5s by default.
+	RetryBase time.Duration
+	// MaxAttempts after which a delivery is given up, 10 by default.
+	MaxAttempts int
+	Now         func() time.Time
+}
+
+// WebhookWorkers deliver the outbox: a dispatcher leases due deliveries and
+// hands them to numWorkers senders. Deliveries are at least once; receivers
+// can dedupe on the X-Webhook-Id header.
+type WebhookWorkers struct {
+	*WorkerPool
+	db   *sql.DB
+	cfg  WebhookConfig
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+type delivery struct {
+	id       int64
+	event    string
+	payload  []byte
+	attempts int
+	url      string
+	secret   string
+}
+
+func StartWebhookWorkers(db *sql.DB, cfg WebhookConfig, numWorkers int) *WebhookWorkers {
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = time.Second
+	}
+	if cfg.RetryBase <= 0 {
+		cfg.RetryBase = 5 * time.Second
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 10
+	}
+	if cfg.Now == nil {
+		cfg.Now = time.Now
+	}
+
+	w := &WebhookWorkers{
+		WorkerPool: &WorkerPool{size: numWorkers},
+		db:         db,
+		cfg:        cfg,
+		stop:       make(chan struct{}),
+	}
+	jobs := make(chan delivery)
+	for i := 0; i < numWorkers; i++ {
+		w.running.Add(1)
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			defer w.running.Add(-1)
+			for d := range jobs {
+				w.deliver(d)
+			}
+		}()
+	}
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		defer close(jobs)
+		w.dispatch(jobs)
+	}()
+	return w
+}
+
+// Stop stops leasing deliveries and waits for those being sent.
+func (w *WebhookWorkers) Stop() {
+	close(w.stop)
+	w.wg.Wait()
+}
+
+const dispatchBatch = 100
+
+func (w *WebhookWorkers) dispatch(jobs chan<- delivery) {
+	ticker := time.NewTicker(w.cfg.PollInterval)
+	defer ticker.Stop()
+	for {
+		due, err := w.lease(dispatchBatch)
+		if err != nil {
+			slog.Error("leasing webhook deliveries", "err", err)
+		}
+		for _, d := range due {
+			select {
+			case jobs <- d:
+			case <-w.stop:
+				return // the lease runs out and the delivery is retried
+			}
+		}
+		if len(due) == dispatchBatch {
+			continue
+		}
+		select {
+		case <-ticker.C:
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// lease returns up to limit due deliveries and postpones them for as long as
+// sending may take, so they are retried if the process stops meanwhile.
+func (w *WebhookWorkers) lease(limit int) ([]delivery, error) {
+	now := w.cfg.Now().UTC()
+	rows, err := w.db.Query(`
+SELECT o.id, o.event, o.payload, o.attempts, h.url, h.secret
+FROM webhook_outbox o JOIN webhooks h ON h.id = o.webhook_id
+WHERE o.delivered_at IS NULL AND o.failed_at IS NULL AND o.next_attempt_at <= ?
+ORDER BY o.next_attempt_at, o.id LIMIT ?`, now, limit)
+	if err != nil {
+		return nil, fmt.Errorf("selecting due deliveries: %w", err)
+	}
+	var due []delivery
+	for rows.Next() {
+		var d delivery
+		var payload string
+		if err := rows.Scan(&d.id, &d.event, &payload, &d.attempts, &d.url, &d.secret); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scanning delivery row: %w", err)
+		}
+		d.payload = []byte(payload)
+		due = append(due, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating delivery rows: %w", err)
+	}
+
+	until := now.Add(2*w.cfg.Client.Timeout + time.Minute)
+	for _, d := range due {
+		if _, err := w.db.Exec("UPDATE webhook_outbox SET next_attempt_at = ? WHERE id = ?", until, d.id); err != nil {
+			return nil, fmt.Errorf("leasing delivery %d: %w", d.id, err)
+		}
+	}
+	return due, nil
+}
+
+func (w *WebhookWorkers) deliver(d delivery) {
+	logger := slog.With("delivery", d.id, "event", d.event, "url", d.url)
+	err := w.send(d)
+	now := w.cfg.Now().UTC()
+	if err == nil {
+		if _, err := w.db.Exec("UPDATE webhook_outbox SET delivered_at = ?, attempts = attempts + 1, last_error = '' WHERE id = ?",
+			now, d.id); err != nil {
+			logger.Error("recording webhook delivery", "err", err)
+		}
+		logger.Info("webhook delivered", "attempt", d.attempts+1)
+		return
+	}
+
+	attempts := d.attempts + 1
+	if attempts >= w.cfg.MaxAttempts {
+		logger.Error("webhook delivery failed, giving up", "attempts", attempts, "err", err)
+		_, err = w.db.Exec("UPDATE webhook_outbox SET failed_at = ?, attempts = ?, last_error = ? WHERE id = ?",
+			now, attempts, err.Error(), d.id)
+	} else {
+		next := now.Add(retryDelay(w.cfg.RetryBase, attempts))
+		logger.Warn("webhook delivery failed, will retry", "attempts", attempts, "next_attempt_at", next, "err", err)
+		_, err = w.db.Exec("UPDATE webhook_outbox SET next_attempt_at = ?, attempts = ?, last_error = ? WHERE id = ?",
+			next, attempts, err.Error(), d.id)
+	}
+	if err != nil {
+		logger.Error("recording webhook failure", "err", err)
+	}
+}
+
+// retryDelay doubles base for every attempt after the first, up to an hour.
+func retryDelay(base time.Duration, attempts int) time.Duration {
+	d := base
+	for i := 1; i < attempts && d < time.Hour; i++ {
+		d *= 2
+	}
+	return min(d, time.Hour)
+}
+
+// send POSTs a delivery, signed with SignWebhook. Any 2xx response counts as
+// delivered.
+func (w *WebhookWorkers) send(d delivery) error {
+	ts := strconv.FormatInt(w.cfg.Now().Unix(), 10)
+	req, err := http.NewRequest(http.MethodPost, d.url, bytes.NewReader(d.payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "urlshortener-webhooks")
+	req.Header.Set("X-Webhook-Id", strconv.FormatInt(d.id, 10))
+	req.Header.Set("X-Webhook-Event", d.event)
+	req.Header.Set("X-Webhook-Timestamp", ts)
+	req.Header.Set("X-Webhook-Signature", SignWebhook(d.secret, ts, d.payload))
+
+	resp, err := w.cfg.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return nil
+}
+
+// SignWebhook returns the X-Webhook-Signature of a delivery:
+// "sha256=" and the hex HMAC-SHA256 of "TIMESTAMP.BODY" keyed with the
+// endpoint's secret. Receivers recompute it and compare with hmac.Equal.
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func handleListWebhooks(hooks *Webhooks) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		list, err := hooks.List()
+		if err != nil {
+			loggerFor(RequestIDFromContext(r.Context())).Error("listing webhooks", "err", err)
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to list webhooks")
+			return
+		}
+		writeJSON(w, http.StatusOK, WebhookList{Webhooks: list})
+	}
+}
+
+func handleCreateWebhook(hooks *Webhooks) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req CreateWebhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "Invalid request body")
+			return
+		}
+		if err := req.validate(); err != nil {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, err.Error())
+			return
+		}
+
+		hook, err := hooks.Create(req)
+		if err != nil {
+			loggerFor(RequestIDFromContext(r.Context())).Error("creating webhook", "err", err)
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to create webhook")
+			return
+		}
+		loggerFor(RequestIDFromContext(r.Context())).Info("webhook created", "id", hook.ID, "url", hook.URL)
+		writeJSON(w, http.StatusCreated, hook)
+	}
+}
+
+func handleDeleteWebhook(hooks *Webhooks) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := hooks.Delete(r.PathValue("id"))
+		if errors.Is(err, ErrWebhookNotFound) {
+			writeError(w, r, http.StatusNotFound, CodeNotFound, "Webhook not found")
+			return
+		}
+		if err != nil {
+			loggerFor(RequestIDFromContext(r.Context())).Error("deleting webhook", "err", err)
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Failed to delete webhook")
+			return
+		}
+		loggerFor(RequestIDFromContext(r.Context())).Info("webhook deleted", "id", r.PathValue("id"))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,241 @@
+package urlshortener
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookEventsQueued(t *testing.T) {
+	db, err := InitDBAt(filepath.Join(t.TempDir(), "hooks.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	hooks := NewWebhooks(db)
+	all, err := hooks.Create(CreateWebhookRequest{URL: "https://all.example/hook", ClickThresholds: []int{1, 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hooks.Create(CreateWebhookRequest{URL: "https://other.example/hook", Events: []string{EventLinkDisabled}}); err != nil {
+		t.Fatal(err)
+	}
+
+	links := NewUrlMapping(db)
+	if err := links.Create("https://example.com/once", "https://sho.rt/a", "aaa", 1, LinkOptions{OneTime: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := links.Create("https://bad.example/x", "https://sho.rt/b", "aaa", 2, LinkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := links.Consume(encodeCode("aaa", 1), ""); err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		if err := links.RecordClick(encodeCode("aaa", 2), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = links.DisableMatching("test", func(dest string) (string, bool) {
+		return "blocked host", strings.HasPrefix(dest, "https://bad.example")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := db.Query("SELECT webhook_id, event, payload FROM webhook_outbox ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var got []string
+	for rows.Next() {
+		var hook, event, payload string
+		if err := rows.Scan(&hook, &event, &payload); err != nil {
+			t.Fatal(err)
+		}
+		var ev WebhookEvent
+		if err := json.Unmarshal([]byte(payload), &ev); err != nil {
+			t.Fatal(err)
+		}
+		if ev.Type != event {
+			t.Errorf("payload type %s in a %s row", ev.Type, event)
+		}
+		who := "other"
+		if hook == all.ID {
+			who = "all"
+		}
+		got = append(got, who+" "+event+" "+ev.Link.OriginalURL)
+	}
+	want := []string{
+		"all link.created https://example.com/once",
+		"all link.created https://bad.example/x",
+		"all link.click_threshold https://example.com/once",
+		"all link.expired https://example.com/once",
+		"all link.click_threshold https://bad.example/x",
+		"all link.click_threshold https://bad.example/x",
+		"all link.disabled https://bad.example/x",
+		"other link.disabled https://bad.example/x",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("outbox:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// receiver is a webhook endpoint answering 503 to its first failures requests.
+type receiver struct {
+	mu       sync.Mutex
+	failures int
+	got      []*http.Request
+	bodies   [][]byte
+	signal   chan struct{}
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rc.mu.Lock()
+	rc.got = append(rc.got, r)
+	rc.bodies = append(rc.bodies, body)
+	fail := rc.failures > 0
+	rc.failures--
+	rc.mu.Unlock()
+	if fail {
+		http.Error(w, "try later", http.StatusServiceUnavailable)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+	rc.signal <- struct{}{}
+}
+
+func (rc *receiver) wait(t *testing.T, n int) {
+	t.Helper()
+	for range n {
+		select {
+		case <-rc.signal:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a webhook delivery")
+		}
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	rc := &receiver{failures: 1, signal: make(chan struct{}, 10)}
+	endpoint := httptest.NewServer(rc)
+	defer endpoint.Close()
+
+	srv, err := NewServer(
+		WithDBPath(filepath.Join(t.TempDir(), "hooks.db")),
+		WithWorkers(1),
+		WithWebhooks(WebhookConfig{PollInterval: 5 * time.Millisecond, RetryBase: 10 * time.Millisecond}, 2),
+		WithHttpConfig(HttpConfig{ShortUrlHost: "sho.rt", AdminToken: "secret"}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown(context.Background())
+	api := httptest.NewServer(srv.Handler())
+	defer api.Close()
+
+	body, _ := json.Marshal(CreateWebhookRequest{URL: endpoint.URL, Events: []string{EventLinkCreated, EventLinkClickThreshold}, ClickThresholds: []int{2}})
+	req, _ := http.NewRequest("POST", api.URL+"/admin/webhooks", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hook NewWebhook
+	json.NewDecoder(resp.Body).Decode(&hook)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || !strings.HasPrefix(hook.Secret, "whsec_") {
+		t.Fatalf("register webhook: status %d, %+v", resp.StatusCode, hook)
+	}
+
+	code := createLink(t, api.URL, `{"original_url":"https://example.com/launch"}`)
+	rc.wait(t, 2) // refused, then retried
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	for range 2 {
+		resp, err := client.Get(api.URL + "/" + code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	rc.wait(t, 1)
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if len(rc.got) != 3 {
+		t.Fatalf("got %d deliveries, want 3", len(rc.got))
+	}
+	if rc.got[0].Header.Get("X-Webhook-Id") != rc.got[1].Header.Get("X-Webhook-Id") {
+		t.Error("retry has a different delivery id")
+	}
+	for i, r := range rc.got {
+		sig := SignWebhook(hook.Secret, r.Header.Get("X-Webhook-Timestamp"), rc.bodies[i])
+		if r.Header.Get("X-Webhook-Signature") != sig {
+			t.Errorf("delivery %d: signature %q, want %q", i, r.Header.Get("X-Webhook-Signature"), sig)
+		}
+	}
+
+	var created, threshold WebhookEvent
+	json.Unmarshal(rc.bodies[1], &created)
+	json.Unmarshal(rc.bodies[2], &threshold)
+	if created.Type != EventLinkCreated || created.Link.Code != code || created.Link.OriginalURL != "https://example.com/launch" {
+		t.Errorf("created event = %+v", created)
+	}
+	if threshold.Type != EventLinkClickThreshold || threshold.Threshold != 2 || threshold.Link.Clicks != 2 {
+		t.Errorf("threshold event = %+v", threshold)
+	}
+}
+
+func TestWebhookDeliveryGivesUp(t *testing.T) {
+	db, err := InitDBAt(filepath.Join(t.TempDir(), "hooks.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	rc := &receiver{failures: 100, signal: make(chan struct{}, 10)}
+	endpoint := httptest.NewServer(rc)
+	defer endpoint.Close()
+	if _, err := NewWebhooks(db).Create(CreateWebhookRequest{URL: endpoint.URL}); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewUrlMapping(db).Create("https://example.com", "https://sho.rt/a", "aaa", 1, LinkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	workers := StartWebhookWorkers(db, WebhookConfig{PollInterval: 5 * time.Millisecond, RetryBase: time.Millisecond, MaxAttempts: 3}, 1)
+	rc.wait(t, 3)
+	workers.Stop()
+
+	var attempts int
+	var lastError string
+	var failed bool
+	err = db.QueryRow("SELECT attempts, last_error, failed_at IS NOT NULL FROM webhook_outbox").Scan(&attempts, &lastError, &failed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 3 || !failed || !strings.Contains(lastError, "503") {
+		t.Errorf("attempts %d, failed %v, last error %q", attempts, failed, lastError)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{1: 5 * time.Second, 2: 10 * time.Second, 4: 40 * time.Second, 20: time.Hour} {
+		if got := retryDelay(5*time.Second, attempts); got != want {
+			t.Errorf("retryDelay after %d attempts = %v, want %v", attempts, got, want)
+		}
+	}
+}
@@ -0,0 +1,676 @@
+// Package shortener is a client for the urlshortener HTTP API.
+package shortener
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	apiKey     string
+	adminToken string
+	maxRetries int
+	backoff    time.Duration
+}
+
+type Option func(*Client)
+
+// WithHTTPClient replaces http.DefaultClient.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithAPIKey authenticates link creation once the server has API keys.
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+// WithAdminToken authenticates the admin operations.
+func WithAdminToken(token string) Option {
+	return func(c *Client) { c.adminToken = token }
+}
+
+// WithRetries sets how many times a request answered with 503 or 429 is
+// retried, waiting backoff, then twice that, and so on. A Retry-After header
+// takes precedence. The default is 3 retries starting at 100ms.
+func WithRetries(n int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = n
+		c.backoff = backoff
+	}
+}
+
+// New returns a client for the server at baseURL, e.g. "https://s.example".
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: http.DefaultClient,
+		maxRetries: 3,
+		backoff:    100 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+type ShortenRequest struct {
+	URL string `json:"original_url"`
+	// QR asks for a PNG QR code data URI in the result.
+	QR bool `json:"qr,omitempty"`
+	// Interstitial shows a preview page before redirecting.
+	Interstitial bool `json:"interstitial,omitempty"`
+	// Owner, Title and Tags describe the link for Search.
+	Owner string   `json:"owner,omitempty"`
+	Title string   `json:"title,omitempty"`
+	Tags  []string `json:"tags,omitempty"`
+	// Redirect rewrites the destination each time the link is followed.
+	Redirect *RedirectRules `json:"redirect,omitempty"`
+	// Password puts a password prompt before the redirect.
+	Password string `json:"password,omitempty"`
+	// OneTime links stop resolving after their first redirect.
+	OneTime bool `json:"one_time,omitempty"`
+}
+
+// RedirectRules rewrite a link's destination at redirect time.
+type RedirectRules struct {
+	// Params are set on the destination's query. Values may use the
+	// placeholders {code}, {owner}, {title}, {tag}, {date} and {query.NAME}.
+	Params map[string]string `json:"params,omitempty"`
+	// PassQuery copies the short URL's query string to the destination.
+	PassQuery bool `json:"pass_query,omitempty"`
+	// ForwardPath appends the path after the code to the destination's path.
+	ForwardPath bool `json:"forward_path,omitempty"`
+	// Routes send matching visits to variants; the first match is used.
+	Routes []Route `json:"routes,omitempty"`
+}
+
+// Route sends visits matching all of its conditions to one of its variants,
+// picked by weight.
+type Route struct {
+	// Devices are mobile, tablet, desktop or bot.
+	Devices []string `json:"devices,omitempty"`
+	// Languages match the visitor's preferred Accept-Language, "de" also
+	// matching regional variants like de-AT.
+	Languages []string   `json:"languages,omitempty"`
+	After     *time.Time `json:"after,omitempty"`
+	Before    *time.Time `json:"before,omitempty"`
+	Variants  []Variant  `json:"variants"`
+}
+
+// Variant is an alternative destination, counted separately in
+// Stats.VariantClicks.
+type Variant struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	Weight int    `json:"weight,omitempty"`
+}
+
+type ShortenResult struct {
+	ShortURL string `json:"shortened_url"`
+	QRCode   string `json:"qr_code,omitempty"`
+}
+
+// BatchResult is one entry of ShortenBatch; Err is set if it failed.
+type BatchResult struct {
+	ShortenResult
+	Err error
+}
+
+type Stats struct {
+	Code           string         `json:"code"`
+	ShortURL       string         `json:"short_url"`
+	OriginalURL    string         `json:"original_url"`
+	CreatedAt      time.Time      `json:"created_at"`
+	Clicks         int            `json:"clicks"`
+	Interstitial   bool           `json:"interstitial"`
+	Disabled       bool           `json:"disabled"`
+	DisabledReason string         `json:"disabled_reason,omitempty"`
+	Owner          string         `json:"owner,omitempty"`
+	Title          string         `json:"title,omitempty"`
+	Tags           []string       `json:"tags,omitempty"`
+	Redirect       *RedirectRules `json:"redirect,omitempty"`
+	VariantClicks  map[string]int `json:"variant_clicks,omitempty"`
+	// PasswordProtected and OneTime links report no OriginalURL or Redirect,
+	// except in ListLinks and searches with the admin token.
+	PasswordProtected bool `json:"password_protected,omitempty"`
+	OneTime           bool `json:"one_time,omitempty"`
+	Consumed          bool `json:"consumed,omitempty"`
+	// Broken is set when the destination failed the server's last check.
+	// LastCheck is only returned by ListLinks and authenticated searches.
+	Broken    bool       `json:"broken,omitempty"`
+	LastCheck *LinkCheck `json:"last_check,omitempty"`
+	// DeletedAt and DeletedBy are only set in ListLinks with Deleted.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	DeletedBy string     `json:"deleted_by,omitempty"`
+}
+
+// LinkCheck is the outcome of the last request to a link's destination;
+// Status is 0 if the request failed without a response.
+type LinkCheck struct {
+	Status    int       `json:"status,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+type BlockRule struct {
+	Kind    string `json:"kind"`
+	Pattern string `json:"pattern"`
+}
+
+type EnforceResult struct {
+	Rules    int `json:"rules"`
+	Disabled int `json:"disabled"`
+}
+
+type ListOptions struct {
+	// Query filters on a substring of the original URL.
+	Query string
+	// Broken only lists links whose destination failed its last check.
+	Broken bool
+	// Deleted lists deleted links instead of live ones.
+	Deleted bool
+	Limit   int
+	Offset  int
+}
+
+// HistoryEntry is a change to a link. Actor is "admin", "key:<id>" for an
+// API key or "anonymous".
+type HistoryEntry struct {
+	Action string    `json:"action"`
+	Actor  string    `json:"actor,omitempty"`
+	At     time.Time `json:"at"`
+	OldURL string    `json:"old_url,omitempty"`
+	NewURL string    `json:"new_url,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+type APIKey struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	// Key is only returned by CreateAPIKey.
+	Key string `json:"key,omitempty"`
+}
+
+// Webhook is an endpoint receiving link events. Secret is only returned by
+// CreateWebhook.
+type Webhook struct {
+	ID              string    `json:"id"`
+	URL             string    `json:"url"`
+	Events          []string  `json:"events,omitempty"`
+	ClickThresholds []int     `json:"click_thresholds,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+	Secret          string    `json:"secret,omitempty"`
+}
+
+// WebhookEvent is the body of a webhook delivery.
+type WebhookEvent struct {
+	Type       string    `json:"type"`
+	OccurredAt time.Time `json:"occurred_at"`
+	Link       struct {
+		Code        string `json:"code"`
+		ShortURL    string `json:"short_url"`
+		OriginalURL string `json:"original_url"`
+		Clicks      int    `json:"clicks"`
+	} `json:"link"`
+	Threshold int    `json:"threshold,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+type Seed struct {
+	Seed        string     `json:"seed"`
+	Status      int        `json:"status"`
+	CounterUsed int        `json:"counter_used"`
+	CounterSize int        `json:"counter_size"`
+	LeaseHolder string     `json:"lease_holder,omitempty"`
+	LeaseTaken  *time.Time `json:"lease_taken,omitempty"`
+}
+
+// StatusName is "available", "used" or "exhausted".
+func (s Seed) StatusName() string {
+	switch s.Status {
+	case 0:
+		return "available"
+	case 1:
+		return "used"
+	case 2:
+		return "exhausted"
+	}
+	return strconv.Itoa(s.Status)
+}
+
+type SeedPool struct {
+	Counts map[string]int `json:"counts"`
+	Seeds  []Seed         `json:"seeds"`
+}
+
+func (c *Client) Shorten(ctx context.Context, req ShortenRequest) (*ShortenResult, error) {
+	var res ShortenResult
+	if err := c.do(ctx, http.MethodPost, "/short", false, req, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// ShortenBatch shortens all reqs in one round trip. The returned slice lines
+// up with reqs; entries fail independently.
+func (c *Client) ShortenBatch(ctx context.Context, reqs []ShortenRequest) ([]BatchResult, error) {
+	var res struct {
+		Results []struct {
+			ShortenResult
+			Error *apiError `json:"error"`
+		} `json:"results"`
+	}
+	body := map[string][]ShortenRequest{"urls": reqs}
+	if err := c.do(ctx, http.MethodPost, "/short/batch", false, body, &res); err != nil {
+		return nil, err
+	}
+	if len(res.Results) != len(reqs) {
+		return nil, fmt.Errorf("shortener: got %d batch results for %d urls", len(res.Results), len(reqs))
+	}
+
+	results := make([]BatchResult, len(res.Results))
+	for i, r := range res.Results {
+		results[i].ShortenResult = r.ShortenResult
+		if r.Error != nil {
+			results[i].Err = r.Error.toError()
+		}
+	}
+	return results, nil
+}
+
+// Resolve returns the destination a visit to a short code or short URL would
+// be sent to, with the link's redirect rules applied. It asks the redirect
+// endpoint with HEAD and does not follow the redirect, so no click is counted.
+// Links that only lead a visitor on are not resolved: Resolve returns
+// ErrPasswordProtected, ErrOneTime or ErrPreview for them.
+func (c *Client) Resolve(ctx context.Context, code string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.baseURL+"/"+codeOf(code), nil)
+	if err != nil {
+		return "", fmt.Errorf("shortener: %w", err)
+	}
+	hc := *c.httpClient
+	hc.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		// 307s hand the visit from a read-only node to the primary; a 302
+		// is the link's own redirect
+		if req.Response.StatusCode == http.StatusFound {
+			return http.ErrUseLastResponse
+		}
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("shortener: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusFound:
+		dest, err := resp.Location()
+		if err != nil {
+			return "", fmt.Errorf("shortener: redirect without destination: %w", err)
+		}
+		return dest.String(), nil
+	case resp.StatusCode == http.StatusOK:
+		// a page for the visitor instead of the redirect; the stats tell which
+		s, err := c.Stats(ctx, code)
+		if err != nil {
+			return "", err
+		}
+		e := &Error{StatusCode: http.StatusForbidden, RequestID: resp.Header.Get("X-Request-ID")}
+		switch {
+		case s.PasswordProtected:
+			e.Code, e.Message = codePasswordRequired, "Link is password protected"
+		case s.OneTime:
+			e.Code, e.Message = codeOneTime, "Link is one-time; only a visit reveals its destination"
+		default:
+			e.Code, e.Message = codePreview, "Link shows a preview page"
+		}
+		return "", e
+	case resp.StatusCode >= 400:
+		return "", errorFromResponse(resp)
+	}
+	return "", &Error{StatusCode: resp.StatusCode, Message: "unexpected response to HEAD " + req.URL.Path}
+}
+
+// Stats returns the details and click count of a short code or short URL.
+func (c *Client) Stats(ctx context.Context, code string) (*Stats, error) {
+	var s Stats
+	if err := c.do(ctx, http.MethodGet, "/"+codeOf(code)+"/stats", false, nil, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (c *Client) BlocklistRules(ctx context.Context) ([]BlockRule, error) {
+	var res struct {
+		Rules []BlockRule `json:"rules"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/admin/blocklist", true, nil, &res); err != nil {
+		return nil, err
+	}
+	return res.Rules, nil
+}
+
+// EnforceBlocklist makes the server reload its blocklist and disable existing
+// links that match it.
+func (c *Client) EnforceBlocklist(ctx context.Context) (*EnforceResult, error) {
+	var res EnforceResult
+	if err := c.do(ctx, http.MethodPost, "/admin/blocklist/enforce", true, nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// ListLinks returns links, newest first.
+func (c *Client) ListLinks(ctx context.Context, opts ListOptions) ([]Stats, error) {
+	q := url.Values{}
+	if opts.Query != "" {
+		q.Set("q", opts.Query)
+	}
+	if opts.Broken {
+		q.Set("broken", "true")
+	}
+	if opts.Deleted {
+		q.Set("deleted", "true")
+	}
+	if opts.Limit > 0 {
+		q.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Offset > 0 {
+		q.Set("offset", strconv.Itoa(opts.Offset))
+	}
+
+	var res struct {
+		Links []Stats `json:"links"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/admin/links?"+q.Encode(), true, nil, &res); err != nil {
+		return nil, err
+	}
+	return res.Links, nil
+}
+
+// DeleteLink soft deletes a link: it stops resolving until RestoreLink, and
+// its code is never issued again. reason, if any, goes to its history.
+func (c *Client) DeleteLink(ctx context.Context, code, reason string) error {
+	path := "/admin/links/" + codeOf(code)
+	if reason != "" {
+		path += "?" + url.Values{"reason": {reason}}.Encode()
+	}
+	return c.do(ctx, http.MethodDelete, path, true, nil, nil)
+}
+
+func (c *Client) RestoreLink(ctx context.Context, code string) (*Stats, error) {
+	var s Stats
+	if err := c.do(ctx, http.MethodPost, "/admin/links/"+codeOf(code)+"/restore", true, nil, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// LinkHistory returns the changes to a link, oldest first.
+func (c *Client) LinkHistory(ctx context.Context, code string) ([]HistoryEntry, error) {
+	var res struct {
+		Entries []HistoryEntry `json:"entries"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/admin/links/"+codeOf(code)+"/history", true, nil, &res); err != nil {
+		return nil, err
+	}
+	return res.Entries, nil
+}
+
+// SearchOptions filters Search; zero fields match everything.
+type SearchOptions struct {
+	// URLPrefix matches the start of the original URL, ignoring case.
+	URLPrefix string
+	Owner     string
+	// Tags must all be present on a link.
+	Tags []string
+	// CreatedAfter (inclusive) and CreatedBefore (exclusive) bound the
+	// creation time.
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	// Title holds words that must all appear in the title.
+	Title  string
+	Limit  int
+	Offset int
+}
+
+// Search returns links matching opts, newest first.
+func (c *Client) Search(ctx context.Context, opts SearchOptions) ([]Stats, error) {
+	q := url.Values{}
+	set := func(k, v string) {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	set("url_prefix", opts.URLPrefix)
+	set("owner", opts.Owner)
+	set("q", opts.Title)
+	for _, t := range opts.Tags {
+		q.Add("tag", t)
+	}
+	if !opts.CreatedAfter.IsZero() {
+		q.Set("created_after", opts.CreatedAfter.Format(time.RFC3339))
+	}
+	if !opts.CreatedBefore.IsZero() {
+		q.Set("created_before", opts.CreatedBefore.Format(time.RFC3339))
+	}
+	if opts.Limit > 0 {
+		q.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Offset > 0 {
+		q.Set("offset", strconv.Itoa(opts.Offset))
+	}
+
+	var res struct {
+		Links []Stats `json:"links"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/links/search?"+q.Encode(), false, nil, &res); err != nil {
+		return nil, err
+	}
+	return res.Links, nil
+}
+
+func (c *Client) SeedPool(ctx context.Context) (*SeedPool, error) {
+	var pool SeedPool
+	if err := c.do(ctx, http.MethodGet, "/admin/seeds", true, nil, &pool); err != nil {
+		return nil, err
+	}
+	return &pool, nil
+}
+
+func (c *Client) APIKeys(ctx context.Context) ([]APIKey, error) {
+	var res struct {
+		Keys []APIKey `json:"keys"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/admin/keys", true, nil, &res); err != nil {
+		return nil, err
+	}
+	return res.Keys, nil
+}
+
+// CreateAPIKey issues a key; its Key field is the only copy of the secret.
+func (c *Client) CreateAPIKey(ctx context.Context, name string) (*APIKey, error) {
+	var key APIKey
+	body := map[string]string{"name": name}
+	if err := c.do(ctx, http.MethodPost, "/admin/keys", true, body, &key); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (c *Client) RevokeAPIKey(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/admin/keys/"+url.PathEscape(id), true, nil, nil)
+}
+
+func (c *Client) Webhooks(ctx context.Context) ([]Webhook, error) {
+	var res struct {
+		Webhooks []Webhook `json:"webhooks"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/admin/webhooks", true, nil, &res); err != nil {
+		return nil, err
+	}
+	return res.Webhooks, nil
+}
+
+// CreateWebhook registers an endpoint for events, or for all of them if
+// events is empty. The returned Secret is the only copy.
+func (c *Client) CreateWebhook(ctx context.Context, endpoint string, events []string, clickThresholds []int) (*Webhook, error) {
+	var hook Webhook
+	body := map[string]any{"url": endpoint, "events": events, "click_thresholds": clickThresholds}
+	if err := c.do(ctx, http.MethodPost, "/admin/webhooks", true, body, &hook); err != nil {
+		return nil, err
+	}
+	return &hook, nil
+}
+
+func (c *Client) DeleteWebhook(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/admin/webhooks/"+url.PathEscape(id), true, nil, nil)
+}
+
+// VerifyWebhook checks a delivery's X-Webhook-Signature against the
+// endpoint secret and parses its body. Deliveries whose X-Webhook-Timestamp
+// is further than tolerance from now are rejected, to limit replays; a zero
+// tolerance skips that check.
+func VerifyWebhook(secret string, h http.Header, body []byte, tolerance time.Duration) (*WebhookEvent, error) {
+	ts := h.Get("X-Webhook-Timestamp")
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(want), []byte(h.Get("X-Webhook-Signature"))) {
+		return nil, fmt.Errorf("webhook signature mismatch")
+	}
+	if tolerance > 0 {
+		sec, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad webhook timestamp %q", ts)
+		}
+		if age := time.Since(time.Unix(sec, 0)); age > tolerance || age < -tolerance {
+			return nil, fmt.Errorf("webhook timestamp %s outside tolerance", time.Unix(sec, 0).UTC().Format(time.RFC3339))
+		}
+	}
+	var ev WebhookEvent
+	if err := json.Unmarshal(body, &ev); err != nil {
+		return nil, fmt.Errorf("decoding webhook event: %w", err)
+	}
+	return &ev, nil
+}
+
+// codeOf accepts either a bare code or a full short URL.
+func codeOf(s string) string {
+	if u, err := url.Parse(s); err == nil && u.Host != "" {
+		s = u.Path
+	}
+	s = strings.Trim(s, "/")
+	if i := strings.LastIndex(s, "/"); i >= 0 {
+		s = s[i+1:]
+	}
+	return url.PathEscape(s)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, admin bool, in, out any) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return fmt.Errorf("shortener: encoding request: %w", err)
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := c.doOnce(ctx, method, path, admin, body, out)
+		retry, ok := err.(*retryAfterError)
+		if !ok {
+			return err
+		}
+		if attempt >= c.maxRetries {
+			return retry.err
+		}
+
+		wait := retry.after
+		if wait <= 0 {
+			// exponential backoff with up to 50% jitter
+			wait = c.backoff << attempt
+			wait += time.Duration(rand.Int64N(int64(wait)/2 + 1))
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// retryAfterError wraps a retryable *Error with the server's Retry-After.
+type retryAfterError struct {
+	err   *Error
+	after time.Duration
+}
+
+func (e *retryAfterError) Error() string { return e.err.Error() }
+
+func (c *Client) doOnce(ctx context.Context, method, path string, admin bool, body []byte, out any) error {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, r)
+	if err != nil {
+		return fmt.Errorf("shortener: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if admin {
+		req.Header.Set("Authorization", "Bearer "+c.adminToken)
+	} else if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("shortener: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		apiErr := errorFromResponse(resp)
+		if apiErr.retryable() {
+			secs, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+			return &retryAfterError{err: apiErr, after: time.Duration(secs) * time.Second}
+		}
+		return apiErr
+	}
+
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("shortener: decoding response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,426 @@
+package shortener
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/George-Yanev/go-playground/internal/urlshortener"
+)
+
+const adminToken = "secret"
+
+// newServer runs the real shortener handlers against a temporary database.
+func newServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	dir := t.TempDir()
+
+	db, err := urlshortener.InitDBAt(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocklistPath := filepath.Join(dir, "blocklist.txt")
+	if err := os.WriteFile(blocklistPath, []byte("suffix:evil.example\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	blocklist, err := urlshortener.LoadBlocklist(blocklistPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	workCh := make(chan urlshortener.WorkRequest)
+	seedCh := make(chan urlshortener.SeedRequest)
+	go urlshortener.Manager(db, seedCh)
+	workers := urlshortener.StartWorkers(db, workCh, seedCh, 2)
+
+	srv := httptest.NewServer(urlshortener.NewHandler(db, workCh, urlshortener.HttpConfig{
+		ShortUrlHost: "s.test",
+		Health:       urlshortener.NewHealth(db, workers, 1),
+		Blocklist:    blocklist,
+		AdminToken:   adminToken,
+	}))
+	t.Cleanup(func() {
+		srv.Close()
+		close(workCh)
+		db.Close()
+	})
+	return srv
+}
+
+func TestShortenStatsResolve(t *testing.T) {
+	srv := newServer(t)
+	c := New(srv.URL)
+	ctx := context.Background()
+
+	res, err := c.Shorten(ctx, ShortenRequest{URL: "https://example.com/page", QR: true})
+	if err != nil {
+		t.Fatalf("Shorten: %v", err)
+	}
+	if res.ShortURL == "" || res.QRCode == "" {
+		t.Fatalf("Shorten = %+v, want short URL and QR code", res)
+	}
+
+	dest, err := c.Resolve(ctx, res.ShortURL)
+	if err != nil || dest != "https://example.com/page" {
+		t.Errorf("Resolve = %q, %v", dest, err)
+	}
+
+	stats, err := c.Stats(ctx, res.ShortURL)
+	if err != nil {
+		t.Fatalf("Stats: %v", err)
+	}
+	if stats.ShortURL != res.ShortURL || stats.Clicks != 0 {
+		t.Errorf("Stats = %+v", stats)
+	}
+
+	if _, err := c.Stats(ctx, "bm9wZTE="); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Stats of unknown code: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	srv := newServer(t)
+	ctx := context.Background()
+	c := New(srv.URL, WithAdminToken(adminToken))
+	shorten := func(req ShortenRequest) string {
+		t.Helper()
+		res, err := c.Shorten(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.ShortURL
+	}
+
+	oneTime := shorten(ShortenRequest{URL: "https://example.com/once", OneTime: true})
+	for range 2 {
+		if dest, err := c.Resolve(ctx, oneTime); !errors.Is(err, ErrOneTime) || dest != "" {
+			t.Errorf("Resolve one-time link = %q, %v; want ErrOneTime", dest, err)
+		}
+	}
+	if s, err := c.Stats(ctx, oneTime); err != nil || s.Consumed || s.Clicks != 0 {
+		t.Errorf("resolving used up the one-time link: %+v, %v", s, err)
+	}
+
+	tagged := shorten(ShortenRequest{URL: "https://example.com/tagged",
+		Redirect: &RedirectRules{Params: map[string]string{"utm_source": "short"}}})
+	if dest, err := c.Resolve(ctx, tagged); err != nil || dest != "https://example.com/tagged?utm_source=short" {
+		t.Errorf("Resolve with redirect rules = %q, %v", dest, err)
+	}
+	if s, err := c.Stats(ctx, tagged); err != nil || s.Clicks != 0 {
+		t.Errorf("resolving counted a click: %+v, %v", s, err)
+	}
+
+	previewed := shorten(ShortenRequest{URL: "https://example.com/previewed", Interstitial: true})
+	if dest, err := c.Resolve(ctx, previewed); !errors.Is(err, ErrPreview) || dest != "" {
+		t.Errorf("Resolve link with a preview = %q, %v; want ErrPreview", dest, err)
+	}
+
+	protected := shorten(ShortenRequest{URL: "https://example.com/secret", Password: "hunter22"})
+	dest, err := c.Resolve(ctx, protected)
+	if !errors.Is(err, ErrPasswordProtected) || errors.Is(err, ErrBlocked) || dest != "" {
+		t.Errorf("Resolve password-protected link = %q, %v; want ErrPasswordProtected", dest, err)
+	}
+
+	deleted := shorten(ShortenRequest{URL: "https://example.com/deleted"})
+	if err := c.DeleteLink(ctx, deleted, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Resolve(ctx, deleted); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Resolve deleted link: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestCodesEscapedOnce(t *testing.T) {
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.EscapedPath())
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+	c := New(srv.URL, WithAdminToken(adminToken))
+	ctx := context.Background()
+
+	c.DeleteLink(ctx, "https://s.test/a%20b", "")
+	c.RestoreLink(ctx, "a b")
+	c.LinkHistory(ctx, "a b")
+	want := []string{"/admin/links/a%20b", "/admin/links/a%20b/restore", "/admin/links/a%20b/history"}
+	if !slices.Equal(paths, want) {
+		t.Errorf("requested %q, want %q", paths, want)
+	}
+}
+
+func TestShortenBlocked(t *testing.T) {
+	srv := newServer(t)
+	c := New(srv.URL)
+
+	_, err := c.Shorten(context.Background(), ShortenRequest{URL: "https://login.evil.example/"})
+	if !errors.Is(err, ErrBlocked) {
+		t.Fatalf("Shorten blocked URL: err = %v, want ErrBlocked", err)
+	}
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.RequestID == "" {
+		t.Errorf("error %v carries no request ID", err)
+	}
+	if apiErr != nil && (apiErr.Code != "destination_blocked" || apiErr.Message != "Destination is blocked") {
+		t.Errorf("error code %q, message %q", apiErr.Code, apiErr.Message)
+	}
+}
+
+func TestShortenBatch(t *testing.T) {
+	srv := newServer(t)
+	c := New(srv.URL)
+
+	results, err := c.ShortenBatch(context.Background(), []ShortenRequest{
+		{URL: "https://example.com/a"},
+		{URL: "https://evil.example/b"},
+		{URL: "https://example.com/c"},
+	})
+	if err != nil {
+		t.Fatalf("ShortenBatch: %v", err)
+	}
+	if results[0].Err != nil || results[2].Err != nil || results[1].Err == nil {
+		t.Fatalf("ShortenBatch errors = %v, %v, %v; want only the second to fail",
+			results[0].Err, results[1].Err, results[2].Err)
+	}
+	if !errors.Is(results[1].Err, ErrBlocked) {
+		t.Errorf("blocked batch entry: err = %v, want ErrBlocked", results[1].Err)
+	}
+	if results[0].ShortURL == results[2].ShortURL {
+		t.Errorf("batch entries share short URL %s", results[0].ShortURL)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	srv := newServer(t)
+	ctx := context.Background()
+
+	if _, err := New(srv.URL).BlocklistRules(ctx); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("BlocklistRules without token: err = %v, want ErrUnauthorized", err)
+	}
+
+	c := New(srv.URL, WithAdminToken(adminToken))
+	rules, err := c.BlocklistRules(ctx)
+	if err != nil || len(rules) != 1 || rules[0].Pattern != "evil.example" {
+		t.Errorf("BlocklistRules = %v, %v", rules, err)
+	}
+	res, err := c.EnforceBlocklist(ctx)
+	if err != nil || res.Rules != 1 {
+		t.Errorf("EnforceBlocklist = %+v, %v", res, err)
+	}
+
+	pool, err := c.SeedPool(ctx)
+	if err != nil || len(pool.Seeds) == 0 || pool.Counts["available"] != len(pool.Seeds) {
+		t.Errorf("SeedPool = %+v, %v", pool, err)
+	}
+}
+
+func TestListLinks(t *testing.T) {
+	srv := newServer(t)
+	ctx := context.Background()
+	c := New(srv.URL, WithAdminToken(adminToken))
+
+	for _, u := range []string{"https://example.com/a", "https://other.test/b", "https://example.com/c"} {
+		if _, err := c.Shorten(ctx, ShortenRequest{URL: u}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	links, err := c.ListLinks(ctx, ListOptions{Query: "EXAMPLE.com"})
+	if err != nil {
+		t.Fatalf("ListLinks: %v", err)
+	}
+	if len(links) != 2 || links[0].OriginalURL != "https://example.com/c" {
+		t.Errorf("ListLinks = %+v, want the two example.com links, newest first", links)
+	}
+}
+
+func TestDeleteRestoreLink(t *testing.T) {
+	srv := newServer(t)
+	ctx := context.Background()
+	c := New(srv.URL, WithAdminToken(adminToken))
+
+	res, err := c.Shorten(ctx, ShortenRequest{URL: "https://example.com/gone"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DeleteLink(ctx, res.ShortURL, "typo"); err != nil {
+		t.Fatalf("DeleteLink: %v", err)
+	}
+	if _, err := c.Stats(ctx, res.ShortURL); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Stats of a deleted link: err = %v, want ErrNotFound", err)
+	}
+	deleted, err := c.ListLinks(ctx, ListOptions{Deleted: true})
+	if err != nil || len(deleted) != 1 || deleted[0].ShortURL != res.ShortURL || deleted[0].DeletedBy != "admin" {
+		t.Errorf("ListLinks(Deleted) = %+v, %v", deleted, err)
+	}
+
+	if s, err := c.RestoreLink(ctx, res.ShortURL); err != nil || s.OriginalURL != "https://example.com/gone" {
+		t.Fatalf("RestoreLink = %+v, %v", s, err)
+	}
+	if _, err := c.RestoreLink(ctx, res.ShortURL); !errors.Is(err, ErrConflict) {
+		t.Errorf("restoring twice: err = %v, want ErrConflict", err)
+	}
+	history, err := c.LinkHistory(ctx, res.ShortURL)
+	if err != nil || len(history) != 3 || history[1].Action != "deleted" || history[1].Reason != "typo" {
+		t.Errorf("LinkHistory = %+v, %v", history, err)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	srv := newServer(t)
+	ctx := context.Background()
+	if _, err := New(srv.URL).Search(ctx, SearchOptions{}); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Search without a key: err = %v, want ErrUnauthorized", err)
+	}
+	c := New(srv.URL, WithAPIKey(adminToken))
+
+	for _, r := range []ShortenRequest{
+		{URL: "https://example.com/a", Owner: "team-x", Title: "Campaign Y launch", Tags: []string{"campaign:y"}},
+		{URL: "https://example.com/b", Owner: "team-x", Tags: []string{"campaign:z"}},
+		{URL: "https://example.com/c", Owner: "team-w", Tags: []string{"campaign:y"}},
+	} {
+		if _, err := c.Shorten(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	links, err := c.Search(ctx, SearchOptions{
+		Owner:        "team-x",
+		Tags:         []string{"campaign:y"},
+		CreatedAfter: time.Now().Add(-time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(links) != 1 || links[0].OriginalURL != "https://example.com/a" || links[0].Title != "Campaign Y launch" {
+		t.Errorf("Search = %+v, want the team-x campaign:y link", links)
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	srv := newServer(t)
+	ctx := context.Background()
+	admin := New(srv.URL, WithAdminToken(adminToken))
+
+	// creation is open until the first key is issued
+	if _, err := New(srv.URL).Shorten(ctx, ShortenRequest{URL: "https://example.com/"}); err != nil {
+		t.Fatalf("Shorten without keys: %v", err)
+	}
+
+	key, err := admin.CreateAPIKey(ctx, "ci")
+	if err != nil || key.Key == "" {
+		t.Fatalf("CreateAPIKey = %+v, %v", key, err)
+	}
+	if strings.Contains(key.Key, key.ID) {
+		t.Errorf("key ID %s is part of the key", key.ID)
+	}
+	if _, err := New(srv.URL).Shorten(ctx, ShortenRequest{URL: "https://example.com/"}); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Shorten without key: err = %v, want ErrUnauthorized", err)
+	}
+	withKey := New(srv.URL, WithAPIKey(key.Key))
+	if _, err := withKey.Shorten(ctx, ShortenRequest{URL: "https://example.com/"}); err != nil {
+		t.Errorf("Shorten with key: %v", err)
+	}
+
+	if err := admin.RevokeAPIKey(ctx, key.ID); err != nil {
+		t.Fatalf("RevokeAPIKey: %v", err)
+	}
+	keys, err := admin.APIKeys(ctx)
+	if err != nil || len(keys) != 1 || keys[0].RevokedAt == nil {
+		t.Errorf("APIKeys = %+v, %v", keys, err)
+	}
+	if err := admin.RevokeAPIKey(ctx, key.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("revoking twice: err = %v, want ErrNotFound", err)
+	}
+
+	// revoking the last key does not reopen creation
+	if _, err := New(srv.URL).Shorten(ctx, ShortenRequest{URL: "https://example.com/"}); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Shorten without key after revoking every key: err = %v, want ErrUnauthorized", err)
+	}
+	if _, err := withKey.Shorten(ctx, ShortenRequest{URL: "https://example.com/"}); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Shorten with a revoked key: err = %v, want ErrUnauthorized", err)
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	srv := newServer(t)
+	ctx := context.Background()
+	admin := New(srv.URL, WithAdminToken(adminToken))
+
+	hook, err := admin.CreateWebhook(ctx, "https://hooks.example/in", []string{"link.created"}, nil)
+	if err != nil || hook.Secret == "" {
+		t.Fatalf("CreateWebhook = %+v, %v", hook, err)
+	}
+	if _, err := admin.CreateWebhook(ctx, "https://hooks.example/in", []string{"link.deleted"}, nil); !errors.Is(err, ErrBadRequest) {
+		t.Errorf("unknown event: err = %v, want ErrBadRequest", err)
+	}
+	hooks, err := admin.Webhooks(ctx)
+	if err != nil || len(hooks) != 1 || hooks[0].ID != hook.ID || hooks[0].Secret != "" {
+		t.Errorf("Webhooks = %+v, %v", hooks, err)
+	}
+
+	body := []byte(`{"type":"link.created","link":{"code":"abc"}}`)
+	h := http.Header{}
+	h.Set("X-Webhook-Timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+	h.Set("X-Webhook-Signature", urlshortener.SignWebhook(hook.Secret, h.Get("X-Webhook-Timestamp"), body))
+	if ev, err := VerifyWebhook(hook.Secret, h, body, time.Minute); err != nil || ev.Link.Code != "abc" {
+		t.Errorf("VerifyWebhook = %+v, %v", ev, err)
+	}
+	if _, err := VerifyWebhook("whsec_other", h, body, time.Minute); err == nil {
+		t.Error("VerifyWebhook accepted the wrong secret")
+	}
+	h.Set("X-Webhook-Timestamp", "1700000000")
+	h.Set("X-Webhook-Signature", urlshortener.SignWebhook(hook.Secret, "1700000000", body))
+	if _, err := VerifyWebhook(hook.Secret, h, body, time.Minute); err == nil {
+		t.Error("VerifyWebhook accepted a stale delivery")
+	}
+
+	if err := admin.DeleteWebhook(ctx, hook.ID); err != nil {
+		t.Fatalf("DeleteWebhook: %v", err)
+	}
+	if err := admin.DeleteWebhook(ctx, hook.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("deleting twice: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	srv := newServer(t)
+
+	target, _ := url.Parse(srv.URL)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+
+	var calls atomic.Int32
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= 2 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer flaky.Close()
+
+	c := New(flaky.URL, WithRetries(3, time.Millisecond))
+	if _, err := c.Shorten(context.Background(), ShortenRequest{URL: "https://example.com/"}); err != nil {
+		t.Fatalf("Shorten after retries: %v", err)
+	}
+	if n := calls.Load(); n != 3 {
+		t.Errorf("server saw %d calls, want 3", n)
+	}
+
+	calls.Store(-10)
+	c = New(flaky.URL, WithRetries(1, time.Millisecond))
+	if _, err := c.Shorten(context.Background(), ShortenRequest{URL: "https://example.com/"}); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Shorten with retries exhausted: err = %v, want ErrUnavailable", err)
+	}
+}
@@ -0,0 +1,124 @@
+package shortener
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Sentinel errors matched by errors.Is against an *Error.
+var (
+	ErrBadRequest   = errors.New("shortener: bad request")
+	ErrUnauthorized = errors.New("shortener: unauthorized")
+	ErrBlocked      = errors.New("shortener: destination blocked")
+	ErrNotFound     = errors.New("shortener: not found")
+	// ErrConflict is returned when restoring a link that is not deleted.
+	ErrConflict    = errors.New("shortener: conflict")
+	ErrGone        = errors.New("shortener: link disabled")
+	ErrRateLimited = errors.New("shortener: rate limited")
+	ErrUnavailable = errors.New("shortener: service unavailable")
+	// ErrPasswordProtected, ErrOneTime and ErrPreview are returned by
+	// Resolve for links that only reveal their destination to a visitor: one
+	// who knows the password, uses the link up or goes through its preview.
+	ErrPasswordProtected = errors.New("shortener: link is password protected")
+	ErrOneTime           = errors.New("shortener: link is one-time")
+	ErrPreview           = errors.New("shortener: link shows a preview")
+)
+
+// Codes of the *Error Resolve returns for links it cannot resolve.
+const (
+	codePasswordRequired = "password_required"
+	codeOneTime          = "one_time_link"
+	codePreview          = "preview_required"
+)
+
+// Error is a non-2xx response from the server.
+type Error struct {
+	StatusCode int
+	// Code is the server's machine-readable error code, such as
+	// "destination_blocked"; empty if the response was not a JSON envelope.
+	Code      string
+	Message   string
+	RequestID string
+}
+
+// apiError is the "error" object of the server's JSON error envelope.
+type apiError struct {
+	Status    int    `json:"status"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+}
+
+func (e *apiError) toError() *Error {
+	return &Error{StatusCode: e.Status, Code: e.Code, Message: e.Message, RequestID: e.RequestID}
+}
+
+// errorFromResponse reads the error envelope of resp, falling back to its
+// body as plain text for proxies and older servers.
+func errorFromResponse(resp *http.Response) *Error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	e := &Error{
+		StatusCode: resp.StatusCode,
+		Message:    strings.TrimSpace(string(body)),
+		RequestID:  resp.Header.Get("X-Request-ID"),
+	}
+
+	var envelope struct {
+		Error *apiError `json:"error"`
+	}
+	if json.Unmarshal(body, &envelope) == nil && envelope.Error != nil {
+		e.Code = envelope.Error.Code
+		e.Message = envelope.Error.Message
+		if envelope.Error.RequestID != "" {
+			e.RequestID = envelope.Error.RequestID
+		}
+	}
+	return e
+}
+
+func (e *Error) Error() string {
+	if e.RequestID != "" {
+		return fmt.Sprintf("shortener: %d %s (request %s)", e.StatusCode, e.Message, e.RequestID)
+	}
+	return fmt.Sprintf("shortener: %d %s", e.StatusCode, e.Message)
+}
+
+func (e *Error) Is(target error) bool {
+	switch e.StatusCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		return target == ErrBadRequest
+	case http.StatusUnauthorized:
+		return target == ErrUnauthorized
+	case http.StatusForbidden:
+		switch e.Code {
+		case codePasswordRequired:
+			return target == ErrPasswordProtected
+		case codeOneTime:
+			return target == ErrOneTime
+		case codePreview:
+			return target == ErrPreview
+		}
+		return target == ErrBlocked
+	case http.StatusNotFound:
+		return target == ErrNotFound
+	case http.StatusConflict:
+		return target == ErrConflict
+	case http.StatusGone:
+		return target == ErrGone
+	case http.StatusTooManyRequests:
+		return target == ErrRateLimited
+	case http.StatusServiceUnavailable:
+		return target == ErrUnavailable
+	}
+	return false
+}
+
+// retryable reports whether the server did not process the request and asked
+// the client to come back later.
+func (e *Error) retryable() bool {
+	return e.StatusCode == http.StatusServiceUnavailable || e.StatusCode == http.StatusTooManyRequests
+}